@@ -0,0 +1,1098 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brandur/perpetual/secrets"
+	"github.com/brandur/perpetual/shamir"
+	"github.com/brandur/perpetual/updater"
+)
+
+// command is a tool that can be run from the command line as an alternative
+// to running as a Lambda function, like `perpetual verify`.
+type command struct {
+	// Run runs the command with the arguments that followed its name.
+	Run func(args []string) error
+
+	// Usage is a short, one line description of the command.
+	Usage string
+}
+
+// commands are all the commands that can be run from the command line, keyed
+// by name.
+var commands = map[string]*command{
+	"adopt":             {Run: runAdopt, Usage: "Mark an interval as posted by an existing tweet"},
+	"authorize":         {Run: runAuthorize, Usage: "Get an access token for an account via OAuth PIN flow"},
+	"check-heartbeat":   {Run: runCheckHeartbeat, Usage: "Alert if runs have stopped or an interval is overdue"},
+	"combine":           {Run: runCombine, Usage: "Reconstruct a secret from trustees' shares"},
+	"commit":            {Run: runCommit, Usage: "Generate a commitment over the schedule's messages"},
+	"drift":             {Run: runDrift, Usage: "Check that posted intervals still match the schedule"},
+	"import-archive":    {Run: runImportArchive, Usage: "Seed the tweet cache from an account's archive zip"},
+	"keygen":            {Run: runKeygen, Usage: "Generate a key pair for signing intervals"},
+	"preflight":         {Run: runPreflight, Usage: "Check credentials and account health without posting"},
+	"reconcile":         {Run: runReconcile, Usage: "Check that every interval post in the state ledger still exists"},
+	"rekey":             {Run: runRekey, Usage: "Reseal every sealed interval in a schedule with a new key"},
+	"retract":           {Run: runRetract, Usage: "Delete the last interval's post so that it's posted again"},
+	"seal":              {Run: runSeal, Usage: "Seal an interval message so it can't be read until posted"},
+	"secrets":           {Run: runSecrets, Usage: "Manage the secrets store (init, list, set)"},
+	"serve":             {Run: runServe, Usage: "Run updates on a schedule as a daemon, serving metrics"},
+	"skip":              {Run: runSkip, Usage: "Mark an interval as intentionally skipped"},
+	"split":             {Run: runSplit, Usage: "Split a secret into shares for trustees"},
+	"status":            {Run: runStatus, Usage: "Show where the schedule is according to the state ledger"},
+	"verify":            {Run: runVerify, Usage: "Verify the signatures of an account's interval posts"},
+	"verify-commitment": {Run: runVerifyCommitment, Usage: "Verify that an interval post was committed to"},
+}
+
+func runCommand(name string, args []string) error {
+	command, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("Unknown command: %s\n\n%s", name, usage())
+	}
+
+	return command.Run(args)
+}
+
+func usage() string {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("Usage: perpetual <command> [flags]\n\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(&sb, "  %-20s %s\n", name, commands[name].Usage)
+	}
+	return sb.String()
+}
+
+//
+// adopt
+//
+
+func runAdopt(args []string) error {
+	flags := flag.NewFlagSet("adopt", flag.ExitOnError)
+	intervalFlag, attr := adminFlags(flags)
+	tweetFlag := flags.Uint64("tweet", 0, "ID of the tweet that posted the interval")
+	flags.Parse(args)
+
+	if *intervalFlag < 0 || *tweetFlag == 0 {
+		return fmt.Errorf("Need both -interval and -tweet")
+	}
+
+	store, err := adminStateStore()
+	if err != nil {
+		return err
+	}
+
+	provider, err := secrets.Default()
+	if err != nil {
+		return err
+	}
+
+	api, err := newTwitterAPI(provider)
+	if err != nil {
+		return err
+	}
+
+	err = updater.AdoptInterval(api, store, *intervalFlag, *tweetFlag, attr, time.Now())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Adopted tweet %v as LHI%03d\n", *tweetFlag, *intervalFlag)
+	return nil
+}
+
+// adminFlags adds the flags shared by the administrative commands (adopt,
+// retract, and skip), returning the interval to operate on and who's
+// operating on it and why.
+func adminFlags(flags *flag.FlagSet) (*int, *updater.Attribution) {
+	attr := &updater.Attribution{}
+	intervalFlag := flags.Int("interval", -1, "ID of the interval to operate on")
+	flags.StringVar(&attr.Actor, "actor", os.Getenv("USER"),
+		"Who's performing the operation (defaults to $USER)")
+	flags.StringVar(&attr.Reason, "reason", "", "Why the operation is being performed")
+	return intervalFlag, attr
+}
+
+// adminStateStore gets the state store for the administrative commands,
+// which all operate on the state ledger.
+func adminStateStore() (updater.StateStore, error) {
+	store, err := stateStore()
+	if err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, fmt.Errorf("Need a state ledger to operate on; set STATE_FILE, DYNAMODB_TABLE, S3_BUCKET, or SQLITE_DB")
+	}
+	return store, nil
+}
+
+//
+// authorize
+//
+
+func runAuthorize(args []string) error {
+	flags := flag.NewFlagSet("authorize", flag.ExitOnError)
+	baseURLFlag := flags.String("base-url", updater.DefaultBaseURL,
+		"Base URL of Twitter's API")
+	flags.Parse(args)
+
+	provider, err := secrets.Default()
+	if err != nil {
+		return err
+	}
+
+	values, err := secrets.Load(provider, "CONSUMER_KEY", "CONSUMER_SECRET")
+	if err != nil {
+		return err
+	}
+
+	screenName, err := secrets.LoadOptional(provider, "SCREEN_NAME")
+	if err != nil {
+		return err
+	}
+
+	// Make sure there's somewhere to put the token before going through the
+	// trouble of getting one.
+	writer, err := secrets.DefaultWriter()
+	if err != nil {
+		return err
+	}
+
+	token, err := updater.AuthorizeWithPIN(values["CONSUMER_KEY"], values["CONSUMER_SECRET"],
+		*baseURLFlag, func(authorizationURL string) (string, error) {
+			fmt.Printf("Sign in as the account to post from and authorize the app at:\n\n")
+			fmt.Printf("    %s\n\n", authorizationURL)
+			fmt.Printf("Then enter the PIN that Twitter shows: ")
+
+			pin, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && err != io.EOF {
+				return "", err
+			}
+			return pin, nil
+		})
+	if err != nil {
+		return err
+	}
+
+	api := updater.NewLiveTwitterAPI(values["CONSUMER_KEY"], values["CONSUMER_SECRET"],
+		token.Token, token.TokenSecret, screenName)
+	api.BaseURL = *baseURLFlag
+
+	user, err := api.VerifyCredentials()
+	if err != nil {
+		return fmt.Errorf("Error verifying new access token: %v", err)
+	}
+
+	if screenName != "" && !strings.EqualFold(user.ScreenName, screenName) {
+		return fmt.Errorf("Authorized as @%s, but SCREEN_NAME is @%s; "+
+			"sign in as the right account and try again", user.ScreenName, screenName)
+	}
+
+	toWrite := secrets.Values{
+		"ACCESS_TOKEN":        token.Token,
+		"ACCESS_TOKEN_SECRET": token.TokenSecret,
+	}
+	if screenName == "" {
+		toWrite["SCREEN_NAME"] = user.ScreenName
+	}
+
+	for key, value := range toWrite {
+		if err := writer.Set(key, value); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("\nAuthorized as @%s; saved access token to the secrets store\n", user.ScreenName)
+	return nil
+}
+
+//
+// check-heartbeat
+//
+
+func runCheckHeartbeat(args []string) error {
+	defaultSilence, err := envDuration("HEARTBEAT_MAX_SILENCE")
+	if err != nil {
+		return err
+	}
+
+	defaultOverdue, err := envDuration("HEARTBEAT_MAX_OVERDUE")
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("check-heartbeat", flag.ExitOnError)
+	maxSilenceFlag := flags.Duration("max-silence", defaultSilence,
+		"Alert if there's been no successful run for this long (defaults to $HEARTBEAT_MAX_SILENCE)")
+	maxOverdueFlag := flags.Duration("max-overdue", defaultOverdue,
+		"Alert if the next interval is this far past its target (defaults to $HEARTBEAT_MAX_OVERDUE)")
+	flags.Parse(args)
+
+	provider, err := secrets.Default()
+	if err != nil {
+		return err
+	}
+
+	alerts, err := checkDeadManSwitch(provider, *maxSilenceFlag, *maxOverdueFlag)
+	for _, alert := range alerts {
+		fmt.Printf("%s\n    %s\n", alert.Subject, alert.Message)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Exits non-zero so that whatever runs the check can alert too
+	if len(alerts) > 0 {
+		return fmt.Errorf("\n%v problem(s) found", len(alerts))
+	}
+
+	fmt.Printf("Heartbeat is healthy\n")
+	return nil
+}
+
+//
+// combine
+//
+
+func runCombine(args []string) error {
+	flags := flag.NewFlagSet("combine", flag.ExitOnError)
+	flags.Parse(args)
+
+	// Shares can be given as arguments or one per line on stdin
+	encodedShares := flags.Args()
+	if len(encodedShares) < 1 {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		encodedShares = shamir.ParseShares(string(data))
+	}
+
+	secret, err := shamir.Combine(encodedShares)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\n", secret)
+	return nil
+}
+
+//
+// commit
+//
+
+func runCommit(args []string) error {
+	flags := flag.NewFlagSet("commit", flag.ExitOnError)
+	flags.Parse(args)
+
+	provider, err := secrets.Default()
+	if err != nil {
+		return err
+	}
+
+	key, err := loadMessageKey(provider)
+	if err != nil {
+		return err
+	}
+
+	commitment, err := updater.CommitIntervals(intervals, key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("commitmentRoot = %q\n\n", commitment.Root)
+	for i := 1; i < len(intervals); i++ {
+		// A salt in the clear would let anyone check guesses at a sealed
+		// message against the root
+		if commitment.SealedSalts[i] != "" {
+			fmt.Printf("// LHI%03d\nProof: %q,\nSealedSalt: %q,\n\n",
+				i, commitment.Proofs[i], commitment.SealedSalts[i])
+			continue
+		}
+
+		fmt.Printf("// LHI%03d\nProof: %q,\nSalt: %q,\n\n",
+			i, commitment.Proofs[i], commitment.Salts[i])
+	}
+
+	fmt.Fprintf(os.Stderr, "Copy the root and each interval's Proof and Salt (or SealedSalt) into intervals.go.\n")
+	fmt.Fprintf(os.Stderr, "Regenerate them if any message changes before the base interval posts.\n")
+
+	return nil
+}
+
+//
+// drift
+//
+
+func runDrift(args []string) error {
+	flags := flag.NewFlagSet("drift", flag.ExitOnError)
+	flags.Parse(args)
+
+	provider, err := secrets.Default()
+	if err != nil {
+		return err
+	}
+
+	api, err := newTwitterAPI(provider)
+	if err != nil {
+		return err
+	}
+
+	key, err := loadMessageKey(provider)
+	if err != nil {
+		return err
+	}
+
+	cachedAPI, err := withTweetCache(api)
+	if err != nil {
+		return err
+	}
+
+	results, err := updater.DriftTimeline(cachedAPI, intervals, key)
+	if err != nil {
+		return err
+	}
+
+	numChanged := 0
+
+	for _, result := range results {
+		fmt.Printf("LHI%03d (tweet %v): %s\n",
+			result.IntervalID, result.Tweet.ID, result.Status)
+
+		if result.Status == updater.DriftChanged {
+			fmt.Printf("    posted:    %q\n", result.Posted)
+			fmt.Printf("    scheduled: %q\n", result.Scheduled)
+			numChanged++
+		}
+	}
+
+	fmt.Printf("\n%v of %v interval posts differ from the schedule\n",
+		numChanged, len(results))
+
+	if numChanged > 0 {
+		return fmt.Errorf("Some interval posts differ from the schedule")
+	}
+
+	return nil
+}
+
+//
+// import-archive
+//
+
+func runImportArchive(args []string) error {
+	flags := flag.NewFlagSet("import-archive", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Need the path to an archive zip to import")
+	}
+
+	cache, err := tweetCache()
+	if err != nil {
+		return err
+	}
+	if cache == nil {
+		return fmt.Errorf("Need a tweet cache to seed; set TWEET_CACHE, SQLITE_DB or S3_BUCKET")
+	}
+
+	tweets, err := updater.ReadArchive(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	err = cache.SaveTweets(tweets)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %v tweet(s) into the tweet cache\n", len(tweets))
+	return nil
+}
+
+//
+// keygen
+//
+
+func runKeygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	messageFlag := flags.Bool("message", false,
+		"Generate a key for sealing messages instead of a signing key pair")
+	flags.Parse(args)
+
+	if *messageFlag {
+		key, err := updater.GenerateMessageKey()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("MESSAGE_KEY=%s\n", key.Encode())
+		fmt.Fprintf(os.Stderr, "\nKeep MESSAGE_KEY secret. Sealed messages can't be read without it.\n")
+		return nil
+	}
+
+	seed, publicKey, err := updater.GenerateSigningKey()
+	if err != nil {
+		return err
+	}
+
+	decoded, err := updater.DecodePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("SIGNING_KEY=%s\n", seed)
+	fmt.Printf("PUBLIC_KEY=%s\n", publicKey)
+	fmt.Printf("Fingerprint: %s\n", updater.KeyFingerprint(decoded))
+	fmt.Fprintf(os.Stderr, "\nKeep SIGNING_KEY secret. Publish PUBLIC_KEY so readers can verify.\n")
+
+	return nil
+}
+
+//
+// preflight
+//
+
+func runPreflight(args []string) error {
+	flags := flag.NewFlagSet("preflight", flag.ExitOnError)
+	flags.Parse(args)
+
+	provider, err := secrets.Default()
+	if err != nil {
+		return err
+	}
+
+	api, err := newTwitterAPI(provider)
+	if err != nil {
+		return err
+	}
+
+	result, err := api.Preflight()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Authenticated as: @%s (ID %v)\n", result.User.ScreenName, result.User.ID)
+	fmt.Printf("Access level:     %s\n", result.AccessLevel)
+	fmt.Printf("Timeline budget:  %v requests until %v\n",
+		result.TimelineRequestsRemaining, result.TimelineRequestsReset)
+	for _, warning := range result.Warnings {
+		fmt.Printf("Warning:          %s\n", warning)
+	}
+	return nil
+}
+
+//
+// reconcile
+//
+
+func runReconcile(args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	flags.Parse(args)
+
+	store, err := stateStore()
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		return fmt.Errorf("Need a state ledger to reconcile; set STATE_FILE, DYNAMODB_TABLE, S3_BUCKET, or SQLITE_DB")
+	}
+
+	state, err := store.LoadState()
+	if err != nil {
+		return err
+	}
+
+	provider, err := secrets.Default()
+	if err != nil {
+		return err
+	}
+
+	api, err := newTwitterAPI(provider)
+	if err != nil {
+		return err
+	}
+
+	missing, err := updater.Reconcile(api, state)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range missing {
+		fmt.Printf("LHI%03d (tweet %v): missing\n", record.IntervalID, record.TweetID)
+	}
+
+	fmt.Printf("\n%v of %v interval posts missing\n", len(missing), len(state.Posts))
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Some interval posts are missing; " +
+			"set MISSING_POST_POLICY to repost or mark_lost to resolve them")
+	}
+
+	return nil
+}
+
+//
+// rekey
+//
+
+// sealedPattern matches the Sealed and SealedSalt fields of an interval in a
+// schedule's source.
+var sealedPattern = regexp.MustCompile("((?:Sealed|SealedSalt):\\s*)([\"`])([A-Za-z0-9_-]+)([\"`])")
+
+func runRekey(args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	fileFlag := flags.String("file", "intervals.go",
+		"Schedule source file to rewrite in place")
+	newKeyFlag := flags.String("new-key", "",
+		"New message key (a new one is generated if not given)")
+	flags.Parse(args)
+
+	provider, err := secrets.Default()
+	if err != nil {
+		return err
+	}
+
+	oldKey, err := loadMessageKey(provider)
+	if err != nil {
+		return err
+	}
+	if oldKey == nil {
+		return fmt.Errorf("Need the current key in MESSAGE_KEY")
+	}
+
+	var newKey *updater.MessageKey
+	if *newKeyFlag != "" {
+		newKey, err = updater.DecodeMessageKey(*newKeyFlag)
+	} else {
+		newKey, err = updater.GenerateMessageKey()
+	}
+	if err != nil {
+		return err
+	}
+
+	src, err := ioutil.ReadFile(*fileFlag)
+	if err != nil {
+		return err
+	}
+
+	out, numResealed, err := rekeySchedule(src, oldKey, newKey)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(*fileFlag, out, 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Resealed %v message(s) and salt(s) in %s\n", numResealed, *fileFlag)
+	fmt.Printf("MESSAGE_KEY=%s\n", newKey.Encode())
+	return nil
+}
+
+// rekeySchedule reseals every sealed message and salt in a schedule's source
+// with a new key, leaving everything else as it was.
+func rekeySchedule(src []byte, oldKey, newKey *updater.MessageKey) ([]byte, int, error) {
+	var err error
+	numResealed := 0
+
+	out := sealedPattern.ReplaceAllFunc(src, func(match []byte) []byte {
+		if err != nil {
+			return match
+		}
+
+		parts := sealedPattern.FindSubmatch(match)
+
+		var resealed string
+		resealed, err = updater.ResealMessage(oldKey, newKey, string(parts[3]))
+		if err != nil {
+			err = fmt.Errorf("Error resealing interval (was anything sealed with another key?): %v", err)
+			return match
+		}
+
+		numResealed++
+		return []byte(string(parts[1]) + string(parts[2]) + resealed + string(parts[4]))
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return out, numResealed, nil
+}
+
+//
+// retract
+//
+
+func runRetract(args []string) error {
+	flags := flag.NewFlagSet("retract", flag.ExitOnError)
+	intervalFlag, attr := adminFlags(flags)
+	flags.Parse(args)
+
+	if *intervalFlag < 0 {
+		return fmt.Errorf("Need -interval")
+	}
+
+	store, err := adminStateStore()
+	if err != nil {
+		return err
+	}
+
+	provider, err := secrets.Default()
+	if err != nil {
+		return err
+	}
+
+	api, err := newTwitterAPI(provider)
+	if err != nil {
+		return err
+	}
+
+	err = updater.RetractInterval(api, store, locker(store), *intervalFlag, attr, time.Now())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Retracted LHI%03d; it'll be posted again on the next run\n", *intervalFlag)
+	return nil
+}
+
+//
+// seal
+//
+
+func runSeal(args []string) error {
+	flags := flag.NewFlagSet("seal", flag.ExitOnError)
+	messageFlag := flags.String("message", "",
+		"Message to seal (read from stdin if not given)")
+	flags.Parse(args)
+
+	provider, err := secrets.Default()
+	if err != nil {
+		return err
+	}
+
+	key, err := loadMessageKey(provider)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return fmt.Errorf("Need a key in MESSAGE_KEY; generate one with `perpetual keygen -message`")
+	}
+
+	message := *messageFlag
+	if message == "" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		message = strings.TrimSuffix(string(data), "\n")
+	}
+
+	sealed, err := updater.SealMessage(key, message)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Sealed: %q,\n", sealed)
+	return nil
+}
+
+//
+// secrets
+//
+
+func runSecrets(args []string) error {
+	flags := flag.NewFlagSet("secrets", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: perpetual secrets init | list | set <KEY>\n\n"+
+			"set reads the secret's value from stdin. The store is the file in\n"+
+			"SECRETS_FILE (opened with SECRETS_KEY) or the directory in SECRETS_DIR.\n")
+	}
+	flags.Parse(args)
+
+	switch flags.Arg(0) {
+	case "init":
+		key, err := secrets.GenerateKey()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("SECRETS_KEY=%s\n", key)
+		fmt.Fprintf(os.Stderr, "\nKeep SECRETS_KEY secret and set SECRETS_FILE to "+
+			"where the encrypted file should live.\n")
+		return nil
+
+	case "list":
+		writer, err := secrets.DefaultWriter()
+		if err != nil {
+			return err
+		}
+
+		keys, err := writer.Keys()
+		if err != nil {
+			return err
+		}
+
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("%s\n", key)
+		}
+		return nil
+
+	case "set":
+		key := flags.Arg(1)
+		if key == "" {
+			flags.Usage()
+			return fmt.Errorf("Need a key to set")
+		}
+
+		writer, err := secrets.DefaultWriter()
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		err = writer.Set(key, strings.TrimRight(string(data), "\r\n"))
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "Set %s\n", key)
+		return nil
+
+	default:
+		flags.Usage()
+		return fmt.Errorf("Unknown secrets command: %q", flags.Arg(0))
+	}
+}
+
+//
+// serve
+//
+
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	everyFlag := flags.Duration("every", 10*time.Minute, "How often to run an update")
+	flags.Parse(args)
+
+	provider, err := secrets.Default()
+	if err != nil {
+		return err
+	}
+
+	// Metrics accumulate across runs for as long as the daemon lives
+	metrics := &updater.PrometheusMetrics{Namespace: os.Getenv("METRICS_NAMESPACE")}
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		listener, err := serveMetrics(addr, metrics)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+
+		logger.Info("Serving metrics", "addr", listener.Addr().String())
+	}
+
+	for {
+		err := serveUpdate(provider, metrics)
+		if err != nil {
+			logger.Error("Error running update", "error", err)
+		}
+
+		time.Sleep(*everyFlag)
+	}
+}
+
+// serveMetrics serves metrics in Prometheus's text format at /metrics on
+// addr until the returned listener is closed.
+func serveMetrics(addr string, metrics *updater.PrometheusMetrics) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error listening for metrics on %v: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go http.Serve(listener, mux)
+
+	return listener, nil
+}
+
+// serveUpdate runs a single update for the serve command, configured from the
+// environment in the same way as a Lambda run.
+func serveUpdate(provider secrets.Provider, metrics updater.Metrics) error {
+	api, err := newTwitterAPI(provider)
+	if err != nil {
+		return err
+	}
+
+	runID := updater.NewRunID()
+	api.Logger = updater.WithLogAttrs(api.Logger, updater.LogKeyRunID, runID)
+	api.Metrics = metrics
+
+	opts, err := updateOptions(provider, api, runID)
+	if err != nil {
+		return err
+	}
+	opts.Metrics = metrics
+
+	cachedAPI, err := withTweetCache(api)
+	if err != nil {
+		return err
+	}
+
+	_, err = updater.Update(cachedAPI, intervals, time.Now(), opts)
+	return err
+}
+
+//
+// skip
+//
+
+func runSkip(args []string) error {
+	flags := flag.NewFlagSet("skip", flag.ExitOnError)
+	intervalFlag, attr := adminFlags(flags)
+	flags.Parse(args)
+
+	if *intervalFlag < 0 {
+		return fmt.Errorf("Need -interval")
+	}
+
+	store, err := adminStateStore()
+	if err != nil {
+		return err
+	}
+
+	err = updater.SkipInterval(store, *intervalFlag, attr, time.Now())
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Skipped LHI%03d\n", *intervalFlag)
+	return nil
+}
+
+//
+// split
+//
+
+func runSplit(args []string) error {
+	flags := flag.NewFlagSet("split", flag.ExitOnError)
+	secretFlag := flags.String("secret", "",
+		"Secret to split (read from stdin if not given)")
+	sharesFlag := flags.Int("shares", 5,
+		"Number of shares to produce, one per trustee")
+	thresholdFlag := flags.Int("threshold", 3,
+		"Number of shares needed to reconstruct the secret")
+	flags.Parse(args)
+
+	secret := *secretFlag
+	if secret == "" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+
+	shares, err := shamir.Split([]byte(secret), *sharesFlag, *thresholdFlag)
+	if err != nil {
+		return err
+	}
+
+	for i, share := range shares {
+		fmt.Printf("Trustee %v: %s\n", i+1, share)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nAny %v of these %v shares reconstruct the secret. "+
+		"Supply them for a run as\ncomma-separated <KEY>_SHARES (e.g. MESSAGE_KEY_SHARES) "+
+		"in place of <KEY>.\n", *thresholdFlag, *sharesFlag)
+	return nil
+}
+
+//
+// status
+//
+
+func runStatus(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	flags.Parse(args)
+
+	store, err := adminStateStore()
+	if err != nil {
+		return err
+	}
+
+	state, err := store.LoadState()
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(formatStatus(state, intervals, time.Now()))
+	return nil
+}
+
+// formatStatus describes where the schedule is according to the state
+// ledger: the last posted interval, when the next one is due, any intervals
+// that need attention, and who holds the lease.
+func formatStatus(state *updater.State, intervals []*updater.Interval, now time.Time) string {
+	var sb strings.Builder
+
+	last := state.Last()
+	if last == nil {
+		sb.WriteString("Last interval: none posted\n")
+	} else {
+		fmt.Fprintf(&sb, "Last interval: LHI%03d (%s", last.IntervalID, last.Status)
+		if last.TweetID != 0 {
+			fmt.Fprintf(&sb, ", tweet %v", last.TweetID)
+		}
+		if !last.PostedAt.IsZero() {
+			fmt.Fprintf(&sb, ", posted %v", last.PostedAt.Format(time.RFC3339))
+		}
+		sb.WriteString(")\n")
+	}
+
+	switch next := state.Next(); {
+	case next >= len(intervals):
+		sb.WriteString("Next interval: none; the schedule is done\n")
+	case intervals[next].Target.After(now):
+		fmt.Fprintf(&sb, "Next interval: LHI%03d, due %v\n",
+			next, intervals[next].Target.Format(time.RFC3339))
+	default:
+		fmt.Fprintf(&sb, "Next interval: LHI%03d, due now\n", next)
+	}
+
+	for _, record := range state.Posts {
+		if record.Status != updater.PostStatusPosted {
+			fmt.Fprintf(&sb, "LHI%03d: %s\n", record.IntervalID, record.Status)
+		}
+	}
+
+	if state.Heartbeat != nil {
+		fmt.Fprintf(&sb, "Last successful run: %v (run %s)\n",
+			state.Heartbeat.At.Format(time.RFC3339), state.Heartbeat.RunID)
+	}
+
+	if lease := state.Lease; lease != nil && lease.Expires.After(now) {
+		fmt.Fprintf(&sb, "Lease: held by %s until %v\n",
+			lease.Holder, lease.Expires.Format(time.RFC3339))
+	}
+
+	if len(state.Actions) > 0 {
+		fmt.Fprintf(&sb, "Administrative actions: %v\n", len(state.Actions))
+	}
+
+	return sb.String()
+}
+
+//
+// verify
+//
+
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	publicKeyFlag := flags.String("public-key", os.Getenv("PUBLIC_KEY"),
+		"Public key to verify against (defaults to $PUBLIC_KEY)")
+	flags.Parse(args)
+
+	if *publicKeyFlag == "" {
+		return fmt.Errorf("Need a public key; pass -public-key or set PUBLIC_KEY")
+	}
+
+	publicKey, err := updater.DecodePublicKey(*publicKeyFlag)
+	if err != nil {
+		return err
+	}
+
+	provider, err := secrets.Default()
+	if err != nil {
+		return err
+	}
+
+	api, err := newTwitterAPI(provider)
+	if err != nil {
+		return err
+	}
+
+	cachedAPI, err := withTweetCache(api)
+	if err != nil {
+		return err
+	}
+
+	results, err := updater.VerifyTimeline(cachedAPI, publicKey, intervals)
+	if err != nil {
+		return err
+	}
+
+	fingerprint := updater.KeyFingerprint(publicKey)
+	numValid := 0
+
+	for _, result := range results {
+		fmt.Printf("LHI%03d (tweet %v): %s\n",
+			result.IntervalID, result.Tweet.ID, result.Status)
+
+		if result.Fingerprint != "" && result.Fingerprint != fingerprint {
+			fmt.Printf("    published fingerprint %s does not match %s\n",
+				result.Fingerprint, fingerprint)
+		}
+
+		if result.Status == updater.SignatureValid {
+			numValid++
+		}
+	}
+
+	fmt.Printf("\n%v of %v interval posts verified\n", numValid, len(results))
+
+	if numValid != len(results) {
+		return fmt.Errorf("Some interval posts failed verification")
+	}
+
+	return nil
+}
+
+//
+// verify-commitment
+//
+
+func runVerifyCommitment(args []string) error {
+	flags := flag.NewFlagSet("verify-commitment", flag.ExitOnError)
+	rootFlag := flags.String("root", "",
+		"Commitment root published with LHI000")
+	postFlag := flags.String("post", "",
+		"Full text of the interval post")
+	proofFlag := flags.String("proof", "",
+		"Full text of the proof reply threaded under the interval post")
+	flags.Parse(args)
+
+	if *rootFlag == "" || *postFlag == "" || *proofFlag == "" {
+		return fmt.Errorf("Need all of -root, -post, and -proof")
+	}
+
+	err := updater.VerifyCommitment(*rootFlag, *postFlag, *proofFlag)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Interval post is included in commitment %s\n", *rootFlag)
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/brandur/perpetual/updater"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestRekeySchedule(t *testing.T) {
+	oldKey, err := updater.GenerateMessageKey()
+	assert.NoError(t, err)
+
+	newKey, err := updater.GenerateMessageKey()
+	assert.NoError(t, err)
+
+	sealed0, err := updater.SealMessage(oldKey, "Interval 000")
+	assert.NoError(t, err)
+
+	sealed1, err := updater.SealMessage(oldKey, "Interval 001")
+	assert.NoError(t, err)
+
+	sealedSalt1, err := updater.SealMessage(oldKey, "salt")
+	assert.NoError(t, err)
+
+	src := fmt.Sprintf(`intervals = []*updater.Interval{
+	{Target: updater.MustParseTime("Jun 24 08:00:00 PST 2018"), // base time
+		Sealed: "%s"},
+
+	{Target: updater.MustParseTime("Jun 25 08:00:00 PST 2018"), // 1 day
+		Sealed:`+"`%s`"+`,
+		SealedSalt: "%s"},
+
+	{Target: updater.MustParseTime("Jul 01 08:00:00 PST 2018"), // 1 week
+		Message: "Interval 002"},
+}`, sealed0, sealed1, sealedSalt1)
+
+	out, numResealed, err := rekeySchedule([]byte(src), oldKey, newKey)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, numResealed)
+	assert.NotContains(t, string(out), sealed0)
+	assert.NotContains(t, string(out), sealed1)
+	assert.NotContains(t, string(out), sealedSalt1)
+	assert.Contains(t, string(out), "// 1 day")
+	assert.Contains(t, string(out), `Message: "Interval 002"`)
+
+	// Salts are resealed along with messages
+	matches := sealedPattern.FindAllStringSubmatch(string(out), -1)
+	assert.Equal(t, 3, len(matches))
+
+	for i, want := range []string{"Interval 000", "Interval 001", "salt"} {
+		message, err := updater.OpenMessage(newKey, matches[i][3])
+		assert.NoError(t, err)
+		assert.Equal(t, want, message)
+	}
+
+	// Rekeying with the wrong old key fails without producing output
+	_, _, err = rekeySchedule(out, oldKey, newKey)
+	assert.Error(t, err)
+}
+
+func TestFormatStatus(t *testing.T) {
+	now := time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)
+	intervals := []*updater.Interval{
+		{Target: now.Add(-3 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(-2 * time.Hour), Message: "Interval 001"},
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 002"},
+		{Target: now.Add(1 * time.Hour), Message: "Interval 003"},
+	}
+
+	assert.Equal(t, "Last interval: none posted\nNext interval: LHI000, due now\n",
+		formatStatus(&updater.State{}, intervals, now))
+
+	state := &updater.State{
+		Heartbeat: &updater.Heartbeat{At: now.Add(-5 * time.Minute), RunID: "abc"},
+		Lease:     &updater.Lease{Expires: now.Add(time.Minute), Holder: "host/1", Token: 3},
+	}
+	state.Put(&updater.PostRecord{IntervalID: 0, PostedAt: now.Add(-3 * time.Hour),
+		Status: updater.PostStatusPosted, TweetID: 123})
+	state.Put(&updater.PostRecord{IntervalID: 1, Status: updater.PostStatusLost})
+	state.Put(&updater.PostRecord{IntervalID: 2, Status: updater.PostStatusSkipped})
+
+	assert.Equal(t, "Last interval: LHI001 (lost)\n"+
+		"Next interval: LHI003, due 2018-07-01T01:00:00Z\n"+
+		"LHI001: lost\n"+
+		"LHI002: skipped\n"+
+		"Last successful run: 2018-06-30T23:55:00Z (run abc)\n"+
+		"Lease: held by host/1 until 2018-07-01T00:01:00Z\n",
+		formatStatus(state, intervals, now))
+
+	state.Put(&updater.PostRecord{IntervalID: 3, PostedAt: now, Status: updater.PostStatusPosted,
+		TweetID: 124})
+	state.Heartbeat = nil
+	state.Lease = nil
+	assert.Equal(t, "Last interval: LHI003 (posted, tweet 124, posted 2018-07-01T00:00:00Z)\n"+
+		"Next interval: none; the schedule is done\n"+
+		"LHI001: lost\n"+
+		"LHI002: skipped\n",
+		formatStatus(state, intervals, now))
+}
+
+func TestServeMetrics(t *testing.T) {
+	metrics := &updater.PrometheusMetrics{Namespace: "perpetual"}
+	metrics.Count("runs", 1, "result", "posted")
+
+	listener, err := serveMetrics("127.0.0.1:0", metrics)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/metrics")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `perpetual_runs_total{result="posted"} 1`)
+
+	// Nothing else is served
+	resp, err = http.Get("http://" + listener.Addr().String() + "/")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
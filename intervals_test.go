@@ -3,6 +3,7 @@ package main
 import (
 	"testing"
 
+	"github.com/brandur/perpetual/secrets"
 	"github.com/brandur/perpetual/updater"
 	assert "github.com/stretchr/testify/require"
 )
@@ -10,15 +11,53 @@ import (
 const maxTweetLength = 280
 
 // Makes sure that all configured intervals are below the maximum length of a
-// tweet.
+// tweet. Signing is optional, but measure intervals as if they were signed
+// because it only makes them longer. The base interval is measured with the
+// commitment root that's posted with it. Sealed intervals can only be checked
+// if MESSAGE_KEY is set.
 func TestIntervalLengths(t *testing.T) {
-	for _, interval := range intervals {
-		length := len(updater.FormatInterval(0, interval.Message))
+	seed, _, err := updater.GenerateSigningKey()
+	assert.NoError(t, err)
+
+	signer, err := updater.NewSigner(seed)
+	assert.NoError(t, err)
+
+	provider, err := secrets.Default()
+	assert.NoError(t, err)
+
+	key, err := loadMessageKey(provider)
+	assert.NoError(t, err)
+
+	opts := &updater.UpdateOptions{CommitmentRoot: commitmentRoot, Signer: signer}
+
+	for i, interval := range intervals {
+		if interval.Sealed != "" && key == nil {
+			t.Logf("Skipping sealed interval %v because MESSAGE_KEY isn't set", i)
+			continue
+		}
+
+		message, err := interval.Open(key)
+		assert.NoError(t, err)
+
+		length := len(updater.FormatPost(i, interval, message, opts))
 		assert.True(t,
 			length < maxTweetLength,
 			"Interval message is too long for a tweet: %s (%v characters)",
-			interval.Message,
+			message,
 			length,
 		)
+
+		salt, err := interval.OpenSalt(key)
+		assert.NoError(t, err)
+
+		if salt != "" {
+			length := len(updater.FormatCommitmentProof(i, salt, interval.Proof))
+			assert.True(t,
+				length < maxTweetLength,
+				"Commitment proof is too long for a tweet: %s (%v characters)",
+				interval.Proof,
+				length,
+			)
+		}
 	}
 }
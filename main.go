@@ -4,59 +4,197 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/brandur/perpetual/secrets"
 	"github.com/brandur/perpetual/updater"
-	"github.com/dghubble/oauth1"
 )
 
 // Event is an event to be passed into the AWS Lambda handler.
 type Event struct {
+	// Mode is what the invocation should do. It's empty to run Update, or
+	// "check-heartbeat" to check the dead man's switch, which should be
+	// scheduled independently (see README).
+	Mode string `json:"mode"`
 }
 
 // HandleRequest is the target to be invoked by AWS Lambda.
 func HandleRequest(ctx context.Context, event Event) (string, error) {
-	consumerKey, err := mustEnv("CONSUMER_KEY")
+	provider, err := secrets.Default()
 	if err != nil {
 		return "", err
 	}
-	consumerSecret, err := mustEnv("CONSUMER_SECRET")
+
+	switch event.Mode {
+	case "":
+	case "check-heartbeat":
+		return handleCheckHeartbeat(provider)
+	default:
+		return "", fmt.Errorf("Unknown mode: %q", event.Mode)
+	}
+
+	api, err := newTwitterAPI(provider)
 	if err != nil {
 		return "", err
 	}
-	accessToken, err := mustEnv("ACCESS_TOKEN")
+
+	// Every line logged during the run carries its ID, including those from
+	// the API, so that a run's lines can be picked out of CloudWatch
+	runID := updater.NewRunID()
+	api.Logger = updater.WithLogAttrs(api.Logger, updater.LogKeyRunID, runID)
+
+	opts, err := updateOptions(provider, api, runID)
 	if err != nil {
 		return "", err
 	}
-	accessTokenSecret, err := mustEnv("ACCESS_TOKEN_SECRET")
+
+	// Metrics are written to the function's logs in CloudWatch's Embedded
+	// Metric Format, from which CloudWatch extracts them
+	var metrics *updater.EMFMetrics
+	if namespace := os.Getenv("METRICS_NAMESPACE"); namespace != "" {
+		metrics = updater.NewEMFMetrics(os.Stdout, namespace,
+			updater.LogKeySeries, api.ScreenName)
+		api.Metrics = metrics
+		opts.Metrics = metrics
+	}
+
+	cachedAPI, err := withTweetCache(api)
 	if err != nil {
 		return "", err
 	}
-	screenName, err := mustEnv("SCREEN_NAME")
+
+	_, err = updater.Update(cachedAPI, intervals, time.Now(), opts)
+
+	if metrics != nil {
+		flushErr := metrics.Flush()
+		if flushErr != nil {
+			logger.Warn("Error flushing metrics", "error", flushErr)
+		}
+	}
+
 	if err != nil {
 		return "", err
 	}
 
-	config := oauth1.NewConfig(consumerKey, consumerSecret)
-	token := oauth1.NewToken(accessToken, accessTokenSecret)
-	httpClient := config.Client(oauth1.NoContext, token)
+	return "Successfully ran check", nil
+}
 
-	api := &updater.LiveTwitterAPI{
-		HTTPClient: httpClient,
-		ScreenName: screenName,
+// handleCheckHeartbeat checks the dead man's switch with thresholds from
+// HEARTBEAT_MAX_SILENCE and HEARTBEAT_MAX_OVERDUE.
+func handleCheckHeartbeat(provider secrets.Provider) (string, error) {
+	maxSilence, err := envDuration("HEARTBEAT_MAX_SILENCE")
+	if err != nil {
+		return "", err
 	}
 
-	_, err = updater.Update(api, intervals, time.Now())
+	maxOverdue, err := envDuration("HEARTBEAT_MAX_OVERDUE")
 	if err != nil {
 		return "", err
 	}
 
-	return "Successfully ran check", nil
+	alerts, err := checkDeadManSwitch(provider, maxSilence, maxOverdue)
+	if err != nil {
+		return "", err
+	}
+
+	for _, alert := range alerts {
+		logger.Warn(alert.Subject, "kind", alert.Kind, "message", alert.Message)
+	}
+
+	return fmt.Sprintf("Checked heartbeat; %v problem(s) found", len(alerts)), nil
+}
+
+// updateOptions gets the options for an update run from the environment,
+// for both Lambda and the serve command.
+func updateOptions(provider secrets.Provider, api *updater.LiveTwitterAPI, runID string) (*updater.UpdateOptions, error) {
+	var err error
+	opts := &updater.UpdateOptions{
+		CommitmentRoot: commitmentRoot,
+		Logger:         updater.WithLogAttrs(logger, updater.LogKeySeries, api.ScreenName),
+		RunID:          runID,
+		Series:         api.ScreenName,
+	}
+
+	opts.Discovery, err = updater.ParseDiscoveryStrategy(os.Getenv("DISCOVERY"))
+	if err != nil {
+		return nil, err
+	}
+
+	opts.MaxScanTweets, err = envInt("MAX_SCAN_TWEETS")
+	if err != nil {
+		return nil, err
+	}
+
+	opts.MissingPostPolicy, err = updater.ParseMissingPostPolicy(os.Getenv("MISSING_POST_POLICY"))
+	if err != nil {
+		return nil, err
+	}
+
+	opts.StateStore, err = stateStore()
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Locker = locker(opts.StateStore)
+
+	opts.Notifier, err = notifier(provider, opts.StateStore)
+	if err != nil {
+		return nil, err
+	}
+
+	reminderDays, err := envInt("REMINDER_DAYS")
+	if err != nil {
+		return nil, err
+	}
+	opts.ReminderLead = time.Duration(reminderDays) * 24 * time.Hour
+
+	opts.UseMarker, err = envBool("USE_MARKER")
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Signer, err = loadSigner(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.MessageKey, err = loadMessageKey(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, nil
 }
 
 func main() {
-	lambda.Start(HandleRequest)
+	level, err := updater.ParseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	// With no arguments we're being run by AWS Lambda. Otherwise, arguments
+	// name one of the command line tools.
+	if len(os.Args) < 2 {
+		logger = updater.NewJSONLogger(os.Stdout, level)
+		lambda.Start(HandleRequest)
+		return
+	}
+
+	logger = updater.NewTextLogger(os.Stdout, level)
+
+	err = runCommand(os.Args[1], os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
 }
 
 //
@@ -68,9 +206,19 @@ func main() {
 // up which still fits within time.Duration's maximum size of ~290 years.
 const hundredYears = time.Hour * 24 * 365 * 100
 
+// logger is where logs go: JSON lines when running in Lambda so that they
+// can be queried in CloudWatch, and text when running a command. Its level
+// is set with LOG_LEVEL.
+var logger updater.Logger = updater.DiscardLogger
+
 // See `intervals.go`
 var intervals []*updater.Interval
 
+// commitmentRoot is the root of a commitment over the messages of intervals,
+// published with the base interval. Optional; see `perpetual commit` and
+// `intervals.go`.
+var commitmentRoot string
+
 // time.Parse won't parse a 5-digit years, so we need a little hackiness to get
 // us to ten thousand. Unfortunately, this is nowhere near as clean as other
 // times because we know that leap years, etc. won't be handled well. This is
@@ -83,10 +231,349 @@ func addTenThousandYears(t time.Time) time.Time {
 	return t
 }
 
-func mustEnv(key string) (string, error) {
+// twitterSecrets are the keys of the secrets needed to use Twitter's API.
+var twitterSecrets = []string{
+	"ACCESS_TOKEN",
+	"ACCESS_TOKEN_SECRET",
+	"CONSUMER_KEY",
+	"CONSUMER_SECRET",
+	"SCREEN_NAME",
+}
+
+// envBool gets an optional boolean setting from the environment, returning
+// false if it's not set.
+func envBool(key string) (bool, error) {
 	val := os.Getenv(key)
 	if val == "" {
-		return "", fmt.Errorf("need env key: %s", val)
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("%s should be true or false: %v", key, err)
+	}
+	return b, nil
+}
+
+// envDuration gets an optional duration setting from the environment, like
+// "36h", returning zero if it's not set.
+func envDuration(key string) (time.Duration, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("%s should be a duration like 36h: %v", key, err)
+	}
+	return d, nil
+}
+
+// envInt gets an optional integer setting from the environment, returning
+// zero if it's not set.
+func envInt(key string) (int, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("%s should be an integer: %v", key, err)
+	}
+	return i, nil
+}
+
+// loadMessageKey gets the key for opening sealed intervals. It returns nil
+// if none was configured, which is fine as long as no intervals are sealed.
+func loadMessageKey(provider secrets.Provider) (*updater.MessageKey, error) {
+	encoded, err := secrets.LoadOptional(provider, "MESSAGE_KEY")
+	if err != nil || encoded == "" {
+		return nil, err
+	}
+
+	return updater.DecodeMessageKey(encoded)
+}
+
+// loadSigner gets a signer for intervals. Signing is optional, so it returns
+// nil if no key was configured.
+func loadSigner(provider secrets.Provider) (*updater.Signer, error) {
+	encoded, err := secrets.LoadOptional(provider, "SIGNING_KEY")
+	if err != nil || encoded == "" {
+		return nil, err
+	}
+
+	return updater.NewSigner(encoded)
+}
+
+// locker gets the lock that's held while deciding whether to post and
+// posting. It's a lease file if one was configured with LOCK_FILE, and
+// otherwise a lease alongside the state ledger if there is one. Without
+// either, there's no lock.
+func locker(store updater.StateStore) updater.Locker {
+	if path := os.Getenv("LOCK_FILE"); path != "" {
+		return &updater.FileLocker{Path: path}
+	}
+
+	if dynamoStore, ok := store.(*updater.DynamoDBStateStore); ok {
+		return &updater.DynamoDBLocker{Client: dynamoStore.Client, Table: dynamoStore.Table}
+	}
+
+	if store != nil {
+		return &updater.StateLocker{Store: store}
+	}
+
+	return nil
+}
+
+// checkDeadManSwitch checks the state ledger for signs that runs have
+// stopped, sending any alerts to the configured notifier. It needs a state
+// ledger, and at least one of the thresholds.
+func checkDeadManSwitch(provider secrets.Provider, maxSilence,
+	maxOverdue time.Duration) ([]*updater.Notification, error) {
+
+	if maxSilence == 0 && maxOverdue == 0 {
+		return nil, fmt.Errorf(
+			"Nothing to check; set HEARTBEAT_MAX_SILENCE, HEARTBEAT_MAX_OVERDUE, or both")
+	}
+
+	store, err := stateStore()
+	if err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, fmt.Errorf(
+			"Need a state ledger to check; set STATE_FILE, DYNAMODB_TABLE, S3_BUCKET, or SQLITE_DB")
+	}
+
+	notifier, err := notifier(provider, store)
+	if err != nil {
+		return nil, err
+	}
+
+	screenName, err := secrets.LoadOptional(provider, "SCREEN_NAME")
+	if err != nil {
+		return nil, err
+	}
+
+	return updater.CheckDeadManSwitch(store, intervals, time.Now(), &updater.DeadManOptions{
+		MaxOverdue: maxOverdue,
+		MaxSilence: maxSilence,
+		Notifier:   notifier,
+		Series:     screenName,
+	})
+}
+
+// notifier gets the notifier for operators, which sends to whichever of
+// email (NOTIFY_SMTP_*), a webhook (NOTIFY_WEBHOOK_URL), and a Slack
+// compatible webhook (NOTIFY_SLACK_URL) are configured, or nil if none are.
+// Webhook URLs and the SMTP password are secrets because anyone who has them
+// can send as us. Repeats are suppressed, and remembered in the state ledger
+// if there is one.
+func notifier(provider secrets.Provider, store updater.StateStore) (updater.Notifier, error) {
+	var notifiers updater.MultiNotifier
+
+	if addr := os.Getenv("NOTIFY_SMTP_ADDR"); addr != "" {
+		password, err := secrets.LoadOptional(provider, "NOTIFY_SMTP_PASSWORD")
+		if err != nil {
+			return nil, err
+		}
+
+		notifiers = append(notifiers, &updater.SMTPNotifier{
+			Addr:     addr,
+			From:     os.Getenv("NOTIFY_SMTP_FROM"),
+			Password: password,
+			To:       strings.Split(os.Getenv("NOTIFY_SMTP_TO"), ","),
+			Username: os.Getenv("NOTIFY_SMTP_USERNAME"),
+		})
+	}
+
+	webhookURL, err := secrets.LoadOptional(provider, "NOTIFY_WEBHOOK_URL")
+	if err != nil {
+		return nil, err
+	}
+	if webhookURL != "" {
+		notifiers = append(notifiers, &updater.WebhookNotifier{URL: webhookURL})
+	}
+
+	slackURL, err := secrets.LoadOptional(provider, "NOTIFY_SLACK_URL")
+	if err != nil {
+		return nil, err
+	}
+	if slackURL != "" {
+		notifiers = append(notifiers, &updater.SlackNotifier{URL: slackURL})
+	}
+
+	if len(notifiers) == 0 {
+		return nil, nil
+	}
+
+	return &updater.DedupNotifier{Notifier: notifiers, Store: store}, nil
+}
+
+// awsSession creates a session for AWS services. Region and credentials come
+// from the environment, which Lambda sets up.
+func awsSession() (*session.Session, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("Error creating AWS session: %v", err)
+	}
+	return sess, nil
+}
+
+// s3Client creates a client for the bucket configured with S3_BUCKET. If
+// S3_ENDPOINT is set, it's used with path-style addressing so that stores
+// other than S3 (like MinIO) work.
+func s3Client() (*s3.S3, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &aws.Config{}
+	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
 	}
-	return val, nil
+
+	return s3.New(sess, config), nil
+}
+
+// sqliteDB is the SQLite store, which is opened once and shared by
+// everything that uses it.
+var sqliteDB *updater.SQLiteStore
+
+// sqliteStore opens the SQLite store at path, or gets it if it's already
+// open.
+func sqliteStore(path string) (*updater.SQLiteStore, error) {
+	if sqliteDB == nil {
+		var err error
+		sqliteDB, err = updater.OpenSQLiteStore(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sqliteDB, nil
+}
+
+// stateStore gets the store for the ledger of posted intervals if one was
+// configured with STATE_FILE, DYNAMODB_TABLE, S3_BUCKET, or SQLITE_DB, and
+// otherwise nil.
+func stateStore() (updater.StateStore, error) {
+	path := os.Getenv("STATE_FILE")
+	table := os.Getenv("DYNAMODB_TABLE")
+	bucket := os.Getenv("S3_BUCKET")
+	db := os.Getenv("SQLITE_DB")
+
+	numSet := 0
+	for _, v := range []string{path, table, bucket, db} {
+		if v != "" {
+			numSet++
+		}
+	}
+	if numSet > 1 {
+		return nil, fmt.Errorf(
+			"Set only one of STATE_FILE, DYNAMODB_TABLE, S3_BUCKET, and SQLITE_DB")
+	}
+
+	switch {
+	case db != "":
+		return sqliteStore(db)
+
+	case path != "":
+		return &updater.FileStateStore{Path: path}, nil
+
+	case table != "":
+		sess, err := awsSession()
+		if err != nil {
+			return nil, err
+		}
+
+		return &updater.DynamoDBStateStore{Client: dynamodb.New(sess), Table: table}, nil
+
+	case bucket != "":
+		client, err := s3Client()
+		if err != nil {
+			return nil, err
+		}
+
+		return &updater.S3StateStore{Bucket: bucket, Client: client,
+			Key: os.Getenv("S3_PREFIX") + "state.json"}, nil
+	}
+
+	return nil, nil
+}
+
+// tweetCache gets the tweet cache if one was configured with TWEET_CACHE,
+// S3_BUCKET, or SQLITE_DB, and otherwise nil.
+func tweetCache() (updater.TweetCache, error) {
+	if path := os.Getenv("TWEET_CACHE"); path != "" {
+		return &updater.FileTweetCache{Path: path}, nil
+	}
+
+	if path := os.Getenv("SQLITE_DB"); path != "" {
+		return sqliteStore(path)
+	}
+
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		client, err := s3Client()
+		if err != nil {
+			return nil, err
+		}
+
+		return &updater.S3TweetCache{Bucket: bucket, Client: client,
+			Key: os.Getenv("S3_PREFIX") + "tweets.json"}, nil
+	}
+
+	return nil, nil
+}
+
+// withTweetCache wraps an API so that tweets are listed from a cache if one
+// was configured.
+func withTweetCache(api updater.TwitterAPI) (updater.TwitterAPI, error) {
+	cache, err := tweetCache()
+	if err != nil {
+		return nil, err
+	}
+
+	if cache == nil {
+		return api, nil
+	}
+
+	var apiLogger updater.Logger = logger
+	if liveAPI, ok := api.(*updater.LiveTwitterAPI); ok {
+		apiLogger = liveAPI.Logger
+	}
+
+	cachedAPI := &updater.CachedTwitterAPI{API: api, Cache: cache, Logger: apiLogger}
+
+	// Bound the first sync like Update bounds its scan
+	cachedAPI.MaxScanTweets, err = envInt("MAX_SCAN_TWEETS")
+	if err != nil {
+		return nil, err
+	}
+	if len(intervals) > 0 {
+		cachedAPI.NotBefore = intervals[0].Target
+	}
+
+	return cachedAPI, nil
+}
+
+func newTwitterAPI(provider secrets.Provider) (*updater.LiveTwitterAPI, error) {
+	values, err := secrets.Load(provider, twitterSecrets...)
+	if err != nil {
+		return nil, err
+	}
+
+	api := updater.NewLiveTwitterAPI(
+		values["CONSUMER_KEY"],
+		values["CONSUMER_SECRET"],
+		values["ACCESS_TOKEN"],
+		values["ACCESS_TOKEN_SECRET"],
+		values["SCREEN_NAME"],
+	)
+	api.Logger = updater.WithLogAttrs(logger, updater.LogKeySeries, api.ScreenName)
+
+	return api, nil
 }
@@ -0,0 +1,150 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// keySize is the size in bytes of a key for an encrypted secrets file.
+const keySize = 32
+
+// nonceSize is the size in bytes of the random nonce that prefixes an
+// encrypted secrets file.
+const nonceSize = 24
+
+var keyEncoding = base64.RawURLEncoding
+
+// DecodeKey decodes a key for an encrypted secrets file like the one returned
+// by GenerateKey.
+func DecodeKey(encoded string) (*[keySize]byte, error) {
+	data, err := keyEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding secrets key: %v", err)
+	}
+
+	if len(data) != keySize {
+		return nil, fmt.Errorf("Secrets key should be %v bytes, but was %v",
+			keySize, len(data))
+	}
+
+	var key [keySize]byte
+	copy(key[:], data)
+	return &key, nil
+}
+
+// GenerateKey generates a new encoded key for an encrypted secrets file.
+func GenerateKey() (string, error) {
+	var key [keySize]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", err
+	}
+	return keyEncoding.EncodeToString(key[:]), nil
+}
+
+// EncryptedFileProvider looks up secrets from a local file that's encrypted
+// with NaCl's secretbox. This allows secrets to be kept alongside a
+// deployment (or even checked in) while only the one key needs to be
+// supplied separately.
+type EncryptedFileProvider struct {
+	// Key is the key that the file is encrypted with.
+	Key *[keySize]byte
+
+	// Path is the path to the file. A file that doesn't exist yet is treated
+	// as though it contains no secrets.
+	Path string
+}
+
+// Keys lists the keys of all secrets in the file (but never their values).
+func (p *EncryptedFileProvider) Keys() ([]string, error) {
+	values, err := p.read()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Lookup gets the value of a secret from the file.
+func (p *EncryptedFileProvider) Lookup(key string) (string, bool, error) {
+	values, err := p.read()
+	if err != nil {
+		return "", false, err
+	}
+
+	value, ok := values[key]
+	return value, ok, nil
+}
+
+// Set stores the value of a secret in the file, reencrypting the whole thing.
+func (p *EncryptedFileProvider) Set(key, value string) error {
+	values, err := p.read()
+	if err != nil {
+		return err
+	}
+
+	values[key] = value
+	return p.write(values)
+}
+
+func (p *EncryptedFileProvider) read() (map[string]string, error) {
+	data, err := ioutil.ReadFile(p.Path)
+	if os.IsNotExist(err) {
+		return make(map[string]string), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading secrets file: %v", err)
+	}
+
+	if len(data) < nonceSize+secretbox.Overhead {
+		return nil, fmt.Errorf("Secrets file is too short")
+	}
+
+	var nonce [nonceSize]byte
+	copy(nonce[:], data[:nonceSize])
+
+	plaintext, ok := secretbox.Open(nil, data[nonceSize:], &nonce, p.Key)
+	if !ok {
+		return nil, fmt.Errorf("Couldn't open secrets file; wrong key or corrupted file")
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal(plaintext, &values); err != nil {
+		return nil, fmt.Errorf("Error decoding secrets file: %v", err)
+	}
+
+	if values == nil {
+		values = make(map[string]string)
+	}
+	return values, nil
+}
+
+func (p *EncryptedFileProvider) write(values map[string]string) error {
+	plaintext, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+
+	data := secretbox.Seal(nonce[:], plaintext, &nonce, p.Key)
+
+	err = ioutil.WriteFile(p.Path, data, 0600)
+	if err != nil {
+		return fmt.Errorf("Error writing secrets file: %v", err)
+	}
+
+	return nil
+}
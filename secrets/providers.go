@@ -0,0 +1,134 @@
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/brandur/perpetual/shamir"
+)
+
+//
+// Environment
+//
+
+// EnvProvider looks up secrets from environment variables of the same name.
+type EnvProvider struct {
+}
+
+// Lookup gets the value of a secret from the environment.
+func (p *EnvProvider) Lookup(key string) (string, bool, error) {
+	value, ok := os.LookupEnv(key)
+	return value, ok, nil
+}
+
+//
+// Directory
+//
+
+// DirProvider looks up secrets from a directory containing one file per
+// secret named after its key, like the ones that Docker mounts at
+// `/run/secrets` or systemd exposes in $CREDENTIALS_DIRECTORY.
+type DirProvider struct {
+	// Dir is the path to the directory.
+	Dir string
+}
+
+// Keys lists the keys of all secrets in the directory.
+func (p *DirProvider) Keys() ([]string, error) {
+	infos, err := ioutil.ReadDir(p.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing secrets: %v", err)
+	}
+
+	var keys []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			keys = append(keys, info.Name())
+		}
+	}
+	return keys, nil
+}
+
+// Lookup gets the value of a secret from its file. A trailing newline is
+// trimmed because most tools used to write these files add one.
+func (p *DirProvider) Lookup(key string) (string, bool, error) {
+	path, err := p.path(key)
+	if err != nil {
+		return "", false, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("Error reading secret %s: %v", key, err)
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// Set writes the value of a secret to its file, readable only by the current
+// user.
+func (p *DirProvider) Set(key, value string) error {
+	path, err := p.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path, []byte(value+"\n"), 0600)
+	if err != nil {
+		return fmt.Errorf("Error writing secret %s: %v", key, err)
+	}
+
+	return nil
+}
+
+func (p *DirProvider) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return "", fmt.Errorf("Invalid secret key: %q", key)
+	}
+	return filepath.Join(p.Dir, key), nil
+}
+
+//
+// Shares
+//
+
+// SharesSuffix is appended to a secret's key to find Shamir shares from
+// which it can be reconstructed.
+const SharesSuffix = "_SHARES"
+
+// SharesProvider wraps another provider so that any secret can be
+// reconstructed from Shamir shares (see the shamir package). If a secret
+// isn't set itself but one with the same key plus SharesSuffix is, the latter
+// is parsed as a list of shares and combined. This lets a set of trustees
+// supply a secret for a run without any one of them holding it.
+type SharesProvider struct {
+	// Provider is the provider to look up secrets and their shares in.
+	Provider Provider
+}
+
+// Lookup gets the value of a secret, reconstructing it from shares if
+// necessary.
+func (p *SharesProvider) Lookup(key string) (string, bool, error) {
+	value, ok, err := p.Provider.Lookup(key)
+	if err != nil || (ok && value != "") {
+		return value, ok, err
+	}
+
+	encodedShares, ok, err := p.Provider.Lookup(key + SharesSuffix)
+	if err != nil || !ok || encodedShares == "" {
+		return "", false, err
+	}
+
+	secret, err := shamir.Combine(shamir.ParseShares(encodedShares))
+	if err != nil {
+		return "", false, fmt.Errorf("Error reconstructing %s from shares: %v", key, err)
+	}
+
+	return string(secret), true, nil
+}
@@ -0,0 +1,223 @@
+// Package secrets loads the credentials and keys that perpetual needs from a
+// pluggable set of sources: environment variables, a directory of files (as
+// used for Docker and systemd credentials), or a locally encrypted secrets
+// file.
+//
+// Secret values are never logged. Values redacts them when formatted, and
+// errors only ever mention keys.
+package secrets
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Provider is a source of secrets.
+type Provider interface {
+	// Lookup gets the value of the secret with the given key. ok is false if
+	// the provider doesn't have it.
+	Lookup(key string) (value string, ok bool, err error)
+}
+
+// Writer is a source of secrets that can also list and store them.
+type Writer interface {
+	Provider
+
+	// Keys lists the keys of all secrets in the store (but never their
+	// values).
+	Keys() ([]string, error)
+
+	// Set stores the value of the secret with the given key, replacing any
+	// existing value.
+	Set(key, value string) error
+}
+
+// MissingError is returned by Load when one or more secrets weren't found in
+// any provider.
+type MissingError struct {
+	// Keys are the keys of all secrets that weren't found.
+	Keys []string
+}
+
+func (e *MissingError) Error() string {
+	return fmt.Sprintf("Missing secrets: %s", strings.Join(e.Keys, ", "))
+}
+
+// Values are secrets keyed by name. Formatting them with fmt never prints
+// their values.
+type Values map[string]string
+
+// GoString implements fmt.GoStringer so that %#v doesn't reveal values.
+func (v Values) GoString() string {
+	return v.String()
+}
+
+// String implements fmt.Stringer so that values are redacted.
+func (v Values) String() string {
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key + ":[REDACTED]"
+	}
+	return "secrets.Values{" + strings.Join(parts, " ") + "}"
+}
+
+// Load gets the values of all of the given keys from a provider. If any are
+// missing, a *MissingError naming all of them is returned rather than just
+// the first.
+func Load(provider Provider, keys ...string) (Values, error) {
+	values := make(Values, len(keys))
+	var missing []string
+
+	for _, key := range keys {
+		value, ok, err := provider.Lookup(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok || value == "" {
+			missing = append(missing, key)
+			continue
+		}
+
+		values[key] = value
+	}
+
+	if len(missing) > 0 {
+		return nil, &MissingError{Keys: missing}
+	}
+
+	return values, nil
+}
+
+// LoadOptional gets the value of a secret that doesn't have to be set,
+// returning an empty string if it's not.
+func LoadOptional(provider Provider, key string) (string, error) {
+	value, _, err := provider.Lookup(key)
+	return value, err
+}
+
+//
+// Chain
+//
+
+// ChainProvider looks up secrets from each of a list of providers in turn,
+// returning the first value found.
+type ChainProvider struct {
+	// Providers are the providers to consult, in order of precedence.
+	Providers []Provider
+}
+
+// Lookup gets the value of a secret from the first provider that has it.
+func (p *ChainProvider) Lookup(key string) (string, bool, error) {
+	for _, provider := range p.Providers {
+		value, ok, err := provider.Lookup(key)
+		if err != nil {
+			return "", false, err
+		}
+
+		if ok && value != "" {
+			return value, true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+//
+// Configuration
+//
+
+// Default builds the provider that perpetual uses everywhere: whether it's
+// running in Lambda, on the command line, or in tests. It's configured with
+// the environment:
+//
+//   - Environment variables are always consulted first.
+//   - SECRETS_DIR (or systemd's CREDENTIALS_DIRECTORY) names a directory of
+//     files, one per secret.
+//   - SECRETS_FILE names an encrypted secrets file, which is opened with the
+//     key in SECRETS_KEY.
+//
+// Any secret can also be reconstructed from Shamir shares. See
+// SharesProvider.
+func Default() (Provider, error) {
+	providers := []Provider{&EnvProvider{}}
+
+	if dir := defaultDir(); dir != "" {
+		providers = append(providers, &DirProvider{Dir: dir})
+	}
+
+	encrypted, err := defaultEncryptedFile(providers)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted != nil {
+		providers = append(providers, encrypted)
+	}
+
+	return &SharesProvider{Provider: &ChainProvider{Providers: providers}}, nil
+}
+
+// DefaultWriter returns the store that new secrets should be written to
+// given the same configuration as Default: the encrypted secrets file if
+// there is one, and otherwise the secrets directory.
+func DefaultWriter() (Writer, error) {
+	providers := []Provider{&EnvProvider{}}
+
+	var dirProvider *DirProvider
+	if dir := defaultDir(); dir != "" {
+		dirProvider = &DirProvider{Dir: dir}
+		providers = append(providers, dirProvider)
+	}
+
+	encrypted, err := defaultEncryptedFile(providers)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted != nil {
+		return encrypted, nil
+	}
+
+	if dirProvider != nil {
+		return dirProvider, nil
+	}
+
+	return nil, fmt.Errorf("No writable secrets store configured; set SECRETS_FILE or SECRETS_DIR")
+}
+
+func defaultDir() string {
+	if dir := os.Getenv("SECRETS_DIR"); dir != "" {
+		return dir
+	}
+	return os.Getenv("CREDENTIALS_DIRECTORY")
+}
+
+// defaultEncryptedFile configures an encrypted secrets file if SECRETS_FILE
+// is set. Its key is looked up from the given providers (and may itself come
+// from shares).
+func defaultEncryptedFile(providers []Provider) (*EncryptedFileProvider, error) {
+	path := os.Getenv("SECRETS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+
+	keyProvider := &SharesProvider{Provider: &ChainProvider{Providers: providers}}
+	values, err := Load(keyProvider, "SECRETS_KEY")
+	if err != nil {
+		return nil, fmt.Errorf("SECRETS_FILE is set, but: %v", err)
+	}
+
+	key, err := DecodeKey(values["SECRETS_KEY"])
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedFileProvider{Key: key, Path: path}, nil
+}
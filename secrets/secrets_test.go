@@ -0,0 +1,220 @@
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/brandur/perpetual/shamir"
+	assert "github.com/stretchr/testify/require"
+)
+
+//
+// Mock provider
+//
+
+type mockProvider map[string]string
+
+func (p mockProvider) Lookup(key string) (string, bool, error) {
+	value, ok := p[key]
+	return value, ok, nil
+}
+
+//
+// Tests
+//
+
+func TestLoad(t *testing.T) {
+	provider := mockProvider{"A": "a", "B": "b", "EMPTY": ""}
+
+	values, err := Load(provider, "A", "B")
+	assert.NoError(t, err)
+	assert.Equal(t, Values{"A": "a", "B": "b"}, values)
+
+	// All missing keys are reported together, and empty counts as missing
+	_, err = Load(provider, "A", "C", "B", "EMPTY", "D")
+	assert.EqualError(t, err, "Missing secrets: C, EMPTY, D")
+	assert.Equal(t, []string{"C", "EMPTY", "D"}, err.(*MissingError).Keys)
+
+	value, err := LoadOptional(provider, "C")
+	assert.NoError(t, err)
+	assert.Equal(t, "", value)
+}
+
+func TestValues_Redacted(t *testing.T) {
+	values := Values{"ACCESS_TOKEN": "hunter2", "SCREEN_NAME": "hunter3"}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		formatted := fmt.Sprintf(format, values)
+		assert.NotContains(t, formatted, "hunter", format)
+		assert.Contains(t, formatted, "ACCESS_TOKEN", format)
+	}
+}
+
+func TestChainProvider(t *testing.T) {
+	provider := &ChainProvider{Providers: []Provider{
+		mockProvider{"A": "first", "B": ""},
+		mockProvider{"A": "second", "B": "second", "C": "second"},
+	}}
+
+	values, err := Load(provider, "A", "B", "C")
+	assert.NoError(t, err)
+	assert.Equal(t, Values{"A": "first", "B": "second", "C": "second"}, values)
+
+	_, ok, err := provider.Lookup("D")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestDirProvider(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	provider := &DirProvider{Dir: dir}
+
+	// Files written by other tools usually end with a newline
+	err := ioutil.WriteFile(filepath.Join(dir, "A"), []byte("a\n"), 0600)
+	assert.NoError(t, err)
+
+	assert.NoError(t, provider.Set("B", "b"))
+
+	values, err := Load(provider, "A", "B")
+	assert.NoError(t, err)
+	assert.Equal(t, Values{"A": "a", "B": "b"}, values)
+
+	keys, err := provider.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"A", "B"}, keys)
+
+	_, ok, err := provider.Lookup("C")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, _, err = provider.Lookup("../A")
+	assert.Error(t, err)
+}
+
+func TestEncryptedFileProvider(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	key := mustGenerateKey(t)
+	provider := &EncryptedFileProvider{Key: key, Path: filepath.Join(dir, "secrets")}
+
+	// A file that doesn't exist yet is empty
+	_, ok, err := provider.Lookup("A")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, provider.Set("A", "super-secret"))
+	assert.NoError(t, provider.Set("B", "b"))
+
+	values, err := Load(provider, "A", "B")
+	assert.NoError(t, err)
+	assert.Equal(t, Values{"A": "super-secret", "B": "b"}, values)
+
+	keys, err := provider.Keys()
+	assert.NoError(t, err)
+	sort.Strings(keys)
+	assert.Equal(t, []string{"A", "B"}, keys)
+
+	// The file isn't readable as plaintext
+	data, err := ioutil.ReadFile(provider.Path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "super-secret")
+
+	// The wrong key
+	other := &EncryptedFileProvider{Key: mustGenerateKey(t), Path: provider.Path}
+	_, _, err = other.Lookup("A")
+	assert.EqualError(t, err, "Couldn't open secrets file; wrong key or corrupted file")
+}
+
+func TestSharesProvider(t *testing.T) {
+	shares, err := shamir.Split([]byte("from shares"), 3, 2)
+	assert.NoError(t, err)
+
+	provider := &SharesProvider{Provider: mockProvider{
+		"PLAIN":         "plain",
+		"PLAIN_SHARES":  strings.Join(shares[1:], ","),
+		"SHARED_SHARES": strings.Join(shares[1:], ", "),
+		"SHORT_SHARES":  shares[0],
+	}}
+
+	values, err := Load(provider, "PLAIN", "SHARED")
+	assert.NoError(t, err)
+	assert.Equal(t, Values{"PLAIN": "plain", "SHARED": "from shares"}, values)
+
+	_, err = Load(provider, "SHORT")
+	assert.EqualError(t, err, "Error reconstructing SHORT from shares: "+
+		"Need at least 2 shares, but got 1")
+
+	_, err = Load(provider, "MISSING")
+	assert.EqualError(t, err, "Missing secrets: MISSING")
+}
+
+func TestDefault(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	key, err := GenerateKey()
+	assert.NoError(t, err)
+
+	defer os.Unsetenv("PERPETUAL_TEST_ENV")
+	defer os.Unsetenv("SECRETS_DIR")
+	defer os.Unsetenv("SECRETS_FILE")
+	defer os.Unsetenv("SECRETS_KEY")
+
+	os.Setenv("PERPETUAL_TEST_ENV", "from env")
+	os.Setenv("SECRETS_DIR", dir)
+	os.Setenv("SECRETS_FILE", filepath.Join(dir, "..", filepath.Base(dir)+".secrets"))
+	defer os.Remove(os.Getenv("SECRETS_FILE"))
+
+	// The key is required if there's a file
+	_, err = Default()
+	assert.EqualError(t, err, "SECRETS_FILE is set, but: Missing secrets: SECRETS_KEY")
+
+	os.Setenv("SECRETS_KEY", key)
+
+	// The encrypted file takes precedence for writing
+	writer, err := DefaultWriter()
+	assert.NoError(t, err)
+	assert.IsType(t, &EncryptedFileProvider{}, writer)
+	assert.NoError(t, writer.Set("PERPETUAL_TEST_FILE", "from file"))
+
+	assert.NoError(t, (&DirProvider{Dir: dir}).Set("PERPETUAL_TEST_DIR", "from dir"))
+
+	provider, err := Default()
+	assert.NoError(t, err)
+
+	values, err := Load(provider, "PERPETUAL_TEST_DIR", "PERPETUAL_TEST_ENV", "PERPETUAL_TEST_FILE")
+	assert.NoError(t, err)
+	assert.Equal(t, Values{
+		"PERPETUAL_TEST_DIR":  "from dir",
+		"PERPETUAL_TEST_ENV":  "from env",
+		"PERPETUAL_TEST_FILE": "from file",
+	}, values)
+}
+
+//
+// Helpers
+//
+
+func mustGenerateKey(t *testing.T) *[keySize]byte {
+	encoded, err := GenerateKey()
+	assert.NoError(t, err)
+
+	key, err := DecodeKey(encoded)
+	assert.NoError(t, err)
+
+	return key
+}
+
+func mustTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "perpetual-secrets")
+	assert.NoError(t, err)
+	return dir
+}
@@ -0,0 +1,314 @@
+// Package shamir implements Shamir's secret sharing so that a secret can be
+// split among a group of trustees such that any K of them can reconstruct it,
+// but fewer than K learn nothing about it.
+//
+// Each byte of the secret is split independently using a random polynomial
+// over GF(2^8). Shares are encoded as text so that they're easy to print or
+// copy, and carry a checksum to catch transcription errors. A short digest of
+// the secret is split along with it, so that a reconstruction from corrupted
+// shares is rejected instead of silently producing garbage, without the
+// digest being readable from any one share. Each split also gets a random ID
+// so that shares from different splits aren't mixed.
+package shamir
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// sharePrefix is prepended to every encoded share so that they're easily
+// recognizable.
+const sharePrefix = "pshare1:"
+
+// Sizes in bytes of the parts of an encoded share.
+const (
+	checksumSize = 4
+	digestSize   = 4
+	idSize       = 4
+
+	// version, threshold, x, ID
+	headerSize = 3 + idSize
+)
+
+// shareVersion is the version of the share encoding, carried in each share's
+// first byte. Shares with any other version are rejected.
+const shareVersion = 2
+
+var shareEncoding = base64.RawURLEncoding
+
+// Combine reconstructs a secret from encoded shares produced by Split. At
+// least as many shares as the threshold they were split with must be given.
+func Combine(encodedShares []string) ([]byte, error) {
+	if len(encodedShares) < 1 {
+		return nil, fmt.Errorf("Need at least one share")
+	}
+
+	shares := make([]*share, len(encodedShares))
+	for i, encoded := range encodedShares {
+		var err error
+		shares[i], err = decodeShare(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Share %v: %v", i+1, err)
+		}
+	}
+
+	first := shares[0]
+	seen := make(map[byte]bool)
+	for i, s := range shares {
+		if s.threshold != first.threshold || !bytes.Equal(s.id, first.id) ||
+			len(s.y) != len(first.y) {
+			return nil, fmt.Errorf("Share %v is from a different split than share 1", i+1)
+		}
+
+		if seen[s.x] {
+			return nil, fmt.Errorf("Share %v is a duplicate", i+1)
+		}
+		seen[s.x] = true
+	}
+
+	if len(shares) < int(first.threshold) {
+		return nil, fmt.Errorf("Need at least %v shares, but got %v",
+			first.threshold, len(shares))
+	}
+
+	// Any threshold's worth of shares is enough, so only use that many.
+	shares = shares[:first.threshold]
+
+	// The secret is followed by its digest
+	payload := make([]byte, len(first.y))
+	for i := range payload {
+		payload[i] = interpolateAtZero(shares, i)
+	}
+	secret, digest := payload[:len(payload)-digestSize], payload[len(payload)-digestSize:]
+
+	if !bytes.Equal(secretDigest(secret), digest) {
+		return nil, fmt.Errorf("Reconstructed secret doesn't match its digest; " +
+			"one or more shares are corrupted")
+	}
+
+	return secret, nil
+}
+
+// ParseShares parses a list of encoded shares separated by commas or
+// whitespace, as they'd be supplied in an environment variable or pasted in
+// one per line.
+func ParseShares(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// Split splits a secret into n encoded shares, any k of which can be used to
+// reconstruct it with Combine.
+func Split(secret []byte, n, k int) ([]string, error) {
+	if len(secret) < 1 {
+		return nil, fmt.Errorf("Secret must not be empty")
+	}
+	if k < 2 {
+		return nil, fmt.Errorf("Threshold must be at least 2")
+	}
+	if n < k {
+		return nil, fmt.Errorf("Number of shares must be at least the threshold")
+	}
+	if n > 255 {
+		return nil, fmt.Errorf("Number of shares must be at most 255")
+	}
+
+	// The digest is split along with the secret so that it's as hidden as the
+	// secret is
+	payload := append(append([]byte{}, secret...), secretDigest(secret)...)
+
+	// One random polynomial per byte of the payload, with the byte itself as
+	// the constant term.
+	coefficients := make([][]byte, len(payload))
+	for i, b := range payload {
+		coefficients[i] = make([]byte, k)
+		coefficients[i][0] = b
+		if _, err := rand.Read(coefficients[i][1:]); err != nil {
+			return nil, err
+		}
+	}
+
+	id := make([]byte, idSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	encoded := make([]string, n)
+	for i := 0; i < n; i++ {
+		s := &share{
+			id:        id,
+			threshold: byte(k),
+			x:         byte(i + 1),
+			y:         make([]byte, len(payload)),
+		}
+
+		for j := range payload {
+			s.y[j] = evaluatePolynomial(coefficients[j], s.x)
+		}
+
+		encoded[i] = s.encode()
+	}
+
+	return encoded, nil
+}
+
+//
+// Private
+//
+
+// share is a single decoded share.
+type share struct {
+	// id is the random ID of the split that the share came from.
+	id []byte
+
+	// threshold is the number of shares needed to reconstruct the secret.
+	threshold byte
+
+	// x is the point at which the share's polynomials were evaluated. It's
+	// never zero because that's where the secret is.
+	x byte
+
+	// y are the values of each of the share's polynomials at x, one for each
+	// byte of the secret followed by one for each byte of its digest.
+	y []byte
+}
+
+func decodeShare(encoded string) (*share, error) {
+	encoded = strings.TrimSpace(encoded)
+	if !strings.HasPrefix(encoded, sharePrefix) {
+		return nil, fmt.Errorf("Not a share (should start with %q)", sharePrefix)
+	}
+
+	data, err := shareEncoding.DecodeString(strings.TrimPrefix(encoded, sharePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding share: %v", err)
+	}
+
+	if len(data) < headerSize+1+digestSize+checksumSize {
+		return nil, fmt.Errorf("Share is too short")
+	}
+
+	body := data[:len(data)-checksumSize]
+	if !bytes.Equal(checksum(body), data[len(data)-checksumSize:]) {
+		return nil, fmt.Errorf("Share checksum doesn't match; it's corrupted")
+	}
+
+	if body[0] != shareVersion {
+		return nil, fmt.Errorf("Unsupported share version: %v", body[0])
+	}
+
+	s := &share{
+		id:        body[3:headerSize],
+		threshold: body[1],
+		x:         body[2],
+		y:         body[headerSize:],
+	}
+
+	if s.x == 0 || s.threshold < 2 {
+		return nil, fmt.Errorf("Share is malformed")
+	}
+
+	return s, nil
+}
+
+func (s *share) encode() string {
+	data := []byte{shareVersion, s.threshold, s.x}
+	data = append(data, s.id...)
+	data = append(data, s.y...)
+	data = append(data, checksum(data)...)
+	return sharePrefix + shareEncoding.EncodeToString(data)
+}
+
+func checksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:checksumSize]
+}
+
+// evaluatePolynomial evaluates a polynomial with the given coefficients
+// (lowest degree first) at x using Horner's method.
+func evaluatePolynomial(coefficients []byte, x byte) byte {
+	var result byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = add(mul(result, x), coefficients[i])
+	}
+	return result
+}
+
+// interpolateAtZero uses Lagrange interpolation to find the value at zero of
+// the polynomial passing through the shares' points for the byte at index.
+func interpolateAtZero(shares []*share, index int) byte {
+	var result byte
+	for i, si := range shares {
+		basis := byte(1)
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+
+			// At zero, each term of the basis polynomial is xj / (xj - xi),
+			// and subtraction is the same as addition in GF(2^8).
+			basis = mul(basis, div(sj.x, add(sj.x, si.x)))
+		}
+		result = add(result, mul(si.y[index], basis))
+	}
+	return result
+}
+
+func secretDigest(secret []byte) []byte {
+	sum := sha256.Sum256(secret)
+	return sum[:digestSize]
+}
+
+//
+// GF(2^8) arithmetic
+//
+
+// Logarithm and exponent tables for GF(2^8) using the same reducing
+// polynomial as AES (x^8 + x^4 + x^3 + x + 1) and 3 as a generator.
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		expTable[i+255] = x
+		logTable[x] = byte(i)
+
+		// Multiply by the generator, 3, which is x * 2 + x
+		doubled := x << 1
+		if x&0x80 != 0 {
+			doubled ^= 0x1b
+		}
+		x = doubled ^ x
+	}
+}
+
+func add(a, b byte) byte {
+	return a ^ b
+}
+
+func div(a, b byte) byte {
+	if b == 0 {
+		panic("Division by zero")
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
@@ -0,0 +1,171 @@
+package shamir
+
+import (
+	"strings"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestArithmetic(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		assert.Equal(t, byte(0), mul(byte(a), 0))
+
+		for b := 1; b < 256; b++ {
+			assert.Equal(t, byte(a), div(mul(byte(a), byte(b)), byte(b)))
+		}
+	}
+}
+
+func TestSplitAndCombine(t *testing.T) {
+	secret := []byte("a secret that should outlive its keeper")
+
+	shares, err := Split(secret, 5, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, len(shares))
+
+	// Every combination of three shares works
+	for i := 0; i < 5; i++ {
+		for j := i + 1; j < 5; j++ {
+			for k := j + 1; k < 5; k++ {
+				actual, err := Combine([]string{shares[i], shares[j], shares[k]})
+				assert.NoError(t, err)
+				assert.Equal(t, secret, actual)
+			}
+		}
+	}
+
+	// So do more than three, in any order
+	actual, err := Combine([]string{shares[4], shares[0], shares[2], shares[1]})
+	assert.NoError(t, err)
+	assert.Equal(t, secret, actual)
+
+	// Surrounding whitespace from copying and pasting is okay
+	actual, err = Combine([]string{" " + shares[0] + "\n", shares[1], shares[2]})
+	assert.NoError(t, err)
+	assert.Equal(t, secret, actual)
+}
+
+func TestCombine_Rejections(t *testing.T) {
+	secret := []byte("a secret that should outlive its keeper")
+
+	shares, err := Split(secret, 5, 3)
+	assert.NoError(t, err)
+
+	// Too few shares
+	_, err = Combine(shares[:2])
+	assert.EqualError(t, err, "Need at least 3 shares, but got 2")
+
+	_, err = Combine(nil)
+	assert.Error(t, err)
+
+	// A duplicate share
+	_, err = Combine([]string{shares[0], shares[1], shares[1]})
+	assert.EqualError(t, err, "Share 3 is a duplicate")
+
+	// A share with a transcription error is caught by its checksum
+	{
+		corrupted := []byte(shares[2])
+		corrupted[len(sharePrefix)+10] = flipChar(corrupted[len(sharePrefix)+10])
+
+		_, err = Combine([]string{shares[0], shares[1], string(corrupted)})
+		assert.EqualError(t, err, "Share 3: Share checksum doesn't match; it's corrupted")
+	}
+
+	// A share that was altered and re-checksummed is caught by the digest of
+	// the secret
+	{
+		s, err := decodeShare(shares[2])
+		assert.NoError(t, err)
+		s.y[0] ^= 0x01
+
+		_, err = Combine([]string{shares[0], shares[1], s.encode()})
+		assert.EqualError(t, err, "Reconstructed secret doesn't match its digest; "+
+			"one or more shares are corrupted")
+	}
+
+	// A share from another split of the same secret
+	{
+		others, err := Split(secret, 5, 3)
+		assert.NoError(t, err)
+
+		_, err = Combine([]string{shares[0], shares[1], others[2]})
+		assert.Error(t, err)
+	}
+
+	// A share from a split of a different secret
+	{
+		others, err := Split([]byte("another secret of the very same length..."), 5, 3)
+		assert.NoError(t, err)
+
+		_, err = Combine([]string{shares[0], shares[1], others[2]})
+		assert.EqualError(t, err, "Share 3 is from a different split than share 1")
+	}
+
+	// Garbage
+	_, err = Combine([]string{shares[0], shares[1], "not a share"})
+	assert.Error(t, err)
+
+	_, err = Combine([]string{shares[0], shares[1], sharePrefix + "AAAA"})
+	assert.Error(t, err)
+}
+
+func TestSplit_Invalid(t *testing.T) {
+	_, err := Split([]byte{}, 5, 3)
+	assert.Error(t, err)
+
+	_, err = Split([]byte("secret"), 5, 1)
+	assert.Error(t, err)
+
+	_, err = Split([]byte("secret"), 2, 3)
+	assert.Error(t, err)
+
+	_, err = Split([]byte("secret"), 256, 3)
+	assert.Error(t, err)
+}
+
+func TestSplit_Encoding(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	assert.NoError(t, err)
+
+	for _, s := range shares {
+		assert.True(t, strings.HasPrefix(s, sharePrefix))
+	}
+}
+
+// Nothing about the secret can be read from a share's header, so splits of
+// the same secret have nothing in common.
+func TestSplit_NoDigestInHeader(t *testing.T) {
+	secret := []byte("secret")
+
+	first, err := Split(secret, 3, 2)
+	assert.NoError(t, err)
+
+	second, err := Split(secret, 3, 2)
+	assert.NoError(t, err)
+
+	s1, err := decodeShare(first[0])
+	assert.NoError(t, err)
+
+	s2, err := decodeShare(second[0])
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, s1.id, s2.id)
+	assert.NotEqual(t, secretDigest(secret), s1.id)
+
+	// The digest is split with the secret
+	assert.Equal(t, len(secret)+digestSize, len(s1.y))
+}
+
+//
+// Helpers
+//
+
+// flipChar swaps a character of base64 for a different one that's still
+// valid base64.
+func flipChar(c byte) byte {
+	if c == 'A' {
+		return 'B'
+	}
+	return 'A'
+}
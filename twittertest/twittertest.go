@@ -0,0 +1,648 @@
+// Package twittertest provides an in-process fake of the parts of Twitter's
+// API that perpetual uses, in the spirit of net/http/httptest, so that the
+// live client can be tested without making requests to Twitter.
+//
+// The fake is meant to behave like the real thing where it matters to a
+// client: requests must carry a valid OAuth 1.0a signature for the server's
+// credentials, timelines are paged newest first with `count`, `max_id` and
+// `since_id`, read endpoints send rate limit headers and are limited, and
+// errors come back with Twitter's status codes and JSON error bodies.
+package twittertest
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Defaults for the server's limits.
+const (
+	// DefaultMaxPageSize is the largest page that a timeline returns, no
+	// matter what `count` is asked for.
+	DefaultMaxPageSize = 200
+
+	// DefaultMaxTimeline is how many of an account's most recent tweets its
+	// timeline reaches back through. Twitter gives up on older ones.
+	DefaultMaxTimeline = 3200
+
+	// DefaultRateLimit is how many requests each read endpoint allows per
+	// rate limit window.
+	DefaultRateLimit = 900
+
+	// RateLimitWindow is how long a rate limit window lasts.
+	RateLimitWindow = 15 * time.Minute
+)
+
+// Twitter's error codes for the errors that the server returns.
+const (
+	ErrorCodeAuthentication = 32
+	ErrorCodeDuplicate      = 187
+	ErrorCodeInvalidParam   = 44
+	ErrorCodeNotFound       = 144
+	ErrorCodeRateLimit      = 88
+	ErrorCodeTooLong        = 186
+	ErrorCodeUserNotFound   = 50
+)
+
+// maxTweetLength is the longest status that can be posted, in characters.
+const maxTweetLength = 280
+
+// truncatedTweetLength is the length that a tweet's `text` is truncated to
+// when it's not requested with `tweet_mode=extended`.
+const truncatedTweetLength = 140
+
+// Tweet is a tweet stored by the server.
+type Tweet struct {
+	// CreatedAt is when the tweet was posted.
+	CreatedAt time.Time
+
+	// ID is the tweet's ID. IDs increase with every tweet.
+	ID uint64
+
+	// InReplyToID is the ID of the tweet that this one replies to, or zero
+	// if it isn't a reply.
+	InReplyToID uint64
+
+	// Text is the tweet's full text.
+	Text string
+}
+
+// Server is a fake of Twitter's API. Create one with NewServer and close it
+// when done.
+//
+// It serves:
+//
+//	GET  /1.1/statuses/lookup.json
+//	GET  /1.1/statuses/user_timeline.json
+//	POST /1.1/statuses/destroy/:id.json
+//	POST /1.1/statuses/update.json
+//
+// The credentials and limits can be changed before requests are made.
+type Server struct {
+	// AccessToken and AccessTokenSecret are the account's access token pair
+	// that requests must be signed with.
+	AccessToken       string
+	AccessTokenSecret string
+
+	// ConsumerKey and ConsumerSecret are the app's key pair that requests
+	// must be signed with.
+	ConsumerKey    string
+	ConsumerSecret string
+
+	// MaxPageSize is the largest page that a timeline returns. Defaults to
+	// DefaultMaxPageSize if zero.
+	MaxPageSize int
+
+	// MaxTimeline is how many of the most recent tweets a timeline reaches.
+	// Defaults to DefaultMaxTimeline if zero.
+	MaxTimeline int
+
+	// RateLimit is how many requests each read endpoint allows per window.
+	// Defaults to DefaultRateLimit if zero.
+	RateLimit int
+
+	// ScreenName is the account's screen name.
+	ScreenName string
+
+	// URL is the base URL of the server, for LiveTwitterAPI's BaseURL.
+	URL string
+
+	mu       sync.Mutex
+	errors   map[string][]*apiError
+	lastID   uint64
+	nonces   map[string]bool
+	now      func() time.Time
+	requests map[string]int
+	server   *httptest.Server
+	tweets   []*Tweet
+	used     map[string]int
+	window   time.Time
+}
+
+// NewServer starts a server for the account @perpetual_test with a made up
+// set of credentials.
+func NewServer() *Server {
+	s := &Server{
+		AccessToken:       "access-token",
+		AccessTokenSecret: "access-token-secret",
+		ConsumerKey:       "consumer-key",
+		ConsumerSecret:    "consumer-secret",
+		ScreenName:        "perpetual_test",
+
+		// IDs start out big like Twitter's do
+		lastID: 1000000000000000000,
+
+		now: time.Now,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1.1/statuses/destroy/", s.handleDestroy)
+	mux.HandleFunc("/1.1/statuses/lookup.json", s.handleLookup)
+	mux.HandleFunc("/1.1/statuses/update.json", s.handleUpdate)
+	mux.HandleFunc("/1.1/statuses/user_timeline.json", s.handleTimeline)
+
+	s.server = httptest.NewServer(s.authenticate(mux))
+	s.URL = s.server.URL
+	return s
+}
+
+// AddTweet adds a tweet to the account as if it had been posted now,
+// returning it.
+func (s *Server) AddTweet(text string) *Tweet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addTweet(text, 0)
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// FailNext makes the next request to the endpoint at path fail with the
+// given status and Twitter error. Failures queue up if called more than
+// once. Failed requests still count against rate limits.
+func (s *Server) FailNext(path string, status int, code int, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.errors == nil {
+		s.errors = make(map[string][]*apiError)
+	}
+	s.errors[path] = append(s.errors[path],
+		&apiError{Code: code, Message: message, status: status})
+}
+
+// Requests gets the number of requests that have been made to the endpoint
+// at path, including ones that failed.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[path]
+}
+
+// ResetRateLimits starts a new rate limit window.
+func (s *Server) ResetRateLimits() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.window = time.Time{}
+}
+
+// Tweets gets the account's tweets, newest first.
+func (s *Server) Tweets() []*Tweet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tweets := make([]*Tweet, len(s.tweets))
+	for i, tweet := range s.tweets {
+		copied := *tweet
+		tweets[i] = &copied
+	}
+	return tweets
+}
+
+//
+// Private
+//
+
+// apiError is an error in one of Twitter's error bodies.
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+
+	status int
+}
+
+// liveTweet is a tweet as it's encoded in responses.
+type liveTweet struct {
+	CreatedAt   string `json:"created_at"`
+	FullText    string `json:"full_text,omitempty"`
+	ID          uint64 `json:"id"`
+	IDStr       string `json:"id_str"`
+	InReplyToID uint64 `json:"in_reply_to_status_id,omitempty"`
+	Text        string `json:"text,omitempty"`
+	Truncated   bool   `json:"truncated"`
+}
+
+// readEndpoints are the endpoints that are rate limited.
+var readEndpoints = map[string]bool{
+	"/1.1/statuses/lookup.json":        true,
+	"/1.1/statuses/user_timeline.json": true,
+}
+
+func (s *Server) addTweet(text string, inReplyToID uint64) *Tweet {
+	s.lastID++
+	tweet := &Tweet{
+		CreatedAt:   s.now().UTC().Truncate(time.Second),
+		ID:          s.lastID,
+		InReplyToID: inReplyToID,
+		Text:        text,
+	}
+	s.tweets = append([]*Tweet{tweet}, s.tweets...)
+	return tweet
+}
+
+// authenticate checks that requests are signed, counts them against rate
+// limits, and fails them if a failure was queued before passing them on.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			writeError(w, &apiError{Code: 0, Message: err.Error(),
+				status: http.StatusBadRequest})
+			return
+		}
+
+		s.mu.Lock()
+		apiErr := s.checkSignature(r)
+		if apiErr == nil {
+			apiErr = s.checkRateLimit(w, r.URL.Path)
+		}
+		if apiErr == nil && len(s.errors[r.URL.Path]) > 0 {
+			apiErr = s.errors[r.URL.Path][0]
+			s.errors[r.URL.Path] = s.errors[r.URL.Path][1:]
+		}
+		s.mu.Unlock()
+
+		if apiErr != nil {
+			writeError(w, apiErr)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkRateLimit counts a request against its endpoint's rate limit, setting
+// the headers that report it. Must be called with the lock held.
+func (s *Server) checkRateLimit(w http.ResponseWriter, path string) *apiError {
+	if s.requests == nil {
+		s.requests = make(map[string]int)
+	}
+	s.requests[path]++
+
+	if !readEndpoints[path] {
+		return nil
+	}
+
+	now := s.now()
+	if s.window.IsZero() || !now.Before(s.window) {
+		s.window = now.Add(RateLimitWindow)
+		s.used = make(map[string]int)
+	}
+	s.used[path]++
+
+	limit := s.RateLimit
+	if limit == 0 {
+		limit = DefaultRateLimit
+	}
+
+	remaining := limit - s.used[path]
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	w.Header().Set("X-Rate-Limit-Limit", strconv.Itoa(limit))
+	w.Header().Set("X-Rate-Limit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-Rate-Limit-Reset", strconv.FormatInt(s.window.Unix(), 10))
+
+	if s.used[path] > limit {
+		return &apiError{Code: ErrorCodeRateLimit, Message: "Rate limit exceeded",
+			status: http.StatusTooManyRequests}
+	}
+	return nil
+}
+
+// checkSignature checks a request's OAuth 1.0a HMAC-SHA1 signature against
+// the server's credentials. Nonces can't be reused. Must be called with the
+// lock held.
+func (s *Server) checkSignature(r *http.Request) *apiError {
+	unauthorized := &apiError{Code: ErrorCodeAuthentication,
+		Message: "Could not authenticate you.", status: http.StatusUnauthorized}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "OAuth ") {
+		return unauthorized
+	}
+
+	oauthParams := make(map[string]string)
+	for _, pair := range strings.Split(strings.TrimPrefix(header, "OAuth "), ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return unauthorized
+		}
+
+		value, err := url.QueryUnescape(strings.Trim(parts[1], `"`))
+		if err != nil {
+			return unauthorized
+		}
+		oauthParams[parts[0]] = value
+	}
+
+	if oauthParams["oauth_consumer_key"] != s.ConsumerKey ||
+		oauthParams["oauth_token"] != s.AccessToken ||
+		oauthParams["oauth_signature_method"] != "HMAC-SHA1" ||
+		oauthParams["oauth_nonce"] == "" ||
+		s.nonces[oauthParams["oauth_nonce"]] {
+
+		return unauthorized
+	}
+
+	// Every parameter is signed: those in the query, the form body, and the
+	// header itself, other than the signature
+	var params []string
+	for key, values := range r.Form {
+		for _, value := range values {
+			params = append(params, percentEncode(key)+"="+percentEncode(value))
+		}
+	}
+	for key, value := range oauthParams {
+		if key != "oauth_signature" && key != "realm" {
+			params = append(params, percentEncode(key)+"="+percentEncode(value))
+		}
+	}
+	sort.Strings(params)
+
+	base := strings.Join([]string{
+		r.Method,
+		percentEncode("http://" + strings.ToLower(r.Host) + r.URL.Path),
+		percentEncode(strings.Join(params, "&")),
+	}, "&")
+
+	mac := hmac.New(sha1.New, []byte(percentEncode(s.ConsumerSecret)+"&"+
+		percentEncode(s.AccessTokenSecret)))
+	mac.Write([]byte(base))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(expected), []byte(oauthParams["oauth_signature"])) {
+		return unauthorized
+	}
+
+	if s.nonces == nil {
+		s.nonces = make(map[string]bool)
+	}
+	s.nonces[oauthParams["oauth_nonce"]] = true
+
+	return nil
+}
+
+func (s *Server) handleDestroy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/1.1/statuses/destroy/"), ".json")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, tweet := range s.tweets {
+		if err == nil && tweet.ID == id {
+			s.tweets = append(s.tweets[:i:i], s.tweets[i+1:]...)
+			writeJSON(w, encodeTweet(tweet, r.Form.Get("tweet_mode") == "extended"))
+			return
+		}
+	}
+
+	writeError(w, &apiError{Code: ErrorCodeNotFound, Message: "No status found with that ID.",
+		status: http.StatusNotFound})
+}
+
+func (s *Server) handleLookup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	extended := r.Form.Get("tweet_mode") == "extended"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tweets := []*liveTweet{}
+	for _, idStr := range strings.Split(r.Form.Get("id"), ",") {
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		for _, tweet := range s.tweets {
+			if tweet.ID == id {
+				tweets = append(tweets, encodeTweet(tweet, extended))
+			}
+		}
+	}
+
+	writeJSON(w, tweets)
+}
+
+func (s *Server) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.EqualFold(r.Form.Get("screen_name"), s.ScreenName) {
+		writeError(w, &apiError{Code: ErrorCodeUserNotFound, Message: "User not found.",
+			status: http.StatusNotFound})
+		return
+	}
+
+	count, err := optionalUint(r.Form, "count", 20)
+	if err != nil || count == 0 {
+		count = 20
+	}
+
+	maxPageSize := s.MaxPageSize
+	if maxPageSize == 0 {
+		maxPageSize = DefaultMaxPageSize
+	}
+	if count > uint64(maxPageSize) {
+		count = uint64(maxPageSize)
+	}
+
+	maxID, err := optionalUint(r.Form, "max_id", 0)
+	if err != nil {
+		writeBadRequest(w, "max_id")
+		return
+	}
+
+	sinceID, err := optionalUint(r.Form, "since_id", 0)
+	if err != nil {
+		writeBadRequest(w, "since_id")
+		return
+	}
+
+	maxTimeline := s.MaxTimeline
+	if maxTimeline == 0 {
+		maxTimeline = DefaultMaxTimeline
+	}
+
+	reachable := s.tweets
+	if len(reachable) > maxTimeline {
+		reachable = reachable[:maxTimeline]
+	}
+
+	extended := r.Form.Get("tweet_mode") == "extended"
+	excludeReplies := r.Form.Get("exclude_replies") == "true"
+
+	tweets := []*liveTweet{}
+	for _, tweet := range reachable {
+		if uint64(len(tweets)) >= count {
+			break
+		}
+
+		// max_id is inclusive and since_id is exclusive
+		if maxID != 0 && tweet.ID > maxID {
+			continue
+		}
+		if tweet.ID <= sinceID {
+			break
+		}
+		if excludeReplies && tweet.InReplyToID != 0 {
+			continue
+		}
+
+		tweets = append(tweets, encodeTweet(tweet, extended))
+	}
+
+	writeJSON(w, tweets)
+}
+
+func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeMethodNotAllowed(w)
+		return
+	}
+
+	status := r.Form.Get("status")
+	inReplyToID, err := optionalUint(r.Form, "in_reply_to_status_id", 0)
+	if err != nil {
+		writeBadRequest(w, "in_reply_to_status_id")
+		return
+	}
+
+	if utf8.RuneCountInString(status) > maxTweetLength {
+		writeError(w, &apiError{Code: ErrorCodeTooLong, Message: "Status is over 280 characters.",
+			status: http.StatusForbidden})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, tweet := range s.tweets {
+		if tweet.Text == status {
+			writeError(w, &apiError{Code: ErrorCodeDuplicate, Message: "Status is a duplicate.",
+				status: http.StatusForbidden})
+			return
+		}
+	}
+
+	// Like Twitter, replies to tweets that don't exist are posted as normal
+	// tweets
+	if inReplyToID != 0 {
+		var found bool
+		for _, tweet := range s.tweets {
+			if tweet.ID == inReplyToID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			inReplyToID = 0
+		}
+	}
+
+	tweet := s.addTweet(status, inReplyToID)
+	writeJSON(w, encodeTweet(tweet, r.Form.Get("tweet_mode") == "extended"))
+}
+
+// encodeTweet encodes a tweet the way that Twitter does. Its text is in
+// `full_text` in extended mode, and otherwise in `text`, where it's
+// truncated if it's long.
+func encodeTweet(tweet *Tweet, extended bool) *liveTweet {
+	encoded := &liveTweet{
+		CreatedAt:   tweet.CreatedAt.Format("Mon Jan 02 15:04:05 -0700 2006"),
+		ID:          tweet.ID,
+		IDStr:       strconv.FormatUint(tweet.ID, 10),
+		InReplyToID: tweet.InReplyToID,
+	}
+
+	switch {
+	case extended:
+		encoded.FullText = tweet.Text
+	case utf8.RuneCountInString(tweet.Text) > truncatedTweetLength:
+		encoded.Text = string([]rune(tweet.Text)[:truncatedTweetLength-1]) + "…"
+		encoded.Truncated = true
+	default:
+		encoded.Text = tweet.Text
+	}
+
+	return encoded
+}
+
+func optionalUint(values url.Values, key string, defaultValue uint64) (uint64, error) {
+	value := values.Get(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// percentEncode encodes a string as OAuth 1.0a requires (RFC 3986), leaving
+// only unreserved characters unescaped.
+func percentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func writeBadRequest(w http.ResponseWriter, param string) {
+	writeError(w, &apiError{Code: ErrorCodeInvalidParam, Message: param + " parameter is invalid.",
+		status: http.StatusBadRequest})
+}
+
+func writeError(w http.ResponseWriter, err *apiError) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(err.status)
+	json.NewEncoder(w).Encode(map[string][]*apiError{"errors": {err}})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	writeError(w, &apiError{Code: 0, Message: "Method not allowed.",
+		status: http.StatusMethodNotAllowed})
+}
@@ -0,0 +1,175 @@
+package twittertest
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dghubble/oauth1"
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestServer_Signatures(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	// Signed requests are accepted
+	resp := mustGet(t, newClient(server), server.URL+"/1.1/statuses/lookup.json?id=1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Unsigned ones aren't
+	resp = mustGet(t, http.DefaultClient, server.URL+"/1.1/statuses/lookup.json?id=1")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, ErrorCodeAuthentication, decodeErrorCode(t, resp))
+
+	// Nor are ones signed with the wrong secret
+	config := oauth1.NewConfig(server.ConsumerKey, "wrong")
+	client := config.Client(oauth1.NoContext,
+		oauth1.NewToken(server.AccessToken, server.AccessTokenSecret))
+	resp = mustGet(t, client, server.URL+"/1.1/statuses/lookup.json?id=1")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Nor ones whose parameters were changed after signing
+	client = newClientWithBase(server, &tamperingTransport{})
+	resp = mustGet(t, client, server.URL+"/1.1/statuses/lookup.json?id=1")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Nor replayed ones
+	client = newClientWithBase(server, &replayingTransport{})
+	resp = mustGet(t, client, server.URL+"/1.1/statuses/lookup.json?id=1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = mustGet(t, client, server.URL+"/1.1/statuses/lookup.json?id=1")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestServer_Timeline(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	var ids []uint64
+	for i := 0; i < 5; i++ {
+		ids = append(ids, server.AddTweet("Tweet "+strconv.Itoa(i)).ID)
+	}
+
+	client := newClient(server)
+	list := func(query string) []uint64 {
+		resp := mustGet(t, client, server.URL+"/1.1/statuses/user_timeline.json?"+
+			"screen_name=perpetual_test&"+query)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		defer resp.Body.Close()
+
+		var tweets []*liveTweet
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&tweets))
+
+		var got []uint64
+		for _, tweet := range tweets {
+			got = append(got, tweet.ID)
+		}
+		return got
+	}
+
+	assert.Equal(t, []uint64{ids[4], ids[3]}, list("count=2"))
+
+	// max_id is inclusive, and since_id exclusive
+	assert.Equal(t, []uint64{ids[2], ids[1]}, list("count=2&max_id="+strconv.FormatUint(ids[2], 10)))
+	assert.Equal(t, []uint64{ids[4], ids[3]}, list("since_id="+strconv.FormatUint(ids[2], 10)))
+
+	server.MaxPageSize = 3
+	assert.Equal(t, []uint64{ids[4], ids[3], ids[2]}, list("count=200"))
+}
+
+func TestServer_RateLimits(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	server.now = func() time.Time { return now }
+	server.RateLimit = 2
+
+	client := newClient(server)
+	path := "/1.1/statuses/lookup.json?id=1"
+
+	resp := mustGet(t, client, server.URL+path)
+	assert.Equal(t, "2", resp.Header.Get("X-Rate-Limit-Limit"))
+	assert.Equal(t, "1", resp.Header.Get("X-Rate-Limit-Remaining"))
+	assert.Equal(t, strconv.FormatInt(now.Add(RateLimitWindow).Unix(), 10),
+		resp.Header.Get("X-Rate-Limit-Reset"))
+
+	mustGet(t, client, server.URL+path)
+	resp = mustGet(t, client, server.URL+path)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, ErrorCodeRateLimit, decodeErrorCode(t, resp))
+
+	// Limits are lifted when the window resets
+	now = now.Add(RateLimitWindow)
+	resp = mustGet(t, client, server.URL+path)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 4, server.Requests("/1.1/statuses/lookup.json"))
+}
+
+//
+// Helpers
+//
+
+// replayingTransport sends requests with the authorization of the first
+// one that it sent.
+type replayingTransport struct {
+	auth string
+}
+
+func (t *replayingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.auth == "" {
+		t.auth = req.Header.Get("Authorization")
+	}
+	req.Header.Set("Authorization", t.auth)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// tamperingTransport changes requests' queries after they've been signed.
+type tamperingTransport struct{}
+
+func (t *tamperingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	query := req.URL.Query()
+	query.Set("id", "2")
+	req.URL.RawQuery = query.Encode()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func decodeErrorCode(t *testing.T, resp *http.Response) int {
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	var body struct {
+		Errors []*apiError `json:"errors"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &body))
+	assert.Equal(t, 1, len(body.Errors))
+	return body.Errors[0].Code
+}
+
+func mustGet(t *testing.T, client *http.Client, u string) *http.Response {
+	req, err := http.NewRequest("GET", u, nil)
+	assert.NoError(t, err)
+
+	resp, err := client.Do(req)
+	assert.NoError(t, err)
+	return resp
+}
+
+func newClient(server *Server) *http.Client {
+	return newClientWithBase(server, http.DefaultTransport)
+}
+
+// newClientWithBase gets a client that signs requests with the server's
+// credentials before sending them with base.
+func newClientWithBase(server *Server, base http.RoundTripper) *http.Client {
+	ctx := context.WithValue(oauth1.NoContext, oauth1.HTTPClient, &http.Client{Transport: base})
+	config := oauth1.NewConfig(server.ConsumerKey, server.ConsumerSecret)
+	return config.Client(ctx, oauth1.NewToken(server.AccessToken, server.AccessTokenSecret))
+}
@@ -0,0 +1,233 @@
+package updater
+
+import (
+	"fmt"
+	"time"
+)
+
+// AdminActionType is the type of an administrative operation on the state
+// ledger.
+type AdminActionType string
+
+// The possible administrative operations.
+const (
+	// AdminAdopt marks an interval as posted by a tweet that was posted some
+	// other way, like by hand.
+	AdminAdopt AdminActionType = "adopt"
+
+	// AdminRetract deletes an interval's post and rolls the ledger back so
+	// that it'll be posted again.
+	AdminRetract AdminActionType = "retract"
+
+	// AdminSkip marks an interval as intentionally skipped so that it's
+	// never posted.
+	AdminSkip AdminActionType = "skip"
+)
+
+// Attribution records who performed an administrative operation and why.
+type Attribution struct {
+	// Actor is who performed the operation.
+	Actor string `json:"actor"`
+
+	// Reason is why the operation was performed.
+	Reason string `json:"reason"`
+}
+
+// AdminAction is an entry in the state ledger's log of administrative
+// operations.
+type AdminAction struct {
+	Attribution
+
+	// Action is the operation that was performed.
+	Action AdminActionType `json:"action"`
+
+	// At is when the operation was performed.
+	At time.Time `json:"at"`
+
+	// IntervalID is the interval that was operated on.
+	IntervalID int `json:"interval_id"`
+
+	// TweetID is the tweet that was adopted or retracted, if any.
+	TweetID uint64 `json:"tweet_id,omitempty"`
+}
+
+// AdoptInterval marks an interval as posted by an existing tweet, like one
+// that was posted by hand. Update then moves on to the next interval. The
+// tweet must exist, but it doesn't need to be formatted like an interval.
+func AdoptInterval(api TwitterAPI, store StateStore, intervalID int, tweetID uint64,
+	attr *Attribution, now time.Time) error {
+
+	return modifyState(store, attr, func(state *State) (*AdminAction, error) {
+		tweets, err := api.LookupTweets([]uint64{tweetID})
+		if err != nil {
+			return nil, fmt.Errorf("Error looking up tweet %v: %v", tweetID, err)
+		}
+		if len(tweets) < 1 {
+			return nil, fmt.Errorf("Tweet %v doesn't exist", tweetID)
+		}
+
+		state.Put(&PostRecord{
+			Attribution: attr,
+			IntervalID:  intervalID,
+			PostedAt:    tweets[0].CreatedAt,
+			Status:      PostStatusPosted,
+			TweetID:     tweetID,
+		})
+
+		return &AdminAction{Action: AdminAdopt, At: now, IntervalID: intervalID,
+			TweetID: tweetID}, nil
+	})
+}
+
+// RetractInterval deletes the post of the last posted interval, along with
+// its commitment proof, and rolls the ledger back so that Update will post it
+// again. Only the last posted interval can be retracted.
+//
+// locker, if not nil, is held throughout so that Update can't run in the
+// middle. The interval is marked pending before anything is deleted, so if
+// retracting is interrupted, the next Update checks whether the post still
+// exists instead of trusting the ledger.
+func RetractInterval(api TwitterAPI, store StateStore, locker Locker, intervalID int,
+	attr *Attribution, now time.Time) error {
+
+	err := checkAttribution(attr)
+	if err != nil {
+		return err
+	}
+
+	var lease *Lease
+	if locker != nil {
+		lease, err = locker.Acquire(newLockHolder(), DefaultLeaseTTL)
+		if err != nil {
+			if _, ok := err.(*LockHeldError); ok {
+				return err
+			}
+			return fmt.Errorf("Error acquiring lock: %v", err)
+		}
+
+		// An error here is ignored because the lease expires on its own
+		defer locker.Release(lease)
+	}
+
+	state, err := store.LoadState()
+	if err != nil {
+		return fmt.Errorf("Error loading state: %v", err)
+	}
+
+	if lease != nil {
+		if state.FencingToken > lease.Token {
+			return ErrStaleFencingToken
+		}
+		state.FencingToken = lease.Token
+	}
+
+	last := state.Last()
+	if last == nil || last.IntervalID != intervalID {
+		return fmt.Errorf("Can only retract the last interval in state")
+	}
+	if last.Status != PostStatusPosted {
+		return fmt.Errorf("Can't retract interval %v; its status is %s",
+			intervalID, last.Status)
+	}
+
+	state.Put(&PostRecord{
+		Attribution:  attr,
+		IntervalID:   intervalID,
+		ProofTweetID: last.ProofTweetID,
+		Status:       PostStatusPending,
+		TweetID:      last.TweetID,
+	})
+
+	err = store.SaveState(state)
+	if err != nil {
+		return fmt.Errorf("Error saving pending state: %v", err)
+	}
+
+	// The post goes first so that if deleting fails part way, it's never
+	// left up without its proof
+	for _, id := range []uint64{last.TweetID, last.ProofTweetID} {
+		if id == 0 {
+			continue
+		}
+
+		err := api.DeleteTweet(id)
+		if err != nil {
+			return fmt.Errorf("Error deleting tweet %v: %v", id, err)
+		}
+	}
+
+	state.Remove(intervalID)
+	state.Actions = append(state.Actions, &AdminAction{Attribution: *attr,
+		Action: AdminRetract, At: now, IntervalID: intervalID, TweetID: last.TweetID})
+
+	err = store.SaveState(state)
+	if err != nil {
+		return fmt.Errorf("Error saving state: %v", err)
+	}
+
+	return nil
+}
+
+// SkipInterval marks an interval as intentionally skipped. When Update gets
+// to it, it moves on to the next interval instead. Intervals can be skipped
+// ahead of time.
+func SkipInterval(store StateStore, intervalID int, attr *Attribution, now time.Time) error {
+	return modifyState(store, attr, func(state *State) (*AdminAction, error) {
+		if existing := state.Get(intervalID); existing != nil {
+			return nil, fmt.Errorf("Can't skip interval %v; its status is already %s",
+				intervalID, existing.Status)
+		}
+
+		state.Put(&PostRecord{
+			Attribution: attr,
+			IntervalID:  intervalID,
+			Status:      PostStatusSkipped,
+		})
+
+		return &AdminAction{Action: AdminSkip, At: now, IntervalID: intervalID}, nil
+	})
+}
+
+//
+// Private
+//
+
+// checkAttribution checks that an administrative operation says who's
+// performing it and why.
+func checkAttribution(attr *Attribution) error {
+	if attr == nil || attr.Actor == "" || attr.Reason == "" {
+		return fmt.Errorf("Need who's performing the operation and why")
+	}
+	return nil
+}
+
+// modifyState loads state, applies an administrative operation to it, and
+// saves it along with a log entry for the operation.
+func modifyState(store StateStore, attr *Attribution,
+	fn func(state *State) (*AdminAction, error)) error {
+
+	err := checkAttribution(attr)
+	if err != nil {
+		return err
+	}
+
+	state, err := store.LoadState()
+	if err != nil {
+		return fmt.Errorf("Error loading state: %v", err)
+	}
+
+	action, err := fn(state)
+	if err != nil {
+		return err
+	}
+
+	action.Attribution = *attr
+	state.Actions = append(state.Actions, action)
+
+	err = store.SaveState(state)
+	if err != nil {
+		return fmt.Errorf("Error saving state: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package updater
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestAdoptInterval(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-2 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 001"},
+	}
+
+	attr := &Attribution{Actor: "brandur", Reason: "Posted by hand during an outage"}
+	api := &mockTwitterAPI{posted: []*Tweet{{CreatedAt: now, ID: 42, Message: "Interval 000"}}}
+	store := &mockStateStore{}
+
+	err := AdoptInterval(api, store, 0, 42, attr, now)
+	assert.NoError(t, err)
+	assert.Equal(t, &PostRecord{Attribution: attr, IntervalID: 0, PostedAt: now,
+		Status: PostStatusPosted, TweetID: 42}, store.state.Last())
+	assert.Equal(t, []*AdminAction{{Attribution: *attr, Action: AdminAdopt, At: now,
+		IntervalID: 0, TweetID: 42}}, store.state.Actions)
+
+	// Update moves on to the next interval
+	result, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger, StateStore: store})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.PostedIntervalID)
+
+	// A tweet that doesn't exist
+	err = AdoptInterval(api, store, 2, 43, attr, now)
+	assert.EqualError(t, err, "Tweet 43 doesn't exist")
+
+	// Who and why are required
+	err = AdoptInterval(api, store, 2, 42, &Attribution{Actor: "brandur"}, now)
+	assert.EqualError(t, err, "Need who's performing the operation and why")
+}
+
+func TestSkipInterval(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-3 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(-2 * time.Hour), Message: "Interval 001"},
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 002"},
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 003"},
+	}
+
+	attr := &Attribution{Actor: "brandur", Reason: "Message is out of date"}
+	api := &mockTwitterAPI{}
+	store := &mockStateStore{}
+
+	// Intervals can be skipped ahead of time
+	assert.NoError(t, SkipInterval(store, 1, attr, now))
+	assert.NoError(t, SkipInterval(store, 2, attr, now))
+	assert.Nil(t, store.state.Last())
+
+	result, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger, StateStore: store})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.PostedIntervalID)
+
+	result, err = Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger, StateStore: store})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.PostedIntervalID)
+
+	// Already posted
+	err = SkipInterval(store, 3, attr, now)
+	assert.EqualError(t, err, "Can't skip interval 3; its status is already posted")
+
+	assert.Equal(t, 2, len(store.state.Actions))
+}
+
+func TestRetractInterval(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-2 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 001"},
+	}
+
+	commitment, err := CommitIntervals(intervals, nil)
+	assert.NoError(t, err)
+	for i, interval := range intervals {
+		interval.Proof = commitment.Proofs[i]
+		interval.Salt = commitment.Salts[i]
+	}
+
+	attr := &Attribution{Actor: "brandur", Reason: "Posted with a typo"}
+	api := &mockTwitterAPI{}
+	store := &mockStateStore{}
+	locker := &StateLocker{Store: store}
+	opts := &UpdateOptions{CommitmentRoot: commitment.Root, Locker: locker,
+		Logger: DiscardLogger, StateStore: store}
+
+	for i := 0; i < 2; i++ {
+		_, err := Update(api, intervals, now, opts)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, api.replies[0].ID, store.state.Last().ProofTweetID)
+
+	// Only the last interval can be retracted
+	err = RetractInterval(api, store, locker, 0, attr, now)
+	assert.EqualError(t, err, "Can only retract the last interval in state")
+
+	// Not while someone else holds the lock
+	{
+		lease, err := locker.Acquire("someone-else", time.Minute)
+		assert.NoError(t, err)
+
+		err = RetractInterval(api, store, locker, 1, attr, now)
+		assert.IsType(t, &LockHeldError{}, err)
+		assert.Equal(t, PostStatusPosted, store.state.Last().Status)
+
+		assert.NoError(t, locker.Release(lease))
+	}
+
+	// A failed delete leaves the interval pending for Update to resolve
+	{
+		api.deleteErr = fmt.Errorf("Rate limited")
+
+		err = RetractInterval(api, store, locker, 1, attr, now)
+		assert.EqualError(t, err,
+			fmt.Sprintf("Error deleting tweet %v: Rate limited", api.posted[1].ID))
+		assert.Equal(t, PostStatusPending, store.state.Last().Status)
+		assert.Equal(t, 0, len(store.state.Actions))
+
+		api.deleteErr = nil
+		store.state.Get(1).Status = PostStatusPosted
+	}
+
+	err = RetractInterval(api, store, locker, 1, attr, now)
+	assert.NoError(t, err)
+	assert.True(t, api.deleted[api.posted[1].ID])
+	assert.True(t, api.deleted[api.replies[0].ID])
+	assert.Equal(t, 0, store.state.Last().IntervalID)
+	assert.Equal(t, []*AdminAction{{Attribution: *attr, Action: AdminRetract, At: now,
+		IntervalID: 1, TweetID: api.posted[1].ID}}, store.state.Actions)
+
+	// Update posts it again
+	result, err := Update(api, intervals, now, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.PostedIntervalID)
+	assert.Equal(t, 3, len(api.posted))
+	assert.Equal(t, 2, len(api.replies))
+}
@@ -0,0 +1,118 @@
+package updater
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// archiveTweetsPattern matches the files in an account archive that contain
+// tweets. Newer archives name the file `data/tweets.js` (and split large
+// archives into `data/tweets-part1.js` and so on), while older ones used
+// `data/tweet.js`.
+var archiveTweetsPattern = regexp.MustCompile(`^data/tweets?(-part\d+)?\.js$`)
+
+// archiveTweet is a tweet as it appears in an account archive.
+type archiveTweet struct {
+	Tweet struct {
+		CreatedAt string `json:"created_at"`
+		FullText  string `json:"full_text"`
+		IDStr     string `json:"id_str"`
+	} `json:"tweet"`
+}
+
+// ReadArchive reads all tweets from the account archive zip that Twitter
+// provides on request, which unlike the API, includes an account's entire
+// history. They're returned in reverse chronological order.
+//
+// Seeding a TweetCache with them (see FileTweetCache) lets Update see
+// intervals that were posted too long ago for the API to return.
+func ReadArchive(archivePath string) ([]*Tweet, error) {
+	reader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var tweets []*Tweet
+	var found bool
+
+	for _, file := range reader.File {
+		// Archives are sometimes zipped up inside a top-level directory
+		name := file.Name
+		if i := strings.Index(name, "data/"); i != -1 {
+			name = name[i:]
+		}
+
+		if !archiveTweetsPattern.MatchString(name) {
+			continue
+		}
+		found = true
+
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		fileTweets, err := ParseArchiveTweets(data)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading %v: %v", path.Base(file.Name), err)
+		}
+
+		tweets = append(tweets, fileTweets...)
+	}
+
+	if !found {
+		return nil, fmt.Errorf("No tweets found in archive; expected data/tweets.js")
+	}
+
+	sortTweets(tweets)
+	return tweets, nil
+}
+
+// ParseArchiveTweets parses the contents of an archive's `data/tweets.js`.
+// The file is JavaScript rather than JSON, but it's only an assignment of a
+// JSON array to a variable like:
+//
+//	window.YTD.tweets.part0 = [ ... ]
+func ParseArchiveTweets(data []byte) ([]*Tweet, error) {
+	start := bytes.IndexByte(data, '[')
+	if start == -1 {
+		return nil, fmt.Errorf("Expected a JSON array")
+	}
+
+	var archived []*archiveTweet
+	err := json.Unmarshal(data[start:], &archived)
+	if err != nil {
+		return nil, err
+	}
+
+	tweets := make([]*Tweet, len(archived))
+	for i, v := range archived {
+		id, err := strconv.ParseUint(v.Tweet.IDStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad tweet ID %q: %v", v.Tweet.IDStr, err)
+		}
+
+		createdAt, err := parseTwitterTime(v.Tweet.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		tweets[i] = &Tweet{CreatedAt: createdAt, ID: id, Message: v.Tweet.FullText}
+	}
+
+	return tweets, nil
+}
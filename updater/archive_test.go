@@ -0,0 +1,137 @@
+package updater
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestParseArchiveTweets(t *testing.T) {
+	tweets, err := ParseArchiveTweets([]byte(`window.YTD.tweets.part0 = [ {
+  "tweet" : {
+    "created_at" : "Mon Jan 02 03:04:05 +0000 2018",
+    "full_text" : "LHI000: Interval 000",
+    "id_str" : "123"
+  }
+} ]`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tweets))
+	assert.Equal(t, uint64(123), tweets[0].ID)
+	assert.Equal(t, "LHI000: Interval 000", tweets[0].Message)
+	assert.Equal(t, time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC), tweets[0].CreatedAt.UTC())
+
+	_, err = ParseArchiveTweets([]byte(`window.YTD.tweets.part0 = `))
+	assert.Error(t, err)
+
+	_, err = ParseArchiveTweets([]byte(`[{"tweet":{"id_str":"abc"}}]`))
+	assert.Error(t, err)
+}
+
+func TestReadArchive(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Large archives are split into parts
+	archivePath := mustWriteArchive(t, dir, map[string]string{
+		"data/account.js": `window.YTD.account.part0 = []`,
+		"data/tweets.js": archiveJS("tweets.part0",
+			&Tweet{ID: 1, Message: "tweet 1"},
+			&Tweet{ID: 3, Message: "tweet 3"}),
+		"data/tweets-part1.js": archiveJS("tweets.part1",
+			&Tweet{ID: 2, Message: "tweet 2"}),
+	})
+
+	tweets, err := ReadArchive(archivePath)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{3, 2, 1}, tweetIDs(tweets))
+
+	// Not an archive
+	archivePath = mustWriteArchive(t, dir, map[string]string{
+		"data/account.js": `window.YTD.account.part0 = []`,
+	})
+
+	_, err = ReadArchive(archivePath)
+	assert.EqualError(t, err, "No tweets found in archive; expected data/tweets.js")
+}
+
+// An account that tweeted too much since its last interval for the API to
+// return it can keep going once its archive is in the cache.
+func TestReadArchive_Update(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-2 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 001"},
+	}
+
+	// Everything that the API will return is newer than the base interval
+	api := &mockSinceTwitterAPI{mockTwitterAPI: mockTwitterAPI{tweets: []*Tweet{
+		{CreatedAt: now, ID: 3, Message: "tweet 3"},
+		{CreatedAt: now, ID: 2, Message: "tweet 2"},
+	}}}
+
+	_, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger})
+	assert.Error(t, err)
+
+	archivePath := mustWriteArchive(t, dir, map[string]string{
+		"twitter-archive/data/tweets.js": archiveJS("tweets.part0",
+			&Tweet{CreatedAt: now.Add(-90 * time.Minute), ID: 1,
+				Message: FormatInterval(0, "Interval 000")},
+			&Tweet{CreatedAt: now, ID: 2, Message: "tweet 2"}),
+	})
+
+	tweets, err := ReadArchive(archivePath)
+	assert.NoError(t, err)
+
+	cache := &FileTweetCache{Path: filepath.Join(dir, "tweets.json")}
+	err = cache.SaveTweets(tweets)
+	assert.NoError(t, err)
+
+	cached := &CachedTwitterAPI{API: api, Cache: cache, Logger: DiscardLogger}
+	result, err := Update(cached, intervals, now, &UpdateOptions{Logger: DiscardLogger})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.LastIntervalID)
+	assert.Equal(t, 1, result.PostedIntervalID)
+	assert.Equal(t, []uint64{2}, api.sinceIDs)
+}
+
+//
+// Helpers
+//
+
+func archiveJS(name string, tweets ...*Tweet) string {
+	js := "window.YTD." + name + " = ["
+	for i, tweet := range tweets {
+		if i > 0 {
+			js += ","
+		}
+		js += fmt.Sprintf(`{"tweet":{"created_at":%q,"full_text":%q,"id_str":"%v"}}`,
+			formatTwitterTime(tweet.CreatedAt), tweet.Message, tweet.ID)
+	}
+	return js + "]"
+}
+
+func mustWriteArchive(t *testing.T, dir string, files map[string]string) string {
+	f, err := os.Create(filepath.Join(dir, "archive.zip"))
+	assert.NoError(t, err)
+	defer f.Close()
+
+	w := zip.NewWriter(f)
+	for name, contents := range files {
+		fw, err := w.Create(name)
+		assert.NoError(t, err)
+
+		_, err = fw.Write([]byte(contents))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+
+	return f.Name()
+}
@@ -0,0 +1,379 @@
+package updater
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+//
+// Tweet cache
+//
+
+// TweetCache stores an account's tweets between runs so that only new ones
+// need to be fetched from Twitter's API, and so that older tweets remain
+// available after the API stops returning them.
+type TweetCache interface {
+	// LoadTweets gets all cached tweets in reverse chronological order (i.e.,
+	// newest first).
+	LoadTweets() ([]*Tweet, error)
+
+	// SaveTweets stores tweets in the cache, replacing any existing ones with
+	// the same ID.
+	SaveTweets(tweets []*Tweet) error
+}
+
+// TweetSinceLister is implemented by APIs that can list only the tweets newer
+// than a given ID, which is much cheaper than listing all of them.
+type TweetSinceLister interface {
+	// ListTweetsSince returns an iterator for tweets with IDs greater than
+	// sinceID, in reverse chronological order.
+	ListTweetsSince(sinceID uint64) TweetIterator
+}
+
+// CachedTwitterAPI wraps another TwitterAPI so that tweets are listed from a
+// local cache, which is first brought up to date with any tweets that have
+// been posted since it was last synced.
+//
+// The first sync fetches as far back as MaxScanTweets and NotBefore allow,
+// which can take a while. After that, only new tweets are fetched.
+type CachedTwitterAPI struct {
+	// API is the API that new tweets are fetched from and posted to.
+	API TwitterAPI
+
+	// Cache stores tweets between runs.
+	Cache TweetCache
+
+	// Logger receives logs about syncing. Defaults to a text logger on
+	// stdout if nil.
+	Logger Logger
+
+	// MaxScanTweets is the most tweets that the first sync fetches, like
+	// UpdateOptions.MaxScanTweets. Zero means no limit.
+	MaxScanTweets int
+
+	// NotBefore stops the first sync once it reaches a tweet older than it,
+	// which is kept so that Update can tell that it's looked back past the
+	// start of the series. It's usually the base interval's target, and zero
+	// means no limit.
+	NotBefore time.Time
+}
+
+// DeleteTweet deletes a tweet through the wrapped API. It stays in the cache,
+// which is a record of everything that was ever posted.
+func (a *CachedTwitterAPI) DeleteTweet(id uint64) error {
+	return a.API.DeleteTweet(id)
+}
+
+// ListTweets syncs the cache and returns an iterator over everything in it.
+// Any error syncing is returned from the iterator's Err.
+func (a *CachedTwitterAPI) ListTweets() TweetIterator {
+	tweets, err := a.Sync()
+	if err != nil {
+		return &sliceTweetIterator{err: err, position: -1}
+	}
+
+	return &sliceTweetIterator{tweets: tweets, position: -1}
+}
+
+// LookupTweets looks tweets up with the wrapped API rather than the cache,
+// which keeps tweets even after they've been deleted.
+func (a *CachedTwitterAPI) LookupTweets(ids []uint64) ([]*Tweet, error) {
+	return a.API.LookupTweets(ids)
+}
+
+// PostReply posts a reply through the wrapped API. It's not added to the
+// cache until the next sync so that any tweets posted in between aren't
+// skipped over.
+func (a *CachedTwitterAPI) PostReply(inReplyToID uint64, message string) (*Tweet, error) {
+	return a.API.PostReply(inReplyToID, message)
+}
+
+// PostTweet posts a tweet through the wrapped API. Like PostReply, it's not
+// added to the cache until the next sync.
+func (a *CachedTwitterAPI) PostTweet(message string) (*Tweet, error) {
+	return a.API.PostTweet(message)
+}
+
+// Preflight runs the wrapped API's preflight check. If the wrapped API isn't
+// a PreflightChecker, it returns a nil result and no error.
+func (a *CachedTwitterAPI) Preflight() (*PreflightResult, error) {
+	checker, ok := a.API.(PreflightChecker)
+	if !ok {
+		return nil, nil
+	}
+
+	return checker.Preflight()
+}
+
+// ReadMarker reads the marker from the wrapped API.
+func (a *CachedTwitterAPI) ReadMarker() (*Marker, error) {
+	return a.API.ReadMarker()
+}
+
+// SearchIntervals searches through the wrapped API, which is usually much
+// cheaper than syncing the cache. If the wrapped API isn't a TweetSearcher,
+// the iterator fails, so Update falls back to the timeline.
+func (a *CachedTwitterAPI) SearchIntervals() TweetIterator {
+	searcher, ok := a.API.(TweetSearcher)
+	if !ok {
+		return &sliceTweetIterator{err: fmt.Errorf("Wrapped API doesn't support search"),
+			position: -1}
+	}
+
+	return searcher.SearchIntervals()
+}
+
+// Sync fetches tweets newer than the newest one in the cache and saves them,
+// then returns all cached tweets in reverse chronological order.
+//
+// New tweets are only saved once they've all been fetched so that the cache
+// never has a gap between what it had before and what was added.
+func (a *CachedTwitterAPI) Sync() ([]*Tweet, error) {
+	cached, err := a.Cache.LoadTweets()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading tweet cache: %v", err)
+	}
+
+	var sinceID uint64
+	for _, tweet := range cached {
+		if tweet.ID > sinceID {
+			sinceID = tweet.ID
+		}
+	}
+
+	var it TweetIterator
+	if lister, ok := a.API.(TweetSinceLister); ok && sinceID != 0 {
+		it = lister.ListTweetsSince(sinceID)
+	} else {
+		it = a.API.ListTweets()
+	}
+
+	var fresh []*Tweet
+	for it.Next() {
+		tweet := it.Value()
+
+		// APIs that don't support since_id (or that ignore it) are stopped
+		// once they reach tweets that we already have.
+		if sinceID != 0 && tweet.ID <= sinceID {
+			break
+		}
+
+		fresh = append(fresh, tweet)
+
+		// The first sync is bounded the same way as Update's scan of the
+		// timeline, which would never look at anything further back
+		if sinceID == 0 {
+			if !a.NotBefore.IsZero() && tweet.CreatedAt.Before(a.NotBefore) {
+				break
+			}
+			if a.MaxScanTweets > 0 && len(fresh) >= a.MaxScanTweets {
+				break
+			}
+		}
+	}
+
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+
+	a.logger().Info("Synced tweet cache",
+		"num_new_tweets", len(fresh), "num_cached_tweets", len(cached))
+
+	if len(fresh) == 0 {
+		return cached, nil
+	}
+
+	err = a.Cache.SaveTweets(fresh)
+	if err != nil {
+		return nil, fmt.Errorf("Error saving tweet cache: %v", err)
+	}
+
+	return mergeTweets(cached, fresh), nil
+}
+
+// WriteMarker writes the marker through the wrapped API.
+func (a *CachedTwitterAPI) WriteMarker(marker *Marker) error {
+	return a.API.WriteMarker(marker)
+}
+
+func (a *CachedTwitterAPI) logger() Logger {
+	if a.Logger == nil {
+		return defaultLogger()
+	}
+	return a.Logger
+}
+
+//
+// File cache
+//
+
+// FileTweetCache is a TweetCache stored as a JSON file.
+type FileTweetCache struct {
+	// Path is the location of the cache file. It's created if it doesn't
+	// exist.
+	Path string
+}
+
+// cachedTweet is a tweet as it's stored in a cache.
+type cachedTweet struct {
+	CreatedAt time.Time `json:"created_at"`
+	ID        uint64    `json:"id"`
+	Message   string    `json:"message"`
+}
+
+// LoadTweets gets all tweets in the file. A file that doesn't exist is
+// treated as an empty cache.
+func (c *FileTweetCache) LoadTweets() ([]*Tweet, error) {
+	data, err := ioutil.ReadFile(c.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tweets, err := decodeTweetCache(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding tweet cache %v: %v", c.Path, err)
+	}
+
+	return tweets, nil
+}
+
+// SaveTweets merges tweets into the file, which is replaced atomically.
+func (c *FileTweetCache) SaveTweets(tweets []*Tweet) error {
+	existing, err := c.LoadTweets()
+	if err != nil {
+		return err
+	}
+
+	data, err := encodeTweetCache(mergeTweets(existing, tweets))
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(c.Path, data)
+}
+
+//
+// Private
+//
+
+// decodeTweetCache decodes tweets encoded by encodeTweetCache, sorted newest
+// first.
+func decodeTweetCache(data []byte) ([]*Tweet, error) {
+	var stored []*cachedTweet
+	err := json.Unmarshal(data, &stored)
+	if err != nil {
+		return nil, err
+	}
+
+	tweets := make([]*Tweet, len(stored))
+	for i, v := range stored {
+		tweets[i] = &Tweet{CreatedAt: v.CreatedAt, ID: v.ID, Message: v.Message}
+	}
+
+	sortTweets(tweets)
+	return tweets, nil
+}
+
+// encodeTweetCache encodes tweets as they're stored in a cache.
+func encodeTweetCache(tweets []*Tweet) ([]byte, error) {
+	stored := make([]*cachedTweet, len(tweets))
+	for i, v := range tweets {
+		stored[i] = &cachedTweet{CreatedAt: v.CreatedAt, ID: v.ID, Message: v.Message}
+	}
+
+	return json.MarshalIndent(stored, "", "  ")
+}
+
+// sliceTweetIterator iterates over a list of tweets that's already in
+// memory.
+type sliceTweetIterator struct {
+	err      error
+	position int
+	tweets   []*Tweet
+}
+
+func (it *sliceTweetIterator) Err() error {
+	return it.err
+}
+
+func (it *sliceTweetIterator) Next() bool {
+	if it.err != nil || it.position >= len(it.tweets)-1 {
+		return false
+	}
+
+	it.position++
+	return true
+}
+
+func (it *sliceTweetIterator) Value() *Tweet {
+	if it.err != nil {
+		panic("Iterator encountered an error; access it using Err")
+	}
+
+	if it.position == -1 {
+		panic("Must call Next on iterator before a call to Value is allowed")
+	}
+
+	return it.tweets[it.position]
+}
+
+// writeFileAtomically writes a file by way of a temporary one that's renamed
+// into place so that a run that's interrupted never leaves it partially
+// written.
+func writeFileAtomically(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// mergeTweets combines two lists of tweets, preferring the second's version
+// of any tweets that appear in both, and sorts the result in reverse
+// chronological order.
+func mergeTweets(a, b []*Tweet) []*Tweet {
+	byID := make(map[uint64]*Tweet, len(a)+len(b))
+	for _, tweet := range a {
+		byID[tweet.ID] = tweet
+	}
+	for _, tweet := range b {
+		byID[tweet.ID] = tweet
+	}
+
+	merged := make([]*Tweet, 0, len(byID))
+	for _, tweet := range byID {
+		merged = append(merged, tweet)
+	}
+
+	sortTweets(merged)
+	return merged
+}
+
+// sortTweets sorts tweets in reverse chronological order. Twitter's IDs are
+// increasing over time, so they're used to order tweets.
+func sortTweets(tweets []*Tweet) {
+	sort.Slice(tweets, func(i, j int) bool {
+		return tweets[i].ID > tweets[j].ID
+	})
+}
@@ -0,0 +1,313 @@
+package updater
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+//
+// Mock since lister
+//
+
+type mockSinceTwitterAPI struct {
+	mockTwitterAPI
+	sinceIDs []uint64
+}
+
+func (a *mockSinceTwitterAPI) ListTweetsSince(sinceID uint64) TweetIterator {
+	a.sinceIDs = append(a.sinceIDs, sinceID)
+
+	var tweets []*Tweet
+	for _, tweet := range a.tweets {
+		if tweet.ID > sinceID {
+			tweets = append(tweets, tweet)
+		}
+	}
+	return &mockTweetIterator{tweets: tweets, position: -1}
+}
+
+//
+// Mock searcher
+//
+
+type mockSearchTwitterAPI struct {
+	mockSinceTwitterAPI
+	searchResults []*Tweet
+}
+
+func (a *mockSearchTwitterAPI) SearchIntervals() TweetIterator {
+	return &mockTweetIterator{tweets: a.searchResults, position: -1}
+}
+
+//
+// Tests
+//
+
+func TestCachedTwitterAPI_Sync(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cache := &FileTweetCache{Path: filepath.Join(dir, "tweets.json")}
+	api := &mockSinceTwitterAPI{mockTwitterAPI: mockTwitterAPI{tweets: []*Tweet{
+		{ID: 2, Message: "tweet 2"},
+		{ID: 1, Message: "tweet 1"},
+	}}}
+	cached := &CachedTwitterAPI{API: api, Cache: cache, Logger: DiscardLogger}
+
+	// The first sync fetches everything
+	{
+		tweets, err := cached.Sync()
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{2, 1}, tweetIDs(tweets))
+		assert.Equal(t, 0, len(api.sinceIDs))
+	}
+
+	// Later syncs only fetch new tweets, and older tweets are still available
+	// after the API stops returning them
+	{
+		api.tweets = []*Tweet{
+			{ID: 4, Message: "tweet 4"},
+			{ID: 3, Message: "tweet 3"},
+		}
+
+		tweets, err := cached.Sync()
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{4, 3, 2, 1}, tweetIDs(tweets))
+		assert.Equal(t, []uint64{2}, api.sinceIDs)
+	}
+
+	// Everything was persisted
+	{
+		tweets, err := cache.LoadTweets()
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{4, 3, 2, 1}, tweetIDs(tweets))
+	}
+
+	// Nothing new
+	{
+		tweets, err := cached.Sync()
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{4, 3, 2, 1}, tweetIDs(tweets))
+		assert.Equal(t, []uint64{2, 4}, api.sinceIDs)
+	}
+}
+
+func TestCachedTwitterAPI_SyncBounded(t *testing.T) {
+	now := time.Now()
+	tweets := []*Tweet{
+		{CreatedAt: now, ID: 4, Message: "tweet 4"},
+		{CreatedAt: now.Add(-1 * time.Hour), ID: 3, Message: "tweet 3"},
+		{CreatedAt: now.Add(-2 * time.Hour), ID: 2, Message: "tweet 2"},
+		{CreatedAt: now.Add(-3 * time.Hour), ID: 1, Message: "tweet 1"},
+	}
+
+	// The first sync stops at the most tweets that Update would scan
+	{
+		dir := mustTempDir(t)
+		defer os.RemoveAll(dir)
+
+		cached := &CachedTwitterAPI{API: &mockTwitterAPI{tweets: tweets},
+			Cache:  &FileTweetCache{Path: filepath.Join(dir, "tweets.json")},
+			Logger: DiscardLogger, MaxScanTweets: 2}
+
+		synced, err := cached.Sync()
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{4, 3}, tweetIDs(synced))
+	}
+
+	// The first sync stops after the first tweet from before the series
+	{
+		dir := mustTempDir(t)
+		defer os.RemoveAll(dir)
+
+		cached := &CachedTwitterAPI{API: &mockTwitterAPI{tweets: tweets},
+			Cache:  &FileTweetCache{Path: filepath.Join(dir, "tweets.json")},
+			Logger: DiscardLogger, NotBefore: now.Add(-90 * time.Minute)}
+
+		synced, err := cached.Sync()
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{4, 3, 2}, tweetIDs(synced))
+	}
+}
+
+func TestCachedTwitterAPI_SyncWithoutSinceID(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cache := &FileTweetCache{Path: filepath.Join(dir, "tweets.json")}
+	err := cache.SaveTweets([]*Tweet{{ID: 1, Message: "cached"}})
+	assert.NoError(t, err)
+
+	// An API that can't list since an ID is read until it reaches tweets that
+	// are already cached. The cached version of a tweet is kept.
+	api := &mockTwitterAPI{tweets: []*Tweet{
+		{ID: 2, Message: "tweet 2"},
+		{ID: 1, Message: "tweet 1"},
+		{ID: 0, Message: "tweet 0"},
+	}}
+	cached := &CachedTwitterAPI{API: api, Cache: cache, Logger: DiscardLogger}
+
+	tweets, err := cached.Sync()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{2, 1}, tweetIDs(tweets))
+	assert.Equal(t, "cached", tweets[1].Message)
+}
+
+func TestCachedTwitterAPI_Update(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cache := &FileTweetCache{Path: filepath.Join(dir, "tweets.json")}
+
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-2 * time.Minute), Message: "Interval 000"},
+		{Target: now.Add(-1 * time.Minute), Message: "Interval 001"},
+		{Target: now.Add(1 * time.Minute), Message: "Interval 002"},
+	}
+
+	api := &mockSinceTwitterAPI{}
+	cached := &CachedTwitterAPI{API: api, Cache: cache, Logger: DiscardLogger}
+
+	for i := 0; i < 2; i++ {
+		result, err := Update(cached, intervals, now, &UpdateOptions{Logger: DiscardLogger})
+		assert.NoError(t, err)
+		assert.Equal(t, i, result.PostedIntervalID)
+
+		// The mock only returns what's newer than the cache, so the API
+		// forgetting about old tweets has no effect
+		api.tweets = []*Tweet{api.posted[i]}
+	}
+
+	result, err := Update(cached, intervals, now, &UpdateOptions{Logger: DiscardLogger})
+	assert.NoError(t, err)
+	assert.Equal(t, -1, result.PostedIntervalID)
+	assert.Equal(t, 1, result.LastIntervalID)
+}
+
+func TestCachedTwitterAPI_SearchIntervals(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cache := &FileTweetCache{Path: filepath.Join(dir, "tweets.json")}
+
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-2 * time.Minute), Message: "Interval 000"},
+		{Target: now.Add(-1 * time.Minute), Message: "Interval 001"},
+	}
+
+	tweets := []*Tweet{{CreatedAt: now, ID: 1, Message: FormatInterval(0, "Interval 000")}}
+	api := &mockSearchTwitterAPI{
+		mockSinceTwitterAPI: mockSinceTwitterAPI{mockTwitterAPI: mockTwitterAPI{tweets: tweets}},
+		searchResults:       tweets,
+	}
+	cached := &CachedTwitterAPI{API: api, Cache: cache, Logger: DiscardLogger}
+
+	// Search goes through to the wrapped API, and what it finds is confirmed
+	// against the cached timeline
+	result, err := Update(cached, intervals, now,
+		&UpdateOptions{Discovery: DiscoverySearch, Logger: DiscardLogger})
+	assert.NoError(t, err)
+	assert.Equal(t, DiscoverySearch, result.Discovery)
+	assert.Equal(t, 1, result.PostedIntervalID)
+
+	cachedTweets, err := cache.LoadTweets()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(cachedTweets))
+
+	// Wrapping an API that can't search fails the iterator
+	it := (&CachedTwitterAPI{API: &mockTwitterAPI{}, Cache: cache, Logger: DiscardLogger}).SearchIntervals()
+	assert.False(t, it.Next())
+	assert.Error(t, it.Err())
+}
+
+func TestFileTweetCache(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	cache := &FileTweetCache{Path: filepath.Join(dir, "tweets.json")}
+
+	// A cache that hasn't been created yet is empty
+	tweets, err := cache.LoadTweets()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(tweets))
+
+	createdAt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = cache.SaveTweets([]*Tweet{
+		{CreatedAt: createdAt, ID: 1, Message: "tweet 1"},
+		{CreatedAt: createdAt, ID: 3, Message: "tweet 3"},
+	})
+	assert.NoError(t, err)
+
+	// Saving merges, replacing tweets with the same ID
+	err = cache.SaveTweets([]*Tweet{
+		{CreatedAt: createdAt, ID: 2, Message: "tweet 2"},
+		{CreatedAt: createdAt, ID: 3, Message: "tweet 3 (edited)"},
+	})
+	assert.NoError(t, err)
+
+	tweets, err = cache.LoadTweets()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{3, 2, 1}, tweetIDs(tweets))
+	assert.Equal(t, "tweet 3 (edited)", tweets[0].Message)
+	assert.True(t, createdAt.Equal(tweets[0].CreatedAt))
+
+	// A corrupt cache
+	err = ioutil.WriteFile(cache.Path, []byte("not json"), 0644)
+	assert.NoError(t, err)
+
+	_, err = cache.LoadTweets()
+	assert.Error(t, err)
+}
+
+func TestLiveTwitterAPI_ListTweetsSince(t *testing.T) {
+	var sinceIDs []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sinceIDs = append(sinceIDs, r.URL.Query().Get("since_id"))
+
+		if r.URL.Query().Get("max_id") != "" {
+			fmt.Fprintf(w, `[]`)
+			return
+		}
+		fmt.Fprintf(w, `[{"created_at":"Mon Jan 02 03:04:05 +0000 2018","id":124,"text":"new"}]`)
+	}))
+	defer server.Close()
+
+	api := &LiveTwitterAPI{BaseURL: server.URL, HTTPClient: server.Client(), Logger: DiscardLogger, ScreenName: "perpetual"}
+
+	it := api.ListTweetsSince(123)
+	assert.True(t, it.Next())
+	assert.Equal(t, uint64(124), it.Value().ID)
+	assert.False(t, it.Next())
+	assert.NoError(t, it.Err())
+
+	assert.Equal(t, []string{"123", "123"}, sinceIDs)
+}
+
+//
+// Helpers
+//
+
+func mustTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "perpetual")
+	assert.NoError(t, err)
+	return dir
+}
+
+func tweetIDs(tweets []*Tweet) []uint64 {
+	ids := make([]uint64, len(tweets))
+	for i, tweet := range tweets {
+		ids[i] = tweet.ID
+	}
+	return ids
+}
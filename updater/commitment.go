@@ -0,0 +1,282 @@
+package updater
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// A commitment scheme lets us prove that a message posted far in the future
+// was written when the series began and hasn't been altered since.
+//
+// Every interval after the base one becomes a leaf in a Merkle tree. Leaves
+// hash the interval's full formatted message along with a random salt so
+// that the published root doesn't give away guessable messages. The root is
+// published with the base interval, and each later interval is followed by a
+// reply carrying its salt and the path of sibling hashes from its leaf up to
+// the root, which is enough for anyone to check inclusion.
+
+// rootSeparator separates the message of the base interval from the
+// commitment root published with it.
+const rootSeparator = "\n\nroot:"
+
+// saltSize is the size in bytes of the random salt mixed into each leaf.
+const saltSize = 16
+
+// Prefixes used to separate leaf hashes from interior node hashes so that one
+// can't be passed off as the other.
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// Each step in an encoded proof starts with one of these to indicate which
+// side the sibling hash goes on.
+const (
+	proofStepLeft  = 'l'
+	proofStepRight = 'r'
+)
+
+var commitmentProofPattern = regexp.MustCompile(
+	`^LHI(\d{3}) proof\nsalt:([A-Za-z0-9_-]+)\npath:([A-Za-z0-9_.-]*)$`)
+var commitmentRootPattern = regexp.MustCompile(`\n\nroot:([A-Za-z0-9_-]+)`)
+
+// Commitment is a commitment over a schedule of intervals, along with
+// everything needed to prove that each interval belongs to it.
+type Commitment struct {
+	// Proofs are encoded inclusion proofs indexed by interval ID. The base
+	// interval isn't committed to and has an empty proof.
+	Proofs []string
+
+	// Root is the encoded Merkle root to be published with the base interval.
+	Root string
+
+	// Salts are encoded random salts indexed by interval ID. The base
+	// interval isn't committed to and has an empty salt.
+	Salts []string
+
+	// SealedSalts are Salts sealed with the message key for intervals whose
+	// messages are sealed, and empty for the rest. They're what should go in
+	// the schedule for sealed intervals (see Interval.SealedSalt).
+	SealedSalts []string
+}
+
+// CommitIntervals builds a commitment over every interval after the base one
+// using freshly generated salts. The results are meant to be copied into the
+// schedule. Commitments are over plaintext messages, so key is needed to open
+// sealed intervals, but may be nil if there are none. The salts of sealed
+// intervals are sealed with the same key.
+func CommitIntervals(intervals []*Interval, key *MessageKey) (*Commitment, error) {
+	if len(intervals) < 2 {
+		return nil, fmt.Errorf("Need at least two intervals to build a commitment")
+	}
+
+	salts := make([][]byte, len(intervals))
+	leaves := make([][]byte, len(intervals)-1)
+	for i := 1; i < len(intervals); i++ {
+		salts[i] = make([]byte, saltSize)
+		if _, err := rand.Read(salts[i]); err != nil {
+			return nil, err
+		}
+
+		message, err := intervals[i].Open(key)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening interval %v: %v", i, err)
+		}
+
+		leaves[i-1] = leafHash(salts[i], FormatInterval(i, message))
+	}
+
+	root, proofs := buildMerkleTree(leaves)
+
+	commitment := &Commitment{
+		Proofs:      make([]string, len(intervals)),
+		Root:        signatureEncoding.EncodeToString(root),
+		Salts:       make([]string, len(intervals)),
+		SealedSalts: make([]string, len(intervals)),
+	}
+	for i := 1; i < len(intervals); i++ {
+		commitment.Proofs[i] = proofs[i-1]
+		commitment.Salts[i] = signatureEncoding.EncodeToString(salts[i])
+
+		if intervals[i].Sealed != "" {
+			sealed, err := SealMessage(key, commitment.Salts[i])
+			if err != nil {
+				return nil, fmt.Errorf("Error sealing salt of interval %v: %v", i, err)
+			}
+			commitment.SealedSalts[i] = sealed
+		}
+	}
+
+	return commitment, nil
+}
+
+// ExtractCommitmentRoot extracts a commitment root from the text of a posted
+// base interval. ok is false if it didn't carry one.
+func ExtractCommitmentRoot(text string) (string, bool) {
+	matches := commitmentRootPattern.FindStringSubmatch(html.UnescapeString(text))
+	if matches == nil {
+		return "", false
+	}
+	return matches[1], true
+}
+
+// FormatCommitmentProof formats the reply that's threaded under a posted
+// interval to make its commitment verifiable.
+func FormatCommitmentProof(id int, salt, proof string) string {
+	return fmt.Sprintf("LHI%03d proof\nsalt:%s\npath:%s", id, salt, proof)
+}
+
+// VerifyCommitment checks that the text of a posted interval is included in
+// the commitment with the given root using the text of the proof reply that
+// was threaded under it. Both texts are accepted exactly as returned by
+// Twitter's API.
+func VerifyCommitment(root, postText, proofText string) error {
+	postText = html.UnescapeString(postText)
+	proofText = html.UnescapeString(proofText)
+
+	id, ok := extractIntervalID(postText)
+	if !ok {
+		return fmt.Errorf("Post is not an interval")
+	}
+
+	// A signature gets appended after the fact, so it's not part of what was
+	// committed to.
+	if sepIndex := strings.LastIndex(postText, signatureSeparator); sepIndex != -1 {
+		postText = postText[:sepIndex]
+	}
+
+	matches := commitmentProofPattern.FindStringSubmatch(proofText)
+	if matches == nil {
+		return fmt.Errorf("Proof is malformed")
+	}
+
+	if matches[1] != fmt.Sprintf("%03d", id) {
+		return fmt.Errorf("Proof is for LHI%s, but post is LHI%03d", matches[1], id)
+	}
+
+	expected, err := signatureEncoding.DecodeString(root)
+	if err != nil {
+		return fmt.Errorf("Error decoding root: %v", err)
+	}
+
+	salt, err := signatureEncoding.DecodeString(matches[2])
+	if err != nil {
+		return fmt.Errorf("Error decoding salt: %v", err)
+	}
+
+	actual, err := applyProof(leafHash(salt, postText), matches[3])
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(expected, actual) {
+		return fmt.Errorf("LHI%03d is not included in commitment %s", id, root)
+	}
+
+	return nil
+}
+
+// applyProof walks an encoded proof from a leaf up to the root that it
+// implies.
+func applyProof(hash []byte, proof string) ([]byte, error) {
+	if proof == "" {
+		return hash, nil
+	}
+
+	for _, step := range strings.Split(proof, ".") {
+		if len(step) < 1 {
+			return nil, fmt.Errorf("Proof has an empty step")
+		}
+
+		sibling, err := signatureEncoding.DecodeString(step[1:])
+		if err != nil || len(sibling) != sha256.Size {
+			return nil, fmt.Errorf("Proof has a malformed step: %s", step)
+		}
+
+		switch step[0] {
+		case proofStepLeft:
+			hash = nodeHash(sibling, hash)
+		case proofStepRight:
+			hash = nodeHash(hash, sibling)
+		default:
+			return nil, fmt.Errorf("Proof has a malformed step: %s", step)
+		}
+	}
+
+	return hash, nil
+}
+
+// buildMerkleTree builds a Merkle tree from a set of leaf hashes and returns
+// its root along with an encoded proof for each leaf. A node without a
+// sibling is carried up to the next level unchanged.
+func buildMerkleTree(leaves [][]byte) ([]byte, []string) {
+	steps := make([][]string, len(leaves))
+
+	// Tracks which leaves sit underneath each node of the current level so
+	// that every one of them gets a step when the node is paired.
+	members := make([][]int, len(leaves))
+	for i := range leaves {
+		members[i] = []int{i}
+	}
+
+	level := leaves
+	for len(level) > 1 {
+		var nextLevel [][]byte
+		var nextMembers [][]int
+
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				nextLevel = append(nextLevel, level[i])
+				nextMembers = append(nextMembers, members[i])
+				continue
+			}
+
+			left, right := level[i], level[i+1]
+			for _, leaf := range members[i] {
+				steps[leaf] = append(steps[leaf],
+					string(proofStepRight)+signatureEncoding.EncodeToString(right))
+			}
+			for _, leaf := range members[i+1] {
+				steps[leaf] = append(steps[leaf],
+					string(proofStepLeft)+signatureEncoding.EncodeToString(left))
+			}
+
+			nextLevel = append(nextLevel, nodeHash(left, right))
+			nextMembers = append(nextMembers, append(members[i], members[i+1]...))
+		}
+
+		level = nextLevel
+		members = nextMembers
+	}
+
+	proofs := make([]string, len(leaves))
+	for i := range leaves {
+		proofs[i] = strings.Join(steps[i], ".")
+	}
+
+	return level[0], proofs
+}
+
+// leafHash hashes an interval's message into a leaf. Links are normalized
+// like they are for signatures so that the posted text, with its t.co links,
+// still hashes to the leaf that was committed to.
+func leafHash(salt []byte, message string) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(salt)
+	h.Write([]byte(normalizeLinks(message)))
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
@@ -0,0 +1,193 @@
+package updater
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestBuildMerkleTree(t *testing.T) {
+	// Try a variety of sizes so that we exercise trees with unpaired nodes at
+	// different levels.
+	for size := 1; size <= 9; size++ {
+		leaves := make([][]byte, size)
+		for i := range leaves {
+			sum := sha256.Sum256([]byte(fmt.Sprintf("leaf %v", i)))
+			leaves[i] = sum[:]
+		}
+
+		root, proofs := buildMerkleTree(leaves)
+		assert.Equal(t, size, len(proofs))
+
+		for i, leaf := range leaves {
+			actual, err := applyProof(leaf, proofs[i])
+			assert.NoError(t, err)
+			assert.Equal(t, root, actual, "size %v, leaf %v", size, i)
+
+			// And a proof shouldn't work for any other leaf
+			if size > 1 {
+				other, err := applyProof(leaves[(i+1)%size], proofs[i])
+				assert.NoError(t, err)
+				assert.NotEqual(t, root, other)
+			}
+		}
+	}
+}
+
+func TestVerifyCommitment(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now, Message: "Interval 000"},
+		{Target: now, Message: "Interval 001"},
+		{Target: now, Message: "Interval 002 & more"},
+		{Target: now, Message: "Interval 003"},
+	}
+
+	commitment, err := CommitIntervals(intervals, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", commitment.Salts[0])
+	assert.Equal(t, "", commitment.Proofs[0])
+
+	for i := 1; i < len(intervals); i++ {
+		post := FormatInterval(i, intervals[i].Message)
+		proof := FormatCommitmentProof(i, commitment.Salts[i], commitment.Proofs[i])
+		assert.NoError(t, VerifyCommitment(commitment.Root, post, proof))
+	}
+
+	post := FormatInterval(2, intervals[2].Message)
+	proof := FormatCommitmentProof(2, commitment.Salts[2], commitment.Proofs[2])
+
+	// Works on HTML escaped text as it comes back from the API
+	assert.NoError(t, VerifyCommitment(commitment.Root,
+		strings.Replace(post, "&", "&amp;", -1), proof))
+
+	// Works on signed posts
+	signer := mustGenerateSigner(t)
+	assert.NoError(t, VerifyCommitment(commitment.Root,
+		signer.FormatInterval(2, intervals[2].Target, intervals[2].Message), proof))
+
+	// Works after Twitter has rewritten a link to t.co
+	linked := []*Interval{intervals[0], {Target: now, Message: "Interval 001 https://example.com"}}
+	linkedCommitment, err := CommitIntervals(linked, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, VerifyCommitment(linkedCommitment.Root,
+		FormatInterval(1, "Interval 001 https://t.co/abc123"),
+		FormatCommitmentProof(1, linkedCommitment.Salts[1], linkedCommitment.Proofs[1])))
+
+	// An altered message
+	assert.Error(t, VerifyCommitment(commitment.Root,
+		FormatInterval(2, "Interval 002 & less"), proof))
+
+	// Somebody else's salt
+	assert.Error(t, VerifyCommitment(commitment.Root, post,
+		FormatCommitmentProof(2, commitment.Salts[1], commitment.Proofs[2])))
+
+	// A proof for a different interval
+	assert.EqualError(t, VerifyCommitment(commitment.Root, post,
+		FormatCommitmentProof(1, commitment.Salts[1], commitment.Proofs[1])),
+		"Proof is for LHI001, but post is LHI002")
+
+	// A different commitment
+	other, err := CommitIntervals(intervals, nil)
+	assert.NoError(t, err)
+	assert.Error(t, VerifyCommitment(other.Root, post, proof))
+
+	// Garbage
+	assert.Error(t, VerifyCommitment(commitment.Root, "just a tweet", proof))
+	assert.Error(t, VerifyCommitment(commitment.Root, post, "just a tweet"))
+	assert.Error(t, VerifyCommitment(commitment.Root, post,
+		FormatCommitmentProof(2, commitment.Salts[2], "x"+commitment.Proofs[2])))
+}
+
+func TestCommitIntervals_TooFew(t *testing.T) {
+	_, err := CommitIntervals([]*Interval{{Message: "Interval 000"}}, nil)
+	assert.Error(t, err)
+}
+
+func TestUpdate_Commitment(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now, Message: "Interval 000"},
+		{Target: now, Message: "Interval 001"},
+	}
+
+	commitment, err := CommitIntervals(intervals, nil)
+	assert.NoError(t, err)
+	for i, interval := range intervals {
+		interval.Proof = commitment.Proofs[i]
+		interval.Salt = commitment.Salts[i]
+	}
+
+	opts := &UpdateOptions{CommitmentRoot: commitment.Root, Logger: DiscardLogger}
+	api := &mockTwitterAPI{}
+
+	// The base interval publishes the root and isn't followed by a proof
+	{
+		result, err := Update(api, intervals, now, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, result.PostedIntervalID)
+		assert.Equal(t, 0, len(api.replies))
+
+		root, ok := ExtractCommitmentRoot(api.posted[0].Message)
+		assert.True(t, ok)
+		assert.Equal(t, commitment.Root, root)
+	}
+
+	api.tweets = []*Tweet{api.posted[0]}
+
+	// Later intervals are followed by a verifiable proof
+	{
+		result, err := Update(api, intervals, now, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.PostedIntervalID)
+		assert.Equal(t, 1, len(api.replies))
+
+		assert.NoError(t, VerifyCommitment(commitment.Root,
+			api.posted[1].Message, api.replies[0].Message))
+	}
+}
+
+func TestUpdate_CommitmentSealed(t *testing.T) {
+	key, err := GenerateMessageKey()
+	assert.NoError(t, err)
+
+	sealed, err := SealMessage(key, "Interval 001")
+	assert.NoError(t, err)
+
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now, Message: "Interval 000"},
+		{Target: now, Sealed: sealed},
+	}
+
+	commitment, err := CommitIntervals(intervals, key)
+	assert.NoError(t, err)
+
+	// The sealed interval's salt is only given sealed
+	assert.Equal(t, "", commitment.SealedSalts[0])
+	salt, err := OpenMessage(key, commitment.SealedSalts[1])
+	assert.NoError(t, err)
+	assert.Equal(t, commitment.Salts[1], salt)
+
+	intervals[1].Proof = commitment.Proofs[1]
+	intervals[1].SealedSalt = commitment.SealedSalts[1]
+
+	api := &mockTwitterAPI{tweets: []*Tweet{{ID: 1, Message: "LHI000: Interval 000"}}}
+
+	// Without the key the salt can't be opened
+	_, err = intervals[1].OpenSalt(nil)
+	assert.Error(t, err)
+
+	result, err := Update(api, intervals, now,
+		&UpdateOptions{CommitmentRoot: commitment.Root, Logger: DiscardLogger, MessageKey: key})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.PostedIntervalID)
+	assert.Equal(t, 1, len(api.replies))
+
+	assert.NoError(t, VerifyCommitment(commitment.Root,
+		api.posted[0].Message, api.replies[0].Message))
+}
@@ -0,0 +1,158 @@
+package updater
+
+import (
+	"fmt"
+)
+
+// DiscoveryStrategy is how Update finds the last posted interval.
+type DiscoveryStrategy string
+
+// The possible discovery strategies.
+const (
+	// DiscoveryMarker means that the last posted interval was read from the
+	// account's marker. It's never configured directly; see
+	// UpdateOptions.UseMarker.
+	DiscoveryMarker DiscoveryStrategy = "marker"
+
+	// DiscoveryState means that the last posted interval was read from the
+	// state ledger. Like DiscoveryMarker, it's never configured directly; see
+	// UpdateOptions.StateStore.
+	DiscoveryState DiscoveryStrategy = "state"
+
+	// DiscoverySearch looks for the last posted interval with Twitter's search
+	// before falling back to scanning the timeline. It only works with APIs
+	// that implement TweetSearcher.
+	//
+	// Search is much cheaper than a timeline scan and isn't limited to the
+	// most recent 3,200 tweets, but it's also best effort: its index only
+	// covers recent tweets and Twitter doesn't guarantee that it's complete.
+	// So an interval that search turns up is only trusted once the timeline
+	// has been paged down to it without finding a newer interval, and the
+	// timeline is scanned in full whenever search doesn't turn up an
+	// interval or it can't be confirmed.
+	DiscoverySearch DiscoveryStrategy = "search"
+
+	// DiscoveryTimeline scans backward through the account's timeline. This
+	// is the default.
+	DiscoveryTimeline DiscoveryStrategy = "timeline"
+)
+
+// TweetSearcher is implemented by APIs that can search for an account's
+// interval posts.
+type TweetSearcher interface {
+	// SearchIntervals returns an iterator for tweets from the account that
+	// may be intervals, in reverse chronological order. Results can include
+	// tweets that aren't intervals.
+	SearchIntervals() TweetIterator
+}
+
+// ParseDiscoveryStrategy parses the name of a discovery strategy. An empty
+// name is the default, DiscoveryTimeline.
+func ParseDiscoveryStrategy(name string) (DiscoveryStrategy, error) {
+	switch DiscoveryStrategy(name) {
+	case "", DiscoveryTimeline:
+		return DiscoveryTimeline, nil
+	case DiscoverySearch:
+		return DiscoverySearch, nil
+	}
+
+	return "", fmt.Errorf("Unknown discovery strategy: %q (should be %q or %q)",
+		name, DiscoverySearch, DiscoveryTimeline)
+}
+
+// searchForInterval uses search to look for the last posted interval,
+// recording it in result if it's found and confirmed (see
+// confirmSearchResult). It returns false if search isn't available, didn't
+// find anything, or found an interval that couldn't be confirmed, in which
+// case the timeline should be scanned instead.
+func searchForInterval(api TwitterAPI, logger Logger, opts *UpdateOptions, result *UpdateResult) bool {
+	searcher, ok := api.(TweetSearcher)
+	if !ok {
+		logger.Info("API doesn't support search; falling back to timeline")
+		return false
+	}
+
+	logger.Debug("Searching for intervals")
+
+	it := searcher.SearchIntervals()
+	var numSearched int
+
+	for it.Next() {
+		numSearched++
+
+		id, ok := extractIntervalID(it.Value().Message)
+		if !ok {
+			continue
+		}
+
+		numConfirmed, ok := confirmSearchResult(api, logger, opts, it.Value())
+		if !ok {
+			return false
+		}
+
+		logger.Info("Found last interval with search",
+			LogKeyIntervalID, id, LogKeyTweetID, it.Value().ID)
+		result.Discovery = DiscoverySearch
+		result.LastIntervalID = id
+		result.LastIntervalTweetID = it.Value().ID
+		result.NumTweetsScanned += numSearched + numConfirmed
+		result.ScanStopReason = ScanStopFoundInterval
+		return true
+	}
+
+	// Search failing is never fatal because there's always the timeline
+	if it.Err() != nil {
+		logger.Warn("Error searching for intervals; falling back to timeline", "error", it.Err())
+		return false
+	}
+
+	logger.Info("Search found no intervals; falling back to timeline",
+		"num_tweets_searched", numSearched)
+	return false
+}
+
+// confirmSearchResult pages through the timeline down to an interval that
+// search found, returning true along with the number of tweets it scanned if
+// no newer tweet is an interval. Search's index is incomplete, so the newest
+// interval might not be in it, and trusting an older one would mean posting
+// intervals again.
+//
+// It returns false if a newer interval turns up, or if the check couldn't be
+// finished because the timeline failed, ended, or went deeper than
+// MaxScanTweets before reaching the found tweet.
+func confirmSearchResult(api TwitterAPI, logger Logger, opts *UpdateOptions,
+	found *Tweet) (int, bool) {
+
+	it := api.ListTweets()
+	var numScanned int
+
+	for it.Next() {
+		tweet := it.Value()
+		numScanned++
+
+		if tweet.ID == found.ID {
+			return numScanned, true
+		}
+
+		if id, ok := extractIntervalID(tweet.Message); ok {
+			logger.Warn("Timeline has an interval newer than search found; "+
+				"falling back to timeline",
+				LogKeyIntervalID, id, LogKeyTweetID, tweet.ID)
+			return numScanned, false
+		}
+
+		if opts.MaxScanTweets > 0 && numScanned >= opts.MaxScanTweets {
+			break
+		}
+	}
+
+	if it.Err() != nil {
+		logger.Warn("Error confirming search result; falling back to timeline",
+			"error", it.Err())
+		return numScanned, false
+	}
+
+	logger.Warn("Couldn't reach the interval that search found in the timeline; "+
+		"falling back to timeline", LogKeyTweetID, found.ID, "num_tweets_scanned", numScanned)
+	return numScanned, false
+}
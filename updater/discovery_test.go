@@ -0,0 +1,210 @@
+package updater
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestParseDiscoveryStrategy(t *testing.T) {
+	strategy, err := ParseDiscoveryStrategy("")
+	assert.NoError(t, err)
+	assert.Equal(t, DiscoveryTimeline, strategy)
+
+	strategy, err = ParseDiscoveryStrategy("search")
+	assert.NoError(t, err)
+	assert.Equal(t, DiscoverySearch, strategy)
+
+	_, err = ParseDiscoveryStrategy("psychic")
+	assert.Error(t, err)
+}
+
+func TestUpdate_Discovery(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-2 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 001"},
+		{Target: now.Add(1 * time.Hour), Message: "Interval 002"},
+	}
+
+	var searchResults, timeline []*liveTweet
+	var searchStatus int
+	var searchQueries []string
+	var numTimelineRequests int
+	var posted []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		switch r.URL.Path {
+		case "/1.1/search/tweets.json":
+			searchQueries = append(searchQueries, query.Get("q"))
+			if searchStatus != http.StatusOK {
+				w.WriteHeader(searchStatus)
+				return
+			}
+			if query.Get("max_id") != "" {
+				json.NewEncoder(w).Encode(&liveSearchResults{})
+				return
+			}
+			json.NewEncoder(w).Encode(&liveSearchResults{Statuses: searchResults})
+
+		case "/1.1/statuses/user_timeline.json":
+			numTimelineRequests++
+			if query.Get("max_id") != "" {
+				json.NewEncoder(w).Encode([]*liveTweet{})
+				return
+			}
+			json.NewEncoder(w).Encode(timeline)
+
+		case "/1.1/statuses/update.json":
+			posted = append(posted, query.Get("status"))
+			json.NewEncoder(w).Encode(&liveTweet{
+				CreatedAt: formatTwitterTime(now), ID: 100, Text: query.Get("status")})
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	api := &LiveTwitterAPI{BaseURL: server.URL, HTTPClient: server.Client(), Logger: DiscardLogger, ScreenName: "perpetual"}
+	opts := &UpdateOptions{Discovery: DiscoverySearch, Logger: DiscardLogger, SkipPreflight: true}
+
+	reset := func() {
+		searchResults, timeline = nil, nil
+		searchStatus = http.StatusOK
+		searchQueries, posted = nil, nil
+		numTimelineRequests = 0
+	}
+
+	// Search finds the last interval, and the timeline is only paged down to
+	// it to confirm that there's nothing newer
+	{
+		reset()
+		searchResults = []*liveTweet{
+			{CreatedAt: formatTwitterTime(now), ID: 3, Text: "LHI is a fine prefix"},
+			{CreatedAt: formatTwitterTime(now), ID: 2, Text: FormatInterval(0, "Interval 000")},
+		}
+		timeline = []*liveTweet{
+			{CreatedAt: formatTwitterTime(now), ID: 3, Text: "LHI is a fine prefix"},
+			{CreatedAt: formatTwitterTime(now), ID: 2, Text: FormatInterval(0, "Interval 000")},
+		}
+
+		result, err := Update(api, intervals, now, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, DiscoverySearch, result.Discovery)
+		assert.Equal(t, 0, result.LastIntervalID)
+		assert.Equal(t, 1, result.PostedIntervalID)
+		assert.Equal(t, []string{`from:perpetual "LHI"`}, searchQueries)
+		assert.Equal(t, 1, numTimelineRequests)
+		assert.Equal(t, []string{FormatInterval(1, "Interval 001")}, posted)
+	}
+
+	// Search's index is missing the newest interval, which the timeline has,
+	// so nothing is posted again
+	{
+		reset()
+		searchResults = []*liveTweet{
+			{CreatedAt: formatTwitterTime(now), ID: 2, Text: FormatInterval(0, "Interval 000")},
+		}
+		timeline = []*liveTweet{
+			{CreatedAt: formatTwitterTime(now), ID: 4, Text: FormatInterval(1, "Interval 001")},
+			{CreatedAt: formatTwitterTime(now), ID: 2, Text: FormatInterval(0, "Interval 000")},
+		}
+
+		result, err := Update(api, intervals, now, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, DiscoveryTimeline, result.Discovery)
+		assert.Equal(t, 1, result.LastIntervalID)
+		assert.Equal(t, -1, result.PostedIntervalID)
+		assert.Equal(t, 0, len(posted))
+	}
+
+	// The interval that search found can't be reached in the timeline, so it
+	// isn't trusted
+	{
+		reset()
+		searchResults = []*liveTweet{
+			{CreatedAt: formatTwitterTime(now), ID: 2, Text: FormatInterval(0, "Interval 000")},
+		}
+
+		result, err := Update(api, intervals, now, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, DiscoveryTimeline, result.Discovery)
+		assert.Equal(t, -1, result.LastIntervalID)
+	}
+
+	// Search comes up empty, so the timeline is scanned
+	{
+		reset()
+		timeline = []*liveTweet{
+			{CreatedAt: formatTwitterTime(now), ID: 3, Text: FormatInterval(1, "Interval 001")},
+		}
+
+		result, err := Update(api, intervals, now, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, DiscoveryTimeline, result.Discovery)
+		assert.Equal(t, 1, result.LastIntervalID)
+		assert.Equal(t, -1, result.PostedIntervalID)
+		assert.Equal(t, 1, len(searchQueries))
+		assert.Equal(t, 1, numTimelineRequests)
+	}
+
+	// Search fails, so the timeline is scanned
+	{
+		reset()
+		searchStatus = http.StatusTooManyRequests
+		timeline = []*liveTweet{
+			{CreatedAt: formatTwitterTime(now), ID: 3, Text: FormatInterval(1, "Interval 001")},
+		}
+
+		result, err := Update(api, intervals, now, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, DiscoveryTimeline, result.Discovery)
+		assert.Equal(t, 1, result.LastIntervalID)
+		assert.Equal(t, 1, numTimelineRequests)
+	}
+
+	// Search isn't used unless it's configured
+	{
+		reset()
+		timeline = []*liveTweet{
+			{CreatedAt: formatTwitterTime(now), ID: 3, Text: FormatInterval(1, "Interval 001")},
+		}
+
+		result, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger, SkipPreflight: true})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.LastIntervalID)
+		assert.Equal(t, 0, len(searchQueries))
+		assert.Equal(t, 1, numTimelineRequests)
+	}
+
+	// An API that can't search always scans the timeline
+	{
+		result, err := Update(&mockTwitterAPI{tweets: []*Tweet{
+			{CreatedAt: now, Message: FormatInterval(1, "Interval 001")},
+		}}, intervals, now, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, DiscoveryTimeline, result.Discovery)
+		assert.Equal(t, 1, result.LastIntervalID)
+	}
+
+	// An unknown strategy
+	{
+		_, err := Update(api, intervals, now, &UpdateOptions{Discovery: "psychic", Logger: DiscardLogger, SkipPreflight: true})
+		assert.EqualError(t, err, `Unknown discovery strategy: "psychic"`)
+	}
+}
+
+//
+// Helpers
+//
+
+func formatTwitterTime(t time.Time) string {
+	return t.UTC().Format("Mon Jan 02 15:04:05 -0700 2006")
+}
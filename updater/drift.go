@@ -0,0 +1,162 @@
+package updater
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// DriftStatus is the result of comparing a single interval post against the
+// schedule.
+type DriftStatus string
+
+// The possible results of comparing an interval post against the schedule.
+const (
+	// DriftChanged means that the posted text differs from the schedule's
+	// message, usually because the schedule was edited after posting.
+	DriftChanged DriftStatus = "changed"
+
+	// DriftMatched means that the posted text matches the schedule.
+	DriftMatched DriftStatus = "matched"
+
+	// DriftSealed means that the interval is sealed and no message key was
+	// given to open it, so it couldn't be compared.
+	DriftSealed DriftStatus = "sealed"
+
+	// DriftUnknownInterval means that the post claims to be an interval that
+	// isn't in the schedule.
+	DriftUnknownInterval DriftStatus = "unknown_interval"
+)
+
+// DriftResult is the result of comparing an interval post against the
+// schedule.
+type DriftResult struct {
+	// IntervalID is the ID of the interval that the post claimed to be.
+	IntervalID int
+
+	// Posted is the post's message after normalization.
+	Posted string
+
+	// Scheduled is the schedule's message after normalization. It's empty if
+	// the interval is unknown or sealed.
+	Scheduled string
+
+	// Status is the outcome of the comparison.
+	Status DriftStatus
+
+	// Tweet is the tweet that was compared.
+	Tweet *Tweet
+}
+
+// CheckDrift compares a tweet's text against the interval that it claims to
+// be in the schedule. ok is false if the tweet isn't an interval post at all.
+//
+// Both sides are normalized before they're compared to account for what
+// Twitter does to a message: HTML entities are unescaped, every link is
+// treated as the same (because Twitter rewrites them to t.co links), and the
+// signature, key fingerprint, and commitment root that Update appends are
+// removed. key is only needed to compare sealed intervals, and may be nil.
+func CheckDrift(intervals []*Interval, key *MessageKey, tweet *Tweet) (*DriftResult, bool) {
+	text := html.UnescapeString(tweet.Message)
+
+	id, ok := extractIntervalID(text)
+	if !ok {
+		return nil, false
+	}
+
+	posted := stripPostSuffixes(id, strings.TrimPrefix(text, FormatInterval(id, "")))
+	result := &DriftResult{IntervalID: id, Posted: normalizeMessage(posted), Tweet: tweet}
+
+	if id >= len(intervals) {
+		result.Status = DriftUnknownInterval
+		return result, true
+	}
+
+	if intervals[id].Sealed != "" && key == nil {
+		result.Status = DriftSealed
+		return result, true
+	}
+
+	message, err := intervals[id].Open(key)
+	if err != nil {
+		// The key doesn't open the interval, so the schedule can't have
+		// produced this post
+		result.Status = DriftChanged
+		return result, true
+	}
+
+	result.Scheduled = normalizeMessage(message)
+
+	if result.Posted == result.Scheduled {
+		result.Status = DriftMatched
+	} else {
+		result.Status = DriftChanged
+	}
+
+	return result, true
+}
+
+// DriftTimeline walks an account's entire available timeline and compares
+// every interval post that it finds against the schedule, returning results
+// in the same reverse chronological order as the timeline.
+func DriftTimeline(api TwitterAPI, intervals []*Interval, key *MessageKey) ([]*DriftResult, error) {
+	var results []*DriftResult
+
+	it := api.ListTweets()
+	for it.Next() {
+		result, ok := CheckDrift(intervals, key, it.Value())
+		if ok {
+			results = append(results, result)
+		}
+	}
+
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+
+	return results, nil
+}
+
+//
+// Private
+//
+
+// linkPattern matches links in a message. Twitter rewrites every link to a
+// t.co link of its own.
+var linkPattern = regexp.MustCompile(`https?://\S+`)
+
+// linkPlaceholder replaces every link in a normalized message.
+const linkPlaceholder = "<link>"
+
+func normalizeMessage(message string) string {
+	return strings.TrimSpace(normalizeLinks(message))
+}
+
+// normalizeLinks replaces every link in a message with a placeholder so that
+// it reads the same before and after Twitter rewrites it.
+func normalizeLinks(message string) string {
+	return linkPattern.ReplaceAllString(message, linkPlaceholder)
+}
+
+// stripPostSuffixes removes what Update appends to an interval's message
+// when posting it. They're appended in the order commitment root, key
+// fingerprint, then signature, so they're removed in reverse.
+func stripPostSuffixes(id int, message string) string {
+	if i := strings.LastIndex(message, signatureSeparator); i != -1 {
+		message = message[:i]
+	}
+
+	if id != 0 {
+		return message
+	}
+
+	if i := strings.LastIndex(message, keySeparator); i != -1 {
+		message = message[:i]
+	}
+
+	if i := strings.LastIndex(message, rootSeparator); i != -1 {
+		message = message[:i]
+	}
+
+	return message
+}
@@ -0,0 +1,89 @@
+package updater
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestCheckDrift(t *testing.T) {
+	key := mustGenerateMessageKey(t)
+
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now, Message: "Interval 000 & https://example.com/a-long-link"},
+		{Target: now, Message: "Interval 001"},
+		{Target: now, Sealed: mustSealMessage(t, key, "Interval 002")},
+	}
+
+	// Post everything with every suffix that Update might append
+	api := &mockTwitterAPI{}
+	for range intervals {
+		_, err := Update(api, intervals, now, &UpdateOptions{
+			CommitmentRoot: "root",
+			Logger:         DiscardLogger,
+			MessageKey:     key,
+			Signer:         mustGenerateSigner(t),
+		})
+		assert.NoError(t, err)
+		api.tweets = append([]*Tweet{api.posted[len(api.posted)-1]}, api.tweets...)
+	}
+
+	// Do what Twitter does to links and ampersands
+	base := api.posted[0]
+	base.Message = strings.Replace(base.Message, "https://example.com/a-long-link",
+		"https://t.co/abc123", 1)
+	base.Message = strings.Replace(base.Message, "&", "&amp;", 1)
+
+	// Everything matches the schedule that posted it
+	{
+		results, err := DriftTimeline(api, intervals, key)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(results))
+
+		for _, result := range results {
+			assert.Equal(t, DriftMatched, result.Status, "LHI%03d", result.IntervalID)
+		}
+		assert.Equal(t, "Interval 000 & <link>", results[2].Posted)
+	}
+
+	// The schedule was edited after posting
+	{
+		edited := []*Interval{intervals[0], {Target: now, Message: "Interval 001 (edited)"}}
+
+		result, ok := CheckDrift(edited, key, api.posted[1])
+		assert.True(t, ok)
+		assert.Equal(t, DriftChanged, result.Status)
+		assert.Equal(t, "Interval 001", result.Posted)
+		assert.Equal(t, "Interval 001 (edited)", result.Scheduled)
+	}
+
+	// A sealed interval without a key
+	{
+		result, ok := CheckDrift(intervals, nil, api.posted[2])
+		assert.True(t, ok)
+		assert.Equal(t, DriftSealed, result.Status)
+	}
+
+	// A sealed interval with the wrong key
+	{
+		result, ok := CheckDrift(intervals, mustGenerateMessageKey(t), api.posted[2])
+		assert.True(t, ok)
+		assert.Equal(t, DriftChanged, result.Status)
+	}
+
+	// An interval that's not in the schedule
+	{
+		result, ok := CheckDrift(intervals[:1], key, api.posted[1])
+		assert.True(t, ok)
+		assert.Equal(t, DriftUnknownInterval, result.Status)
+	}
+
+	// Not an interval at all
+	{
+		_, ok := CheckDrift(intervals, key, &Tweet{Message: "just a tweet"})
+		assert.False(t, ok)
+	}
+}
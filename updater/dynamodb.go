@@ -0,0 +1,318 @@
+package updater
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// The keys of the items that state and the lease are kept in. Both live in
+// the same table, which has a string partition key called "id".
+const (
+	dynamoDBLockKey  = "lock"
+	dynamoDBStateKey = "state"
+)
+
+// DynamoDBAPI is the subset of DynamoDB's API that's used to keep state and
+// leases in it. It's satisfied by *dynamodb.DynamoDB.
+type DynamoDBAPI interface {
+	GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+	UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+}
+
+//
+// State store
+//
+
+// DynamoDBStateStore is a StateStore kept as a single item in a DynamoDB
+// table. Its compare-and-swap is a conditional PutItem, so only one
+// invocation can save state that advances to a given interval.
+type DynamoDBStateStore struct {
+	// Client is the DynamoDB client.
+	Client DynamoDBAPI
+
+	// Table is the name of the table. It must have a string partition key
+	// called "id".
+	Table string
+}
+
+// LoadState reads state from the table with a consistent read.
+func (s *DynamoDBStateStore) LoadState() (*State, error) {
+	item, err := getDynamoDBItem(s.Client, s.Table, dynamoDBStateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil {
+		return &State{}, nil
+	}
+
+	if item["state"] == nil || item["state"].S == nil {
+		return nil, fmt.Errorf("State item in %v has no state", s.Table)
+	}
+
+	var state State
+	err = json.Unmarshal([]byte(*item["state"].S), &state)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding state in %v: %v", s.Table, err)
+	}
+
+	return &state, nil
+}
+
+// SaveState writes state to the table, as long as it's still the version
+// that was loaded and wasn't saved under a newer lease.
+func (s *DynamoDBStateStore) SaveState(state *State) error {
+	state.Version++
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		state.Version--
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		Item: map[string]*dynamodb.AttributeValue{
+			"id":            {S: aws.String(dynamoDBStateKey)},
+			"fencing_token": dynamoDBNumber(int64(state.FencingToken)),
+			"state":         {S: aws.String(string(data))},
+			"version":       dynamoDBNumber(state.Version),
+		},
+		TableName: aws.String(s.Table),
+	}
+
+	// State that's never been saved must not exist yet. Otherwise it must be
+	// at the version that it was loaded from. DynamoDB rejects expression
+	// attribute names that aren't used, so each branch only sets its own.
+	if state.Version == 1 {
+		input.ConditionExpression = aws.String("attribute_not_exists(#id)")
+		input.ExpressionAttributeNames = map[string]*string{"#id": aws.String("id")}
+	} else {
+		input.ConditionExpression = aws.String(
+			"#version = :version AND #fencing_token <= :fencing_token")
+		input.ExpressionAttributeNames = map[string]*string{
+			"#fencing_token": aws.String("fencing_token"),
+			"#version":       aws.String("version"),
+		}
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":fencing_token": dynamoDBNumber(int64(state.FencingToken)),
+			":version":       dynamoDBNumber(state.Version - 1),
+		}
+	}
+
+	_, err = s.Client.PutItem(input)
+	if err == nil {
+		return nil
+	}
+
+	state.Version--
+
+	if !isConditionalCheckFailed(err) {
+		return fmt.Errorf("Error saving state to %v: %v", s.Table, err)
+	}
+
+	// Find out which of the conditions failed
+	current, loadErr := s.LoadState()
+	if loadErr != nil {
+		return ErrStateConflict
+	}
+
+	err = checkStateSave(current, state)
+	if err == nil {
+		// Changed back in between; still a conflict
+		return ErrStateConflict
+	}
+
+	return err
+}
+
+//
+// Locker
+//
+
+// DynamoDBLocker is a Locker kept as a single item in a DynamoDB table,
+// which may be the same table as a DynamoDBStateStore's. Leases are acquired
+// with a conditional UpdateItem.
+type DynamoDBLocker struct {
+	// Client is the DynamoDB client.
+	Client DynamoDBAPI
+
+	// Table is the name of the table. It must have a string partition key
+	// called "id".
+	Table string
+}
+
+// Acquire takes the lock if it's not held, it's expired, or it's already
+// held by holder. The fencing token is incremented atomically.
+func (l *DynamoDBLocker) Acquire(holder string, ttl time.Duration) (*Lease, error) {
+	now := time.Now()
+	expires := now.Add(ttl)
+
+	out, err := l.Client.UpdateItem(&dynamodb.UpdateItemInput{
+		ConditionExpression: aws.String(
+			"attribute_not_exists(#expires) OR #expires <= :now OR #holder = :holder"),
+		ExpressionAttributeNames: map[string]*string{
+			"#expires": aws.String("expires"),
+			"#holder":  aws.String("holder"),
+			"#token":   aws.String("token"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":expires": dynamoDBNumber(timeToMillis(expires)),
+			":holder":  {S: aws.String(holder)},
+			":now":     dynamoDBNumber(timeToMillis(now)),
+			":one":     dynamoDBNumber(1),
+		},
+		Key:              dynamoDBKey(dynamoDBLockKey),
+		ReturnValues:     aws.String(dynamodb.ReturnValueAllNew),
+		TableName:        aws.String(l.Table),
+		UpdateExpression: aws.String("SET #holder = :holder, #expires = :expires ADD #token :one"),
+	})
+	if isConditionalCheckFailed(err) {
+		held, getErr := l.getLease()
+		if getErr != nil {
+			return nil, getErr
+		}
+		return nil, &LockHeldError{Lease: held}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error acquiring lease in %v: %v", l.Table, err)
+	}
+
+	lease, err := dynamoDBLease(out.Attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+// Release gives up a lease. Nothing happens if it's been taken over.
+func (l *DynamoDBLocker) Release(lease *Lease) error {
+	_, err := l.Client.UpdateItem(&dynamodb.UpdateItemInput{
+		ConditionExpression: aws.String("#token = :token"),
+		ExpressionAttributeNames: map[string]*string{
+			"#expires": aws.String("expires"),
+			"#token":   aws.String("token"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":token": dynamoDBNumber(int64(lease.Token)),
+			":zero":  dynamoDBNumber(0),
+		},
+		Key:              dynamoDBKey(dynamoDBLockKey),
+		TableName:        aws.String(l.Table),
+		UpdateExpression: aws.String("SET #expires = :zero"),
+	})
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error releasing lease in %v: %v", l.Table, err)
+	}
+
+	return nil
+}
+
+func (l *DynamoDBLocker) getLease() (*Lease, error) {
+	item, err := getDynamoDBItem(l.Client, l.Table, dynamoDBLockKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil {
+		return nil, fmt.Errorf("Lease in %v disappeared", l.Table)
+	}
+
+	return dynamoDBLease(item)
+}
+
+//
+// Private
+//
+
+func dynamoDBKey(key string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{"id": {S: aws.String(key)}}
+}
+
+// dynamoDBLease decodes a lease from the attributes of the lock item.
+func dynamoDBLease(item map[string]*dynamodb.AttributeValue) (*Lease, error) {
+	var lease Lease
+
+	for name, value := range item {
+		var err error
+
+		switch name {
+		case "expires":
+			var millis int64
+			millis, err = dynamoDBParseNumber(value)
+			lease.Expires = millisToTime(millis)
+
+		case "holder":
+			if value.S != nil {
+				lease.Holder = *value.S
+			}
+
+		case "token":
+			var token int64
+			token, err = dynamoDBParseNumber(value)
+			lease.Token = uint64(token)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding lease attribute %v: %v", name, err)
+		}
+	}
+
+	return &lease, nil
+}
+
+func dynamoDBNumber(n int64) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(n, 10))}
+}
+
+func dynamoDBParseNumber(value *dynamodb.AttributeValue) (int64, error) {
+	if value.N == nil {
+		return 0, fmt.Errorf("Not a number")
+	}
+	return strconv.ParseInt(*value.N, 10, 64)
+}
+
+// getDynamoDBItem gets an item with a consistent read, returning nil if it
+// doesn't exist.
+func getDynamoDBItem(client DynamoDBAPI, table, key string) (map[string]*dynamodb.AttributeValue, error) {
+	out, err := client.GetItem(&dynamodb.GetItemInput{
+		ConsistentRead: aws.Bool(true),
+		Key:            dynamoDBKey(key),
+		TableName:      aws.String(table),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting %v from %v: %v", key, table, err)
+	}
+
+	if len(out.Item) == 0 {
+		return nil, nil
+	}
+
+	return out.Item, nil
+}
+
+func isConditionalCheckFailed(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+func millisToTime(millis int64) time.Time {
+	if millis == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
+
+func timeToMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,353 @@
+package updater
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	assert "github.com/stretchr/testify/require"
+)
+
+//
+// Fake DynamoDB
+//
+
+// fakeDynamoDB is an in-memory DynamoDBAPI for a table with a string
+// partition key called "id". It only understands as much of DynamoDB's
+// expression syntax as DynamoDBStateStore and DynamoDBLocker use: conditions
+// made of comparisons and attribute_not_exists joined by AND and OR (without
+// parentheses), and updates made of SET and ADD clauses. Like DynamoDB, it
+// rejects expression attribute names and values that aren't used.
+type fakeDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (d *fakeDynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return &dynamodb.GetItemOutput{Item: copyDynamoDBItem(d.items[*input.Key["id"].S])}, nil
+}
+
+func (d *fakeDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := *input.Item["id"].S
+
+	err := checkFakeDynamoDBExpressionUse(input.ExpressionAttributeNames,
+		input.ExpressionAttributeValues, input.ConditionExpression)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkFakeDynamoDBCondition(d.items[key], input.ConditionExpression,
+		input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.items == nil {
+		d.items = make(map[string]map[string]*dynamodb.AttributeValue)
+	}
+	d.items[key] = copyDynamoDBItem(input.Item)
+
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (d *fakeDynamoDB) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := *input.Key["id"].S
+	names := input.ExpressionAttributeNames
+	values := input.ExpressionAttributeValues
+
+	err := checkFakeDynamoDBExpressionUse(names, values, input.ConditionExpression,
+		input.UpdateExpression)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkFakeDynamoDBCondition(d.items[key], input.ConditionExpression, names, values)
+	if err != nil {
+		return nil, err
+	}
+
+	item := copyDynamoDBItem(d.items[key])
+	if item == nil {
+		item = copyDynamoDBItem(input.Key)
+	}
+
+	expr := *input.UpdateExpression
+	var add string
+	if i := strings.Index(expr, " ADD "); i != -1 {
+		expr, add = expr[:i], expr[i+len(" ADD "):]
+	}
+
+	for _, clause := range strings.Split(strings.TrimPrefix(expr, "SET "), ", ") {
+		parts := strings.Split(clause, " = ")
+		item[resolveFakeDynamoDBName(parts[0], names)] = values[parts[1]]
+	}
+
+	if add != "" {
+		for _, clause := range strings.Split(add, ", ") {
+			parts := strings.Split(clause, " ")
+			name := resolveFakeDynamoDBName(parts[0], names)
+
+			var n int64
+			if item[name] != nil {
+				n, _ = dynamoDBParseNumber(item[name])
+			}
+			delta, _ := dynamoDBParseNumber(values[parts[1]])
+			item[name] = dynamoDBNumber(n + delta)
+		}
+	}
+
+	if d.items == nil {
+		d.items = make(map[string]map[string]*dynamodb.AttributeValue)
+	}
+	d.items[key] = item
+
+	return &dynamodb.UpdateItemOutput{Attributes: copyDynamoDBItem(item)}, nil
+}
+
+//
+// Tests
+//
+
+func TestDynamoDBStateStore(t *testing.T) {
+	testStateStore(t, &DynamoDBStateStore{Client: &fakeDynamoDB{}, Table: "perpetual"})
+}
+
+func TestDynamoDBLocker(t *testing.T) {
+	testLocker(t, &DynamoDBLocker{Client: &fakeDynamoDB{}, Table: "perpetual"})
+}
+
+func TestUpdate_DynamoDB(t *testing.T) {
+	client := &fakeDynamoDB{}
+	testUpdateConcurrently(t, &UpdateOptions{
+		Locker:     &DynamoDBLocker{Client: client, Table: "perpetual"},
+		Logger:     DiscardLogger,
+		StateStore: &DynamoDBStateStore{Client: client, Table: "perpetual"},
+	})
+
+	// State and lease share the table
+	assert.Equal(t, 2, len(client.items))
+}
+
+// Runs against DynamoDB Local, which can be started with:
+//
+//	docker run -p 8000:8000 amazon/dynamodb-local
+//	export DYNAMODB_LOCAL_ENDPOINT=http://localhost:8000
+func TestDynamoDB_Local(t *testing.T) {
+	endpoint := os.Getenv("DYNAMODB_LOCAL_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("Set DYNAMODB_LOCAL_ENDPOINT to run against DynamoDB Local")
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials("local", "local", ""),
+		Endpoint:    aws.String(endpoint),
+		Region:      aws.String("us-east-1"),
+	})
+	assert.NoError(t, err)
+	client := dynamodb.New(sess)
+
+	newTable := func(t *testing.T) string {
+		table := fmt.Sprintf("perpetual-test-%v", time.Now().UnixNano())
+		_, err := client.CreateTable(&dynamodb.CreateTableInput{
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{AttributeName: aws.String("id"), AttributeType: aws.String("S")},
+			},
+			BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("id"), KeyType: aws.String("HASH")},
+			},
+			TableName: aws.String(table),
+		})
+		assert.NoError(t, err)
+		return table
+	}
+
+	deleteTable := func(table string) {
+		_, err := client.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(table)})
+		if err != nil {
+			t.Logf("Error deleting table %v: %v", table, err)
+		}
+	}
+
+	t.Run("StateStore", func(t *testing.T) {
+		table := newTable(t)
+		defer deleteTable(table)
+
+		testStateStore(t, &DynamoDBStateStore{Client: client, Table: table})
+	})
+
+	t.Run("Locker", func(t *testing.T) {
+		table := newTable(t)
+		defer deleteTable(table)
+
+		testLocker(t, &DynamoDBLocker{Client: client, Table: table})
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		table := newTable(t)
+		defer deleteTable(table)
+
+		testUpdateConcurrently(t, &UpdateOptions{
+			Locker:     &DynamoDBLocker{Client: client, Table: table},
+			Logger:     DiscardLogger,
+			StateStore: &DynamoDBStateStore{Client: client, Table: table},
+		})
+	})
+}
+
+//
+// Private
+//
+
+// checkFakeDynamoDBCondition evaluates a condition expression against an
+// item, which is nil if it doesn't exist.
+func checkFakeDynamoDBCondition(item map[string]*dynamodb.AttributeValue, condition *string,
+	names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+
+	if condition == nil {
+		return nil
+	}
+
+	for _, or := range strings.Split(*condition, " OR ") {
+		matched := true
+
+		for _, term := range strings.Split(or, " AND ") {
+			if !evalFakeDynamoDBTerm(item, term, names, values) {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return nil
+		}
+	}
+
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException,
+		"The conditional request failed", nil)
+}
+
+// checkFakeDynamoDBExpressionUse checks that every expression attribute name
+// and value is used by one of the expressions, which DynamoDB requires.
+func checkFakeDynamoDBExpressionUse(names map[string]*string,
+	values map[string]*dynamodb.AttributeValue, expressions ...*string) error {
+
+	var all string
+	for _, expr := range expressions {
+		if expr != nil {
+			all += " " + *expr
+		}
+	}
+
+	placeholderPattern := regexp.MustCompile(`[#:][A-Za-z0-9_]+`)
+	used := make(map[string]bool)
+	for _, placeholder := range placeholderPattern.FindAllString(all, -1) {
+		used[placeholder] = true
+	}
+
+	for name := range names {
+		if !used[name] {
+			return awserr.New("ValidationException", fmt.Sprintf(
+				"Value provided in ExpressionAttributeNames unused in expressions: keys: {%s}",
+				name), nil)
+		}
+	}
+	for value := range values {
+		if !used[value] {
+			return awserr.New("ValidationException", fmt.Sprintf(
+				"Value provided in ExpressionAttributeValues unused in expressions: keys: {%s}",
+				value), nil)
+		}
+	}
+
+	return nil
+}
+
+func copyDynamoDBItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+
+	itemCopy := make(map[string]*dynamodb.AttributeValue, len(item))
+	for name, value := range item {
+		valueCopy := *value
+		itemCopy[name] = &valueCopy
+	}
+	return itemCopy
+}
+
+func evalFakeDynamoDBTerm(item map[string]*dynamodb.AttributeValue, term string,
+	names map[string]*string, values map[string]*dynamodb.AttributeValue) bool {
+
+	if strings.HasPrefix(term, "attribute_not_exists(") {
+		name := strings.TrimSuffix(strings.TrimPrefix(term, "attribute_not_exists("), ")")
+		return item[resolveFakeDynamoDBName(name, names)] == nil
+	}
+
+	parts := strings.Split(term, " ")
+	if len(parts) != 3 {
+		panic(fmt.Sprintf("Unsupported condition: %q", term))
+	}
+
+	left := item[resolveFakeDynamoDBName(parts[0], names)]
+	right := values[parts[2]]
+	if left == nil || right == nil {
+		return false
+	}
+
+	var cmp int
+	switch {
+	case left.N != nil && right.N != nil:
+		l, _ := strconv.ParseInt(*left.N, 10, 64)
+		r, _ := strconv.ParseInt(*right.N, 10, 64)
+		switch {
+		case l < r:
+			cmp = -1
+		case l > r:
+			cmp = 1
+		}
+
+	case left.S != nil && right.S != nil:
+		cmp = strings.Compare(*left.S, *right.S)
+
+	default:
+		return false
+	}
+
+	switch parts[1] {
+	case "=":
+		return cmp == 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	default:
+		panic(fmt.Sprintf("Unsupported comparison: %q", parts[1]))
+	}
+}
+
+func resolveFakeDynamoDBName(name string, names map[string]*string) string {
+	if resolved, ok := names[name]; ok {
+		return *resolved
+	}
+	return name
+}
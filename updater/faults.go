@@ -0,0 +1,290 @@
+package updater
+
+import (
+	"errors"
+	"sync"
+)
+
+// DefaultFaultPageSize is the size of the pages that FaultyTwitterAPI splits
+// tweets into if its PageSize isn't set. It's the same as the live API's.
+const DefaultFaultPageSize = 200
+
+// ErrInjectedFault is returned by FaultyTwitterAPI when it fails a request
+// without passing it on.
+var ErrInjectedFault = errors.New("Injected fault")
+
+// ErrInjectedTimeout is returned by FaultyTwitterAPI when it passes a request
+// on but reports that it timed out, so the caller can't know that it
+// succeeded.
+var ErrInjectedTimeout = errors.New("Injected timeout; the request may have succeeded")
+
+// FaultyTwitterAPI wraps another TwitterAPI and injects faults into it, for
+// testing how Update holds up when things go wrong. Faults are configured
+// through its fields, and counts of failures are used up as requests are
+// made, so a test can have the first post fail and the next one succeed.
+//
+// Listed tweets are split into pages of PageSize to emulate the live API's
+// paging. Update assumes that timelines are newest first, as Twitter's are,
+// so reordering only tests that something other than the timeline (the state
+// ledger or marker) is trusted when there is one.
+type FaultyTwitterAPI struct {
+	// API is the API that's wrapped.
+	API TwitterAPI
+
+	// DuplicateTweets lists each tweet twice in a row, as happens when pages
+	// overlap.
+	DuplicateTweets bool
+
+	// ListErrPage makes listing tweets fail with ErrInjectedFault when it
+	// reaches this page, starting from 1. Zero means never.
+	ListErrPage int
+
+	// LookupFailures is how many LookupTweets calls fail with
+	// ErrInjectedFault before they start succeeding.
+	LookupFailures int
+
+	// MarkerFailures is how many WriteMarker calls fail with
+	// ErrInjectedFault before they start succeeding.
+	MarkerFailures int
+
+	// PageSize is the number of tweets per page. Defaults to
+	// DefaultFaultPageSize if zero.
+	PageSize int
+
+	// PostFailures is how many posts (tweets and replies) fail with
+	// ErrInjectedFault without posting before they start succeeding.
+	PostFailures int
+
+	// PostTimeouts is how many posts are made but then reported as having
+	// failed with ErrInjectedTimeout. They're used up after PostFailures.
+	PostTimeouts int
+
+	// ReorderTweets lists each page of tweets in reverse.
+	ReorderTweets bool
+
+	// TruncateHistory only lists this many of the newest tweets, as if the
+	// API wouldn't return any older ones. Zero means no limit.
+	TruncateHistory int
+
+	// UnindexedIntervals leaves this many of the newest intervals out of
+	// search results, as if search hadn't indexed them, so that the newest
+	// interval that search finds is stale. It doesn't affect the timeline.
+	UnindexedIntervals int
+
+	mu sync.Mutex
+}
+
+// DeleteTweet deletes a tweet through the wrapped API.
+func (a *FaultyTwitterAPI) DeleteTweet(id uint64) error {
+	return a.API.DeleteTweet(id)
+}
+
+// ListTweets lists tweets from the wrapped API with faults injected.
+func (a *FaultyTwitterAPI) ListTweets() TweetIterator {
+	return a.newIterator(a.API.ListTweets())
+}
+
+// LookupTweets looks tweets up through the wrapped API unless a failure is
+// due.
+func (a *FaultyTwitterAPI) LookupTweets(ids []uint64) ([]*Tweet, error) {
+	if a.takeFault(&a.LookupFailures) {
+		return nil, ErrInjectedFault
+	}
+	return a.API.LookupTweets(ids)
+}
+
+// PostReply posts a reply through the wrapped API unless a failure or
+// timeout is due.
+func (a *FaultyTwitterAPI) PostReply(inReplyToID uint64, message string) (*Tweet, error) {
+	return a.post(func() (*Tweet, error) {
+		return a.API.PostReply(inReplyToID, message)
+	})
+}
+
+// PostTweet posts a tweet through the wrapped API unless a failure or
+// timeout is due.
+func (a *FaultyTwitterAPI) PostTweet(message string) (*Tweet, error) {
+	return a.post(func() (*Tweet, error) {
+		return a.API.PostTweet(message)
+	})
+}
+
+// ReadMarker reads the marker from the wrapped API.
+func (a *FaultyTwitterAPI) ReadMarker() (*Marker, error) {
+	return a.API.ReadMarker()
+}
+
+// SearchIntervals searches through the wrapped API with faults injected. If
+// the wrapped API isn't a TweetSearcher, the iterator fails, so Update falls
+// back to the timeline.
+func (a *FaultyTwitterAPI) SearchIntervals() TweetIterator {
+	searcher, ok := a.API.(TweetSearcher)
+	if !ok {
+		return &faultyTweetIterator{err: errors.New("Wrapped API doesn't support search")}
+	}
+	it := a.newIterator(searcher.SearchIntervals())
+
+	a.mu.Lock()
+	it.unindexed = a.UnindexedIntervals
+	a.mu.Unlock()
+
+	return it
+}
+
+// WriteMarker writes the marker through the wrapped API unless a failure is
+// due.
+func (a *FaultyTwitterAPI) WriteMarker(marker *Marker) error {
+	if a.takeFault(&a.MarkerFailures) {
+		return ErrInjectedFault
+	}
+	return a.API.WriteMarker(marker)
+}
+
+func (a *FaultyTwitterAPI) newIterator(it TweetIterator) *faultyTweetIterator {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	pageSize := a.PageSize
+	if pageSize == 0 {
+		pageSize = DefaultFaultPageSize
+	}
+
+	return &faultyTweetIterator{
+		duplicate: a.DuplicateTweets,
+		errPage:   a.ListErrPage,
+		it:        it,
+		limit:     a.TruncateHistory,
+		pageSize:  pageSize,
+		position:  -1,
+		reorder:   a.ReorderTweets,
+	}
+}
+
+func (a *FaultyTwitterAPI) post(post func() (*Tweet, error)) (*Tweet, error) {
+	if a.takeFault(&a.PostFailures) {
+		return nil, ErrInjectedFault
+	}
+
+	tweet, err := post()
+	if err != nil {
+		return nil, err
+	}
+
+	if a.takeFault(&a.PostTimeouts) {
+		return nil, ErrInjectedTimeout
+	}
+
+	return tweet, nil
+}
+
+// takeFault uses up one of a count of faults, returning true if there was
+// one left.
+func (a *FaultyTwitterAPI) takeFault(count *int) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if *count <= 0 {
+		return false
+	}
+	*count--
+	return true
+}
+
+// faultyTweetIterator reads a wrapped iterator a page at a time, applying
+// faults to each page.
+type faultyTweetIterator struct {
+	duplicate bool
+	err       error
+	errPage   int
+	it        TweetIterator
+	limit     int
+	page      []*Tweet
+	pageNum   int
+	pageSize  int
+	position  int
+	reorder   bool
+	unindexed int
+
+	// The number of tweets read from the wrapped iterator.
+	numRead int
+}
+
+func (it *faultyTweetIterator) Err() error {
+	return it.err
+}
+
+func (it *faultyTweetIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	if it.position != -1 && it.position < len(it.page)-1 {
+		it.position++
+		return true
+	}
+
+	if !it.nextPage() {
+		return false
+	}
+
+	it.position = 0
+	return true
+}
+
+func (it *faultyTweetIterator) Value() *Tweet {
+	if it.position == -1 {
+		panic("Must call Next on iterator before a call to Value is allowed")
+	}
+
+	return it.page[it.position]
+}
+
+// nextPage reads the next page from the wrapped iterator, returning false if
+// there isn't one or it failed.
+func (it *faultyTweetIterator) nextPage() bool {
+	it.pageNum++
+	if it.errPage != 0 && it.pageNum >= it.errPage {
+		it.err = ErrInjectedFault
+		return false
+	}
+
+	var page []*Tweet
+	for len(page) < it.pageSize && (it.limit == 0 || it.numRead < it.limit) {
+		if !it.it.Next() {
+			break
+		}
+		it.numRead++
+
+		if _, ok := extractIntervalID(it.it.Value().Message); ok && it.unindexed > 0 {
+			it.unindexed--
+			continue
+		}
+		page = append(page, it.it.Value())
+	}
+
+	if it.it.Err() != nil {
+		it.err = it.it.Err()
+		return false
+	}
+
+	if len(page) == 0 {
+		return false
+	}
+
+	if it.reorder {
+		for i, j := 0, len(page)-1; i < j; i, j = i+1, j-1 {
+			page[i], page[j] = page[j], page[i]
+		}
+	}
+
+	if it.duplicate {
+		var duplicated []*Tweet
+		for _, tweet := range page {
+			duplicated = append(duplicated, tweet, tweet)
+		}
+		page = duplicated
+	}
+
+	it.page = page
+	return true
+}
@@ -0,0 +1,187 @@
+package updater
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+// maxFaultyRuns is how many times a test runs Update against a faulty API
+// before expecting it to have caught up.
+const maxFaultyRuns = 20
+
+func TestFaultyTwitterAPI_ListTweets(t *testing.T) {
+	var tweets []*Tweet
+	for i := 1; i <= 5; i++ {
+		tweets = append(tweets, &Tweet{ID: uint64(i)})
+	}
+
+	listIDs := func(api *FaultyTwitterAPI) ([]uint64, error) {
+		var ids []uint64
+		it := api.ListTweets()
+		for it.Next() {
+			ids = append(ids, it.Value().ID)
+		}
+		return ids, it.Err()
+	}
+
+	api := &FaultyTwitterAPI{API: &mockTwitterAPI{tweets: tweets}, PageSize: 2}
+
+	ids, err := listIDs(api)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5}, ids)
+
+	api.ReorderTweets = true
+	ids, err = listIDs(api)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{2, 1, 4, 3, 5}, ids)
+
+	api.DuplicateTweets = true
+	api.ReorderTweets = false
+	api.TruncateHistory = 3
+	ids, err = listIDs(api)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 1, 2, 2, 3, 3}, ids)
+
+	api.DuplicateTweets = false
+	api.ListErrPage = 2
+	api.TruncateHistory = 0
+	ids, err = listIDs(api)
+	assert.Equal(t, ErrInjectedFault, err)
+	assert.Equal(t, []uint64{1, 2}, ids)
+
+	// The wrapped API doesn't support search
+	it := api.SearchIntervals()
+	assert.False(t, it.Next())
+	assert.Error(t, it.Err())
+}
+
+func TestFaultyTwitterAPI_Posts(t *testing.T) {
+	mock := &mockTwitterAPI{}
+	api := &FaultyTwitterAPI{API: mock, PostFailures: 1, PostTimeouts: 1}
+
+	_, err := api.PostTweet("a")
+	assert.Equal(t, ErrInjectedFault, err)
+	assert.Equal(t, 0, len(mock.posted))
+
+	// Times out, but posts anyway
+	_, err = api.PostTweet("b")
+	assert.Equal(t, ErrInjectedTimeout, err)
+	assert.Equal(t, 1, len(mock.posted))
+
+	tweet, err := api.PostTweet("c")
+	assert.NoError(t, err)
+	assert.Equal(t, "c", tweet.Message)
+	assert.Equal(t, 2, len(mock.posted))
+}
+
+// Update never double-posts or skips an interval while faults come and go,
+// as long as it's run again until it succeeds.
+func TestUpdate_Faults(t *testing.T) {
+	testCases := []struct {
+		name   string
+		faults *FaultyTwitterAPI
+		opts   UpdateOptions
+	}{
+		{"ListErrPage", &FaultyTwitterAPI{ListErrPage: 1}, UpdateOptions{}},
+		{"ListErrPageWithState", &FaultyTwitterAPI{ListErrPage: 1},
+			UpdateOptions{StateStore: &mockStateStore{}}},
+		{"DuplicateTweets", &FaultyTwitterAPI{DuplicateTweets: true}, UpdateOptions{}},
+		{"PostFailures", &FaultyTwitterAPI{PostFailures: 3}, UpdateOptions{}},
+		{"PostTimeouts", &FaultyTwitterAPI{PostTimeouts: 3}, UpdateOptions{}},
+		{"PostTimeoutsWithMarker", &FaultyTwitterAPI{PostTimeouts: 3},
+			UpdateOptions{UseMarker: true}},
+		{"PostTimeoutsWithState", &FaultyTwitterAPI{PostTimeouts: 3},
+			UpdateOptions{StateStore: &mockStateStore{}}},
+		{"LookupFailures", &FaultyTwitterAPI{LookupFailures: 3},
+			UpdateOptions{StateStore: &mockStateStore{}}},
+		{"MarkerFailures", &FaultyTwitterAPI{MarkerFailures: 3},
+			UpdateOptions{UseMarker: true}},
+
+		// Update assumes a newest first timeline, so reordering is only
+		// survivable when the ledger is trusted over the timeline
+		{"ReorderTweetsWithState", &FaultyTwitterAPI{PageSize: 2, ReorderTweets: true},
+			UpdateOptions{StateStore: &mockStateStore{}}},
+
+		// Search finds an older interval than the newest one, which has to be
+		// caught against the timeline
+		{"UnindexedIntervalsWithSearch", &FaultyTwitterAPI{UnindexedIntervals: 1},
+			UpdateOptions{Discovery: DiscoverySearch}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			var intervals []*Interval
+			for i := 0; i < 5; i++ {
+				intervals = append(intervals, &Interval{
+					Target:  now.Add(time.Duration(i-5) * time.Hour),
+					Message: fmt.Sprintf("Interval %03d", i),
+				})
+			}
+
+			mock := &syncTwitterAPI{}
+			api := tc.faults
+			api.API = mock
+
+			opts := tc.opts
+			opts.Logger = DiscardLogger
+
+			// Faults that stick around are cleared after a few runs
+			var numRuns int
+			for ; numRuns < maxFaultyRuns; numRuns++ {
+				if numRuns == 3 {
+					api.ListErrPage = 0
+				}
+
+				result, err := Update(api, intervals, now, &opts)
+				if err == nil && result.NextIntervalID == -1 {
+					break
+				}
+			}
+			assert.True(t, numRuns < maxFaultyRuns, "Never caught up")
+
+			var posted []int
+			for _, tweet := range mock.api.posted {
+				id, ok := extractIntervalID(tweet.Message)
+				assert.True(t, ok)
+				posted = append(posted, id)
+			}
+			assert.Equal(t, []int{0, 1, 2, 3, 4}, posted)
+		})
+	}
+}
+
+func TestUpdate_FaultsTruncateHistory(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-2 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 001"},
+	}
+
+	mock := &syncTwitterAPI{}
+	mock.api.tweets = []*Tweet{
+		{CreatedAt: now, ID: 4, Message: "tweet"},
+		{CreatedAt: now, ID: 3, Message: "tweet"},
+		{CreatedAt: now.Add(-90 * time.Minute), ID: 2, Message: "LHI000 Interval 000"},
+	}
+
+	// The posted interval is out of reach, so posting would start the series
+	// over. Refuse instead.
+	api := &FaultyTwitterAPI{API: mock, TruncateHistory: 2}
+	_, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger})
+	assert.IsType(t, &AmbiguousHistoryError{}, err)
+	assert.Equal(t, 0, len(mock.api.posted))
+
+	// The ledger knows better than the timeline
+	store := &mockStateStore{state: &State{Posts: []*PostRecord{
+		{IntervalID: 0, Status: PostStatusPosted, TweetID: 2},
+	}}}
+	mock.api.posted = []*Tweet{mock.api.tweets[2]}
+	result, err := Update(api, intervals, now,
+		&UpdateOptions{Logger: DiscardLogger, StateStore: store})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.PostedIntervalID)
+}
@@ -0,0 +1,190 @@
+package updater
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxHeartbeatSaveAttempts is how many times recording a heartbeat is tried
+// when it loses a race with another writer.
+const maxHeartbeatSaveAttempts = 3
+
+// Heartbeat records the last run of Update that succeeded, whether or not it
+// posted anything. A dead man's switch (see CheckDeadManSwitch) watches it
+// so that runs stopping altogether doesn't go unnoticed.
+type Heartbeat struct {
+	// At is when the run happened.
+	At time.Time `json:"at"`
+
+	// RunID is the ID of the run (see LogKeyRunID).
+	RunID string `json:"run_id"`
+}
+
+// DeadManOptions configures CheckDeadManSwitch. Each check is skipped if
+// its threshold is zero.
+type DeadManOptions struct {
+	// MaxOverdue is how long the next interval can be past its target
+	// without having been posted before alerting.
+	MaxOverdue time.Duration
+
+	// MaxSilence is how long there can be no successful run before
+	// alerting.
+	MaxSilence time.Duration
+
+	// Notifier is sent alerts. If nil, they're only returned.
+	Notifier Notifier
+
+	// Series is the name of the account being checked, which is included in
+	// alerts.
+	Series string
+}
+
+// The kinds of notification sent by CheckDeadManSwitch.
+const (
+	// NotificationOverdue means that the next interval is past its target by
+	// more than DeadManOptions.MaxOverdue.
+	NotificationOverdue NotificationKind = "overdue"
+
+	// NotificationSilence means that there's been no successful run for
+	// longer than DeadManOptions.MaxSilence.
+	NotificationSilence NotificationKind = "silence"
+)
+
+// CheckDeadManSwitch checks the heartbeat and the ledger in a state store for
+// signs that runs have stopped: no successful run for too long, or the next
+// interval overdue by too long. It's meant to be run on a schedule that's
+// independent of the one that runs Update, so that it keeps running when
+// that one stops.
+//
+// Alerts are sent to the notifier and returned. Failing to load state is
+// itself alerted on, because a store that can't be read means runs can't
+// succeed either.
+func CheckDeadManSwitch(store StateStore, intervals []*Interval, now time.Time,
+	opts *DeadManOptions) ([]*Notification, error) {
+
+	if opts == nil {
+		opts = &DeadManOptions{}
+	}
+
+	var alerts []*Notification
+	alert := func(kind NotificationKind, intervalID int, subject, message string) *Notification {
+		if opts.Series != "" {
+			subject = "@" + opts.Series + ": " + subject
+		}
+
+		n := &Notification{
+			IntervalID: intervalID,
+			Kind:       kind,
+			Message:    message,
+			Series:     opts.Series,
+			Subject:    subject,
+			Time:       now,
+		}
+		alerts = append(alerts, n)
+		return n
+	}
+
+	state, loadErr := store.LoadState()
+	if loadErr != nil {
+		n := alert(NotificationError, -1, "Dead man's switch can't read state",
+			fmt.Sprintf("Error loading state: %v", loadErr))
+		n.Cause = errorCause(loadErr)
+	} else {
+		checkHeartbeat(state, intervals, now, opts, alert)
+	}
+
+	var notifyErr error
+	if opts.Notifier != nil {
+		for _, n := range alerts {
+			err := opts.Notifier.Notify(n)
+			if err != nil && notifyErr == nil {
+				notifyErr = err
+			}
+		}
+	}
+
+	if loadErr != nil {
+		return alerts, fmt.Errorf("Error loading state: %v", loadErr)
+	}
+	return alerts, notifyErr
+}
+
+//
+// Private
+//
+
+// checkHeartbeat applies the checks of CheckDeadManSwitch to state.
+func checkHeartbeat(state *State, intervals []*Interval, now time.Time, opts *DeadManOptions,
+	alert func(kind NotificationKind, intervalID int, subject, message string) *Notification) {
+
+	if opts.MaxSilence > 0 {
+		switch {
+		case state.Heartbeat == nil:
+			alert(NotificationSilence, -1, "No successful run recorded",
+				"No run has ever recorded a heartbeat. Check that the function is "+
+					"being invoked and is configured with the same state ledger.")
+
+		case now.Sub(state.Heartbeat.At) > opts.MaxSilence:
+			alert(NotificationSilence, -1, "No successful run recently",
+				fmt.Sprintf("The last successful run was %v at %v (run %s). Check that "+
+					"the function is still being invoked and look at its logs.",
+					now.Sub(state.Heartbeat.At).Round(time.Minute),
+					state.Heartbeat.At.Format(time.RFC3339), state.Heartbeat.RunID))
+		}
+	}
+
+	if opts.MaxOverdue > 0 {
+		next, pending := unpostedInterval(state)
+		if next < len(intervals) && now.Sub(intervals[next].Target) > opts.MaxOverdue {
+			message := fmt.Sprintf("LHI%03d was due at %v and hasn't been posted after %v.",
+				next, intervals[next].Target.Format(time.RFC3339),
+				now.Sub(intervals[next].Target).Round(time.Minute))
+			if pending {
+				message += " A post of it is pending in the ledger, but it's not " +
+					"known whether it went out."
+			}
+
+			alert(NotificationOverdue, next, fmt.Sprintf("LHI%03d is overdue", next), message)
+		}
+	}
+}
+
+// unpostedInterval gets the earliest interval that isn't known to have been
+// posted: one whose post is still pending if there is one, since that's the
+// interval that's actually stuck, and otherwise the next one. pending is true
+// in the former case.
+func unpostedInterval(state *State) (id int, pending bool) {
+	id = -1
+	for _, record := range state.Posts {
+		if record.Status == PostStatusPending && (id == -1 || record.IntervalID < id) {
+			id = record.IntervalID
+		}
+	}
+
+	if id == -1 {
+		return state.Next(), false
+	}
+	return id, true
+}
+
+// recordHeartbeat saves a heartbeat for a successful run in state.
+func recordHeartbeat(store StateStore, runID string, now time.Time) error {
+	var err error
+
+	for attempt := 0; attempt < maxHeartbeatSaveAttempts; attempt++ {
+		var state *State
+		state, err = store.LoadState()
+		if err != nil {
+			return err
+		}
+
+		state.Heartbeat = &Heartbeat{At: now, RunID: runID}
+
+		err = store.SaveState(state)
+		if err != ErrStateConflict {
+			return err
+		}
+	}
+
+	return err
+}
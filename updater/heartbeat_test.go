@@ -0,0 +1,134 @@
+package updater
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+//
+// Failing state store
+//
+
+type failingStateStore struct {
+	err error
+}
+
+func (s *failingStateStore) LoadState() (*State, error) {
+	return nil, s.err
+}
+
+func (s *failingStateStore) SaveState(state *State) error {
+	return s.err
+}
+
+//
+// Tests
+//
+
+func TestCheckDeadManSwitch(t *testing.T) {
+	now := time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)
+	intervals := []*Interval{
+		{Target: now.Add(-72 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(-48 * time.Hour), Message: "Interval 001"},
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 002"},
+		{Target: now.Add(24 * time.Hour), Message: "Interval 003"},
+	}
+	opts := &DeadManOptions{MaxOverdue: 6 * time.Hour, MaxSilence: 2 * time.Hour,
+		Series: "perpetual_test"}
+
+	store := &mockStateStore{state: &State{
+		Heartbeat: &Heartbeat{At: now.Add(-30 * time.Minute), RunID: "abc"},
+		Posts: []*PostRecord{
+			{IntervalID: 0, Status: PostStatusPosted, TweetID: 1},
+			{IntervalID: 1, Status: PostStatusPosted, TweetID: 2},
+		},
+	}}
+
+	// Healthy: a recent run, and the next interval is only a little late
+	alerts, err := CheckDeadManSwitch(store, intervals, now, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(alerts))
+
+	// Runs have stopped and the next interval is overdue
+	notifier := &mockNotifier{}
+	opts.Notifier = notifier
+	alerts, err = CheckDeadManSwitch(store, intervals, now.Add(12*time.Hour), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []NotificationKind{NotificationSilence, NotificationOverdue},
+		notifier.kinds())
+	assert.Equal(t, notifier.notifications, alerts)
+	assert.Equal(t, "@perpetual_test: LHI002 is overdue", alerts[1].Subject)
+	assert.Equal(t, 2, alerts[1].IntervalID)
+	assert.Equal(t, "The last successful run was 12h30m0s at 2018-06-30T23:30:00Z "+
+		"(run abc). Check that the function is still being invoked and look at its logs.",
+		alerts[0].Message)
+
+	// An interval stuck pending is what's overdue, not the one after it
+	{
+		store := &mockStateStore{state: &State{Posts: []*PostRecord{
+			{IntervalID: 0, Status: PostStatusPosted, TweetID: 1},
+			{IntervalID: 1, Status: PostStatusPending},
+		}}}
+		alerts, err := CheckDeadManSwitch(store, intervals, now.Add(12*time.Hour),
+			&DeadManOptions{MaxOverdue: 6 * time.Hour})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(alerts))
+		assert.Equal(t, 1, alerts[0].IntervalID)
+		assert.Contains(t, alerts[0].Message, "A post of it is pending")
+	}
+
+	// Intervals skipped ahead of time aren't overdue
+	store.state.Posts = append(store.state.Posts,
+		&PostRecord{IntervalID: 2, Status: PostStatusSkipped})
+	alerts, err = CheckDeadManSwitch(store, intervals, now.Add(12*time.Hour),
+		&DeadManOptions{MaxOverdue: 6 * time.Hour})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(alerts))
+
+	// Nothing has ever run
+	alerts, err = CheckDeadManSwitch(&mockStateStore{}, intervals, now,
+		&DeadManOptions{MaxSilence: time.Hour})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(alerts))
+	assert.Equal(t, "No successful run recorded", alerts[0].Subject)
+
+	// State can't be read
+	notifier.notifications = nil
+	alerts, err = CheckDeadManSwitch(&failingStateStore{err: errors.New("boom")},
+		intervals, now, opts)
+	assert.EqualError(t, err, "Error loading state: boom")
+	assert.Equal(t, []NotificationKind{NotificationError}, notifier.kinds())
+	assert.Equal(t, alerts, notifier.notifications)
+}
+
+func TestUpdate_Heartbeat(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{{Target: now.Add(time.Hour), Message: "Interval 000"}}
+	store := &mockStateStore{}
+
+	// A run that succeeds records one, even if it posts nothing
+	_, err := Update(&mockTwitterAPI{}, intervals, now,
+		&UpdateOptions{Logger: DiscardLogger, RunID: "abc", StateStore: store})
+	assert.NoError(t, err)
+	assert.Equal(t, &Heartbeat{At: now, RunID: "abc"}, store.state.Heartbeat)
+
+	// A run that fails doesn't
+	_, err = Update(&mockTwitterAPI{}, intervals, now.Add(time.Hour),
+		&UpdateOptions{Discovery: "bogus", Logger: DiscardLogger, RunID: "def",
+			StateStore: store})
+	assert.Error(t, err)
+	assert.Equal(t, "abc", store.state.Heartbeat.RunID)
+
+	// Notifications are de-duplicated across checks by what they're about
+	// rather than their changing messages
+	dedup := &DedupNotifier{Notifier: &mockNotifier{}, Store: store}
+	for i := 0; i < 2; i++ {
+		_, err = CheckDeadManSwitch(store, intervals, now.Add(time.Duration(i+2)*time.Hour),
+			&DeadManOptions{MaxSilence: time.Hour, Notifier: dedup})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, len(dedup.Notifier.(*mockNotifier).notifications))
+}
@@ -9,9 +9,31 @@ const timeLayout = "Jan 2 15:04:00 MST 2006"
 // Interval is a threshold in time that we're measuring across. This program wakes
 // up and posts the message of one after it crosses the target time.
 type Interval struct {
-	// Message is the content to tweet for this interval.
+	// Message is the content to tweet for this interval. It should be left
+	// empty if Sealed is set instead.
 	Message string
 
+	// Proof is an encoded proof that this interval's message is included in
+	// the commitment published with the base interval. It's threaded under
+	// the interval's post along with Salt. See CommitIntervals.
+	Proof string
+
+	// Salt is the encoded salt that was mixed into this interval's leaf of
+	// the commitment. Intervals without a salt (or a sealed salt) aren't
+	// committed to.
+	Salt string
+
+	// Sealed is the content to tweet for this interval encrypted with
+	// SealMessage. It's used instead of Message so that the message can't be
+	// read until the interval is posted. See UpdateOptions.MessageKey.
+	Sealed string
+
+	// SealedSalt is Salt sealed with SealMessage, and is used instead of it
+	// for sealed intervals. A salt in the clear next to a sealed message would
+	// let anyone check guesses at the message against the published
+	// commitment root.
+	SealedSalt string
+
 	// Target is the target time for the interval to be posted. This is measured
 	// directly as a time instead of a duration (which would be easier for
 	// testing/readability) to avoid problems with timezones, leap years, etc.
@@ -0,0 +1,294 @@
+package updater
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// DefaultLeaseTTL is how long a lease lasts if UpdateOptions.LeaseTTL isn't
+// set. It's the longest that a Lambda function can run for, so a lease can't
+// expire while the invocation holding it is still running.
+const DefaultLeaseTTL = 15 * time.Minute
+
+// ErrStaleFencingToken is returned when saving state under a lease that's
+// older than the one that state was last saved under, which means that the
+// lease expired and someone else acquired the lock.
+var ErrStaleFencingToken = errors.New("State was saved under a newer lease; ours has expired")
+
+// ErrStateConflict is returned when saving state that was modified by
+// someone else since it was loaded.
+var ErrStateConflict = errors.New("State was modified concurrently")
+
+// Lease is a lock held by one invocation of Update. Its token is greater
+// than that of every lease issued before it, and is written alongside state
+// as a fencing token so that an invocation whose lease expired can't
+// clobber the work of the one that took over from it.
+type Lease struct {
+	// Expires is when the lease expires if it's not released first.
+	Expires time.Time `json:"expires"`
+
+	// Holder identifies who holds the lease.
+	Holder string `json:"holder"`
+
+	// Token is the lease's fencing token.
+	Token uint64 `json:"token"`
+}
+
+// Locker is a lock that's held around the part of Update that decides
+// whether to post and then posts, so that overlapping invocations can't both
+// post the same interval.
+type Locker interface {
+	// Acquire takes the lock for ttl. If someone else holds an unexpired
+	// lease, a *LockHeldError is returned.
+	Acquire(holder string, ttl time.Duration) (*Lease, error)
+
+	// Release gives up a lease before it expires.
+	Release(lease *Lease) error
+}
+
+// LockHeldError is returned from Locker.Acquire when someone else holds the
+// lock.
+type LockHeldError struct {
+	// Lease is the lease that's held.
+	Lease *Lease
+}
+
+func (e *LockHeldError) Error() string {
+	return fmt.Sprintf("Lock is held by %s until %v; another invocation is probably running",
+		e.Lease.Holder, e.Lease.Expires.Format(time.RFC3339))
+}
+
+//
+// File locker
+//
+
+// FileLocker is a Locker that keeps its lease in a local file. It only
+// protects against overlapping invocations on the same machine.
+type FileLocker struct {
+	// Path is the location of the lease file. It's created if it doesn't
+	// exist.
+	Path string
+}
+
+// Acquire takes the lock.
+func (l *FileLocker) Acquire(holder string, ttl time.Duration) (*Lease, error) {
+	var lease *Lease
+
+	err := withFileLock(l.Path, func(f *os.File) error {
+		existing, err := readLease(f)
+		if err != nil {
+			return err
+		}
+
+		lease, err = nextLease(existing, holder, ttl)
+		if err != nil {
+			return err
+		}
+
+		return writeLease(f, lease)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+// Release gives up a lease. The lease file is kept so that the next lease's
+// token is greater than this one's.
+func (l *FileLocker) Release(lease *Lease) error {
+	return withFileLock(l.Path, func(f *os.File) error {
+		existing, err := readLease(f)
+		if err != nil {
+			return err
+		}
+
+		if existing == nil || existing.Token != lease.Token {
+			return nil
+		}
+
+		return writeLease(f, &Lease{Holder: lease.Holder, Token: lease.Token})
+	})
+}
+
+//
+// State locker
+//
+
+// StateLocker is a Locker that keeps its lease in state, relying on the
+// store's compare-and-swap to make sure that only one invocation can acquire
+// it. It protects against overlapping invocations anywhere that share the
+// same store.
+type StateLocker struct {
+	// Store is the store that the lease is kept in.
+	Store StateStore
+}
+
+// Acquire takes the lock. Losing a race with another invocation that's
+// acquiring it at the same time is reported as a *LockHeldError.
+func (l *StateLocker) Acquire(holder string, ttl time.Duration) (*Lease, error) {
+	state, err := l.Store.LoadState()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading state: %v", err)
+	}
+
+	// State may have been saved under a newer lease from some other locker
+	existing := state.Lease
+	if existing == nil || existing.Token < state.FencingToken {
+		existing = &Lease{Token: state.FencingToken}
+	}
+
+	lease, err := nextLease(existing, holder, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	state.Lease = lease
+
+	err = l.Store.SaveState(state)
+	if err == ErrStateConflict {
+		reloaded, loadErr := l.Store.LoadState()
+		if loadErr == nil && reloaded.Lease != nil {
+			return nil, &LockHeldError{Lease: reloaded.Lease}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error saving lease: %v", err)
+	}
+
+	return lease, nil
+}
+
+// Release gives up a lease.
+func (l *StateLocker) Release(lease *Lease) error {
+	state, err := l.Store.LoadState()
+	if err != nil {
+		return fmt.Errorf("Error loading state: %v", err)
+	}
+
+	if state.Lease == nil || state.Lease.Token != lease.Token {
+		return nil
+	}
+
+	state.Lease = &Lease{Holder: lease.Holder, Token: lease.Token}
+	return l.Store.SaveState(state)
+}
+
+//
+// Private
+//
+
+// checkStateSave checks that state can be saved over current, returning
+// ErrStateConflict if current isn't the version that state was loaded from,
+// and ErrStaleFencingToken if current was saved under a newer lease. It's
+// shared by state stores' implementations of compare-and-swap.
+func checkStateSave(current, state *State) error {
+	if current.Version != state.Version {
+		return ErrStateConflict
+	}
+
+	if current.FencingToken > state.FencingToken {
+		return ErrStaleFencingToken
+	}
+
+	return nil
+}
+
+// newLockHolder generates an identifier for an invocation of Update that's
+// unique enough to tell invocations apart in a lease.
+func newLockHolder() string {
+	hostname, _ := os.Hostname()
+
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		// Only used to tell holders apart in messages, so do without
+		return fmt.Sprintf("%s/%v", hostname, os.Getpid())
+	}
+
+	return fmt.Sprintf("%s/%v/%s", hostname, os.Getpid(), hex.EncodeToString(b))
+}
+
+// nextLease issues a lease that replaces existing (which may be nil), as
+// long as existing has expired or belongs to the same holder.
+func nextLease(existing *Lease, holder string, ttl time.Duration) (*Lease, error) {
+	now := time.Now()
+
+	var token uint64
+	if existing != nil {
+		if existing.Holder != holder && existing.Expires.After(now) {
+			return nil, &LockHeldError{Lease: existing}
+		}
+		token = existing.Token
+	}
+
+	return &Lease{Expires: now.Add(ttl), Holder: holder, Token: token + 1}, nil
+}
+
+func readLease(f *os.File) (*Lease, error) {
+	_, err := f.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var lease Lease
+	err = json.Unmarshal(data, &lease)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding lease %v: %v", f.Name(), err)
+	}
+
+	return &lease, nil
+}
+
+// withFileLock runs fn while holding an exclusive lock on the file at path,
+// which is created if it doesn't exist. The lock is released when fn
+// returns.
+func withFileLock(path string, fn func(f *os.File) error) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = lockFile(f)
+	if err != nil {
+		return fmt.Errorf("Error locking %v: %v", path, err)
+	}
+	defer unlockFile(f)
+
+	return fn(f)
+}
+
+func writeLease(f *os.File, lease *Lease) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(data, 0)
+	if err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
@@ -0,0 +1,228 @@
+package updater
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+//
+// Synchronized mock API
+//
+
+// syncTwitterAPI wraps mockTwitterAPI so that it can be used from multiple
+// goroutines. Posted tweets show up in its timeline so that an invocation
+// that runs after another has posted can see what it posted.
+type syncTwitterAPI struct {
+	mu  sync.Mutex
+	api mockTwitterAPI
+}
+
+func (a *syncTwitterAPI) DeleteTweet(id uint64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.api.DeleteTweet(id)
+}
+
+func (a *syncTwitterAPI) ListTweets() TweetIterator {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	tweets := append([]*Tweet(nil), a.api.tweets...)
+	return &mockTweetIterator{tweets: tweets, position: -1}
+}
+
+func (a *syncTwitterAPI) LookupTweets(ids []uint64) ([]*Tweet, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.api.LookupTweets(ids)
+}
+
+func (a *syncTwitterAPI) PostReply(inReplyToID uint64, message string) (*Tweet, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.api.PostReply(inReplyToID, message)
+}
+
+func (a *syncTwitterAPI) PostTweet(message string) (*Tweet, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	tweet, err := a.api.PostTweet(message)
+	if err != nil {
+		return nil, err
+	}
+	a.api.tweets = append([]*Tweet{tweet}, a.api.tweets...)
+	return tweet, nil
+}
+
+func (a *syncTwitterAPI) ReadMarker() (*Marker, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.api.ReadMarker()
+}
+
+// SearchIntervals "searches" by listing the whole timeline, so that search
+// is as complete as it could ever be.
+func (a *syncTwitterAPI) SearchIntervals() TweetIterator {
+	return a.ListTweets()
+}
+
+func (a *syncTwitterAPI) WriteMarker(marker *Marker) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.api.WriteMarker(marker)
+}
+
+//
+// Tests
+//
+
+func TestFileLocker(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	testLocker(t, &FileLocker{Path: filepath.Join(dir, "lease.json")})
+}
+
+func TestStateLocker(t *testing.T) {
+	store := &mockStateStore{}
+	testLocker(t, &StateLocker{Store: store})
+
+	// The lease is kept alongside state, and the fencing token of state saved
+	// under a lease is respected even if the lease itself is gone
+	state, err := store.LoadState()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), state.Lease.Token)
+
+	state.FencingToken = 10
+	state.Lease = nil
+	assert.NoError(t, store.SaveState(state))
+
+	lease, err := (&StateLocker{Store: store}).Acquire("a", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(11), lease.Token)
+}
+
+func TestUpdate_Concurrent(t *testing.T) {
+	t.Run("FileLocker", func(t *testing.T) {
+		dir := mustTempDir(t)
+		defer os.RemoveAll(dir)
+
+		testUpdateConcurrently(t, &UpdateOptions{
+			Locker: &FileLocker{Path: filepath.Join(dir, "lease.json")},
+			Logger: DiscardLogger,
+		})
+	})
+
+	t.Run("StateLocker", func(t *testing.T) {
+		store := &mockStateStore{}
+		testUpdateConcurrently(t, &UpdateOptions{
+			Locker:     &StateLocker{Store: store},
+			Logger:     DiscardLogger,
+			StateStore: store,
+		})
+
+		state, err := store.LoadState()
+		assert.NoError(t, err)
+		assert.Equal(t, PostStatusPosted, state.Last().Status)
+		assert.NotEqual(t, uint64(0), state.FencingToken)
+	})
+
+	t.Run("FileStateStore", func(t *testing.T) {
+		dir := mustTempDir(t)
+		defer os.RemoveAll(dir)
+
+		store := &FileStateStore{Path: filepath.Join(dir, "state.json")}
+		testUpdateConcurrently(t, &UpdateOptions{
+			Locker:     &StateLocker{Store: store},
+			Logger:     DiscardLogger,
+			StateStore: store,
+		})
+	})
+}
+
+func TestUpdate_StaleLease(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 000"},
+	}
+
+	api := &mockTwitterAPI{}
+	store := &mockStateStore{}
+	locker := &FileLocker{}
+
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+	locker.Path = filepath.Join(dir, "lease.json")
+
+	// State was saved under a lease from a different locker with a newer
+	// token, so ours must have been superseded
+	store.state = &State{FencingToken: 5}
+
+	_, err := Update(api, intervals, now, &UpdateOptions{Locker: locker, Logger: DiscardLogger, StateStore: store})
+	assert.Equal(t, "State was saved under a newer lease; ours has expired", err.Error())
+	assert.Equal(t, 0, len(api.posted))
+}
+
+//
+// Private
+//
+
+// testLocker runs the tests common to every Locker.
+func testLocker(t *testing.T, locker Locker) {
+	lease, err := locker.Acquire("a", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", lease.Holder)
+	assert.Equal(t, uint64(1), lease.Token)
+
+	// Held by someone else
+	_, err = locker.Acquire("b", time.Minute)
+	assert.IsType(t, &LockHeldError{}, err)
+
+	// Released
+	assert.NoError(t, locker.Release(lease))
+	lease, err = locker.Acquire("b", -time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), lease.Token)
+
+	// Expired, so it can be taken over. The token keeps increasing so that
+	// "b" can be fenced out.
+	lease, err = locker.Acquire("c", time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), lease.Token)
+
+	// Releasing a lease that's been taken over does nothing
+	assert.NoError(t, locker.Release(&Lease{Holder: "b", Token: 2}))
+	_, err = locker.Acquire("b", time.Minute)
+	assert.IsType(t, &LockHeldError{}, err)
+}
+
+// testUpdateConcurrently hammers Update with overlapping invocations and
+// checks that only one of them posted.
+func testUpdateConcurrently(t *testing.T, opts *UpdateOptions) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(1 * time.Hour), Message: "Interval 001"},
+	}
+
+	api := &syncTwitterAPI{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Losing the race for the lock is expected, so errors are
+			// ignored
+			Update(api, intervals, now, opts)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, len(api.api.posted))
+}
@@ -0,0 +1,17 @@
+package updater
+
+import (
+	"fmt"
+	"os"
+)
+
+// File locking isn't implemented on Windows, which perpetual doesn't run on
+// (it targets Lambda). This is here so that the package still builds.
+
+func lockFile(f *os.File) error {
+	return fmt.Errorf("File locking isn't supported on Windows")
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,351 @@
+package updater
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log line. Its values are the same as those
+// of log/slog's levels.
+type LogLevel int
+
+// The possible log levels.
+const (
+	LogLevelDebug LogLevel = -4
+	LogLevelInfo  LogLevel = 0
+	LogLevelWarn  LogLevel = 4
+	LogLevelError LogLevel = 8
+)
+
+// String returns the level's name as log/slog would print it.
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelWarn:
+		return "WARN"
+	case LogLevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// ParseLogLevel parses a level's name, case insensitively. An empty string is
+// LogLevelInfo.
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToUpper(s) {
+	case "DEBUG":
+		return LogLevelDebug, nil
+	case "", "INFO":
+		return LogLevelInfo, nil
+	case "WARN", "WARNING":
+		return LogLevelWarn, nil
+	case "ERROR":
+		return LogLevelError, nil
+	}
+	return 0, fmt.Errorf("Unknown log level: %q", s)
+}
+
+// The keys of fields that are logged consistently everywhere they apply.
+const (
+	// LogKeyIntervalID is the ID of the interval being worked on.
+	LogKeyIntervalID = "interval_id"
+
+	// LogKeyMaxID is the max_id of a request for a page of tweets.
+	LogKeyMaxID = "max_id"
+
+	// LogKeyPage is the number of a page of tweets, starting from 1.
+	LogKeyPage = "page"
+
+	// LogKeyRunID identifies a single invocation of Update.
+	LogKeyRunID = "run_id"
+
+	// LogKeySeries is the account that an interval series is posted to.
+	LogKeySeries = "series"
+
+	// LogKeyTweetID is the ID of the tweet being worked on.
+	LogKeyTweetID = "tweet_id"
+)
+
+// redactedValue replaces the values of sensitive fields.
+const redactedValue = "[REDACTED]"
+
+// Logger is a leveled, structured logger. Each method takes a message
+// followed by alternating keys and values, like log/slog, whose *slog.Logger
+// satisfies it.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// DiscardLogger is a Logger that logs nothing, for silencing tests.
+var DiscardLogger Logger = &writerLogger{level: LogLevelError + 1, mu: &sync.Mutex{}}
+
+// NewJSONLogger creates a Logger that writes each line as a JSON object with
+// the same "time", "level", and "msg" fields as log/slog's JSON handler. It's
+// meant for Lambda, where logs end up in CloudWatch.
+func NewJSONLogger(w io.Writer, level LogLevel) Logger {
+	return &writerLogger{json: true, level: level, mu: &sync.Mutex{}, w: w}
+}
+
+// NewTextLogger creates a Logger that writes lines meant to be read by a
+// person: the message followed by its fields as key=value, with a prefix on
+// lines that aren't LogLevelInfo.
+func NewTextLogger(w io.Writer, level LogLevel) Logger {
+	return &writerLogger{level: level, mu: &sync.Mutex{}, w: w}
+}
+
+// defaultLogger is used where no Logger was given. It writes text to stdout,
+// which is where output went before there were loggers.
+func defaultLogger() Logger {
+	return NewTextLogger(os.Stdout, LogLevelInfo)
+}
+
+// WithLogAttrs creates a Logger that adds fields to every line logged through
+// it.
+func WithLogAttrs(logger Logger, args ...interface{}) Logger {
+	if l, ok := logger.(*writerLogger); ok {
+		clone := *l
+		clone.attrs = append(append([]interface{}(nil), l.attrs...), args...)
+		return &clone
+	}
+
+	return &attrLogger{attrs: args, logger: logger}
+}
+
+// IsSensitiveLogKey returns true if values logged with key should never
+// appear in logs, like credentials and keys. Loggers created by this package
+// redact them. With log/slog, use it in a ReplaceAttr function.
+func IsSensitiveLogKey(key string) bool {
+	key = strings.ToLower(key)
+
+	for _, s := range []string{"authorization", "credential", "password", "secret"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+
+	// Fencing tokens are safe to log; other tokens aren't
+	if key == "fencing_token" {
+		return false
+	}
+
+	return key == "key" || key == "token" ||
+		strings.HasSuffix(key, "_key") || strings.HasSuffix(key, "_token")
+}
+
+// NewRunID generates an ID for an invocation of Update.
+func NewRunID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		// Only used to correlate log lines, so a weaker ID will do
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+//
+// Private
+//
+
+// attrLogger adds fields to the lines of a Logger that wasn't created by this
+// package, redacting sensitive ones along the way.
+type attrLogger struct {
+	attrs  []interface{}
+	logger Logger
+}
+
+func (l *attrLogger) Debug(msg string, args ...interface{}) {
+	l.logger.Debug(msg, l.args(args)...)
+}
+
+func (l *attrLogger) Info(msg string, args ...interface{}) {
+	l.logger.Info(msg, l.args(args)...)
+}
+
+func (l *attrLogger) Warn(msg string, args ...interface{}) {
+	l.logger.Warn(msg, l.args(args)...)
+}
+
+func (l *attrLogger) Error(msg string, args ...interface{}) {
+	l.logger.Error(msg, l.args(args)...)
+}
+
+func (l *attrLogger) args(args []interface{}) []interface{} {
+	var all []interface{}
+	for _, field := range logFields(append(append([]interface{}(nil), l.attrs...), args...)) {
+		all = append(all, field.key, field.value)
+	}
+	return all
+}
+
+// logField is a single key and value.
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// logFields pairs up alternating keys and values, redacting sensitive values.
+// A value without a key gets the key "!BADKEY", as in log/slog.
+func logFields(args []interface{}) []logField {
+	var fields []logField
+	for i := 0; i < len(args); i++ {
+		key, ok := args[i].(string)
+		if !ok || i == len(args)-1 {
+			fields = append(fields, logField{"!BADKEY", args[i]})
+			continue
+		}
+
+		value := args[i+1]
+		if IsSensitiveLogKey(key) {
+			value = redactedValue
+		}
+
+		fields = append(fields, logField{key, value})
+		i++
+	}
+	return fields
+}
+
+// writerLogger is the Logger implementation behind NewJSONLogger and
+// NewTextLogger.
+type writerLogger struct {
+	attrs []interface{}
+	json  bool
+	level LogLevel
+
+	// Shared between a logger and those derived from it with WithLogAttrs
+	// so that their lines aren't interleaved.
+	mu *sync.Mutex
+
+	w io.Writer
+
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+func (l *writerLogger) Debug(msg string, args ...interface{}) {
+	l.log(LogLevelDebug, msg, args)
+}
+
+func (l *writerLogger) Info(msg string, args ...interface{}) {
+	l.log(LogLevelInfo, msg, args)
+}
+
+func (l *writerLogger) Warn(msg string, args ...interface{}) {
+	l.log(LogLevelWarn, msg, args)
+}
+
+func (l *writerLogger) Error(msg string, args ...interface{}) {
+	l.log(LogLevelError, msg, args)
+}
+
+func (l *writerLogger) log(level LogLevel, msg string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	fields := logFields(append(append([]interface{}(nil), l.attrs...), args...))
+
+	var line string
+	if l.json {
+		now := time.Now
+		if l.now != nil {
+			now = l.now
+		}
+		line = formatJSONLogLine(now(), level, msg, fields)
+	} else {
+		line = formatTextLogLine(level, msg, fields)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, line+"\n")
+}
+
+func formatJSONLogLine(t time.Time, level LogLevel, msg string, fields []logField) string {
+	var sb strings.Builder
+	sb.WriteString(`{"time":`)
+	writeJSONLogValue(&sb, t)
+	sb.WriteString(`,"level":`)
+	writeJSONLogValue(&sb, level.String())
+	sb.WriteString(`,"msg":`)
+	writeJSONLogValue(&sb, msg)
+
+	for _, field := range fields {
+		sb.WriteString(",")
+		writeJSONLogValue(&sb, field.key)
+		sb.WriteString(":")
+		writeJSONLogValue(&sb, field.value)
+	}
+
+	sb.WriteString("}")
+	return sb.String()
+}
+
+func formatTextLogLine(level LogLevel, msg string, fields []logField) string {
+	var sb strings.Builder
+
+	switch level {
+	case LogLevelDebug:
+		sb.WriteString("Debug: ")
+	case LogLevelWarn:
+		sb.WriteString("Warning: ")
+	case LogLevelError:
+		sb.WriteString("Error: ")
+	}
+
+	sb.WriteString(msg)
+
+	for _, field := range fields {
+		value := formatTextLogValue(field.value)
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&sb, " %s=%s", field.key, value)
+	}
+
+	return sb.String()
+}
+
+func formatTextLogValue(v interface{}) string {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
+
+func writeJSONLogValue(sb *strings.Builder, v interface{}) {
+	switch value := v.(type) {
+	case error:
+		v = value.Error()
+	case fmt.Stringer:
+		// Stringers like Marker and ScanStopReason read better as strings
+		// than as their JSON encodings, but times encode well
+		if _, isTime := v.(time.Time); !isTime {
+			v = value.String()
+		}
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	sb.Write(data)
+}
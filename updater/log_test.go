@@ -0,0 +1,153 @@
+package updater
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for _, level := range []LogLevel{LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError} {
+		parsed, err := ParseLogLevel(strings.ToLower(level.String()))
+		assert.NoError(t, err)
+		assert.Equal(t, level, parsed)
+	}
+
+	level, err := ParseLogLevel("")
+	assert.NoError(t, err)
+	assert.Equal(t, LogLevelInfo, level)
+
+	_, err = ParseLogLevel("loud")
+	assert.Equal(t, `Unknown log level: "loud"`, err.Error())
+}
+
+func TestIsSensitiveLogKey(t *testing.T) {
+	for _, key := range []string{"ACCESS_TOKEN_SECRET", "Authorization",
+		"consumer_key", "password", "token"} {
+
+		assert.True(t, IsSensitiveLogKey(key), key)
+	}
+
+	for _, key := range []string{"fencing_token", "interval_id", "max_id", "message",
+		"tweet_id"} {
+
+		assert.False(t, IsSensitiveLogKey(key), key)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf, LogLevelInfo)
+	logger.(*writerLogger).now = func() time.Time {
+		return time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+
+	logger = WithLogAttrs(logger, LogKeyRunID, "abc")
+	logger.Debug("Not logged")
+	logger.Info("Posting tweet", LogKeyIntervalID, 3, "access_token", "hunter2")
+	logger.Error("Failed", "err", errors.New("boom"), "dangling")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, `{"time":"2018-01-02T03:04:05Z","level":"INFO","msg":"Posting tweet",`+
+		`"run_id":"abc","interval_id":3,"access_token":"[REDACTED]"}`, lines[0])
+
+	var fields map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &fields))
+	assert.Equal(t, "ERROR", fields["level"])
+	assert.Equal(t, "boom", fields["err"])
+	assert.Equal(t, "dangling", fields["!BADKEY"])
+}
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewTextLogger(&buf, LogLevelDebug)
+
+	logger.Debug("Requesting page of tweets", LogKeyPage, 2, LogKeyMaxID, 123)
+	logger.Info("Posting tweet", "message", "hello there", "secret", "hunter2")
+	logger.Warn("Marker is stale", "marker", "")
+
+	assert.Equal(t, `Debug: Requesting page of tweets page=2 max_id=123
+Posting tweet message="hello there" secret=[REDACTED]
+Warning: Marker is stale marker=""
+`, buf.String())
+}
+
+func TestWithLogAttrs(t *testing.T) {
+	// Attributes added to a logger from elsewhere (like log/slog) are
+	// passed along with each line, redacted
+	logger := &recordingLogger{}
+	WithLogAttrs(logger, LogKeySeries, "perpetual_test", "api_key", "abc").
+		Warn("Something", LogKeyTweetID, 1)
+
+	assert.Equal(t, []interface{}{LogKeySeries, "perpetual_test", "api_key", redactedValue,
+		LogKeyTweetID, 1}, logger.args)
+	assert.Equal(t, "WARN Something", logger.msg)
+
+	// Attributes don't leak between loggers derived from the same parent
+	var buf bytes.Buffer
+	parent := NewTextLogger(&buf, LogLevelInfo)
+	a := WithLogAttrs(parent, "a", 1)
+	WithLogAttrs(parent, "b", 2)
+	a.Info("Hello")
+	assert.Equal(t, "Hello a=1\n", buf.String())
+}
+
+func TestUpdate_Logs(t *testing.T) {
+	now := time.Now()
+
+	var buf bytes.Buffer
+	_, err := Update(
+		&mockTwitterAPI{},
+		[]*Interval{{Target: now, Message: "Interval 000"}},
+		now,
+		&UpdateOptions{Logger: NewJSONLogger(&buf, LogLevelDebug), RunID: "run-1"},
+	)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.True(t, len(lines) > 0)
+
+	var postedIntervalID bool
+	for _, line := range lines {
+		var fields map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &fields), line)
+		assert.Equal(t, "run-1", fields[LogKeyRunID], line)
+
+		if fields[LogKeyIntervalID] == float64(0) {
+			postedIntervalID = true
+		}
+	}
+	assert.True(t, postedIntervalID)
+}
+
+//
+// Private
+//
+
+// recordingLogger is a Logger that remembers the last line logged to it.
+type recordingLogger struct {
+	args []interface{}
+	msg  string
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) {
+	l.msg, l.args = "DEBUG "+msg, args
+}
+
+func (l *recordingLogger) Info(msg string, args ...interface{}) {
+	l.msg, l.args = "INFO "+msg, args
+}
+
+func (l *recordingLogger) Warn(msg string, args ...interface{}) {
+	l.msg, l.args = "WARN "+msg, args
+}
+
+func (l *recordingLogger) Error(msg string, args ...interface{}) {
+	l.msg, l.args = "ERROR "+msg, args
+}
@@ -0,0 +1,168 @@
+package updater
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxDescriptionLength is the longest that Twitter allows a profile's
+// description to be.
+const maxDescriptionLength = 160
+
+// markerPattern matches a marker embedded in a profile description. A
+// trailing "?" means that the interval's post is pending.
+var markerPattern = regexp.MustCompile(`\bLHI:(\d+)(\?)?`)
+
+// Marker is a record of the last posted interval that's kept in the account
+// itself, so that it survives the loss of any other storage.
+//
+// Before an interval is posted, a pending marker is written for it. Once the
+// post succeeds, the marker is committed. A marker that's still pending was
+// interrupted partway through, and isn't trusted.
+type Marker struct {
+	// IntervalID is the ID of the last posted interval.
+	IntervalID int
+
+	// Pending is true if the interval was about to be posted, but it's not
+	// known whether it was.
+	Pending bool
+}
+
+// String formats the marker as it's embedded in the account, like `LHI:3`
+// or `LHI:4?` for a pending one.
+func (m *Marker) String() string {
+	s := "LHI:" + strconv.Itoa(m.IntervalID)
+	if m.Pending {
+		s += "?"
+	}
+	return s
+}
+
+// ReadMarker gets the marker from the configured account's profile
+// description. It returns nil if there isn't one.
+func (a *LiveTwitterAPI) ReadMarker() (*Marker, error) {
+	user, _, err := a.verifyCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseMarker(user.Description), nil
+}
+
+// WriteMarker writes a marker into the configured account's profile
+// description. An existing marker is replaced, and the rest of the
+// description is left alone.
+func (a *LiveTwitterAPI) WriteMarker(marker *Marker) error {
+	user, _, err := a.verifyCredentials()
+	if err != nil {
+		return err
+	}
+
+	description, err := replaceMarker(user.Description, marker)
+	if err != nil {
+		return err
+	}
+
+	req, err := a.newAuthorizedRequest("POST", "/1.1/account/update_profile.json")
+	if err != nil {
+		return err
+	}
+
+	a.logger().Info("Writing marker", "marker", marker)
+
+	query := req.URL.Query()
+	query.Add("description", description)
+	query.Add("include_entities", "false")
+	query.Add("skip_status", "true")
+
+	var updated *liveUser
+	return a.encodeAndExecuteRequest(req, query, &updated)
+}
+
+//
+// Private
+//
+
+// readMarker reads the account's marker at the start of Update, recording
+// the last posted interval in result if the marker can be trusted.
+func readMarker(api TwitterAPI, logger Logger, result *UpdateResult) (*Marker, error) {
+	marker, err := api.ReadMarker()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading marker: %v", err)
+	}
+
+	switch {
+	case marker == nil:
+		logger.Info("No marker found")
+
+	case marker.Pending:
+		logger.Warn("Found pending marker; can't be sure if it posted",
+			LogKeyIntervalID, marker.IntervalID)
+
+	case result.LastIntervalID != -1:
+		// Already found in state, which takes precedence. The marker is
+		// still returned so that it can be repaired if it's out of date.
+
+	default:
+		logger.Info("Found last interval in marker", LogKeyIntervalID, marker.IntervalID)
+		result.Discovery = DiscoveryMarker
+		result.LastIntervalID = marker.IntervalID
+	}
+
+	return marker, nil
+}
+
+// repairMarker brings the account's marker in line with the last posted
+// interval that was found some other way. This covers a pending marker left
+// by an interrupted run, and accounts that started using markers partway
+// through their series.
+func repairMarker(api TwitterAPI, logger Logger, marker *Marker, result *UpdateResult) error {
+	if result.Discovery == DiscoveryMarker || result.LastIntervalID == -1 {
+		return nil
+	}
+
+	if marker != nil && !marker.Pending && marker.IntervalID == result.LastIntervalID {
+		return nil
+	}
+
+	logger.Info("Repairing marker", LogKeyIntervalID, result.LastIntervalID)
+
+	err := api.WriteMarker(&Marker{IntervalID: result.LastIntervalID})
+	if err != nil {
+		return fmt.Errorf("Error repairing marker: %v", err)
+	}
+
+	return nil
+}
+
+func parseMarker(description string) *Marker {
+	matches := markerPattern.FindStringSubmatch(description)
+	if matches == nil {
+		return nil
+	}
+
+	id, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return nil
+	}
+
+	return &Marker{IntervalID: id, Pending: matches[2] != ""}
+}
+
+func replaceMarker(description string, marker *Marker) (string, error) {
+	var updated string
+	if markerPattern.MatchString(description) {
+		updated = markerPattern.ReplaceAllLiteralString(description, marker.String())
+	} else {
+		updated = strings.TrimSpace(description + " " + marker.String())
+	}
+
+	if len([]rune(updated)) > maxDescriptionLength {
+		return "", fmt.Errorf("No room for marker in profile description; "+
+			"it'd be longer than %v characters", maxDescriptionLength)
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,155 @@
+package updater
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestParseMarker(t *testing.T) {
+	assert.Nil(t, parseMarker(""))
+	assert.Nil(t, parseMarker("Posting until the year 10000"))
+	assert.Equal(t, &Marker{IntervalID: 3}, parseMarker("Posting until 10000. LHI:3"))
+	assert.Equal(t, &Marker{IntervalID: 4, Pending: true}, parseMarker("LHI:4? is next"))
+
+	// Not to be confused with an interval post
+	assert.Nil(t, parseMarker("LHI003: Interval 003"))
+}
+
+func TestReplaceMarker(t *testing.T) {
+	description, err := replaceMarker("", &Marker{IntervalID: 0, Pending: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "LHI:0?", description)
+
+	description, err = replaceMarker("Posting until 10000.", &Marker{IntervalID: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, "Posting until 10000. LHI:3", description)
+
+	description, err = replaceMarker("Posting LHI:4? until 10000.", &Marker{IntervalID: 4})
+	assert.NoError(t, err)
+	assert.Equal(t, "Posting LHI:4 until 10000.", description)
+
+	_, err = replaceMarker(strings.Repeat("x", maxDescriptionLength), &Marker{IntervalID: 3})
+	assert.Error(t, err)
+}
+
+func TestLiveTwitterAPI_Marker(t *testing.T) {
+	description := "Posting until 10000."
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1.1/account/verify_credentials.json":
+		case "/1.1/account/update_profile.json":
+			assert.Equal(t, "POST", r.Method)
+			description = r.URL.Query().Get("description")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		json.NewEncoder(w).Encode(&liveUser{
+			Description: description, ID: 123, ScreenName: "perpetual"})
+	}))
+	defer server.Close()
+
+	api := &LiveTwitterAPI{BaseURL: server.URL, HTTPClient: server.Client(), Logger: DiscardLogger, ScreenName: "perpetual"}
+
+	marker, err := api.ReadMarker()
+	assert.NoError(t, err)
+	assert.Nil(t, marker)
+
+	err = api.WriteMarker(&Marker{IntervalID: 3, Pending: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "Posting until 10000. LHI:3?", description)
+
+	err = api.WriteMarker(&Marker{IntervalID: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, "Posting until 10000. LHI:3", description)
+
+	marker, err = api.ReadMarker()
+	assert.NoError(t, err)
+	assert.Equal(t, &Marker{IntervalID: 3}, marker)
+}
+
+func TestUpdate_Marker(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-2 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 001"},
+		{Target: now.Add(1 * time.Hour), Message: "Interval 002"},
+	}
+	opts := &UpdateOptions{Logger: DiscardLogger, UseMarker: true}
+
+	// No marker yet, so the timeline is scanned. The marker goes pending
+	// before the post and is committed after it.
+	{
+		api := &mockTwitterAPI{tweets: []*Tweet{
+			{CreatedAt: now, Message: FormatInterval(0, "Interval 000")},
+		}}
+
+		result, err := Update(api, intervals, now, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, DiscoveryTimeline, result.Discovery)
+		assert.Equal(t, 1, result.PostedIntervalID)
+		assert.Equal(t, []*Marker{
+			{IntervalID: 0},
+			{IntervalID: 1, Pending: true},
+			{IntervalID: 1},
+		}, api.markers)
+	}
+
+	// A committed marker is trusted without scanning
+	{
+		api := &mockTwitterAPI{marker: &Marker{IntervalID: 0}, tweets: []*Tweet{
+			{CreatedAt: now, Message: FormatInterval(1, "Interval 001")},
+		}}
+
+		result, err := Update(api, intervals, now, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, DiscoveryMarker, result.Discovery)
+		assert.Equal(t, 0, result.NumTweetsScanned)
+		assert.Equal(t, 1, result.PostedIntervalID)
+	}
+
+	// A pending marker isn't trusted. The timeline shows that the post did go
+	// out, so the marker is repaired and nothing is posted again.
+	{
+		api := &mockTwitterAPI{marker: &Marker{IntervalID: 1, Pending: true}, tweets: []*Tweet{
+			{CreatedAt: now, Message: FormatInterval(1, "Interval 001")},
+		}}
+
+		result, err := Update(api, intervals, now, opts)
+		assert.NoError(t, err)
+		assert.Equal(t, DiscoveryTimeline, result.Discovery)
+		assert.Equal(t, -1, result.PostedIntervalID)
+		assert.Equal(t, []*Marker{{IntervalID: 1}}, api.markers)
+	}
+
+	// Markers aren't used unless they're configured
+	{
+		api := &mockTwitterAPI{marker: &Marker{IntervalID: 1}, tweets: []*Tweet{
+			{CreatedAt: now, Message: FormatInterval(0, "Interval 000")},
+		}}
+
+		result, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.PostedIntervalID)
+		assert.Equal(t, 0, len(api.markers))
+	}
+
+	// The marker can't be written, so nothing is posted
+	{
+		api := &mockTwitterAPI{marker: &Marker{IntervalID: 0},
+			markerErr: fmt.Errorf("Profile is locked")}
+
+		_, err := Update(api, intervals, now, opts)
+		assert.EqualError(t, err, "Error writing pending marker: Profile is locked")
+		assert.Equal(t, 0, len(api.posted))
+	}
+}
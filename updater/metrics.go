@@ -0,0 +1,381 @@
+package updater
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The names of the metrics that are emitted. Names ending in "_seconds" are
+// durations in seconds; the rest are counts.
+const (
+	// MetricAPIRequestDuration is the latency of a request to Twitter's API,
+	// labeled by endpoint.
+	MetricAPIRequestDuration = "api_request_duration_seconds"
+
+	// MetricAPIRequests counts requests to Twitter's API, labeled by endpoint
+	// and status (an HTTP status code, or "error" if there wasn't a
+	// response).
+	MetricAPIRequests = "api_requests"
+
+	// MetricPostLateness is how long after its target an interval was posted.
+	MetricPostLateness = "post_lateness_seconds"
+
+	// MetricRunDuration is how long a call to Update took.
+	MetricRunDuration = "run_duration_seconds"
+
+	// MetricRuns counts calls to Update, labeled by result: "posted" if an
+	// interval was posted, "idle" if none was due, or "error".
+	MetricRuns = "runs"
+
+	// MetricTimelinePages counts pages of tweets requested from the timeline
+	// or search. Summed over a run, it's how many pages the run scanned.
+	MetricTimelinePages = "timeline_pages"
+
+	// MetricTweetsScanned is how many tweets a run scanned looking for the
+	// last posted interval.
+	MetricTweetsScanned = "tweets_scanned"
+)
+
+// Metrics receives measurements. Labels are alternating keys and values, as
+// with Logger.
+type Metrics interface {
+	// Count adds delta to a counter.
+	Count(name string, delta float64, labels ...string)
+
+	// Observe records a single measurement of something like a latency.
+	Observe(name string, value float64, labels ...string)
+}
+
+// DiscardMetrics is a Metrics that drops everything. It's used where no
+// Metrics was given.
+var DiscardMetrics Metrics = discardMetrics{}
+
+//
+// CloudWatch
+//
+
+// EMFMetrics collects metrics and writes them in CloudWatch's Embedded Metric
+// Format, which CloudWatch extracts from a Lambda function's logs without any
+// API calls. Each metric's labels become its dimensions.
+type EMFMetrics struct {
+	// Labels are added to every metric, like the series being posted.
+	Labels []string
+
+	// Namespace is the CloudWatch namespace that metrics are put in.
+	Namespace string
+
+	// Writer is where Flush writes. In Lambda, it should be stdout.
+	Writer io.Writer
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+// NewEMFMetrics creates an EMFMetrics that writes to w.
+func NewEMFMetrics(w io.Writer, namespace string, labels ...string) *EMFMetrics {
+	return &EMFMetrics{Labels: labels, Namespace: namespace, Writer: w}
+}
+
+// Count adds delta to a counter.
+func (m *EMFMetrics) Count(name string, delta float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	recordMetric(&m.series, name, delta, false,
+		append(append([]string(nil), m.Labels...), labels...))
+}
+
+// Observe records a single measurement.
+func (m *EMFMetrics) Observe(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := recordMetric(&m.series, name, value, true,
+		append(append([]string(nil), m.Labels...), labels...))
+	s.values = append(s.values, value)
+}
+
+// Flush writes everything collected since the last flush, one line per set
+// of labels, and resets. It should be called before a Lambda invocation
+// returns.
+func (m *EMFMetrics) Flush() error {
+	m.mu.Lock()
+	series := m.series
+	m.series = nil
+	m.mu.Unlock()
+
+	now := time.Now
+	if m.now != nil {
+		now = m.now
+	}
+	timestamp := now().UnixNano() / int64(time.Millisecond)
+
+	// Metrics with the same labels share a line
+	type emfLine struct {
+		labels  []metricLabel
+		metrics []*metricSeries
+	}
+	var lines []*emfLine
+	byLabels := make(map[string]*emfLine)
+	for _, s := range sortedMetricSeries(series) {
+		key := formatMetricLabels(s.labels)
+		line, ok := byLabels[key]
+		if !ok {
+			line = &emfLine{labels: s.labels}
+			byLabels[key] = line
+			lines = append(lines, line)
+		}
+		line.metrics = append(line.metrics, s)
+	}
+
+	for _, line := range lines {
+		dimensions := []string{}
+		doc := make(map[string]interface{})
+		for _, label := range line.labels {
+			dimensions = append(dimensions, label.key)
+			doc[label.key] = label.value
+		}
+
+		var definitions []map[string]string
+		for _, s := range line.metrics {
+			definitions = append(definitions,
+				map[string]string{"Name": s.name, "Unit": emfUnit(s.name)})
+
+			if s.observation {
+				// Up to 100 values are allowed per metric per line, which
+				// is plenty for a single run
+				doc[s.name] = s.values
+			} else {
+				doc[s.name] = s.sum
+			}
+		}
+
+		doc["_aws"] = map[string]interface{}{
+			"Timestamp": timestamp,
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  m.Namespace,
+				"Dimensions": [][]string{dimensions},
+				"Metrics":    definitions,
+			}},
+		}
+
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+
+		_, err = m.Writer.Write(append(data, '\n'))
+		if err != nil {
+			return fmt.Errorf("Error writing metrics: %v", err)
+		}
+	}
+
+	return nil
+}
+
+//
+// Prometheus
+//
+
+// PrometheusMetrics collects metrics in memory for as long as the process
+// runs and serves them in Prometheus's text format, so it's an http.Handler
+// to mount at something like /metrics. Counters are exposed with a "_total"
+// suffix and observations as summaries (a sum and a count).
+type PrometheusMetrics struct {
+	// Namespace is prefixed to every metric's name, separated by an
+	// underscore.
+	Namespace string
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+// Count adds delta to a counter.
+func (m *PrometheusMetrics) Count(name string, delta float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	recordMetric(&m.series, name, delta, false, labels)
+}
+
+// Observe records a single measurement.
+func (m *PrometheusMetrics) Observe(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	recordMetric(&m.series, name, value, true, labels)
+}
+
+// ServeHTTP writes every metric in Prometheus's text exposition format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, m.format())
+}
+
+func (m *PrometheusMetrics) format() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sb strings.Builder
+	var lastName string
+	for _, s := range sortedMetricSeries(m.series) {
+		name := s.name
+		if m.Namespace != "" {
+			name = m.Namespace + "_" + name
+		}
+
+		labels := formatPrometheusLabels(s.labels)
+
+		if s.observation {
+			if s.name != lastName {
+				fmt.Fprintf(&sb, "# TYPE %s summary\n", name)
+			}
+			fmt.Fprintf(&sb, "%s_sum%s %s\n", name, labels, formatMetricValue(s.sum))
+			fmt.Fprintf(&sb, "%s_count%s %d\n", name, labels, s.count)
+		} else {
+			if s.name != lastName {
+				fmt.Fprintf(&sb, "# TYPE %s_total counter\n", name)
+			}
+			fmt.Fprintf(&sb, "%s_total%s %s\n", name, labels, formatMetricValue(s.sum))
+		}
+
+		lastName = s.name
+	}
+
+	return sb.String()
+}
+
+//
+// Private
+//
+
+// endpointIDPattern matches the ID at the end of an endpoint's path, like
+// the one in /1.1/statuses/destroy/123.json.
+var endpointIDPattern = regexp.MustCompile(`/\d+(\.json)?$`)
+
+// discardMetrics is the implementation behind DiscardMetrics.
+type discardMetrics struct{}
+
+func (discardMetrics) Count(name string, delta float64, labels ...string)   {}
+func (discardMetrics) Observe(name string, value float64, labels ...string) {}
+
+// metricLabel is a single label's key and value.
+type metricLabel struct {
+	key   string
+	value string
+}
+
+// metricSeries is everything recorded for a metric with a set of labels.
+type metricSeries struct {
+	count       int
+	labels      []metricLabel
+	name        string
+	observation bool
+	sum         float64
+
+	// values are only kept by EMFMetrics, which sends each one.
+	values []float64
+}
+
+// emfUnit gets the CloudWatch unit of a metric from its name.
+func emfUnit(name string) string {
+	if strings.HasSuffix(name, "_seconds") {
+		return "Seconds"
+	}
+	return "Count"
+}
+
+// formatMetricLabels formats labels so that they can be used as a key.
+func formatMetricLabels(labels []metricLabel) string {
+	var parts []string
+	for _, label := range labels {
+		parts = append(parts, label.key+"="+label.value)
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func formatPrometheusLabels(labels []metricLabel) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var parts []string
+	for _, label := range labels {
+		parts = append(parts, label.key+"="+strconv.Quote(label.value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// metricEndpoint gets the endpoint of a request to Twitter's API for use as a
+// label, with any ID replaced so that each endpoint is a single series.
+func metricEndpoint(path string) string {
+	return endpointIDPattern.ReplaceAllString(path, "/:id$1")
+}
+
+// pairMetricLabels pairs up alternating keys and values, sorted by key so
+// that the same labels in a different order are the same series. A key
+// without a value gets an empty one.
+func pairMetricLabels(labels []string) []metricLabel {
+	var pairs []metricLabel
+	for i := 0; i < len(labels); i += 2 {
+		label := metricLabel{key: labels[i]}
+		if i+1 < len(labels) {
+			label.value = labels[i+1]
+		}
+		pairs = append(pairs, label)
+	}
+
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].key < pairs[j].key })
+	return pairs
+}
+
+// recordMetric adds a value to the series of a metric with labels, creating
+// the map or the series if needed, and returns the series.
+func recordMetric(series *map[string]*metricSeries, name string, value float64,
+	observation bool, labels []string) *metricSeries {
+
+	if *series == nil {
+		*series = make(map[string]*metricSeries)
+	}
+
+	pairs := pairMetricLabels(labels)
+	key := name + "{" + formatMetricLabels(pairs) + "}"
+
+	s, ok := (*series)[key]
+	if !ok {
+		s = &metricSeries{labels: pairs, name: name, observation: observation}
+		(*series)[key] = s
+	}
+
+	s.count++
+	s.sum += value
+	return s
+}
+
+// sortedMetricSeries gets series ordered by name and then labels, so that
+// output is stable.
+func sortedMetricSeries(series map[string]*metricSeries) []*metricSeries {
+	var sorted []*metricSeries
+	for _, s := range series {
+		sorted = append(sorted, s)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].name != sorted[j].name {
+			return sorted[i].name < sorted[j].name
+		}
+		return formatMetricLabels(sorted[i].labels) < formatMetricLabels(sorted[j].labels)
+	})
+	return sorted
+}
@@ -0,0 +1,157 @@
+package updater
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestEMFMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	metrics := NewEMFMetrics(&buf, "perpetual", LogKeySeries, "perpetual_test")
+	metrics.now = func() time.Time { return time.Unix(1514862245, 0) }
+
+	metrics.Count(MetricRuns, 1, "result", "posted")
+	metrics.Observe(MetricRunDuration, 1.5)
+	metrics.Observe(MetricRunDuration, 0.5)
+	metrics.Count(MetricTimelinePages, 1)
+	metrics.Count(MetricTimelinePages, 2)
+	assert.NoError(t, metrics.Flush())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+
+	// Metrics with the same labels share a line
+	assert.JSONEq(t, `{
+		"_aws": {
+			"Timestamp": 1514862245000,
+			"CloudWatchMetrics": [{
+				"Namespace": "perpetual",
+				"Dimensions": [["series"]],
+				"Metrics": [
+					{"Name": "run_duration_seconds", "Unit": "Seconds"},
+					{"Name": "timeline_pages", "Unit": "Count"}
+				]
+			}]
+		},
+		"series": "perpetual_test",
+		"run_duration_seconds": [1.5, 0.5],
+		"timeline_pages": 3
+	}`, lines[0])
+
+	var doc map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &doc))
+	assert.Equal(t, "posted", doc["result"])
+	assert.Equal(t, float64(1), doc[MetricRuns])
+
+	// Flushing resets
+	buf.Reset()
+	assert.NoError(t, metrics.Flush())
+	assert.Equal(t, "", buf.String())
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	metrics := &PrometheusMetrics{Namespace: "perpetual"}
+	metrics.Count(MetricAPIRequests, 1, "status", "200", "endpoint", "/a")
+	metrics.Count(MetricAPIRequests, 1, "endpoint", "/a", "status", "200")
+	metrics.Count(MetricAPIRequests, 1, "endpoint", "/b", "status", "error")
+	metrics.Observe(MetricPostLateness, 2)
+	metrics.Observe(MetricPostLateness, 0.5)
+
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	var body bytes.Buffer
+	_, err = body.ReadFrom(resp.Body)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "text/plain; version=0.0.4", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `# TYPE perpetual_api_requests_total counter
+perpetual_api_requests_total{endpoint="/a",status="200"} 2
+perpetual_api_requests_total{endpoint="/b",status="error"} 1
+# TYPE perpetual_post_lateness_seconds summary
+perpetual_post_lateness_seconds_sum 2.5
+perpetual_post_lateness_seconds_count 2
+`, body.String())
+}
+
+func TestMetricEndpoint(t *testing.T) {
+	assert.Equal(t, "/1.1/statuses/user_timeline.json",
+		metricEndpoint("/1.1/statuses/user_timeline.json"))
+	assert.Equal(t, "/1.1/statuses/destroy/:id.json",
+		metricEndpoint("/1.1/statuses/destroy/123.json"))
+}
+
+func TestLiveTwitterAPI_Metrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/1.1/statuses/destroy/") {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"errors":[{"code":144}]}`)
+			return
+		}
+		fmt.Fprintf(w, `[]`)
+	}))
+	defer server.Close()
+
+	metrics := &PrometheusMetrics{}
+	api := &LiveTwitterAPI{BaseURL: server.URL, HTTPClient: server.Client(),
+		Logger: DiscardLogger, Metrics: metrics, ScreenName: "perpetual"}
+
+	it := api.ListTweets()
+	assert.False(t, it.Next())
+	assert.NoError(t, it.Err())
+	assert.Error(t, api.DeleteTweet(123))
+
+	output := metrics.format()
+	assert.Contains(t, output,
+		`api_requests_total{endpoint="/1.1/statuses/user_timeline.json",status="200"} 1`)
+	assert.Contains(t, output,
+		`api_requests_total{endpoint="/1.1/statuses/destroy/:id.json",status="404"} 1`)
+	assert.Contains(t, output,
+		`api_request_duration_seconds_count{endpoint="/1.1/statuses/destroy/:id.json"} 1`)
+	assert.Contains(t, output, "timeline_pages_total 1\n")
+}
+
+func TestUpdate_Metrics(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(1 * time.Hour), Message: "Interval 001"},
+	}
+	api := &mockTwitterAPI{}
+	metrics := &PrometheusMetrics{}
+	opts := &UpdateOptions{Logger: DiscardLogger, Metrics: metrics}
+
+	// Posted an hour late
+	_, err := Update(api, intervals, now, opts)
+	assert.NoError(t, err)
+
+	// Nothing due
+	api.tweets = api.posted
+	_, err = Update(api, intervals, now, opts)
+	assert.NoError(t, err)
+
+	// Failed
+	_, err = Update(api, intervals, now,
+		&UpdateOptions{Discovery: "bogus", Logger: DiscardLogger, Metrics: metrics})
+	assert.Error(t, err)
+
+	output := metrics.format()
+	assert.Contains(t, output, `runs_total{result="error"} 1`)
+	assert.Contains(t, output, `runs_total{result="idle"} 1`)
+	assert.Contains(t, output, `runs_total{result="posted"} 1`)
+	assert.Contains(t, output, "run_duration_seconds_count 3\n")
+	assert.Contains(t, output, "post_lateness_seconds_sum 3600\n")
+	assert.Contains(t, output, "tweets_scanned_count 2\n")
+}
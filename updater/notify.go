@@ -0,0 +1,445 @@
+package updater
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultNotificationWindow is how long DedupNotifier suppresses repeats of
+// a notification if its Window isn't set.
+const DefaultNotificationWindow = 24 * time.Hour
+
+// maxDedupSaveAttempts is how many times DedupNotifier tries to record a
+// notification in state when it loses a race with another writer.
+const maxDedupSaveAttempts = 3
+
+// NotificationKind is what a notification is about.
+type NotificationKind string
+
+// The possible kinds of notification.
+const (
+	// NotificationError means that a run failed.
+	NotificationError NotificationKind = "error"
+
+	// NotificationPosted means that an interval was posted.
+	NotificationPosted NotificationKind = "posted"
+
+	// NotificationRefusal means that a run refused to post because it
+	// couldn't tell whether the next interval had already been posted (see
+	// AmbiguousHistoryError). Someone has to look at the account.
+	NotificationRefusal NotificationKind = "refusal"
+
+	// NotificationReminder means that the next interval is coming up.
+	NotificationReminder NotificationKind = "reminder"
+)
+
+// Notification is a message for the people operating a series.
+type Notification struct {
+	// Cause is what the error that a notification about a failure or refusal
+	// is about, without the details that change from run to run (see
+	// errorCause). It's empty for other notifications.
+	Cause string `json:"cause,omitempty"`
+
+	// IntervalID is the interval that the notification is about, or -1 if
+	// it's not about any one.
+	IntervalID int `json:"interval_id"`
+
+	// Kind is what the notification is about.
+	Kind NotificationKind `json:"kind"`
+
+	// Message is the notification's body.
+	Message string `json:"message"`
+
+	// Series is the account that the notification is about.
+	Series string `json:"series,omitempty"`
+
+	// Subject is a one line summary.
+	Subject string `json:"subject"`
+
+	// Time is when the notification was sent.
+	Time time.Time `json:"time"`
+}
+
+// Notifier delivers notifications.
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// MultiNotifier delivers notifications to every one of a set of notifiers.
+// Every notifier is tried even if one fails.
+type MultiNotifier []Notifier
+
+// Notify delivers a notification to each notifier, returning an error if any
+// of them failed.
+func (m MultiNotifier) Notify(n *Notification) error {
+	var errs []string
+	for _, notifier := range m {
+		err := notifier.Notify(n)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Error sending notification: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+//
+// De-duplication
+//
+
+// DedupNotifier wraps a Notifier so that the same notification is sent at
+// most once per Window, so that a run that fails the same way every few
+// minutes doesn't send a message every few minutes. Notifications about an
+// interval are the same if they're the same kind about the same interval,
+// and ones about errors are the same if their errors have the same Cause.
+// Others are the same if their messages are.
+//
+// When Store is set, sent notifications are recorded in state so that
+// they're remembered between invocations. Otherwise, they're only remembered
+// in memory.
+type DedupNotifier struct {
+	// Notifier is the notifier that's wrapped.
+	Notifier Notifier
+
+	// Store is where sent notifications are recorded. Optional.
+	Store StateStore
+
+	// Window is how long a notification is suppressed for after it's sent.
+	// Defaults to DefaultNotificationWindow if zero.
+	Window time.Duration
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+// Notify sends a notification unless the same one was sent within the
+// window.
+func (d *DedupNotifier) Notify(n *Notification) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if d.now != nil {
+		now = d.now()
+	}
+
+	window := d.Window
+	if window == 0 {
+		window = DefaultNotificationWindow
+	}
+
+	key := notificationKey(n)
+
+	if sentAt, ok := d.sent[key]; ok && now.Sub(sentAt) < window {
+		return nil
+	}
+
+	if d.Store != nil {
+		// If state can't be loaded (which may well be what's being notified
+		// about), err on the side of sending
+		state, err := d.Store.LoadState()
+		if err == nil {
+			if sentAt, ok := state.Notified[key]; ok && now.Sub(sentAt) < window {
+				return nil
+			}
+		}
+	}
+
+	err := d.Notifier.Notify(n)
+	if err != nil {
+		return err
+	}
+
+	if d.sent == nil {
+		d.sent = make(map[string]time.Time)
+	}
+	d.sent[key] = now
+
+	if d.Store != nil {
+		err = d.record(key, now, window)
+		if err != nil {
+			return fmt.Errorf("Sent notification but failed to record it: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// record saves that a notification was sent in state, dropping the records
+// of those that have left the window.
+func (d *DedupNotifier) record(key string, now time.Time, window time.Duration) error {
+	var err error
+
+	for attempt := 0; attempt < maxDedupSaveAttempts; attempt++ {
+		var state *State
+		state, err = d.Store.LoadState()
+		if err != nil {
+			return err
+		}
+
+		for k, sentAt := range state.Notified {
+			if now.Sub(sentAt) >= window {
+				delete(state.Notified, k)
+			}
+		}
+
+		if state.Notified == nil {
+			state.Notified = make(map[string]time.Time)
+		}
+		state.Notified[key] = now
+
+		err = d.Store.SaveState(state)
+		if err != ErrStateConflict {
+			return err
+		}
+	}
+
+	return err
+}
+
+//
+// Email
+//
+
+// SMTPNotifier sends notifications as email.
+type SMTPNotifier struct {
+	// Addr is the SMTP server's host and port, like "smtp.example.com:587".
+	Addr string
+
+	// From is the sender's address.
+	From string
+
+	// Password authenticates with the server along with Username.
+	Password string
+
+	// To are the recipients' addresses.
+	To []string
+
+	// Username authenticates with the server if set. Otherwise, mail is sent
+	// without authenticating.
+	Username string
+
+	// sendMail is overridden in tests.
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// Notify sends a notification as an email to each recipient.
+func (s *SMTPNotifier) Notify(n *Notification) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := s.Addr
+		if i := strings.LastIndex(host, ":"); i != -1 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	sendMail := smtp.SendMail
+	if s.sendMail != nil {
+		sendMail = s.sendMail
+	}
+
+	err := sendMail(s.Addr, auth, s.From, s.To, formatNotificationEmail(s.From, s.To, n))
+	if err != nil {
+		return fmt.Errorf("Error sending notification email: %v", err)
+	}
+	return nil
+}
+
+//
+// Webhooks
+//
+
+// WebhookNotifier sends notifications to a URL as a JSON-encoded
+// Notification in the body of a POST.
+type WebhookNotifier struct {
+	// HTTPClient is the client used for requests. Defaults to
+	// http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// URL is where notifications are posted.
+	URL string
+}
+
+// Notify posts a notification to the webhook.
+func (w *WebhookNotifier) Notify(n *Notification) error {
+	return postNotification(w.HTTPClient, w.URL, n)
+}
+
+// SlackNotifier sends notifications to a Slack incoming webhook, or anything
+// else that accepts the same messages (like Mattermost or Discord's Slack
+// compatible endpoint).
+type SlackNotifier struct {
+	// HTTPClient is the client used for requests. Defaults to
+	// http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// URL is the incoming webhook's URL.
+	URL string
+}
+
+// Notify posts a notification to the webhook as a message.
+func (s *SlackNotifier) Notify(n *Notification) error {
+	return postNotification(s.HTTPClient, s.URL, map[string]string{
+		"text": "*" + n.Subject + "*\n" + n.Message,
+	})
+}
+
+//
+// Private
+//
+
+// formatNotificationEmail formats a notification as an email message.
+func formatNotificationEmail(from string, to []string, n *Notification) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", n.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.Replace(n.Message, "\n", "\r\n", -1))
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// errorCause gets what an error is about without the details that change
+// from run to run: its type, and its message up to the first colon. Errors
+// here are wrapped as "Context: detail", so that's the outermost context.
+func errorCause(err error) string {
+	message := err.Error()
+	if i := strings.Index(message, ":"); i != -1 {
+		message = message[:i]
+	}
+	return fmt.Sprintf("%T/%s", err, message)
+}
+
+// notificationKey gets the key that DedupNotifier considers notifications the
+// same by.
+func notificationKey(n *Notification) string {
+	switch {
+	case n.IntervalID != -1:
+		return fmt.Sprintf("%s:%s:%d", n.Series, n.Kind, n.IntervalID)
+
+	// Its message changes as the silence goes on
+	case n.Kind == NotificationSilence:
+		return fmt.Sprintf("%s:%s", n.Series, n.Kind)
+
+	// Error messages carry details like IDs and times that change from run to
+	// run even when it's failing the same way
+	case n.Cause != "":
+		return fmt.Sprintf("%s:%s:%s", n.Series, n.Kind, n.Cause)
+	}
+
+	sum := sha256.Sum256([]byte(n.Message))
+	return fmt.Sprintf("%s:%s:%s", n.Series, n.Kind, hex.EncodeToString(sum[:8]))
+}
+
+// notifyRun sends the notifications that are due after a call to Update.
+// Failing to notify doesn't fail the run, so errors are only logged.
+func notifyRun(notifier Notifier, logger Logger, intervals []*Interval, now time.Time,
+	result *UpdateResult, runErr error, opts *UpdateOptions) {
+
+	var notifications []*Notification
+	newNotification := func(kind NotificationKind, intervalID int, subject, message string) *Notification {
+		if opts.Series != "" {
+			subject = "@" + opts.Series + ": " + subject
+		}
+
+		n := &Notification{
+			IntervalID: intervalID,
+			Kind:       kind,
+			Message:    message,
+			Series:     opts.Series,
+			Subject:    subject,
+			Time:       now,
+		}
+		notifications = append(notifications, n)
+		return n
+	}
+
+	switch runErr.(type) {
+	case nil:
+	case *AmbiguousHistoryError:
+		n := newNotification(NotificationRefusal, -1, "Refused to post",
+			runErr.Error()+"\n\nCheck the account and record its last posted interval "+
+				"(e.g. with `perpetual adopt`) so that posting can continue.")
+		n.Cause = errorCause(runErr)
+	case *LockHeldError:
+		// Another invocation is running, which is expected now and then
+	default:
+		n := newNotification(NotificationError, -1, "Run failed", runErr.Error())
+		n.Cause = errorCause(runErr)
+	}
+
+	if result != nil && result.PostedIntervalID != -1 {
+		id := result.PostedIntervalID
+		newNotification(NotificationPosted, id, fmt.Sprintf("Posted LHI%03d", id),
+			fmt.Sprintf("Posted LHI%03d, which was due at %v.", id,
+				intervals[id].Target.Format(time.RFC3339)))
+	}
+
+	if result != nil && result.NextIntervalID != -1 && opts.ReminderLead > 0 {
+		id := result.NextIntervalID
+		target := intervals[id].Target
+		if target.After(now) && target.Sub(now) <= opts.ReminderLead {
+			newNotification(NotificationReminder, id, fmt.Sprintf("LHI%03d is coming up", id),
+				fmt.Sprintf("LHI%03d is due at %v, in %v.", id, target.Format(time.RFC3339),
+					target.Sub(now).Round(time.Minute)))
+		}
+	}
+
+	for _, n := range notifications {
+		err := notifier.Notify(n)
+		if err != nil {
+			logger.Warn("Error sending notification", "kind", n.Kind, "error", err)
+			continue
+		}
+
+		logger.Info("Sent notification", "kind", n.Kind, "subject", n.Subject)
+	}
+}
+
+// postNotification posts v to a URL as JSON.
+func postNotification(client *http.Client, url string, v interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		// The URL often contains a secret, and errors from the client
+		// include it, so it's left out
+		return fmt.Errorf("Error posting notification to webhook")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Improper response from webhook (status: %v): %s",
+			resp.Status, string(body))
+	}
+
+	return nil
+}
@@ -0,0 +1,251 @@
+package updater
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+//
+// Mock notifier
+//
+
+type mockNotifier struct {
+	err           error
+	notifications []*Notification
+}
+
+func (n *mockNotifier) Notify(notification *Notification) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.notifications = append(n.notifications, notification)
+	return nil
+}
+
+func (n *mockNotifier) kinds() []NotificationKind {
+	var kinds []NotificationKind
+	for _, notification := range n.notifications {
+		kinds = append(kinds, notification.Kind)
+	}
+	return kinds
+}
+
+//
+// Tests
+//
+
+func TestMultiNotifier(t *testing.T) {
+	failing := &mockNotifier{err: errors.New("boom")}
+	working := &mockNotifier{}
+
+	err := MultiNotifier{failing, working}.Notify(&Notification{Kind: NotificationError})
+	assert.EqualError(t, err, "Error sending notification: boom")
+	assert.Equal(t, 1, len(working.notifications))
+}
+
+func TestDedupNotifier(t *testing.T) {
+	now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	store := &mockStateStore{}
+	inner := &mockNotifier{}
+
+	newDedup := func() *DedupNotifier {
+		return &DedupNotifier{Notifier: inner, Store: store, Window: time.Hour,
+			now: func() time.Time { return now }}
+	}
+	dedup := newDedup()
+
+	failure := &Notification{IntervalID: -1, Kind: NotificationError, Message: "boom"}
+	assert.NoError(t, dedup.Notify(failure))
+	assert.NoError(t, dedup.Notify(failure))
+	assert.Equal(t, 1, len(inner.notifications))
+
+	// A different failure isn't a repeat
+	assert.NoError(t, dedup.Notify(
+		&Notification{IntervalID: -1, Kind: NotificationError, Message: "bang"}))
+	assert.Equal(t, 2, len(inner.notifications))
+
+	// Failures with the same cause are the same even if their messages vary
+	assert.NoError(t, dedup.Notify(&Notification{Cause: "lookup", IntervalID: -1,
+		Kind: NotificationError, Message: "Error looking up 123"}))
+	assert.NoError(t, dedup.Notify(&Notification{Cause: "lookup", IntervalID: -1,
+		Kind: NotificationError, Message: "Error looking up 456"}))
+	assert.Equal(t, 3, len(inner.notifications))
+
+	// Posts are the same if they're about the same interval
+	assert.NoError(t, dedup.Notify(&Notification{IntervalID: 3, Kind: NotificationPosted,
+		Message: "a"}))
+	assert.NoError(t, dedup.Notify(&Notification{IntervalID: 3, Kind: NotificationPosted,
+		Message: "b"}))
+	assert.Equal(t, 4, len(inner.notifications))
+
+	// Remembered between invocations through state
+	assert.NoError(t, newDedup().Notify(failure))
+	assert.Equal(t, 4, len(inner.notifications))
+
+	// Sent again once the window has passed, and old records are dropped
+	now = now.Add(time.Hour)
+	assert.NoError(t, newDedup().Notify(failure))
+	assert.Equal(t, 5, len(inner.notifications))
+
+	state, err := store.LoadState()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(state.Notified))
+
+	// Failures to send aren't recorded
+	inner.err = errors.New("unreachable")
+	dedup = newDedup()
+	reminder := &Notification{IntervalID: 4, Kind: NotificationReminder}
+	assert.Error(t, dedup.Notify(reminder))
+	inner.err = nil
+	assert.NoError(t, dedup.Notify(reminder))
+	assert.Equal(t, 6, len(inner.notifications))
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	var sentAddr, sentFrom string
+	var sentAuth smtp.Auth
+	var sentMsg []byte
+	var sentTo []string
+
+	notifier := &SMTPNotifier{
+		Addr:     "smtp.example.com:587",
+		From:     "perpetual@example.com",
+		Password: "hunter2",
+		To:       []string{"a@example.com", "b@example.com"},
+		Username: "perpetual",
+		sendMail: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			sentAddr, sentAuth, sentFrom, sentTo, sentMsg = addr, a, from, to, msg
+			return nil
+		},
+	}
+
+	assert.NoError(t, notifier.Notify(&Notification{
+		Message: "Posted LHI003.\nIt was on time.",
+		Subject: "Posted LHI003",
+		Time:    time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+	}))
+
+	assert.Equal(t, "smtp.example.com:587", sentAddr)
+	assert.NotNil(t, sentAuth)
+	assert.Equal(t, "perpetual@example.com", sentFrom)
+	assert.Equal(t, []string{"a@example.com", "b@example.com"}, sentTo)
+	assert.Equal(t, "From: perpetual@example.com\r\n"+
+		"To: a@example.com, b@example.com\r\n"+
+		"Subject: Posted LHI003\r\n"+
+		"Date: Tue, 02 Jan 2018 03:04:05 +0000\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"\r\n"+
+		"Posted LHI003.\r\nIt was on time.\r\n", string(sentMsg))
+}
+
+func TestWebhookNotifiers(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("invalid_token"))
+			return
+		}
+		bodies = append(bodies, string(data))
+	}))
+	defer server.Close()
+
+	n := &Notification{IntervalID: 3, Kind: NotificationPosted, Message: "On time",
+		Series: "perpetual_test", Subject: "Posted LHI003",
+		Time: time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+	assert.NoError(t, (&WebhookNotifier{URL: server.URL + "/hook"}).Notify(n))
+	assert.NoError(t, (&SlackNotifier{URL: server.URL + "/slack"}).Notify(n))
+
+	var decoded Notification
+	assert.NoError(t, json.Unmarshal([]byte(bodies[0]), &decoded))
+	assert.Equal(t, *n, decoded)
+	assert.Equal(t, `{"text":"*Posted LHI003*\nOn time"}`, bodies[1])
+
+	err := (&SlackNotifier{URL: server.URL + "/fail"}).Notify(n)
+	assert.EqualError(t, err,
+		"Improper response from webhook (status: 403 Forbidden): invalid_token")
+
+	// The URL isn't included in errors because it's usually a secret
+	err = (&WebhookNotifier{URL: "http://127.0.0.1:0/secret"}).Notify(n)
+	assert.Error(t, err)
+	assert.False(t, strings.Contains(err.Error(), "secret"))
+}
+
+func TestUpdate_Notify(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(48 * time.Hour), Message: "Interval 001"},
+	}
+	notifier := &mockNotifier{}
+	opts := &UpdateOptions{Logger: DiscardLogger, Notifier: notifier,
+		ReminderLead: 72 * time.Hour, Series: "perpetual_test"}
+
+	// Posts, and the next interval is within the reminder's lead
+	api := &mockTwitterAPI{}
+	result, err := Update(api, intervals, now, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.NextIntervalID)
+	assert.Equal(t, []NotificationKind{NotificationPosted, NotificationReminder},
+		notifier.kinds())
+	assert.Equal(t, "@perpetual_test: Posted LHI000", notifier.notifications[0].Subject)
+	assert.Equal(t, 1, notifier.notifications[1].IntervalID)
+
+	// Too far out for a reminder
+	notifier.notifications = nil
+	api.tweets = api.posted
+	_, err = Update(api, intervals, now,
+		&UpdateOptions{Logger: DiscardLogger, Notifier: notifier, ReminderLead: time.Hour})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(notifier.notifications))
+
+	// Refuses because the history is ambiguous
+	notifier.notifications = nil
+	_, err = Update(
+		&mockTwitterAPI{tweets: []*Tweet{{CreatedAt: now, Message: "tweet"}}},
+		intervals, now, opts)
+	assert.IsType(t, &AmbiguousHistoryError{}, err)
+	assert.Equal(t, []NotificationKind{NotificationRefusal}, notifier.kinds())
+
+	// Another invocation holds the lock, which isn't worth an alert
+	notifier.notifications = nil
+	locker := &StateLocker{Store: &mockStateStore{}}
+	_, err = locker.Acquire("someone-else", time.Hour)
+	assert.NoError(t, err)
+	opts.Locker = locker
+	_, err = Update(&mockTwitterAPI{}, intervals, now, opts)
+	assert.IsType(t, &LockHeldError{}, err)
+	assert.Equal(t, 0, len(notifier.notifications))
+	opts.Locker = nil
+
+	// Fails
+	notifier.notifications = nil
+	opts.Discovery = "bogus"
+	_, err = Update(&mockTwitterAPI{}, intervals, now, opts)
+	assert.Error(t, err)
+	assert.Equal(t, []NotificationKind{NotificationError}, notifier.kinds())
+	assert.Equal(t, err.Error(), notifier.notifications[0].Message)
+	assert.Equal(t, "*errors.errorString/Unknown discovery strategy",
+		notifier.notifications[0].Cause)
+}
+
+func TestErrorCause(t *testing.T) {
+	assert.Equal(t, "*errors.errorString/Error loading state",
+		errorCause(errors.New("Error loading state: timed out after 3.2s")))
+	assert.Equal(t, "*updater.AmbiguousHistoryError/Last available tweet is after beginning",
+		errorCause(&AmbiguousHistoryError{msg: "Last available tweet is after beginning"}))
+}
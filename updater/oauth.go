@@ -0,0 +1,65 @@
+package updater
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dghubble/oauth1"
+)
+
+// OAuthEndpoint returns the endpoints for Twitter's OAuth 1.0a flow relative
+// to an API base URL like DefaultBaseURL.
+func OAuthEndpoint(baseURL string) oauth1.Endpoint {
+	return oauth1.Endpoint{
+		AccessTokenURL:  baseURL + "/oauth/access_token",
+		AuthorizeURL:    baseURL + "/oauth/authorize",
+		RequestTokenURL: baseURL + "/oauth/request_token",
+	}
+}
+
+// AuthorizeWithPIN runs Twitter's three-legged, PIN-based OAuth 1.0a flow to
+// get an access token pair that lets an app act on behalf of any account,
+// not just the one that owns the app.
+//
+// A request token is obtained and the URL for authorizing it is passed to
+// prompt, which should show it to the user. After approving the app there,
+// the user is shown a PIN, which prompt should return so that it can be
+// exchanged for an access token.
+func AuthorizeWithPIN(consumerKey, consumerSecret, baseURL string,
+	prompt func(authorizationURL string) (string, error)) (*oauth1.Token, error) {
+
+	config := &oauth1.Config{
+		// "oob" (out-of-band) is what asks for a PIN instead of a redirect
+		CallbackURL:    "oob",
+		ConsumerKey:    consumerKey,
+		ConsumerSecret: consumerSecret,
+		Endpoint:       OAuthEndpoint(baseURL),
+	}
+
+	requestToken, requestSecret, err := config.RequestToken()
+	if err != nil {
+		return nil, fmt.Errorf("Error getting request token: %v", err)
+	}
+
+	authorizationURL, err := config.AuthorizationURL(requestToken)
+	if err != nil {
+		return nil, err
+	}
+
+	pin, err := prompt(authorizationURL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	pin = strings.TrimSpace(pin)
+	if pin == "" {
+		return nil, fmt.Errorf("No PIN was entered")
+	}
+
+	accessToken, accessSecret, err := config.AccessToken(requestToken, requestSecret, pin)
+	if err != nil {
+		return nil, fmt.Errorf("Error exchanging PIN for access token: %v", err)
+	}
+
+	return oauth1.NewToken(accessToken, accessSecret), nil
+}
@@ -0,0 +1,115 @@
+package updater
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+//
+// Fake OAuth server
+//
+
+// newFakeOAuthServer starts a server that implements just enough of Twitter's
+// OAuth 1.0a endpoints to run the PIN-based flow, issuing an access token for
+// screenName if it receives the right PIN.
+func newFakeOAuthServer(t *testing.T, pin, screenName string) *httptest.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/oauth/request_token", func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.Contains(auth, `oauth_consumer_key="consumer-key"`) ||
+			!strings.Contains(auth, `oauth_callback="oob"`) {
+			http.Error(w, "bad consumer", http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Fprintf(w, "oauth_token=request-token&oauth_token_secret=request-secret"+
+			"&oauth_callback_confirmed=true")
+	})
+
+	mux.HandleFunc("/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.Contains(auth, `oauth_token="request-token"`) ||
+			!strings.Contains(auth, fmt.Sprintf(`oauth_verifier="%s"`, pin)) {
+			http.Error(w, "bad verifier", http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Fprintf(w, "oauth_token=access-token&oauth_token_secret=access-secret"+
+			"&screen_name=%s&user_id=123", screenName)
+	})
+
+	mux.HandleFunc("/1.1/account/verify_credentials.json", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), `oauth_token="access-token"`) {
+			http.Error(w, `{"errors":[{"code":89,"message":"Invalid or expired token."}]}`,
+				http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Fprintf(w, `{"id":123,"screen_name":%q}`, screenName)
+	})
+
+	return httptest.NewServer(mux)
+}
+
+//
+// Tests
+//
+
+func TestAuthorizeWithPIN(t *testing.T) {
+	server := newFakeOAuthServer(t, "1234567", "perpetual")
+	defer server.Close()
+
+	var shownURL string
+	token, err := AuthorizeWithPIN("consumer-key", "consumer-secret", server.URL,
+		func(authorizationURL string) (string, error) {
+			shownURL = authorizationURL
+			return " 1234567\n", nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, "access-token", token.Token)
+	assert.Equal(t, "access-secret", token.TokenSecret)
+	assert.Equal(t, server.URL+"/oauth/authorize?oauth_token=request-token", shownURL)
+
+	// The new token works and belongs to the expected account
+	api := NewLiveTwitterAPI("consumer-key", "consumer-secret",
+		token.Token, token.TokenSecret, "perpetual")
+	api.BaseURL = server.URL
+
+	user, err := api.VerifyCredentials()
+	assert.NoError(t, err)
+	assert.Equal(t, &User{ID: 123, ScreenName: "perpetual"}, user)
+}
+
+func TestAuthorizeWithPIN_Failures(t *testing.T) {
+	server := newFakeOAuthServer(t, "1234567", "perpetual")
+	defer server.Close()
+
+	// The wrong PIN
+	_, err := AuthorizeWithPIN("consumer-key", "consumer-secret", server.URL,
+		func(string) (string, error) { return "7654321", nil })
+	assert.Error(t, err)
+
+	// No PIN
+	_, err = AuthorizeWithPIN("consumer-key", "consumer-secret", server.URL,
+		func(string) (string, error) { return "", nil })
+	assert.EqualError(t, err, "No PIN was entered")
+
+	// An unknown app
+	_, err = AuthorizeWithPIN("other-key", "consumer-secret", server.URL,
+		func(string) (string, error) { return "1234567", nil })
+	assert.Error(t, err)
+
+	// A token that doesn't work
+	api := NewLiveTwitterAPI("consumer-key", "consumer-secret",
+		"revoked-token", "revoked-secret", "perpetual")
+	api.BaseURL = server.URL
+
+	_, err = api.VerifyCredentials()
+	assert.Error(t, err)
+}
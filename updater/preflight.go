@@ -0,0 +1,112 @@
+package updater
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// preflightMinTimelineRequests is the number of timeline requests that should
+// be left in the current rate limit window for a run to be able to page all
+// the way back through the 3,200 tweets that Twitter makes available (at 200
+// per page).
+const preflightMinTimelineRequests = 16
+
+// PreflightChecker is implemented by APIs that can check ahead of time that
+// they'll be able to read an account's timeline and post to it. Update runs
+// the check on every invocation, even when nothing is due, so that problems
+// like revoked tokens, a suspended account, or a renamed screen name surface
+// long before an interval's target rather than at the moment it needs to
+// post.
+type PreflightChecker interface {
+	Preflight() (*PreflightResult, error)
+}
+
+// PreflightResult is the outcome of a successful preflight check.
+type PreflightResult struct {
+	// AccessLevel is the access level that the credentials were granted, like
+	// "read-write".
+	AccessLevel string
+
+	// TimelineRequestsRemaining is the number of timeline requests left in
+	// the current rate limit window.
+	TimelineRequestsRemaining int
+
+	// TimelineRequestsReset is when the current rate limit window resets.
+	TimelineRequestsReset time.Time
+
+	// User is the user that the credentials belong to.
+	User *User
+
+	// Warnings are problems that don't stop a run, but might. For example,
+	// a low timeline budget only matters when a run has to scan the
+	// timeline, which it doesn't when the last interval is in the state
+	// ledger, the marker, the tweet cache, or search.
+	Warnings []string
+}
+
+// liveRateLimitStatus is a rate limit status that we decoded in a response
+// from the Twitter API.
+type liveRateLimitStatus struct {
+	Resources map[string]map[string]struct {
+		Limit     int   `json:"limit"`
+		Remaining int   `json:"remaining"`
+		Reset     int64 `json:"reset"`
+	} `json:"resources"`
+}
+
+// Preflight checks that the API's credentials are valid, that they belong to
+// the account named by ScreenName, that they're allowed to post, and that
+// there's enough rate limit left to page through the account's timeline.
+func (a *LiveTwitterAPI) Preflight() (*PreflightResult, error) {
+	user, header, err := a.verifyCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("Error verifying credentials: %v", err)
+	}
+
+	result := &PreflightResult{
+		AccessLevel: header.Get("X-Access-Level"),
+		User:        user,
+	}
+
+	if !strings.EqualFold(user.ScreenName, a.ScreenName) {
+		return nil, fmt.Errorf("Credentials belong to @%s, but configured to post as @%s",
+			user.ScreenName, a.ScreenName)
+	}
+
+	if !strings.Contains(result.AccessLevel, "write") {
+		return nil, fmt.Errorf("Credentials don't have write access (access level: %q)",
+			result.AccessLevel)
+	}
+
+	req, err := a.newAuthorizedRequest("GET", "/1.1/application/rate_limit_status.json")
+	if err != nil {
+		return nil, err
+	}
+
+	query := req.URL.Query()
+	query.Add("resources", "statuses")
+
+	var status *liveRateLimitStatus
+	err = a.encodeAndExecuteRequest(req, query, &status)
+	if err != nil {
+		return nil, fmt.Errorf("Error checking rate limit: %v", err)
+	}
+
+	timeline, ok := status.Resources["statuses"]["/statuses/user_timeline"]
+	if !ok {
+		return nil, fmt.Errorf("Rate limit status didn't include the user timeline")
+	}
+
+	result.TimelineRequestsRemaining = timeline.Remaining
+	result.TimelineRequestsReset = time.Unix(timeline.Reset, 0)
+
+	if timeline.Remaining < preflightMinTimelineRequests {
+		result.Warnings = append(result.Warnings, fmt.Sprintf(
+			"Only %v timeline requests left until %v; a full scan of the timeline needs %v",
+			timeline.Remaining, result.TimelineRequestsReset.UTC().Format(time.RFC3339),
+			preflightMinTimelineRequests))
+	}
+
+	return result, nil
+}
@@ -0,0 +1,154 @@
+package updater
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+//
+// Mock preflight checker
+//
+
+type mockPreflightTwitterAPI struct {
+	mockTwitterAPI
+	err       error
+	numChecks int
+	warnings  []string
+}
+
+func (a *mockPreflightTwitterAPI) Preflight() (*PreflightResult, error) {
+	a.numChecks++
+	if a.err != nil {
+		return nil, a.err
+	}
+	return &PreflightResult{AccessLevel: "read-write", User: &User{ScreenName: "perpetual"},
+		Warnings: a.warnings}, nil
+}
+
+//
+// Tests
+//
+
+func TestLiveTwitterAPI_Preflight(t *testing.T) {
+	var accessLevel, screenName string
+	var remaining int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1.1/account/verify_credentials.json":
+			w.Header().Set("X-Access-Level", accessLevel)
+			fmt.Fprintf(w, `{"id":123,"screen_name":%q}`, screenName)
+		case "/1.1/application/rate_limit_status.json":
+			fmt.Fprintf(w, `{"resources":{"statuses":{"/statuses/user_timeline":`+
+				`{"limit":900,"remaining":%v,"reset":1500000000}}}}`, remaining)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	api := &LiveTwitterAPI{BaseURL: server.URL, HTTPClient: server.Client(), Logger: DiscardLogger, ScreenName: "Perpetual"}
+
+	// Everything in order (and screen names are case insensitive)
+	{
+		accessLevel, screenName, remaining = "read-write", "perpetual", 900
+
+		result, err := api.Preflight()
+		assert.NoError(t, err)
+		assert.Equal(t, "read-write", result.AccessLevel)
+		assert.Equal(t, 900, result.TimelineRequestsRemaining)
+		assert.Equal(t, time.Unix(1500000000, 0), result.TimelineRequestsReset)
+		assert.Equal(t, &User{ID: 123, ScreenName: "perpetual"}, result.User)
+		assert.Equal(t, 0, len(result.Warnings))
+	}
+
+	// The account was renamed, or the token belongs to someone else
+	{
+		accessLevel, screenName, remaining = "read-write", "someone_else", 900
+
+		_, err := api.Preflight()
+		assert.EqualError(t, err,
+			"Credentials belong to @someone_else, but configured to post as @Perpetual")
+	}
+
+	// Read-only credentials
+	{
+		accessLevel, screenName, remaining = "read", "perpetual", 900
+
+		_, err := api.Preflight()
+		assert.EqualError(t, err, `Credentials don't have write access (access level: "read")`)
+	}
+
+	// Not enough rate limit left to scan the timeline, which doesn't matter
+	// if the run won't need to
+	{
+		accessLevel, screenName, remaining = "read-write", "perpetual", 3
+
+		result, err := api.Preflight()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Only 3 timeline requests left until " +
+			"2017-07-14T02:40:00Z; a full scan of the timeline needs 16"}, result.Warnings)
+	}
+
+	// Revoked credentials
+	{
+		api := &LiveTwitterAPI{BaseURL: server.URL + "/revoked", HTTPClient: server.Client(),
+			Logger:     DiscardLogger,
+			ScreenName: "perpetual"}
+
+		_, err := api.Preflight()
+		assert.Error(t, err)
+	}
+}
+
+func TestUpdate_Preflight(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(1 * time.Minute), Message: "Interval 000"},
+	}
+
+	// Runs even when nothing is due
+	{
+		api := &mockPreflightTwitterAPI{}
+		result, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger})
+		assert.NoError(t, err)
+		assert.Equal(t, -1, result.PostedIntervalID)
+		assert.Equal(t, 1, api.numChecks)
+	}
+
+	// A failure stops everything
+	{
+		api := &mockPreflightTwitterAPI{err: fmt.Errorf("account suspended")}
+		_, err := Update(api, intervals, now.Add(2*time.Minute), &UpdateOptions{Logger: DiscardLogger})
+		assert.EqualError(t, err, "Preflight check failed: account suspended")
+		assert.Equal(t, 0, len(api.posted))
+	}
+
+	// Warnings are logged, but don't stop a post
+	{
+		var buf bytes.Buffer
+		api := &mockPreflightTwitterAPI{warnings: []string{"Only 3 timeline requests left"}}
+		result, err := Update(api, intervals, now.Add(2*time.Minute),
+			&UpdateOptions{Logger: NewTextLogger(&buf, LogLevelInfo)})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, result.PostedIntervalID)
+		assert.Contains(t, buf.String(),
+			`warning="Only 3 timeline requests left"`)
+	}
+
+	// Unless skipped
+	{
+		api := &mockPreflightTwitterAPI{err: fmt.Errorf("account suspended")}
+		result, err := Update(api, intervals, now.Add(2*time.Minute),
+			&UpdateOptions{Logger: DiscardLogger, SkipPreflight: true})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, result.PostedIntervalID)
+		assert.Equal(t, 0, api.numChecks)
+	}
+}
@@ -0,0 +1,168 @@
+package updater
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MissingPostPolicy is what Update does about interval posts that the state
+// ledger says exist, but which can no longer be found.
+type MissingPostPolicy string
+
+// The possible policies for missing posts.
+const (
+	// MissingPostHalt refuses to do anything until someone intervenes. This
+	// is the default.
+	MissingPostHalt MissingPostPolicy = "halt"
+
+	// MissingPostMarkLost marks missing intervals as lost in the ledger, and
+	// carries on without posting them again.
+	MissingPostMarkLost MissingPostPolicy = "mark_lost"
+
+	// MissingPostRepost posts missing intervals again.
+	MissingPostRepost MissingPostPolicy = "repost"
+)
+
+// ParseMissingPostPolicy parses the name of a missing post policy. An empty
+// name is the default, MissingPostHalt.
+func ParseMissingPostPolicy(name string) (MissingPostPolicy, error) {
+	switch MissingPostPolicy(name) {
+	case "", MissingPostHalt:
+		return MissingPostHalt, nil
+	case MissingPostMarkLost, MissingPostRepost:
+		return MissingPostPolicy(name), nil
+	}
+
+	return "", fmt.Errorf("Unknown missing post policy: %q (should be %q, %q, or %q)",
+		name, MissingPostHalt, MissingPostMarkLost, MissingPostRepost)
+}
+
+// MissingPostsError is returned by Update when interval posts have gone
+// missing and the policy is MissingPostHalt.
+type MissingPostsError struct {
+	// Missing are the ledger records of the posts that are missing.
+	Missing []*PostRecord
+}
+
+func (e *MissingPostsError) Error() string {
+	parts := make([]string, len(e.Missing))
+	for i, record := range e.Missing {
+		parts[i] = fmt.Sprintf("LHI%03d (tweet %v)", record.IntervalID, record.TweetID)
+	}
+
+	return fmt.Sprintf("Interval posts are missing: %s; halting for manual intervention",
+		strings.Join(parts, ", "))
+}
+
+// Reconcile compares the interval posts that the ledger says exist against
+// what actually exists by looking their tweets up by ID. It returns the
+// records of any that are missing, which usually means that they were
+// deleted.
+//
+// Only records that were posted and have a known tweet ID are checked.
+func Reconcile(api TwitterAPI, state *State) ([]*PostRecord, error) {
+	var ids []uint64
+	for _, record := range state.Posts {
+		if record.Status == PostStatusPosted && record.TweetID != 0 {
+			ids = append(ids, record.TweetID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	found := make(map[uint64]bool, len(ids))
+	for i := 0; i < len(ids); i += maxLookupTweets {
+		end := i + maxLookupTweets
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		tweets, err := api.LookupTweets(ids[i:end])
+		if err != nil {
+			return nil, fmt.Errorf("Error looking up interval posts: %v", err)
+		}
+
+		for _, tweet := range tweets {
+			found[tweet.ID] = true
+		}
+	}
+
+	var missing []*PostRecord
+	for _, record := range state.Posts {
+		if record.Status == PostStatusPosted && record.TweetID != 0 && !found[record.TweetID] {
+			missing = append(missing, record)
+		}
+	}
+
+	return missing, nil
+}
+
+//
+// Private
+//
+
+// maxLookupTweets is the largest number of tweets that can be looked up in
+// a single request.
+const maxLookupTweets = 100
+
+// reconcileState reconciles the ledger and then handles any missing posts
+// according to policy. It returns true if the state changed, which it may
+// have even if an error is also returned.
+func reconcileState(api TwitterAPI, logger Logger, intervals []*Interval, state *State,
+	opts *UpdateOptions) (bool, error) {
+
+	missing, err := Reconcile(api, state)
+	if err != nil {
+		return false, err
+	}
+
+	if len(missing) == 0 {
+		return false, nil
+	}
+
+	for _, record := range missing {
+		logger.Warn("Interval post is missing",
+			LogKeyIntervalID, record.IntervalID, LogKeyTweetID, record.TweetID)
+	}
+
+	switch opts.MissingPostPolicy {
+	case "", MissingPostHalt:
+		return false, &MissingPostsError{Missing: missing}
+
+	case MissingPostMarkLost:
+		for _, record := range missing {
+			record.Status = PostStatusLost
+		}
+		return true, nil
+
+	case MissingPostRepost:
+		// Any reposts that succeed are reported as changes even if a later
+		// one fails so that they're saved and never posted a third time.
+		var changed bool
+		for _, record := range missing {
+			if record.IntervalID >= len(intervals) {
+				return changed, fmt.Errorf("Can't repost interval %v; it's not in the schedule",
+					record.IntervalID)
+			}
+
+			tweet, proof, err := postInterval(api, logger, intervals, record.IntervalID, opts)
+			if err != nil {
+				return changed, fmt.Errorf("Error reposting interval %v: %v",
+					record.IntervalID, err)
+			}
+
+			record.PostedAt = tweet.CreatedAt
+			record.ProofTweetID = 0
+			if proof != nil {
+				record.ProofTweetID = proof.ID
+			}
+			record.TweetID = tweet.ID
+			changed = true
+		}
+		return changed, nil
+	}
+
+	return false, fmt.Errorf("Unknown missing post policy: %q", opts.MissingPostPolicy)
+}
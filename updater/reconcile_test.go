@@ -0,0 +1,133 @@
+package updater
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestParseMissingPostPolicy(t *testing.T) {
+	policy, err := ParseMissingPostPolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, MissingPostHalt, policy)
+
+	policy, err = ParseMissingPostPolicy("repost")
+	assert.NoError(t, err)
+	assert.Equal(t, MissingPostRepost, policy)
+
+	_, err = ParseMissingPostPolicy("shrug")
+	assert.Error(t, err)
+}
+
+func TestReconcile(t *testing.T) {
+	api := &mockTwitterAPI{
+		deleted: map[uint64]bool{2: true},
+		posted:  []*Tweet{{ID: 1}, {ID: 2}, {ID: 3}},
+	}
+
+	state := &State{Posts: []*PostRecord{
+		{IntervalID: 0, Status: PostStatusPosted, TweetID: 1},
+		{IntervalID: 1, Status: PostStatusPosted, TweetID: 2},
+
+		// Only posted records with a known tweet are checked
+		{IntervalID: 2, Status: PostStatusLost, TweetID: 4},
+		{IntervalID: 3, Status: PostStatusPosted},
+		{IntervalID: 4, Status: PostStatusPending},
+	}}
+
+	missing, err := Reconcile(api, state)
+	assert.NoError(t, err)
+	assert.Equal(t, []*PostRecord{state.Posts[1]}, missing)
+}
+
+func TestUpdate_MissingPosts(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-2 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 001"},
+		{Target: now.Add(1 * time.Hour), Message: "Interval 002"},
+	}
+
+	newFixtures := func() (*mockTwitterAPI, *mockStateStore) {
+		api := &mockTwitterAPI{
+			deleted: map[uint64]bool{1: true},
+			posted:  []*Tweet{{ID: 1}, {ID: 2}},
+		}
+		store := &mockStateStore{state: &State{Posts: []*PostRecord{
+			{IntervalID: 0, Status: PostStatusPosted, TweetID: 1},
+			{IntervalID: 1, Status: PostStatusPosted, TweetID: 2},
+		}}}
+		return api, store
+	}
+
+	// Halt
+	{
+		api, store := newFixtures()
+
+		_, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger, StateStore: store})
+		assert.EqualError(t, err, "Interval posts are missing: LHI000 (tweet 1); "+
+			"halting for manual intervention")
+		assert.Equal(t, 2, len(api.posted))
+		assert.Equal(t, 0, store.numSaves)
+	}
+
+	// Mark lost
+	{
+		api, store := newFixtures()
+
+		result, err := Update(api, intervals, now, &UpdateOptions{
+			Logger:            DiscardLogger,
+			MissingPostPolicy: MissingPostMarkLost,
+			StateStore:        store,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, -1, result.PostedIntervalID)
+		assert.Equal(t, 2, len(api.posted))
+		assert.Equal(t, PostStatusLost, store.state.Posts[0].Status)
+	}
+
+	// Repost
+	{
+		api, store := newFixtures()
+
+		result, err := Update(api, intervals, now, &UpdateOptions{
+			Logger:            DiscardLogger,
+			MissingPostPolicy: MissingPostRepost,
+			StateStore:        store,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, -1, result.PostedIntervalID)
+		assert.Equal(t, 3, len(api.posted))
+		assert.Equal(t, FormatInterval(0, "Interval 000"), api.posted[2].Message)
+		assert.Equal(t, PostStatusPosted, store.state.Posts[0].Status)
+		assert.Equal(t, api.posted[2].ID, store.state.Posts[0].TweetID)
+
+		// Nothing's missing anymore
+		_, err = Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger, StateStore: store})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(api.posted))
+	}
+}
+
+func TestLiveTwitterAPI_LookupTweets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/1.1/statuses/lookup.json", r.URL.Path)
+		assert.Equal(t, "1,2", r.URL.Query().Get("id"))
+
+		// Tweets that don't exist are left out
+		json.NewEncoder(w).Encode([]*liveTweet{
+			{CreatedAt: formatTwitterTime(time.Now()), ID: 1, Text: "tweet 1"},
+		})
+	}))
+	defer server.Close()
+
+	api := &LiveTwitterAPI{BaseURL: server.URL, HTTPClient: server.Client(), Logger: DiscardLogger, ScreenName: "perpetual"}
+
+	tweets, err := api.LookupTweets([]uint64{1, 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1}, tweetIDs(tweets))
+}
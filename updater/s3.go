@@ -0,0 +1,238 @@
+package updater
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxS3CacheAttempts is how many times saving to an S3TweetCache is tried
+// when it loses a race with another writer.
+const maxS3CacheAttempts = 3
+
+// errS3PreconditionFailed is returned from putS3Object when the object was
+// modified since its ETag was read.
+var errS3PreconditionFailed = errors.New("Object was modified concurrently")
+
+//
+// State store
+//
+
+// S3StateStore is a StateStore kept as a JSON object in an S3-compatible
+// bucket. Its compare-and-swap is a conditional PutObject with If-Match on
+// the ETag of the object that was checked (or If-None-Match if there wasn't
+// one), so the store must support conditional writes.
+type S3StateStore struct {
+	// Bucket is the bucket that the object is kept in.
+	Bucket string
+
+	// Client is the S3 client. For stores other than S3, it'll usually need
+	// an endpoint and path-style addressing.
+	Client *s3.S3
+
+	// Key is the object's key.
+	Key string
+}
+
+// LoadState reads state from the object.
+func (s *S3StateStore) LoadState() (*State, error) {
+	state, _, err := s.loadState()
+	return state, err
+}
+
+// SaveState writes state to the object, as long as the object is still the
+// version that state was loaded from and wasn't saved under a newer lease.
+func (s *S3StateStore) SaveState(state *State) error {
+	current, etag, err := s.loadState()
+	if err != nil {
+		return err
+	}
+
+	err = checkStateSave(current, state)
+	if err != nil {
+		return err
+	}
+
+	state.Version++
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		state.Version--
+		return err
+	}
+
+	err = putS3Object(s.Client, s.Bucket, s.Key, data, etag)
+	if err != nil {
+		state.Version--
+
+		if err == errS3PreconditionFailed {
+			return ErrStateConflict
+		}
+		return err
+	}
+
+	return nil
+}
+
+// loadState reads state along with the ETag of the object that it was read
+// from, which is empty if there's no object yet.
+func (s *S3StateStore) loadState() (*State, string, error) {
+	data, etag, err := getS3Object(s.Client, s.Bucket, s.Key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if data == nil {
+		return &State{}, "", nil
+	}
+
+	var state State
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error decoding state s3://%v/%v: %v", s.Bucket, s.Key, err)
+	}
+
+	return &state, etag, nil
+}
+
+//
+// Tweet cache
+//
+
+// S3TweetCache is a TweetCache kept as a JSON object in an S3-compatible
+// bucket. Saves are conditional writes, and are merged again and retried if
+// someone else saved in between.
+type S3TweetCache struct {
+	// Bucket is the bucket that the object is kept in.
+	Bucket string
+
+	// Client is the S3 client.
+	Client *s3.S3
+
+	// Key is the object's key.
+	Key string
+}
+
+// LoadTweets gets all tweets in the object. An object that doesn't exist is
+// treated as an empty cache.
+func (c *S3TweetCache) LoadTweets() ([]*Tweet, error) {
+	tweets, _, err := c.loadTweets()
+	return tweets, err
+}
+
+// SaveTweets merges tweets into the object.
+func (c *S3TweetCache) SaveTweets(tweets []*Tweet) error {
+	var err error
+
+	for attempt := 0; attempt < maxS3CacheAttempts; attempt++ {
+		var existing []*Tweet
+		var etag string
+		existing, etag, err = c.loadTweets()
+		if err != nil {
+			return err
+		}
+
+		var data []byte
+		data, err = encodeTweetCache(mergeTweets(existing, tweets))
+		if err != nil {
+			return err
+		}
+
+		err = putS3Object(c.Client, c.Bucket, c.Key, data, etag)
+		if err != errS3PreconditionFailed {
+			return err
+		}
+	}
+
+	return fmt.Errorf("Error saving tweet cache s3://%v/%v after %v attempts: %v",
+		c.Bucket, c.Key, maxS3CacheAttempts, err)
+}
+
+func (c *S3TweetCache) loadTweets() ([]*Tweet, string, error) {
+	data, etag, err := getS3Object(c.Client, c.Bucket, c.Key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if data == nil {
+		return nil, "", nil
+	}
+
+	tweets, err := decodeTweetCache(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error decoding tweet cache s3://%v/%v: %v",
+			c.Bucket, c.Key, err)
+	}
+
+	return tweets, etag, nil
+}
+
+//
+// Private
+//
+
+// getS3Object gets an object's contents and ETag, returning nil contents if
+// it doesn't exist.
+func getS3Object(client *s3.S3, bucket, key string) ([]byte, string, error) {
+	out, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("Error getting s3://%v/%v: %v", bucket, key, err)
+	}
+	defer out.Body.Close()
+
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error reading s3://%v/%v: %v", bucket, key, err)
+	}
+
+	return data, aws.StringValue(out.ETag), nil
+}
+
+// putS3Object writes an object as long as its ETag is still etag, or as long
+// as it doesn't exist if etag is empty. Otherwise, errS3PreconditionFailed
+// is returned.
+func putS3Object(client *s3.S3, bucket, key string, data []byte, etag string) error {
+	req, _ := client.PutObjectRequest(&s3.PutObjectInput{
+		Body:        bytes.NewReader(data),
+		Bucket:      aws.String(bucket),
+		ContentType: aws.String("application/json"),
+		Key:         aws.String(key),
+	})
+
+	// The SDK doesn't model conditional writes, so the headers are set
+	// directly
+	if etag == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", etag)
+	}
+
+	err := req.Send()
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		// S3 returns a 409 instead of a 412 if there's a conditional write
+		// to the same object in flight
+		if reqErr.StatusCode() == http.StatusPreconditionFailed ||
+			reqErr.StatusCode() == http.StatusConflict {
+
+			return errS3PreconditionFailed
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Error putting s3://%v/%v: %v", bucket, key, err)
+	}
+
+	return nil
+}
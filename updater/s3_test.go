@@ -0,0 +1,196 @@
+package updater
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	assert "github.com/stretchr/testify/require"
+)
+
+//
+// Fake S3 server
+//
+
+// fakeS3Server is an in-process stand-in for an S3-compatible store that
+// supports just enough to keep objects in it: GetObject and PutObject with
+// path-style addressing, including conditional writes with If-Match and
+// If-None-Match.
+type fakeS3Server struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	puts    int
+}
+
+func (s *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, exists := s.objects[r.URL.Path]
+
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			writeFakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		w.Header().Set("ETag", fakeS3ETag(data))
+		w.Write(data)
+
+	case http.MethodPut:
+		if match := r.Header.Get("If-Match"); match != "" &&
+			(!exists || match != fakeS3ETag(data)) {
+
+			writeFakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			writeFakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeFakeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+
+		if s.objects == nil {
+			s.objects = make(map[string][]byte)
+		}
+		s.objects[r.URL.Path] = body
+		s.puts++
+
+		w.Header().Set("ETag", fakeS3ETag(body))
+
+	default:
+		writeFakeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+//
+// Tests
+//
+
+func TestS3StateStore(t *testing.T) {
+	client, server := newFakeS3(t)
+	defer server.Close()
+
+	testStateStore(t, &S3StateStore{Bucket: "perpetual", Client: client, Key: "state.json"})
+}
+
+func TestS3TweetCache(t *testing.T) {
+	client, server := newFakeS3(t)
+	defer server.Close()
+
+	cache := &S3TweetCache{Bucket: "perpetual", Client: client, Key: "tweets.json"}
+
+	tweets, err := cache.LoadTweets()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(tweets))
+
+	now := time.Now().UTC().Truncate(time.Second)
+	assert.NoError(t, cache.SaveTweets([]*Tweet{{CreatedAt: now, ID: 1, Message: "a"}}))
+	assert.NoError(t, cache.SaveTweets([]*Tweet{{CreatedAt: now, ID: 2, Message: "b"}}))
+
+	tweets, err = cache.LoadTweets()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{2, 1}, tweetIDs(tweets))
+	assert.Equal(t, now, tweets[0].CreatedAt)
+
+	// Saves that overlap are both merged in
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			assert.NoError(t, cache.SaveTweets([]*Tweet{{CreatedAt: now, ID: id}}))
+		}(uint64(3 + i))
+	}
+	wg.Wait()
+
+	tweets, err = cache.LoadTweets()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{4, 3, 2, 1}, tweetIDs(tweets))
+}
+
+func TestPutS3Object(t *testing.T) {
+	client, server := newFakeS3(t)
+	defer server.Close()
+
+	// Only if it doesn't exist
+	assert.NoError(t, putS3Object(client, "perpetual", "obj", []byte("a"), ""))
+	assert.Equal(t, errS3PreconditionFailed,
+		putS3Object(client, "perpetual", "obj", []byte("b"), ""))
+
+	data, etag, err := getS3Object(client, "perpetual", "obj")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+
+	// Only if it hasn't changed
+	assert.NoError(t, putS3Object(client, "perpetual", "obj", []byte("b"), etag))
+	assert.Equal(t, errS3PreconditionFailed,
+		putS3Object(client, "perpetual", "obj", []byte("c"), etag))
+	assert.Equal(t, 2, server.Config.Handler.(*fakeS3Server).puts)
+
+	// Doesn't exist
+	data, etag, err = getS3Object(client, "perpetual", "missing")
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+	assert.Equal(t, "", etag)
+}
+
+func TestUpdate_S3(t *testing.T) {
+	client, server := newFakeS3(t)
+	defer server.Close()
+
+	store := &S3StateStore{Bucket: "perpetual", Client: client, Key: "state.json"}
+	testUpdateConcurrently(t, &UpdateOptions{
+		Locker:     &StateLocker{Store: store},
+		Logger:     DiscardLogger,
+		StateStore: store,
+	})
+}
+
+//
+// Private
+//
+
+func fakeS3ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// newFakeS3 starts a fake S3 server along with a client that talks to it.
+func newFakeS3(t *testing.T) (*s3.S3, *httptest.Server) {
+	server := httptest.NewServer(&fakeS3Server{})
+
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("fake", "fake", ""),
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	assert.NoError(t, err)
+
+	return s3.New(sess), server
+}
+
+func writeFakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>`+
+		`<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
@@ -0,0 +1,129 @@
+package updater
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Interval messages can be sealed so that anyone who can read the schedule
+// (say, from the repository or a deployed package) can't read messages until
+// they're posted. Sealed messages are encrypted with NaCl's secretbox using a
+// symmetric key that's only supplied at runtime.
+
+// messageKeySize is the size in bytes of a key used to seal messages.
+const messageKeySize = 32
+
+// nonceSize is the size in bytes of the random nonce prepended to a sealed
+// message.
+const nonceSize = 24
+
+// MessageKey is a key used to seal and open interval messages.
+type MessageKey [messageKeySize]byte
+
+// DecodeMessageKey decodes a message key like the one returned by
+// GenerateMessageKey.
+func DecodeMessageKey(encoded string) (*MessageKey, error) {
+	data, err := signatureEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding message key: %v", err)
+	}
+
+	if len(data) != messageKeySize {
+		return nil, fmt.Errorf("Message key should be %v bytes, but was %v",
+			messageKeySize, len(data))
+	}
+
+	var key MessageKey
+	copy(key[:], data)
+	return &key, nil
+}
+
+// GenerateMessageKey generates a new random key for sealing messages.
+func GenerateMessageKey() (*MessageKey, error) {
+	var key MessageKey
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// Encode encodes the key so that it can be stored as a secret and later
+// decoded with DecodeMessageKey.
+func (k *MessageKey) Encode() string {
+	return signatureEncoding.EncodeToString(k[:])
+}
+
+// OpenMessage decrypts a message that was sealed with SealMessage.
+func OpenMessage(key *MessageKey, sealed string) (string, error) {
+	data, err := signatureEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", fmt.Errorf("Error decoding sealed message: %v", err)
+	}
+
+	if len(data) < nonceSize+secretbox.Overhead {
+		return "", fmt.Errorf("Sealed message is too short")
+	}
+
+	var nonce [nonceSize]byte
+	copy(nonce[:], data[:nonceSize])
+
+	message, ok := secretbox.Open(nil, data[nonceSize:], &nonce, (*[messageKeySize]byte)(key))
+	if !ok {
+		return "", fmt.Errorf("Couldn't open sealed message; wrong key or corrupted message")
+	}
+
+	return string(message), nil
+}
+
+// ResealMessage opens a sealed message with one key and seals it again with
+// another.
+func ResealMessage(oldKey, newKey *MessageKey, sealed string) (string, error) {
+	message, err := OpenMessage(oldKey, sealed)
+	if err != nil {
+		return "", err
+	}
+
+	return SealMessage(newKey, message)
+}
+
+// SealMessage encrypts a message so that it can be stored in an interval's
+// Sealed field.
+func SealMessage(key *MessageKey, message string) (string, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+
+	data := secretbox.Seal(nonce[:], []byte(message), &nonce, (*[messageKeySize]byte)(key))
+	return signatureEncoding.EncodeToString(data), nil
+}
+
+// Open gets the interval's message, opening it with key if it was sealed. key
+// may be nil if the interval isn't sealed.
+func (i *Interval) Open(key *MessageKey) (string, error) {
+	if i.Sealed == "" {
+		return i.Message, nil
+	}
+
+	if key == nil {
+		return "", fmt.Errorf("Interval is sealed, but no message key was provided")
+	}
+
+	return OpenMessage(key, i.Sealed)
+}
+
+// OpenSalt gets the interval's commitment salt, opening it with key if it
+// was sealed. It's empty if the interval isn't committed to.
+func (i *Interval) OpenSalt(key *MessageKey) (string, error) {
+	if i.SealedSalt == "" {
+		return i.Salt, nil
+	}
+
+	if key == nil {
+		return "", fmt.Errorf("Interval's salt is sealed, but no message key was provided")
+	}
+
+	return OpenMessage(key, i.SealedSalt)
+}
@@ -0,0 +1,118 @@
+package updater
+
+import (
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestSealMessage(t *testing.T) {
+	key := mustGenerateMessageKey(t)
+
+	sealed, err := SealMessage(key, "Interval 000")
+	assert.NoError(t, err)
+	assert.NotContains(t, sealed, "Interval")
+
+	message, err := OpenMessage(key, sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "Interval 000", message)
+
+	// Sealing the same message twice produces different output because of
+	// the random nonce
+	other, err := SealMessage(key, "Interval 000")
+	assert.NoError(t, err)
+	assert.NotEqual(t, sealed, other)
+
+	// The wrong key
+	_, err = OpenMessage(mustGenerateMessageKey(t), sealed)
+	assert.Error(t, err)
+
+	// Tampering
+	tampered := []byte(sealed)
+	tampered[len(tampered)-1] ^= 0x01
+	_, err = OpenMessage(key, string(tampered))
+	assert.Error(t, err)
+
+	// Garbage
+	_, err = OpenMessage(key, "short")
+	assert.Error(t, err)
+}
+
+func TestDecodeMessageKey(t *testing.T) {
+	key := mustGenerateMessageKey(t)
+
+	decoded, err := DecodeMessageKey(key.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, key, decoded)
+
+	_, err = DecodeMessageKey("c2hvcnQ")
+	assert.Error(t, err)
+
+	_, err = DecodeMessageKey("not a key")
+	assert.Error(t, err)
+}
+
+func TestResealMessage(t *testing.T) {
+	oldKey := mustGenerateMessageKey(t)
+	newKey := mustGenerateMessageKey(t)
+
+	sealed, err := SealMessage(oldKey, "Interval 000")
+	assert.NoError(t, err)
+
+	resealed, err := ResealMessage(oldKey, newKey, sealed)
+	assert.NoError(t, err)
+
+	_, err = OpenMessage(oldKey, resealed)
+	assert.Error(t, err)
+
+	message, err := OpenMessage(newKey, resealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "Interval 000", message)
+}
+
+func TestUpdate_Sealed(t *testing.T) {
+	key := mustGenerateMessageKey(t)
+
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now, Sealed: mustSealMessage(t, key, "Interval 000")},
+
+		// Sealed with a different key to show that only the interval being
+		// posted is ever opened
+		{Target: now.Add(1 * time.Minute),
+			Sealed: mustSealMessage(t, mustGenerateMessageKey(t), "Interval 001")},
+	}
+
+	// Without a key
+	{
+		_, err := Update(&mockTwitterAPI{}, intervals, now, &UpdateOptions{Logger: DiscardLogger})
+		assert.EqualError(t, err, "Error opening interval 0: "+
+			"Interval is sealed, but no message key was provided")
+	}
+
+	// With a key
+	{
+		api := &mockTwitterAPI{}
+		result, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger, MessageKey: key})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, result.PostedIntervalID)
+		assert.Equal(t, "LHI000: Interval 000", api.posted[0].Message)
+	}
+}
+
+//
+// Helpers
+//
+
+func mustGenerateMessageKey(t *testing.T) *MessageKey {
+	key, err := GenerateMessageKey()
+	assert.NoError(t, err)
+	return key
+}
+
+func mustSealMessage(t *testing.T, key *MessageKey, message string) string {
+	sealed, err := SealMessage(key, message)
+	assert.NoError(t, err)
+	return sealed
+}
@@ -0,0 +1,216 @@
+package updater
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// keySeparator separates the message of the base interval from the
+// fingerprint of the public key that can be used to verify the series.
+const keySeparator = "\n\nkey:"
+
+// signatureSeparator separates an interval's message from its signature.
+const signatureSeparator = "\n\nsig:"
+
+// Signatures and keys are encoded compactly as unpadded URL-safe base64 so
+// that they take as few of a tweet's characters as possible (an Ed25519
+// signature comes out to 86 characters).
+var signatureEncoding = base64.RawURLEncoding
+
+// Signer signs interval posts so that readers can verify that they were
+// produced by the holder of a particular private key and not an impersonator.
+type Signer struct {
+	privateKey ed25519.PrivateKey
+}
+
+// NewSigner initializes a signer from an encoded private key seed like the
+// one returned by GenerateSigningKey.
+func NewSigner(encodedSeed string) (*Signer, error) {
+	seed, err := signatureEncoding.DecodeString(encodedSeed)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding signing key: %v", err)
+	}
+
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("Signing key should be %v bytes, but was %v",
+			ed25519.SeedSize, len(seed))
+	}
+
+	return &Signer{privateKey: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// GenerateSigningKey generates a new key pair, returning an encoded private
+// key seed suitable for use with NewSigner and an encoded public key suitable
+// for use with DecodePublicKey.
+func GenerateSigningKey() (string, string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	return signatureEncoding.EncodeToString(privateKey.Seed()),
+		signatureEncoding.EncodeToString(publicKey), nil
+}
+
+// DecodePublicKey decodes a public key like the one returned by
+// GenerateSigningKey.
+func DecodePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := signatureEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding public key: %v", err)
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Public key should be %v bytes, but was %v",
+			ed25519.PublicKeySize, len(key))
+	}
+
+	return ed25519.PublicKey(key), nil
+}
+
+// KeyFingerprint produces a short, human-comparable fingerprint for a public
+// key. It's published along with the base interval.
+func KeyFingerprint(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return "SHA256:" + signatureEncoding.EncodeToString(sum[:])
+}
+
+// PublicKey returns the public key corresponding to the signer's private key.
+func (s *Signer) PublicKey() ed25519.PublicKey {
+	return s.privateKey.Public().(ed25519.PublicKey)
+}
+
+// FormatInterval formats an interval message into a full tweet like the
+// package-level FormatInterval, but also appends a signature over the
+// interval's ID, target, and message. The base interval additionally gets the
+// fingerprint of the signer's public key (which is covered by the signature).
+func (s *Signer) FormatInterval(id int, target time.Time, message string) string {
+	if id == 0 {
+		message += keySeparator + KeyFingerprint(s.PublicKey())
+	}
+
+	signature := ed25519.Sign(s.privateKey, signaturePayload(id, target, message))
+
+	return FormatInterval(id, message) + signatureSeparator +
+		signatureEncoding.EncodeToString(signature)
+}
+
+// SignatureStatus is the result of verifying a single interval post.
+type SignatureStatus string
+
+// The possible results of verifying an interval post.
+const (
+	SignatureInvalid         SignatureStatus = "invalid"
+	SignatureUnknownInterval SignatureStatus = "unknown_interval"
+	SignatureUnsigned        SignatureStatus = "unsigned"
+	SignatureValid           SignatureStatus = "valid"
+)
+
+// SignatureResult is the result of verifying an interval post.
+type SignatureResult struct {
+	// Fingerprint is the key fingerprint published with the base interval.
+	// It's only set for interval 000.
+	Fingerprint string
+
+	// IntervalID is the ID of the interval that the post claimed to be.
+	IntervalID int
+
+	// Status is the outcome of verification.
+	Status SignatureStatus
+
+	// Tweet is the tweet that was verified.
+	Tweet *Tweet
+}
+
+// VerifyTweet checks whether a tweet is a validly signed interval post. ok is
+// false if the tweet isn't an interval post at all.
+func VerifyTweet(publicKey ed25519.PublicKey, intervals []*Interval,
+	tweet *Tweet) (*SignatureResult, bool) {
+
+	// The API returns tweets with some characters escaped as HTML entities,
+	// which we have to undo to get back to what was signed.
+	text := html.UnescapeString(tweet.Message)
+
+	id, ok := extractIntervalID(text)
+	if !ok {
+		return nil, false
+	}
+
+	result := &SignatureResult{IntervalID: id, Tweet: tweet}
+
+	message := strings.TrimPrefix(text, FormatInterval(id, ""))
+
+	sepIndex := strings.LastIndex(message, signatureSeparator)
+	if sepIndex == -1 {
+		result.Status = SignatureUnsigned
+		return result, true
+	}
+
+	encodedSignature := message[sepIndex+len(signatureSeparator):]
+	message = message[:sepIndex]
+
+	if id == 0 {
+		if keyIndex := strings.LastIndex(message, keySeparator); keyIndex != -1 {
+			result.Fingerprint = message[keyIndex+len(keySeparator):]
+		}
+	}
+
+	if id >= len(intervals) {
+		result.Status = SignatureUnknownInterval
+		return result, true
+	}
+
+	signature, err := signatureEncoding.DecodeString(encodedSignature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		result.Status = SignatureInvalid
+		return result, true
+	}
+
+	payload := signaturePayload(id, intervals[id].Target, message)
+	if !ed25519.Verify(publicKey, payload, signature) {
+		result.Status = SignatureInvalid
+		return result, true
+	}
+
+	result.Status = SignatureValid
+	return result, true
+}
+
+// VerifyTimeline walks an account's entire available timeline and verifies
+// every interval post that it finds, returning results in the same reverse
+// chronological order as the timeline.
+func VerifyTimeline(api TwitterAPI, publicKey ed25519.PublicKey,
+	intervals []*Interval) ([]*SignatureResult, error) {
+
+	var results []*SignatureResult
+
+	it := api.ListTweets()
+	for it.Next() {
+		result, ok := VerifyTweet(publicKey, intervals, it.Value())
+		if ok {
+			results = append(results, result)
+		}
+	}
+
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+
+	return results, nil
+}
+
+// signaturePayload produces the bytes that get signed for an interval. The
+// target is included so that a post can't be lifted from one series and
+// replayed into another with a different schedule. Links are normalized
+// because Twitter rewrites them to t.co links, which would otherwise break
+// the signature of any message containing one.
+func signaturePayload(id int, target time.Time, message string) []byte {
+	return []byte(fmt.Sprintf("LHI%03d\n%s\n%s",
+		id, target.UTC().Format(time.RFC3339), normalizeLinks(message)))
+}
@@ -0,0 +1,188 @@
+package updater
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestNewSigner(t *testing.T) {
+	seed, publicKey, err := GenerateSigningKey()
+	assert.NoError(t, err)
+
+	signer, err := NewSigner(seed)
+	assert.NoError(t, err)
+
+	decoded, err := DecodePublicKey(publicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, decoded, signer.PublicKey())
+
+	_, err = NewSigner("not-a-key")
+	assert.Error(t, err)
+
+	_, err = NewSigner("c2hvcnQ")
+	assert.Error(t, err)
+}
+
+func TestVerifyTweet(t *testing.T) {
+	signer := mustGenerateSigner(t)
+
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now, Message: "Interval 000"},
+		{Target: now.Add(1 * time.Minute), Message: "Interval 001 & more"},
+	}
+
+	// A valid signature on a base interval which also carries the key
+	// fingerprint
+	{
+		message := signer.FormatInterval(0, intervals[0].Target, intervals[0].Message)
+		assert.True(t, strings.HasPrefix(message, "LHI000: Interval 000\n\nkey:SHA256:"))
+
+		result, ok := VerifyTweet(signer.PublicKey(), intervals, &Tweet{Message: message})
+		assert.True(t, ok)
+		assert.Equal(t, SignatureValid, result.Status)
+		assert.Equal(t, 0, result.IntervalID)
+		assert.Equal(t, KeyFingerprint(signer.PublicKey()), result.Fingerprint)
+	}
+
+	// A valid signature, even after the API has escaped HTML entities
+	{
+		message := signer.FormatInterval(1, intervals[1].Target, intervals[1].Message)
+		message = strings.Replace(message, "&", "&amp;", -1)
+
+		result, ok := VerifyTweet(signer.PublicKey(), intervals, &Tweet{Message: message})
+		assert.True(t, ok)
+		assert.Equal(t, SignatureValid, result.Status)
+		assert.Equal(t, "", result.Fingerprint)
+	}
+
+	// A valid signature, even after Twitter has rewritten a link to t.co
+	{
+		message := signer.FormatInterval(1, intervals[1].Target,
+			"Interval 001 https://example.com/more")
+		message = strings.Replace(message, "https://example.com/more", "https://t.co/abc123", 1)
+
+		result, ok := VerifyTweet(signer.PublicKey(), intervals, &Tweet{Message: message})
+		assert.True(t, ok)
+		assert.Equal(t, SignatureValid, result.Status)
+	}
+
+	// An altered message
+	{
+		message := signer.FormatInterval(1, intervals[1].Target, intervals[1].Message)
+		message = strings.Replace(message, "Interval 001", "Interval 002", 1)
+
+		result, ok := VerifyTweet(signer.PublicKey(), intervals, &Tweet{Message: message})
+		assert.True(t, ok)
+		assert.Equal(t, SignatureInvalid, result.Status)
+	}
+
+	// Signed with a target that doesn't match the schedule
+	{
+		message := signer.FormatInterval(1, now, intervals[1].Message)
+
+		result, ok := VerifyTweet(signer.PublicKey(), intervals, &Tweet{Message: message})
+		assert.True(t, ok)
+		assert.Equal(t, SignatureInvalid, result.Status)
+	}
+
+	// Signed by somebody else
+	{
+		impostor := mustGenerateSigner(t)
+		message := impostor.FormatInterval(1, intervals[1].Target, intervals[1].Message)
+
+		result, ok := VerifyTweet(signer.PublicKey(), intervals, &Tweet{Message: message})
+		assert.True(t, ok)
+		assert.Equal(t, SignatureInvalid, result.Status)
+	}
+
+	// A garbled signature
+	{
+		message := FormatInterval(1, intervals[1].Message) + signatureSeparator + "garbage"
+
+		result, ok := VerifyTweet(signer.PublicKey(), intervals, &Tweet{Message: message})
+		assert.True(t, ok)
+		assert.Equal(t, SignatureInvalid, result.Status)
+	}
+
+	// An unsigned interval
+	{
+		result, ok := VerifyTweet(signer.PublicKey(), intervals,
+			&Tweet{Message: FormatInterval(1, intervals[1].Message)})
+		assert.True(t, ok)
+		assert.Equal(t, SignatureUnsigned, result.Status)
+	}
+
+	// An interval that's not in the schedule
+	{
+		message := signer.FormatInterval(2, now, "Interval 002")
+
+		result, ok := VerifyTweet(signer.PublicKey(), intervals, &Tweet{Message: message})
+		assert.True(t, ok)
+		assert.Equal(t, SignatureUnknownInterval, result.Status)
+	}
+
+	// Not an interval at all
+	{
+		_, ok := VerifyTweet(signer.PublicKey(), intervals, &Tweet{Message: "just a tweet"})
+		assert.False(t, ok)
+	}
+}
+
+func TestVerifyTimeline(t *testing.T) {
+	signer := mustGenerateSigner(t)
+
+	now := time.Now()
+	past := now.Add(-1 * time.Second)
+	intervals := []*Interval{
+		{Target: now, Message: "Interval 000"},
+		{Target: now, Message: "Interval 001"},
+	}
+
+	api := &mockTwitterAPI{}
+	for i := 0; i < len(intervals); i++ {
+		result, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger, Signer: signer})
+		assert.NoError(t, err)
+		assert.Equal(t, i, result.PostedIntervalID)
+
+		// Prepend so that the mock returns tweets in reverse chronological
+		// order
+		api.tweets = append([]*Tweet{api.posted[i]}, api.tweets...)
+	}
+
+	api.tweets = append([]*Tweet{
+		{CreatedAt: past, Message: "LHI001: an impersonator"},
+		{CreatedAt: past, Message: "just a tweet"},
+	}, api.tweets...)
+
+	results, err := VerifyTimeline(api, signer.PublicKey(), intervals)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(results))
+
+	assert.Equal(t, 1, results[0].IntervalID)
+	assert.Equal(t, SignatureUnsigned, results[0].Status)
+
+	assert.Equal(t, 1, results[1].IntervalID)
+	assert.Equal(t, SignatureValid, results[1].Status)
+
+	assert.Equal(t, 0, results[2].IntervalID)
+	assert.Equal(t, SignatureValid, results[2].Status)
+	assert.Equal(t, KeyFingerprint(signer.PublicKey()), results[2].Fingerprint)
+}
+
+//
+// Helpers
+//
+
+func mustGenerateSigner(t *testing.T) *Signer {
+	seed, _, err := GenerateSigningKey()
+	assert.NoError(t, err)
+
+	signer, err := NewSigner(seed)
+	assert.NoError(t, err)
+
+	return signer
+}
@@ -0,0 +1,526 @@
+package updater
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	// Registers the "sqlite3" driver. Without cgo, the driver is a stub that
+	// fails when it's opened.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteMigrations are the schema's migrations, applied in order. A
+// migration's version is its index plus one. Once released, a migration must
+// never change; add a new one instead.
+var sqliteMigrations = []string{
+	// 1: the ledger and the lease
+	`
+	CREATE TABLE state (
+		id            INTEGER PRIMARY KEY CHECK (id = 1),
+		fencing_token INTEGER NOT NULL,
+		lease_expires TEXT,
+		lease_holder  TEXT,
+		lease_token   INTEGER,
+		version       INTEGER NOT NULL
+	);
+
+	CREATE TABLE posts (
+		interval_id INTEGER PRIMARY KEY,
+		actor       TEXT,
+		posted_at   TEXT,
+		reason      TEXT,
+		status      TEXT NOT NULL,
+		tweet_id    INTEGER
+	);
+
+	CREATE TABLE admin_actions (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		action      TEXT NOT NULL,
+		actor       TEXT NOT NULL,
+		at          TEXT NOT NULL,
+		interval_id INTEGER NOT NULL,
+		reason      TEXT NOT NULL,
+		tweet_id    INTEGER
+	);
+	`,
+
+	// 2: the tweet cache
+	`
+	CREATE TABLE tweets (
+		id         INTEGER PRIMARY KEY,
+		created_at TEXT NOT NULL,
+		message    TEXT NOT NULL
+	);
+	`,
+
+	// 3: notifications that were sent, for de-duplication
+	`
+	CREATE TABLE notifications (
+		key     TEXT PRIMARY KEY,
+		sent_at TEXT NOT NULL
+	);
+	`,
+
+	// 4: the heartbeat of the last successful run
+	`
+	ALTER TABLE state ADD COLUMN heartbeat_at TEXT;
+	ALTER TABLE state ADD COLUMN heartbeat_run_id TEXT;
+	`,
+
+	// 5: the reply carrying each post's commitment proof
+	`
+	ALTER TABLE posts ADD COLUMN proof_tweet_id INTEGER;
+	`,
+}
+
+// SQLiteStore keeps state and cached tweets in a single SQLite database, so
+// that everything that runs on a host shares one source of truth. It's both
+// a StateStore and a TweetCache. Intervals are only ever posted to Twitter,
+// so the ledger's post records are the only progress that it tracks.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStore opens the SQLite database at path, creating it if it
+// doesn't exist, and brings its schema up to date.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	// Writes take the database's lock as soon as they start so that a
+	// compare-and-swap can't be interleaved with another writer's, and wait
+	// for other writers rather than failing immediately.
+	db, err := sql.Open("sqlite3",
+		"file:"+path+"?_busy_timeout=10000&_journal_mode=WAL&_txlock=immediate")
+	if err != nil {
+		return nil, fmt.Errorf("Error opening SQLite database %v: %v", path, err)
+	}
+
+	store := &SQLiteStore{db: db}
+
+	err = store.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error migrating SQLite database %v: %v", path, err)
+	}
+
+	return store, nil
+}
+
+// Close closes the database.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// SchemaVersion gets the version of the last migration that was applied.
+func (s *SQLiteStore) SchemaVersion() (int, error) {
+	var version int
+	err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).
+		Scan(&version)
+	return version, err
+}
+
+//
+// StateStore
+//
+
+// LoadState reads state from the database.
+func (s *SQLiteStore) LoadState() (*State, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return loadSQLiteState(tx)
+}
+
+// SaveState writes state to the database in a transaction, as long as it's
+// still the version that was loaded and wasn't saved under a newer lease.
+func (s *SQLiteStore) SaveState(state *State) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := loadSQLiteState(tx)
+	if err != nil {
+		return err
+	}
+
+	err = checkStateSave(current, state)
+	if err != nil {
+		return err
+	}
+
+	var heartbeatAt, heartbeatRunID interface{}
+	if state.Heartbeat != nil {
+		heartbeatAt = formatSQLiteTime(state.Heartbeat.At)
+		heartbeatRunID = state.Heartbeat.RunID
+	}
+
+	var leaseExpires, leaseHolder, leaseToken interface{}
+	if state.Lease != nil {
+		leaseExpires = formatSQLiteTime(state.Lease.Expires)
+		leaseHolder = state.Lease.Holder
+		leaseToken = int64(state.Lease.Token)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO state (id, fencing_token, heartbeat_at, heartbeat_run_id,
+			lease_expires, lease_holder, lease_token, version)
+		VALUES (1, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			fencing_token    = excluded.fencing_token,
+			heartbeat_at     = excluded.heartbeat_at,
+			heartbeat_run_id = excluded.heartbeat_run_id,
+			lease_expires    = excluded.lease_expires,
+			lease_holder     = excluded.lease_holder,
+			lease_token      = excluded.lease_token,
+			version          = excluded.version`,
+		int64(state.FencingToken), heartbeatAt, heartbeatRunID,
+		leaseExpires, leaseHolder, leaseToken, state.Version+1)
+	if err != nil {
+		return err
+	}
+
+	// The ledger is small, so it's simplest to replace it wholesale
+	_, err = tx.Exec(`DELETE FROM posts`)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range state.Posts {
+		var actor, reason interface{}
+		if record.Attribution != nil {
+			actor = record.Attribution.Actor
+			reason = record.Attribution.Reason
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO posts (interval_id, actor, posted_at, proof_tweet_id, reason,
+				status, tweet_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			record.IntervalID, actor, formatSQLiteTime(record.PostedAt),
+			nullSQLiteID(record.ProofTweetID), reason, string(record.Status),
+			nullSQLiteID(record.TweetID))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Like the ledger, notifications are few
+	_, err = tx.Exec(`DELETE FROM notifications`)
+	if err != nil {
+		return err
+	}
+
+	for key, sentAt := range state.Notified {
+		_, err = tx.Exec(`INSERT INTO notifications (key, sent_at) VALUES (?, ?)`,
+			key, formatSQLiteTime(sentAt))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Actions are only ever appended
+	var numActions int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM admin_actions`).Scan(&numActions)
+	if err != nil {
+		return err
+	}
+
+	for i := numActions; i < len(state.Actions); i++ {
+		action := state.Actions[i]
+		_, err = tx.Exec(`
+			INSERT INTO admin_actions (action, actor, at, interval_id, reason, tweet_id)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			string(action.Action), action.Actor, formatSQLiteTime(action.At),
+			action.IntervalID, action.Reason, nullSQLiteID(action.TweetID))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	state.Version++
+	return nil
+}
+
+//
+// TweetCache
+//
+
+// LoadTweets gets all cached tweets.
+func (s *SQLiteStore) LoadTweets() ([]*Tweet, error) {
+	rows, err := s.db.Query(`SELECT id, created_at, message FROM tweets ORDER BY id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tweets []*Tweet
+	for rows.Next() {
+		var createdAt string
+		var id int64
+		tweet := &Tweet{}
+
+		err = rows.Scan(&id, &createdAt, &tweet.Message)
+		if err != nil {
+			return nil, err
+		}
+
+		tweet.ID = uint64(id)
+		tweet.CreatedAt, err = parseSQLiteTime(createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		tweets = append(tweets, tweet)
+	}
+
+	return tweets, rows.Err()
+}
+
+// SaveTweets merges tweets into the cache. Tweets that were already cached
+// are replaced.
+func (s *SQLiteStore) SaveTweets(tweets []*Tweet) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, tweet := range tweets {
+		_, err = tx.Exec(`
+			INSERT INTO tweets (id, created_at, message) VALUES (?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				created_at = excluded.created_at,
+				message    = excluded.message`,
+			int64(tweet.ID), formatSQLiteTime(tweet.CreatedAt), tweet.Message)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//
+// Private
+//
+
+// migrate applies any migrations that haven't been applied yet, each in its
+// own transaction.
+func (s *SQLiteStore) migrate() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			applied_at TEXT NOT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+
+	for i, migration := range sqliteMigrations {
+		version := i + 1
+
+		err := func() error {
+			tx, err := s.db.Begin()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+
+			// Checked inside the transaction in case another process is
+			// migrating at the same time
+			var applied int
+			err = tx.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`,
+				version).Scan(&applied)
+			if err != nil {
+				return err
+			}
+			if applied > 0 {
+				return nil
+			}
+
+			_, err = tx.Exec(migration)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`,
+				version, formatSQLiteTime(time.Now()))
+			if err != nil {
+				return err
+			}
+
+			return tx.Commit()
+		}()
+		if err != nil {
+			return fmt.Errorf("Error applying migration %v: %v", version, err)
+		}
+	}
+
+	return nil
+}
+
+// formatSQLiteTime formats a time for storage, or returns nil for a zero
+// time. Times are stored in UTC.
+func formatSQLiteTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func loadSQLiteState(tx *sql.Tx) (*State, error) {
+	state := &State{}
+
+	var fencingToken int64
+	var heartbeatAt, heartbeatRunID, leaseExpires, leaseHolder sql.NullString
+	var leaseToken sql.NullInt64
+	err := tx.QueryRow(`
+		SELECT fencing_token, heartbeat_at, heartbeat_run_id,
+			lease_expires, lease_holder, lease_token, version
+		FROM state WHERE id = 1`).
+		Scan(&fencingToken, &heartbeatAt, &heartbeatRunID,
+			&leaseExpires, &leaseHolder, &leaseToken, &state.Version)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state.FencingToken = uint64(fencingToken)
+
+	if heartbeatAt.Valid {
+		state.Heartbeat = &Heartbeat{RunID: heartbeatRunID.String}
+		state.Heartbeat.At, err = parseSQLiteTime(heartbeatAt.String)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if leaseToken.Valid {
+		state.Lease = &Lease{Holder: leaseHolder.String, Token: uint64(leaseToken.Int64)}
+		state.Lease.Expires, err = parseSQLiteTime(leaseExpires.String)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := tx.Query(`
+		SELECT interval_id, actor, posted_at, proof_tweet_id, reason, status, tweet_id
+		FROM posts ORDER BY interval_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var actor, postedAt, reason sql.NullString
+		var status string
+		var proofTweetID, tweetID sql.NullInt64
+		record := &PostRecord{}
+
+		err = rows.Scan(&record.IntervalID, &actor, &postedAt, &proofTweetID, &reason,
+			&status, &tweetID)
+		if err != nil {
+			return nil, err
+		}
+
+		if actor.Valid {
+			record.Attribution = &Attribution{Actor: actor.String, Reason: reason.String}
+		}
+		record.PostedAt, err = parseSQLiteTime(postedAt.String)
+		if err != nil {
+			return nil, err
+		}
+		record.ProofTweetID = uint64(proofTweetID.Int64)
+		record.Status = PostStatus(status)
+		record.TweetID = uint64(tweetID.Int64)
+
+		state.Posts = append(state.Posts, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	notificationRows, err := tx.Query(`SELECT key, sent_at FROM notifications`)
+	if err != nil {
+		return nil, err
+	}
+	defer notificationRows.Close()
+
+	for notificationRows.Next() {
+		var key, sentAt string
+		err = notificationRows.Scan(&key, &sentAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if state.Notified == nil {
+			state.Notified = make(map[string]time.Time)
+		}
+		state.Notified[key], err = parseSQLiteTime(sentAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := notificationRows.Err(); err != nil {
+		return nil, err
+	}
+
+	actionRows, err := tx.Query(`
+		SELECT action, actor, at, interval_id, reason, tweet_id
+		FROM admin_actions ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer actionRows.Close()
+
+	for actionRows.Next() {
+		var actionType, at string
+		var tweetID sql.NullInt64
+		action := &AdminAction{}
+
+		err = actionRows.Scan(&actionType, &action.Actor, &at, &action.IntervalID,
+			&action.Reason, &tweetID)
+		if err != nil {
+			return nil, err
+		}
+
+		action.Action = AdminActionType(actionType)
+		action.At, err = parseSQLiteTime(at)
+		if err != nil {
+			return nil, err
+		}
+		action.TweetID = uint64(tweetID.Int64)
+
+		state.Actions = append(state.Actions, action)
+	}
+
+	return state, actionRows.Err()
+}
+
+// nullSQLiteID stores a zero ID (meaning not known) as NULL.
+func nullSQLiteID(id uint64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return int64(id)
+}
+
+// parseSQLiteTime parses a time formatted by formatSQLiteTime, returning a
+// zero time for an empty string.
+func parseSQLiteTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
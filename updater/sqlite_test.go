@@ -0,0 +1,119 @@
+package updater
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestOpenSQLiteStore(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "perpetual.db")
+
+	store := mustOpenSQLiteStore(t, path)
+	version, err := store.SchemaVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, len(sqliteMigrations), version)
+	assert.NoError(t, store.Close())
+
+	// Migrations that were already applied aren't applied again
+	store = mustOpenSQLiteStore(t, path)
+	defer store.Close()
+
+	version, err = store.SchemaVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, len(sqliteMigrations), version)
+}
+
+func TestSQLiteStore_State(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	store := mustOpenSQLiteStore(t, filepath.Join(dir, "perpetual.db"))
+	defer store.Close()
+
+	testStateStore(t, store)
+
+	// Everything in state survives a round trip
+	state, err := store.LoadState()
+	assert.NoError(t, err)
+
+	now := time.Date(2018, 1, 2, 3, 4, 5, 6, time.UTC)
+	attr := &Attribution{Actor: "brandur", Reason: "Posted by hand"}
+	state.Actions = append(state.Actions, &AdminAction{Attribution: *attr,
+		Action: AdminAdopt, At: now, IntervalID: 2, TweetID: 125})
+	state.Heartbeat = &Heartbeat{At: now, RunID: "abc"}
+	state.Lease = &Lease{Expires: now, Holder: "a", Token: 2}
+	state.Notified = map[string]time.Time{"perpetual:posted:2": now}
+	state.Put(&PostRecord{Attribution: attr, IntervalID: 2, PostedAt: now,
+		ProofTweetID: 126, Status: PostStatusPosted, TweetID: 125})
+	state.Put(&PostRecord{IntervalID: 3, Status: PostStatusSkipped})
+	assert.NoError(t, store.SaveState(state))
+
+	loaded, err := store.LoadState()
+	assert.NoError(t, err)
+	assert.Equal(t, state, loaded)
+}
+
+func TestSQLiteStore_Tweets(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	store := mustOpenSQLiteStore(t, filepath.Join(dir, "perpetual.db"))
+	defer store.Close()
+
+	tweets, err := store.LoadTweets()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(tweets))
+
+	now := time.Now().UTC()
+	assert.NoError(t, store.SaveTweets([]*Tweet{
+		{CreatedAt: now, ID: 1, Message: "a"},
+		{CreatedAt: now, ID: 2, Message: "b"},
+	}))
+	assert.NoError(t, store.SaveTweets([]*Tweet{
+		{CreatedAt: now, ID: 2, Message: "b (edited)"},
+		{CreatedAt: now, ID: 3, Message: "c"},
+	}))
+
+	tweets, err = store.LoadTweets()
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{3, 2, 1}, tweetIDs(tweets))
+	assert.Equal(t, "b (edited)", tweets[1].Message)
+	assert.True(t, now.Equal(tweets[0].CreatedAt))
+
+	// Works as the cache for an API
+	api := &CachedTwitterAPI{API: &mockTwitterAPI{}, Cache: store, Logger: DiscardLogger}
+	it := api.ListTweets()
+	assert.True(t, it.Next())
+	assert.Equal(t, uint64(3), it.Value().ID)
+}
+
+func TestUpdate_SQLite(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	store := mustOpenSQLiteStore(t, filepath.Join(dir, "perpetual.db"))
+	defer store.Close()
+
+	testUpdateConcurrently(t, &UpdateOptions{
+		Locker:     &StateLocker{Store: store},
+		Logger:     DiscardLogger,
+		StateStore: store,
+	})
+}
+
+//
+// Private
+//
+
+func mustOpenSQLiteStore(t *testing.T, path string) *SQLiteStore {
+	store, err := OpenSQLiteStore(path)
+	assert.NoError(t, err)
+	return store
+}
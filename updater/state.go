@@ -0,0 +1,354 @@
+package updater
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// maxRecordSaveAttempts is how many times Update tries to save a record in
+// the ledger when it loses a race with a write that didn't touch the posts.
+const maxRecordSaveAttempts = 3
+
+// PostStatus is the status of an interval in the state ledger.
+type PostStatus string
+
+// The possible statuses of an interval.
+const (
+	// PostStatusLost means that the interval's post went missing and it was
+	// deliberately not posted again. See MissingPostPolicy.
+	PostStatusLost PostStatus = "lost"
+
+	// PostStatusPending means that the interval was about to be posted, but
+	// it's not known whether it was. It's resolved on the next run.
+	PostStatusPending PostStatus = "pending"
+
+	// PostStatusPosted means that the interval was posted.
+	PostStatusPosted PostStatus = "posted"
+
+	// PostStatusSkipped means that the interval was intentionally skipped
+	// and will never be posted. See SkipInterval.
+	PostStatusSkipped PostStatus = "skipped"
+)
+
+// PostRecord is the ledger entry for a single interval.
+type PostRecord struct {
+	// Attribution is who made the record and why, if it was made by an
+	// administrative operation rather than by Update.
+	Attribution *Attribution `json:"attribution,omitempty"`
+
+	// IntervalID is the ID of the interval.
+	IntervalID int `json:"interval_id"`
+
+	// PostedAt is when the interval was posted. It's zero if that's not
+	// known.
+	PostedAt time.Time `json:"posted_at,omitempty"`
+
+	// ProofTweetID is the ID of the reply carrying the interval's commitment
+	// proof, if one was posted.
+	ProofTweetID uint64 `json:"proof_tweet_id,omitempty"`
+
+	// Status is the interval's status.
+	Status PostStatus `json:"status"`
+
+	// TweetID is the ID of the interval's post. It's zero if that's not
+	// known, as for an interval that was found through a marker.
+	TweetID uint64 `json:"tweet_id,omitempty"`
+}
+
+// State is a ledger of which intervals have been posted, and as which
+// tweets. With it, Update doesn't need to look for the last posted interval
+// at all, and can notice if posts go missing.
+type State struct {
+	// Actions are a log of the administrative operations that have been
+	// performed on the ledger, oldest first.
+	Actions []*AdminAction `json:"actions,omitempty"`
+
+	// FencingToken is the token of the lease that state was last saved under,
+	// if any. Stores refuse to save state under an older lease. See Lease.
+	FencingToken uint64 `json:"fencing_token,omitempty"`
+
+	// Heartbeat records the last successful run, if any.
+	Heartbeat *Heartbeat `json:"heartbeat,omitempty"`
+
+	// Lease is the lease held on state by StateLocker, if any.
+	Lease *Lease `json:"lease,omitempty"`
+
+	// Notified records when notifications were last sent, keyed by what
+	// makes them the same, so that DedupNotifier doesn't repeat them.
+	Notified map[string]time.Time `json:"notified,omitempty"`
+
+	// Posts are the ledger's records, ordered by interval ID.
+	Posts []*PostRecord `json:"posts"`
+
+	// Version is incremented every time that state is saved. Stores use it to
+	// detect that state was modified by someone else since it was loaded.
+	Version int64 `json:"version"`
+}
+
+// Get gets the record for an interval, or nil if there isn't one.
+func (s *State) Get(intervalID int) *PostRecord {
+	for _, record := range s.Posts {
+		if record.IntervalID == intervalID {
+			return record
+		}
+	}
+	return nil
+}
+
+// Last gets the record of the interval with the highest ID that wasn't
+// skipped, or nil if there isn't one. Intervals can be skipped ahead of
+// time, so they don't say anything about how far the series has gotten.
+func (s *State) Last() *PostRecord {
+	for i := len(s.Posts) - 1; i >= 0; i-- {
+		if s.Posts[i].Status != PostStatusSkipped {
+			return s.Posts[i]
+		}
+	}
+	return nil
+}
+
+// Next gets the ID of the interval after the last one in the ledger that
+// wasn't skipped, passing over any that were skipped ahead of time. It's
+// zero if nothing has been posted. It may be past the end of the schedule.
+func (s *State) Next() int {
+	next := 0
+	if last := s.Last(); last != nil {
+		next = last.IntervalID + 1
+	}
+
+	for s.Skipped(next) {
+		next++
+	}
+	return next
+}
+
+// Skipped returns true if the interval was marked as skipped.
+func (s *State) Skipped(intervalID int) bool {
+	record := s.Get(intervalID)
+	return record != nil && record.Status == PostStatusSkipped
+}
+
+// Put adds a record to the ledger, replacing any existing one for the same
+// interval.
+func (s *State) Put(record *PostRecord) {
+	s.Remove(record.IntervalID)
+	s.Posts = append(s.Posts, record)
+	sort.Slice(s.Posts, func(i, j int) bool {
+		return s.Posts[i].IntervalID < s.Posts[j].IntervalID
+	})
+}
+
+// Remove removes the record for an interval from the ledger, if there is
+// one.
+func (s *State) Remove(intervalID int) {
+	for i, record := range s.Posts {
+		if record.IntervalID == intervalID {
+			s.Posts = append(s.Posts[:i], s.Posts[i+1:]...)
+			return
+		}
+	}
+}
+
+// StateStore persists State between runs.
+type StateStore interface {
+	// LoadState gets the stored state. A store that's never been saved to
+	// returns an empty state.
+	LoadState() (*State, error)
+
+	// SaveState stores state, replacing what was there, as long as what was
+	// there is still the version that state was loaded from. Otherwise it
+	// returns ErrStateConflict. It also returns ErrStaleFencingToken if what
+	// was there was saved under a newer lease. On success, state's version is
+	// incremented.
+	SaveState(state *State) error
+}
+
+//
+// File store
+//
+
+// FileStateStore is a StateStore stored as a JSON file.
+type FileStateStore struct {
+	// Path is the location of the state file. It's created if it doesn't
+	// exist.
+	Path string
+}
+
+// LoadState reads state from the file.
+func (s *FileStateStore) LoadState() (*State, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state State
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding state %v: %v", s.Path, err)
+	}
+
+	return &state, nil
+}
+
+// SaveState writes state to the file, which is replaced atomically. The
+// compare-and-swap is guarded by a lock on a file next to it.
+func (s *FileStateStore) SaveState(state *State) error {
+	return withFileLock(s.Path+".lock", func(_ *os.File) error {
+		current, err := s.LoadState()
+		if err != nil {
+			return err
+		}
+
+		err = checkStateSave(current, state)
+		if err != nil {
+			return err
+		}
+
+		state.Version++
+
+		data, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			state.Version--
+			return err
+		}
+
+		err = writeFileAtomically(s.Path, data)
+		if err != nil {
+			state.Version--
+			return err
+		}
+
+		return nil
+	})
+}
+
+//
+// Private
+//
+
+// readState uses the ledger to determine the last posted interval,
+// recording it in result. A pending record at the end of the ledger means
+// that the last run was interrupted, so it's left for other discovery to
+// resolve.
+func readState(logger Logger, state *State, result *UpdateResult) {
+	last := state.Last()
+
+	switch {
+	case last == nil:
+		logger.Info("State is empty")
+
+	case last.Status == PostStatusPending:
+		logger.Warn("Found pending state; can't be sure if it posted",
+			LogKeyIntervalID, last.IntervalID)
+
+	default:
+		logger.Info("Found last interval in state",
+			LogKeyIntervalID, last.IntervalID, LogKeyTweetID, last.TweetID)
+		result.Discovery = DiscoveryState
+		result.LastIntervalID = last.IntervalID
+		result.LastIntervalTweetID = last.TweetID
+	}
+}
+
+// repairState brings the ledger in line with the last posted interval that
+// was found some other way. Pending records are resolved: as posted if the
+// interval was found, and otherwise removed so that the interval is posted
+// again. It returns true if the state changed.
+func repairState(logger Logger, state *State, result *UpdateResult) bool {
+	if result.Discovery == DiscoveryState {
+		return false
+	}
+
+	var changed bool
+
+	for _, record := range append([]*PostRecord(nil), state.Posts...) {
+		if record.Status == PostStatusPending && record.IntervalID > result.LastIntervalID {
+			logger.Warn("Interval was never posted; removing it from state",
+				LogKeyIntervalID, record.IntervalID)
+			state.Remove(record.IntervalID)
+			changed = true
+		}
+	}
+
+	if result.LastIntervalID == -1 {
+		return changed
+	}
+
+	existing := state.Last()
+	if existing != nil && existing.IntervalID == result.LastIntervalID &&
+		existing.Status == PostStatusPosted {
+
+		return changed
+	}
+
+	state.Put(&PostRecord{
+		IntervalID: result.LastIntervalID,
+		Status:     PostStatusPosted,
+		TweetID:    result.LastIntervalTweetID,
+	})
+	return true
+}
+
+// saveRecord puts a record in the ledger and saves it. Bookkeeping like
+// DedupNotifier's and heartbeats is saved to the same ledger without holding
+// the lease, so saving can fail with ErrStateConflict even though nothing
+// that matters to the ledger changed. In that case, as long as the posts are
+// as they were and no newer lease has saved state, the record is put in the
+// reloaded state and saved again. state is replaced with what was saved.
+func saveRecord(store StateStore, state *State, record *PostRecord) error {
+	posts := append([]*PostRecord(nil), state.Posts...)
+	state.Put(record)
+
+	var err error
+	for attempt := 0; attempt < maxRecordSaveAttempts; attempt++ {
+		err = store.SaveState(state)
+		if err != ErrStateConflict {
+			return err
+		}
+
+		current, loadErr := store.LoadState()
+		if loadErr != nil {
+			return loadErr
+		}
+
+		if current.FencingToken > state.FencingToken {
+			return ErrStaleFencingToken
+		}
+
+		// Someone else changed the posts, so our view of them can't be
+		// trusted
+		if !postsEqual(current.Posts, posts) {
+			return ErrStateConflict
+		}
+
+		current.FencingToken = state.FencingToken
+		current.Put(record)
+		*state = *current
+	}
+
+	return err
+}
+
+// postsEqual returns true if two sets of ledger records are the same.
+func postsEqual(a, b []*PostRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].IntervalID != b[i].IntervalID || !a[i].PostedAt.Equal(b[i].PostedAt) ||
+			a[i].ProofTweetID != b[i].ProofTweetID || a[i].Status != b[i].Status ||
+			a[i].TweetID != b[i].TweetID {
+
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,369 @@
+package updater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+//
+// Mock state store
+//
+
+type mockStateStore struct {
+	mu       sync.Mutex
+	numSaves int
+	state    *State
+}
+
+func (s *mockStateStore) LoadState() (*State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == nil {
+		return &State{}, nil
+	}
+	return cloneState(s.state), nil
+}
+
+func (s *mockStateStore) SaveState(state *State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.state
+	if current == nil {
+		current = &State{}
+	}
+
+	err := checkStateSave(current, state)
+	if err != nil {
+		return err
+	}
+
+	state.Version++
+	s.numSaves++
+	s.state = cloneState(state)
+	return nil
+}
+
+// racingStateStore wraps a store so that a write of its own can be slipped in
+// just before a save, as bookkeeping that doesn't hold the lease might.
+type racingStateStore struct {
+	StateStore
+
+	// race is called before each save with the state being saved, and
+	// returns true once it's done racing.
+	race func(state *State) bool
+
+	raced bool
+}
+
+func (s *racingStateStore) SaveState(state *State) error {
+	if !s.raced && s.race != nil {
+		s.raced = s.race(state)
+	}
+	return s.StateStore.SaveState(state)
+}
+
+// cloneState copies state deeply enough that the copy can be modified without
+// affecting the original.
+func cloneState(state *State) *State {
+	clone := *state
+
+	clone.Actions = nil
+	for _, action := range state.Actions {
+		actionClone := *action
+		clone.Actions = append(clone.Actions, &actionClone)
+	}
+
+	if state.Lease != nil {
+		leaseClone := *state.Lease
+		clone.Lease = &leaseClone
+	}
+
+	if state.Heartbeat != nil {
+		heartbeatClone := *state.Heartbeat
+		clone.Heartbeat = &heartbeatClone
+	}
+
+	clone.Notified = nil
+	for key, sentAt := range state.Notified {
+		if clone.Notified == nil {
+			clone.Notified = make(map[string]time.Time)
+		}
+		clone.Notified[key] = sentAt
+	}
+
+	clone.Posts = nil
+	for _, record := range state.Posts {
+		recordClone := *record
+		clone.Posts = append(clone.Posts, &recordClone)
+	}
+
+	return &clone
+}
+
+//
+// Tests
+//
+
+func TestState(t *testing.T) {
+	state := &State{}
+	assert.Nil(t, state.Last())
+
+	state.Put(&PostRecord{IntervalID: 1, Status: PostStatusPosted})
+	state.Put(&PostRecord{IntervalID: 0, Status: PostStatusPosted})
+	state.Put(&PostRecord{IntervalID: 2, Status: PostStatusPending})
+	assert.Equal(t, 2, state.Last().IntervalID)
+	assert.Equal(t, 3, len(state.Posts))
+
+	// Replaces
+	state.Put(&PostRecord{IntervalID: 2, Status: PostStatusPosted, TweetID: 123})
+	assert.Equal(t, 3, len(state.Posts))
+	assert.Equal(t, uint64(123), state.Last().TweetID)
+
+	state.Remove(2)
+	assert.Equal(t, 1, state.Last().IntervalID)
+
+	// Not there
+	state.Remove(5)
+	assert.Equal(t, 2, len(state.Posts))
+}
+
+func TestFileStateStore(t *testing.T) {
+	dir := mustTempDir(t)
+	defer os.RemoveAll(dir)
+
+	testStateStore(t, &FileStateStore{Path: filepath.Join(dir, "state-cas.json")})
+
+	store := &FileStateStore{Path: filepath.Join(dir, "state.json")}
+
+	// A store that hasn't been created yet is empty
+	state, err := store.LoadState()
+	assert.NoError(t, err)
+	assert.Nil(t, state.Last())
+
+	postedAt := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	state.Put(&PostRecord{IntervalID: 0, PostedAt: postedAt, Status: PostStatusPosted, TweetID: 123})
+	err = store.SaveState(state)
+	assert.NoError(t, err)
+
+	loaded, err := store.LoadState()
+	assert.NoError(t, err)
+	assert.Equal(t, state, loaded)
+	assert.Equal(t, int64(1), loaded.Version)
+
+	// A corrupt store
+	err = ioutil.WriteFile(store.Path, []byte("not json"), 0644)
+	assert.NoError(t, err)
+
+	_, err = store.LoadState()
+	assert.Error(t, err)
+}
+
+func TestUpdate_State(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-2 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 001"},
+		{Target: now.Add(1 * time.Hour), Message: "Interval 002"},
+	}
+
+	// With an empty ledger, the timeline is scanned and the ledger seeded
+	// with what's found along with what's posted
+	{
+		api := &mockTwitterAPI{tweets: []*Tweet{
+			{CreatedAt: now, ID: 99, Message: FormatInterval(0, "Interval 000")},
+		}}
+		store := &mockStateStore{}
+
+		result, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger, StateStore: store})
+		assert.NoError(t, err)
+		assert.Equal(t, DiscoveryTimeline, result.Discovery)
+		assert.Equal(t, 1, result.PostedIntervalID)
+		assert.Equal(t, []*PostRecord{
+			{IntervalID: 0, Status: PostStatusPosted, TweetID: 99},
+			{IntervalID: 1, PostedAt: api.posted[0].CreatedAt, Status: PostStatusPosted,
+				TweetID: api.posted[0].ID},
+		}, store.state.Posts)
+
+		// Seeded, pending, posted, heartbeat
+		assert.Equal(t, 4, store.numSaves)
+		assert.Equal(t, now, store.state.Heartbeat.At)
+	}
+
+	// The ledger is trusted without scanning
+	{
+		api := &mockTwitterAPI{posted: []*Tweet{{ID: 1}}}
+		store := &mockStateStore{state: &State{Posts: []*PostRecord{
+			{IntervalID: 0, Status: PostStatusPosted, TweetID: 1},
+		}}}
+
+		result, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger, StateStore: store})
+		assert.NoError(t, err)
+		assert.Equal(t, DiscoveryState, result.Discovery)
+		assert.Equal(t, 0, result.NumTweetsScanned)
+		assert.Equal(t, 1, result.PostedIntervalID)
+	}
+
+	// A pending record for an interval that did post is resolved from the
+	// timeline, and nothing is posted again
+	{
+		api := &mockTwitterAPI{tweets: []*Tweet{
+			{CreatedAt: now, ID: 99, Message: FormatInterval(1, "Interval 001")},
+		}}
+		store := &mockStateStore{state: &State{Posts: []*PostRecord{
+			{IntervalID: 1, Status: PostStatusPending},
+		}}}
+
+		result, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger, StateStore: store})
+		assert.NoError(t, err)
+		assert.Equal(t, DiscoveryTimeline, result.Discovery)
+		assert.Equal(t, -1, result.PostedIntervalID)
+		assert.Equal(t, []*PostRecord{
+			{IntervalID: 1, Status: PostStatusPosted, TweetID: 99},
+		}, store.state.Posts)
+	}
+
+	// A pending record for an interval that never posted is removed, and
+	// the interval is posted
+	{
+		api := &mockTwitterAPI{tweets: []*Tweet{
+			{CreatedAt: now, ID: 99, Message: FormatInterval(0, "Interval 000")},
+		}}
+		store := &mockStateStore{state: &State{Posts: []*PostRecord{
+			{IntervalID: 1, Status: PostStatusPending},
+		}}}
+
+		result, err := Update(api, intervals, now, &UpdateOptions{Logger: DiscardLogger, StateStore: store})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.PostedIntervalID)
+		assert.Equal(t, PostStatusPosted, store.state.Last().Status)
+		assert.Equal(t, api.posted[0].ID, store.state.Last().TweetID)
+	}
+}
+
+// Bookkeeping saved to the ledger between Update's loading it and saving a
+// record doesn't fail the save, but changes to the posts do.
+func TestUpdate_StateRaces(t *testing.T) {
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-2 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 001"},
+	}
+
+	newStore := func() *mockStateStore {
+		return &mockStateStore{state: &State{Posts: []*PostRecord{
+			{IntervalID: 0, Status: PostStatusPosted, TweetID: 1},
+		}}}
+	}
+
+	// raceOn makes a write to store just before a record with status is
+	// saved for interval 1
+	raceOn := func(store StateStore, status PostStatus, write func(state *State)) func(*State) bool {
+		return func(saving *State) bool {
+			record := saving.Get(1)
+			if record == nil || record.Status != status {
+				return false
+			}
+
+			state, err := store.LoadState()
+			assert.NoError(t, err)
+			write(state)
+			assert.NoError(t, store.SaveState(state))
+			return true
+		}
+	}
+
+	// A notification recorded before the pending save
+	{
+		store := newStore()
+		racing := &racingStateStore{StateStore: store,
+			race: raceOn(store, PostStatusPending, func(state *State) {
+				state.Notified = map[string]time.Time{"key": now}
+			})}
+
+		result, err := Update(&mockTwitterAPI{posted: []*Tweet{{ID: 1}}}, intervals, now,
+			&UpdateOptions{Logger: DiscardLogger, StateStore: racing})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.PostedIntervalID)
+		assert.Equal(t, PostStatusPosted, store.state.Get(1).Status)
+		assert.Equal(t, now, store.state.Notified["key"])
+	}
+
+	// A heartbeat recorded before the posted save
+	{
+		store := newStore()
+		racing := &racingStateStore{StateStore: store,
+			race: raceOn(store, PostStatusPosted, func(state *State) {
+				state.Heartbeat = &Heartbeat{At: now, RunID: "other"}
+			})}
+
+		result, err := Update(&mockTwitterAPI{posted: []*Tweet{{ID: 1}}}, intervals, now,
+			&UpdateOptions{Logger: DiscardLogger, StateStore: racing})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.PostedIntervalID)
+		assert.Equal(t, PostStatusPosted, store.state.Get(1).Status)
+	}
+
+	// The posts changed, so the ledger can't be trusted
+	{
+		store := newStore()
+		racing := &racingStateStore{StateStore: store,
+			race: raceOn(store, PostStatusPending, func(state *State) {
+				state.Put(&PostRecord{IntervalID: 1, Status: PostStatusSkipped})
+			})}
+
+		api := &mockTwitterAPI{posted: []*Tweet{{ID: 1}}}
+		_, err := Update(api, intervals, now,
+			&UpdateOptions{Logger: DiscardLogger, StateStore: racing})
+		assert.EqualError(t, err, "Error saving pending state: "+ErrStateConflict.Error())
+		assert.Equal(t, 1, len(api.posted))
+	}
+}
+
+//
+// Private
+//
+
+// testStateStore runs the tests common to every StateStore against an empty
+// store.
+func testStateStore(t *testing.T, store StateStore) {
+	state, err := store.LoadState()
+	assert.NoError(t, err)
+	assert.Equal(t, &State{}, state)
+
+	state.Put(&PostRecord{IntervalID: 0, Status: PostStatusPosted, TweetID: 123})
+	assert.NoError(t, store.SaveState(state))
+	assert.Equal(t, int64(1), state.Version)
+
+	loaded, err := store.LoadState()
+	assert.NoError(t, err)
+	assert.Equal(t, state, loaded)
+
+	// Saving state over state that's changed since it was loaded
+	stale := &State{}
+	assert.Equal(t, ErrStateConflict, store.SaveState(stale))
+	assert.Equal(t, int64(0), stale.Version)
+
+	loaded.Put(&PostRecord{IntervalID: 1, Status: PostStatusPosted, TweetID: 124})
+	assert.NoError(t, store.SaveState(loaded))
+	assert.Equal(t, ErrStateConflict, store.SaveState(state))
+
+	// Saving under an older lease than state was last saved under
+	loaded.FencingToken = 2
+	assert.NoError(t, store.SaveState(loaded))
+
+	reloaded, err := store.LoadState()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), reloaded.Version)
+	assert.Equal(t, 2, len(reloaded.Posts))
+
+	reloaded.FencingToken = 1
+	assert.Equal(t, ErrStaleFencingToken, store.SaveState(reloaded))
+}
@@ -7,7 +7,10 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/dghubble/oauth1"
 )
 
 //
@@ -40,8 +43,24 @@ type TweetIterator interface {
 // TwitterAPI is a subset of the implementation of Twitter's API needed for the
 // purposes of this project.
 type TwitterAPI interface {
+	// DeleteTweet deletes one of the account's tweets.
+	DeleteTweet(id uint64) error
+
 	ListTweets() TweetIterator
+
+	// LookupTweets gets tweets by ID. Tweets that don't exist (because they
+	// were deleted, for example) are left out of the result.
+	LookupTweets(ids []uint64) ([]*Tweet, error)
+
+	PostReply(inReplyToID uint64, message string) (*Tweet, error)
 	PostTweet(message string) (*Tweet, error)
+
+	// ReadMarker gets the marker recording the last posted interval from the
+	// account, or nil if there isn't one. See Marker.
+	ReadMarker() (*Marker, error)
+
+	// WriteMarker records the last posted interval in the account.
+	WriteMarker(marker *Marker) error
 }
 
 //
@@ -67,17 +86,51 @@ type LiveTweetIterator struct {
 	// `max_id` the next time we fetch a page).
 	lastID uint64
 
+	// The number of pages that have been requested.
+	page int
+
 	// Our position within the current page (in currentTweets).
 	position int
+
+	// If set, tweets are found with this search query instead of being listed
+	// from the account's timeline.
+	searchQuery string
+
+	// If set, only tweets with IDs greater than this one are returned.
+	sinceID uint64
 }
 
 // liveTweet is a tweet that we decoded in a response from the Twitter API.
 type liveTweet struct {
 	CreatedAt string `json:"created_at"`
+	FullText  string `json:"full_text"`
 	ID        uint64 `json:"id"`
 	Text      string `json:"text"`
 }
 
+// toTweet converts a decoded tweet to a Tweet. Requests are made with
+// `tweet_mode=extended` so that long tweets come back untruncated in
+// `full_text`, but `text` is used if that's all there is.
+func (t *liveTweet) toTweet() (*Tweet, error) {
+	createdAt, err := parseTwitterTime(t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	message := t.FullText
+	if message == "" {
+		message = t.Text
+	}
+
+	return &Tweet{CreatedAt: createdAt, ID: t.ID, Message: message}, nil
+}
+
+// liveSearchResults is a page of search results that we decoded in a response
+// from the Twitter API.
+type liveSearchResults struct {
+	Statuses []*liveTweet `json:"statuses"`
+}
+
 // Err gets an error set on the iterator.
 func (it *LiveTweetIterator) Err() error {
 	return it.err
@@ -95,35 +148,68 @@ func (it *LiveTweetIterator) Next() bool {
 		return true
 	}
 
-	fmt.Printf("\nRequesting next page (max ID = %v)\n\n", it.lastID)
+	path := "/1.1/statuses/user_timeline.json"
+	if it.searchQuery != "" {
+		path = "/1.1/search/tweets.json"
+	}
 
-	req, err := it.api.newAuthorizedRequest(
-		"GET", "https://api.twitter.com/1.1/statuses/user_timeline.json")
+	req, err := it.api.newAuthorizedRequest("GET", path)
 	if err != nil {
 		it.err = err
 		return false
 	}
 
 	query := req.URL.Query()
-	query.Add("count", "200") // 200 is the largest page allowed
-	query.Add("exclude_replies", "true")
-	query.Add("include_rts", "false")
-	query.Add("screen_name", it.api.ScreenName)
+	if it.searchQuery != "" {
+		query.Add("count", "100") // 100 is the largest page allowed
+		query.Add("q", it.searchQuery)
+		query.Add("result_type", "recent")
+	} else {
+		query.Add("count", "200") // 200 is the largest page allowed
+		query.Add("exclude_replies", "true")
+		query.Add("include_rts", "false")
+		query.Add("screen_name", it.api.ScreenName)
+	}
 	query.Add("trim_user", "true")
+	query.Add("tweet_mode", "extended")
+
+	if it.sinceID != 0 {
+		query.Add("since_id", strconv.FormatUint(it.sinceID, 10))
+	}
+
+	it.page++
+	logArgs := []interface{}{LogKeyPage, it.page}
 
 	// If this isn't the first page, ask for the next sequence by subtracting
 	// one from the last ID of the last page that we processed.
 	if it.lastID != 0 {
 		query.Add("max_id", strconv.FormatUint(it.lastID-1, 10))
+		logArgs = append(logArgs, LogKeyMaxID, it.lastID-1)
 
 		// Also, sleep one second if this isn't the first request so we don't
 		// hit a rate limit. This particular Twitter API allows one request per
 		// second.
-		time.Sleep(1 * time.Second)
+		sleep := time.Sleep
+		if it.api.sleep != nil {
+			sleep = it.api.sleep
+		}
+		sleep(1 * time.Second)
 	}
 
+	if it.searchQuery != "" {
+		logArgs = append(logArgs, "query", it.searchQuery)
+	}
+	it.api.logger().Debug("Requesting page of tweets", logArgs...)
+	it.api.metrics().Count(MetricTimelinePages, 1)
+
 	var tweets []*liveTweet
-	err = it.api.encodeAndExecuteRequest(req, query, &tweets)
+	if it.searchQuery != "" {
+		var results liveSearchResults
+		err = it.api.encodeAndExecuteRequest(req, query, &results)
+		tweets = results.Statuses
+	} else {
+		err = it.api.encodeAndExecuteRequest(req, query, &tweets)
+	}
 	if err != nil {
 		it.err = err
 		return false
@@ -136,17 +222,11 @@ func (it *LiveTweetIterator) Next() bool {
 
 	it.currentTweets = make([]*Tweet, len(tweets))
 	for i, v := range tweets {
-		createdAt, err := parseTwitterTime(v.CreatedAt)
+		it.currentTweets[i], err = v.toTweet()
 		if err != nil {
 			it.err = err
 			return false
 		}
-
-		it.currentTweets[i] = &Tweet{
-			CreatedAt: createdAt,
-			ID:        v.ID,
-			Message:   v.Text,
-		}
 	}
 
 	// Set the page's last ID so we know where to start on the next iteration
@@ -172,13 +252,77 @@ func (it *LiveTweetIterator) Value() *Tweet {
 	return it.currentTweets[it.position]
 }
 
+// DefaultBaseURL is the base URL of Twitter's API.
+const DefaultBaseURL = "https://api.twitter.com"
+
 // LiveTwitterAPI is an API implementation for the live Twitter API.
 type LiveTwitterAPI struct {
+	// BaseURL is the base URL of the API. Defaults to DefaultBaseURL if
+	// empty.
+	BaseURL string
+
 	// HTTPClient is an authorized HTTP client to use for requests.
 	HTTPClient *http.Client
 
+	// Logger receives logs about requests. Defaults to a text logger on
+	// stdout if nil.
+	Logger Logger
+
+	// Metrics receives measurements of requests, like their latency and
+	// status. Defaults to DiscardMetrics if nil.
+	Metrics Metrics
+
 	// ScreenName is the Twitter screen name that will be read from and posted to.
 	ScreenName string
+
+	// sleep is overridden in tests.
+	sleep func(d time.Duration)
+}
+
+// User represents a Twitter user returned from Twitter's API.
+type User struct {
+	Description string
+	ID          uint64
+	ScreenName  string
+}
+
+// liveUser is a user that we decoded in a response from the Twitter API.
+type liveUser struct {
+	Description string `json:"description"`
+	ID          uint64 `json:"id"`
+	ScreenName  string `json:"screen_name"`
+}
+
+// NewLiveTwitterAPI initializes an API for the given account which authorizes
+// requests with OAuth 1.0a using an app's consumer key pair and the account's
+// access token pair.
+func NewLiveTwitterAPI(consumerKey, consumerSecret, accessToken, accessTokenSecret,
+	screenName string) *LiveTwitterAPI {
+
+	config := oauth1.NewConfig(consumerKey, consumerSecret)
+	token := oauth1.NewToken(accessToken, accessTokenSecret)
+
+	return &LiveTwitterAPI{
+		HTTPClient: config.Client(oauth1.NoContext, token),
+		ScreenName: screenName,
+	}
+}
+
+// DeleteTweet deletes one of the configured account's tweets.
+func (a *LiveTwitterAPI) DeleteTweet(id uint64) error {
+	req, err := a.newAuthorizedRequest("POST",
+		"/1.1/statuses/destroy/"+strconv.FormatUint(id, 10)+".json")
+	if err != nil {
+		return err
+	}
+
+	a.logger().Info("Deleting tweet", LogKeyTweetID, id)
+
+	query := req.URL.Query()
+	query.Add("trim_user", "true")
+
+	var tweet *liveTweet
+	return a.encodeAndExecuteRequest(req, query, &tweet)
 }
 
 // ListTweets returns an iterator for the configured account's live tweets.
@@ -186,65 +330,197 @@ func (a *LiveTwitterAPI) ListTweets() TweetIterator {
 	return &LiveTweetIterator{api: a, lastID: 0, position: -1}
 }
 
+// ListTweetsSince returns an iterator for the configured account's live
+// tweets that are newer than the one with the given ID.
+func (a *LiveTwitterAPI) ListTweetsSince(sinceID uint64) TweetIterator {
+	return &LiveTweetIterator{api: a, lastID: 0, position: -1, sinceID: sinceID}
+}
+
+// SearchIntervals returns an iterator for tweets from the configured account
+// that Twitter's search finds by the interval prefix.
+func (a *LiveTwitterAPI) SearchIntervals() TweetIterator {
+	return &LiveTweetIterator{api: a, lastID: 0, position: -1,
+		searchQuery: fmt.Sprintf(`from:%s "LHI"`, a.ScreenName)}
+}
+
+// LookupTweets gets tweets by ID, leaving out any that don't exist. At most
+// 100 can be looked up at once.
+func (a *LiveTwitterAPI) LookupTweets(ids []uint64) ([]*Tweet, error) {
+	req, err := a.newAuthorizedRequest("GET", "/1.1/statuses/lookup.json")
+	if err != nil {
+		return nil, err
+	}
+
+	idStrs := make([]string, len(ids))
+	for i, id := range ids {
+		idStrs[i] = strconv.FormatUint(id, 10)
+	}
+
+	query := req.URL.Query()
+	query.Add("id", strings.Join(idStrs, ","))
+	query.Add("include_entities", "false")
+	query.Add("trim_user", "true")
+	query.Add("tweet_mode", "extended")
+
+	var liveTweets []*liveTweet
+	err = a.encodeAndExecuteRequest(req, query, &liveTweets)
+	if err != nil {
+		return nil, err
+	}
+
+	tweets := make([]*Tweet, len(liveTweets))
+	for i, v := range liveTweets {
+		tweets[i], err = v.toTweet()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tweets, nil
+}
+
+// PostReply posts a tweet to the configured account as a reply to one of its
+// existing tweets, threading the two together.
+func (a *LiveTwitterAPI) PostReply(inReplyToID uint64, message string) (*Tweet, error) {
+	return a.postStatus(message, inReplyToID)
+}
+
 // PostTweet posts a tweet to the configured account.
 func (a *LiveTwitterAPI) PostTweet(message string) (*Tweet, error) {
-	req, err := a.newAuthorizedRequest("POST", "https://api.twitter.com/1.1/statuses/update.json")
+	return a.postStatus(message, 0)
+}
+
+// VerifyCredentials checks that the API's credentials are valid and returns
+// the user that they belong to (which isn't necessarily the one named by
+// ScreenName).
+func (a *LiveTwitterAPI) VerifyCredentials() (*User, error) {
+	user, _, err := a.verifyCredentials()
+	return user, err
+}
+
+func (a *LiveTwitterAPI) verifyCredentials() (*User, http.Header, error) {
+	req, err := a.newAuthorizedRequest("GET", "/1.1/account/verify_credentials.json")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query := req.URL.Query()
+	query.Add("include_entities", "false")
+	query.Add("skip_status", "true")
+
+	var user *liveUser
+	header, err := a.encodeAndExecuteRequestWithHeader(req, query, &user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &User{
+		Description: user.Description,
+		ID:          user.ID,
+		ScreenName:  user.ScreenName,
+	}, header, nil
+}
+
+func (a *LiveTwitterAPI) postStatus(message string, inReplyToID uint64) (*Tweet, error) {
+	req, err := a.newAuthorizedRequest("POST", "/1.1/statuses/update.json")
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Printf("Posting tweet: %v\n", message)
+	logArgs := []interface{}{"message", message}
+	if inReplyToID != 0 {
+		logArgs = append(logArgs, "in_reply_to", inReplyToID)
+	}
+	a.logger().Info("Posting tweet", logArgs...)
 
 	query := req.URL.Query()
 	query.Add("status", message)
+	query.Add("tweet_mode", "extended")
 
-	var tweet *liveTweet
-	err = a.encodeAndExecuteRequest(req, query, &tweet)
+	if inReplyToID != 0 {
+		query.Add("in_reply_to_status_id", strconv.FormatUint(inReplyToID, 10))
+	}
+
+	var liveTweet *liveTweet
+	err = a.encodeAndExecuteRequest(req, query, &liveTweet)
 	if err != nil {
 		return nil, err
 	}
 
-	createdAt, err := parseTwitterTime(tweet.CreatedAt)
+	tweet, err := liveTweet.toTweet()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Tweet{
-		CreatedAt: createdAt,
-		ID:        tweet.ID,
-		Message:   tweet.Text,
-	}, nil
+	a.logger().Info("Posted tweet", LogKeyTweetID, tweet.ID)
+	return tweet, nil
 }
 
 func (a *LiveTwitterAPI) encodeAndExecuteRequest(
 	req *http.Request, query url.Values, v interface{}) error {
 
+	_, err := a.encodeAndExecuteRequestWithHeader(req, query, v)
+	return err
+}
+
+// encodeAndExecuteRequestWithHeader is the same as encodeAndExecuteRequest,
+// but also returns the response's headers, which Twitter uses to convey
+// things like rate limits and access levels.
+func (a *LiveTwitterAPI) encodeAndExecuteRequestWithHeader(
+	req *http.Request, query url.Values, v interface{}) (http.Header, error) {
+
 	req.URL.RawQuery = query.Encode()
 	query.Add("trim_user", "true")
 
+	endpoint := metricEndpoint(req.URL.Path)
+	start := time.Now()
 	resp, err := a.HTTPClient.Do(req)
+	a.metrics().Observe(MetricAPIRequestDuration, time.Since(start).Seconds(),
+		"endpoint", endpoint)
 	if err != nil {
-		return err
+		a.metrics().Count(MetricAPIRequests, 1, "endpoint", endpoint, "status", "error")
+		return nil, err
 	}
+	a.metrics().Count(MetricAPIRequests, 1,
+		"endpoint", endpoint, "status", strconv.Itoa(resp.StatusCode))
 
 	defer resp.Body.Close()
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"Improper response from the Twitter API (status: %v): %s",
 			resp.Status,
 			string(data))
 	}
 
-	return json.Unmarshal(data, v)
+	return resp.Header, json.Unmarshal(data, v)
+}
+
+func (a *LiveTwitterAPI) logger() Logger {
+	if a.Logger == nil {
+		return defaultLogger()
+	}
+	return a.Logger
+}
+
+func (a *LiveTwitterAPI) metrics() Metrics {
+	if a.Metrics == nil {
+		return DiscardMetrics
+	}
+	return a.Metrics
 }
 
-func (a *LiveTwitterAPI) newAuthorizedRequest(method, url string) (*http.Request, error) {
-	req, err := http.NewRequest(method, url, nil)
+func (a *LiveTwitterAPI) newAuthorizedRequest(method, path string) (*http.Request, error) {
+	baseURL := a.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+
+	req, err := http.NewRequest(method, baseURL+path, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -2,12 +2,12 @@ package updater
 
 import (
 	"fmt"
-	"os"
+	"net/http"
 	"strings"
 	"testing"
 	"time"
 
-	"github.com/dghubble/oauth1"
+	"github.com/brandur/perpetual/twittertest"
 	assert "github.com/stretchr/testify/require"
 )
 
@@ -41,16 +41,71 @@ func (i *mockTweetIterator) Value() *Tweet {
 }
 
 type mockTwitterAPI struct {
-	tweets []*Tweet
+	deleteErr error
+	deleted   map[uint64]bool
+	marker    *Marker
+	markerErr error
+	markers   []*Marker
+	posted    []*Tweet
+	replies   []*Tweet
+	tweets    []*Tweet
+}
+
+func (a *mockTwitterAPI) DeleteTweet(id uint64) error {
+	if a.deleteErr != nil {
+		return a.deleteErr
+	}
+	if a.deleted == nil {
+		a.deleted = make(map[uint64]bool)
+	}
+	a.deleted[id] = true
+	return nil
 }
 
 func (a *mockTwitterAPI) ListTweets() TweetIterator {
 	return &mockTweetIterator{tweets: a.tweets, position: -1}
 }
 
+func (a *mockTwitterAPI) LookupTweets(ids []uint64) ([]*Tweet, error) {
+	var tweets []*Tweet
+	for _, id := range ids {
+		if a.deleted[id] {
+			continue
+		}
+
+		for _, tweet := range a.posted {
+			if tweet.ID == id {
+				tweets = append(tweets, tweet)
+			}
+		}
+	}
+	return tweets, nil
+}
+
+// Replies are numbered from 1001 so that they're told apart from posts.
+func (a *mockTwitterAPI) PostReply(inReplyToID uint64, message string) (*Tweet, error) {
+	tweet := &Tweet{CreatedAt: time.Now(), ID: uint64(1001 + len(a.replies)), Message: message}
+	a.replies = append(a.replies, tweet)
+	return tweet, nil
+}
+
 func (a *mockTwitterAPI) PostTweet(message string) (*Tweet, error) {
-	fmt.Printf("Posting tweet: %v\n", message)
-	return &Tweet{CreatedAt: time.Now(), Message: message}, nil
+	tweet := &Tweet{CreatedAt: time.Now(), ID: uint64(len(a.posted) + 1), Message: message}
+	a.posted = append(a.posted, tweet)
+	return tweet, nil
+}
+
+func (a *mockTwitterAPI) ReadMarker() (*Marker, error) {
+	return a.marker, nil
+}
+
+func (a *mockTwitterAPI) WriteMarker(marker *Marker) error {
+	if a.markerErr != nil {
+		return a.markerErr
+	}
+	a.marker = marker
+	a.markers = append(a.markers, marker)
+	return nil
 }
 
 //
@@ -58,35 +113,186 @@ func (a *mockTwitterAPI) PostTweet(message string) (*Tweet, error) {
 //
 
 func TestLiveTwitterAPI_ListTweets(t *testing.T) {
-	t.Skip("Makes live API requests")
+	server := twittertest.NewServer()
+	defer server.Close()
+	server.MaxPageSize = 2
+
+	api, sleeps := newFakeLiveTwitterAPI(server)
 
-	api := getLiveTwitterAPI()
+	var want []uint64
+	for i := 0; i < 5; i++ {
+		want = append([]uint64{server.AddTweet(fmt.Sprintf("Tweet %v", i)).ID}, want...)
+	}
+	long := server.AddTweet(strings.Repeat("a", 200))
+	want = append([]uint64{long.ID}, want...)
+
+	// Replies are left out
+	_, err := api.PostReply(long.ID, "Reply")
+	assert.NoError(t, err)
 
+	var got []uint64
 	it := api.ListTweets()
 	for it.Next() {
-		tweet := it.Value()
+		got = append(got, it.Value().ID)
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, want, got)
 
-		message := tweet.Message
-		if len(message) > 50 {
-			message = message[0:50]
-		}
-		message = strings.Replace(message, "\n", "", -1)
+	// Three full pages and an empty one, with a pause between each
+	assert.Equal(t, 4, server.Requests(fakeTimelinePath))
+	assert.Equal(t, 3, len(*sleeps))
 
-		fmt.Printf("	ID: %v | Tweet: %s\n", tweet.ID, message)
-	}
+	// Long tweets come back untruncated
+	it = api.ListTweets()
+	assert.True(t, it.Next())
+	assert.Equal(t, long.Text, it.Value().Message)
 
+	// Twitter only reaches so far back, counting replies that are left out
+	server.MaxTimeline = 3
+	got = nil
+	it = api.ListTweets()
+	for it.Next() {
+		got = append(got, it.Value().ID)
+	}
 	assert.NoError(t, it.Err())
+	assert.Equal(t, want[:2], got)
+}
+
+func TestLiveTwitterAPI_ListTweets_Errors(t *testing.T) {
+	server := twittertest.NewServer()
+	defer server.Close()
+	server.AddTweet("Tweet")
+
+	api, _ := newFakeLiveTwitterAPI(server)
+
+	server.FailNext(fakeTimelinePath, http.StatusServiceUnavailable, 130, "Over capacity")
+	it := api.ListTweets()
+	assert.False(t, it.Next())
+	assert.EqualError(t, it.Err(), "Improper response from the Twitter API "+
+		`(status: 503 Service Unavailable): {"errors":[{"code":130,"message":"Over capacity"}]}`+"\n")
+
+	server.RateLimit = 2
+	it = api.ListTweets()
+	assert.True(t, it.Next())
+	assert.False(t, it.Next())
+	assert.Error(t, it.Err())
+	assert.Contains(t, it.Err().Error(), "429 Too Many Requests")
+
+	server.ResetRateLimits()
+	it = api.ListTweets()
+	assert.True(t, it.Next())
+
+	// Requests that aren't signed with the account's credentials are refused
+	api.ScreenName = "someone_else"
+	it = api.ListTweets()
+	assert.False(t, it.Next())
+	assert.Contains(t, it.Err().Error(), "404 Not Found")
+
+	server.AccessTokenSecret = "rotated"
+	_, err := api.PostTweet("Hello")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "401 Unauthorized")
+	assert.Equal(t, 1, len(server.Tweets()))
+}
+
+func TestLiveTwitterAPI_LookupAndDeleteTweets(t *testing.T) {
+	server := twittertest.NewServer()
+	defer server.Close()
+
+	api, _ := newFakeLiveTwitterAPI(server)
+
+	first := server.AddTweet("First")
+	second := server.AddTweet("Second")
+
+	tweets, err := api.LookupTweets([]uint64{first.ID, second.ID, 123})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(tweets))
+	assert.Equal(t, "First", tweets[0].Message)
+	assert.True(t, first.CreatedAt.Equal(tweets[0].CreatedAt))
+
+	assert.NoError(t, api.DeleteTweet(first.ID))
+	tweets, err = api.LookupTweets([]uint64{first.ID, second.ID})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(tweets))
+	assert.Equal(t, second.ID, tweets[0].ID)
+
+	err = api.DeleteTweet(first.ID)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "No status found with that ID.")
 }
 
 func TestLiveTwitterAPI_PostTweet(t *testing.T) {
-	t.Skip("Makes live API requests")
+	server := twittertest.NewServer()
+	defer server.Close()
 
-	api := getLiveTwitterAPI()
+	api, _ := newFakeLiveTwitterAPI(server)
 
 	tweet, err := api.PostTweet("Hello from Perpetual.")
 	assert.NoError(t, err)
+	assert.Equal(t, "Hello from Perpetual.", tweet.Message)
+
+	reply, err := api.PostReply(tweet.ID, "A reply & some characters that need escaping: +/=%")
+	assert.NoError(t, err)
+
+	posted := server.Tweets()
+	assert.Equal(t, 2, len(posted))
+	assert.Equal(t, reply.ID, posted[0].ID)
+	assert.Equal(t, tweet.ID, posted[0].InReplyToID)
+	assert.Equal(t, "A reply & some characters that need escaping: +/=%", posted[0].Text)
+
+	_, err = api.PostTweet("Hello from Perpetual.")
+	assert.EqualError(t, err, "Improper response from the Twitter API "+
+		`(status: 403 Forbidden): {"errors":[{"code":187,"message":"Status is a duplicate."}]}`+"\n")
+}
+
+// Update runs end to end against the fake, posting each interval once as it
+// comes due.
+func TestLiveTwitterAPI_Update(t *testing.T) {
+	server := twittertest.NewServer()
+	defer server.Close()
+	server.MaxPageSize = 2
+
+	api, _ := newFakeLiveTwitterAPI(server)
+
+	now := time.Now()
+	intervals := []*Interval{
+		{Target: now.Add(-1 * time.Hour), Message: "Interval 000"},
+		{Target: now.Add(1 * time.Hour), Message: "Interval 001"},
+	}
+	opts := &UpdateOptions{Logger: DiscardLogger, SkipPreflight: true}
+
+	for _, at := range []time.Time{now, now, now.Add(2 * time.Hour), now.Add(2 * time.Hour)} {
+		_, err := Update(api, intervals, at, opts)
+		assert.NoError(t, err)
+		server.AddTweet(fmt.Sprintf("Unrelated %v", at.UnixNano()))
+	}
+
+	var posted []string
+	for _, tweet := range server.Tweets() {
+		if _, ok := extractIntervalID(tweet.Text); ok {
+			posted = append(posted, tweet.Text)
+		}
+	}
+	assert.Equal(t, []string{
+		FormatInterval(1, "Interval 001"),
+		FormatInterval(0, "Interval 000"),
+	}, posted)
+}
+
+func TestLiveTweet_ToTweet(t *testing.T) {
+	createdAt := "Mon Jan 02 03:04:05 +0000 2018"
+
+	// Extended mode tweets aren't truncated
+	tweet, err := (&liveTweet{CreatedAt: createdAt, FullText: "full", Text: "trunc…"}).toTweet()
+	assert.NoError(t, err)
+	assert.Equal(t, "full", tweet.Message)
 
-	fmt.Printf("Posted tweet: %+v\n", tweet)
+	tweet, err = (&liveTweet{CreatedAt: createdAt, Text: "text"}).toTweet()
+	assert.NoError(t, err)
+	assert.Equal(t, "text", tweet.Message)
+
+	_, err = (&liveTweet{CreatedAt: "yesterday"}).toTweet()
+	assert.Error(t, err)
 }
 
 func TestParseTwitterTime(t *testing.T) {
@@ -99,21 +305,20 @@ func TestParseTwitterTime(t *testing.T) {
 // Helpers
 //
 
-func getLiveTwitterAPI() TwitterAPI {
-	fmt.Printf("Access token = %s\n", os.Getenv("ACCESS_TOKEN"))
-	fmt.Printf("Access token secret = %s\n", os.Getenv("ACCESS_TOKEN_SECRET"))
+// fakeTimelinePath is the path of the timeline endpoint.
+const fakeTimelinePath = "/1.1/statuses/user_timeline.json"
 
-	fmt.Printf("Consumer key = %s\n", os.Getenv("CONSUMER_KEY"))
-	fmt.Printf("Consumer secret = %s\n", os.Getenv("CONSUMER_SECRET"))
+// newFakeLiveTwitterAPI gets a LiveTwitterAPI that makes requests to a fake
+// server with its credentials. It doesn't sleep between pages, but records
+// how long it would have.
+func newFakeLiveTwitterAPI(server *twittertest.Server) (*LiveTwitterAPI, *[]time.Duration) {
+	var sleeps []time.Duration
 
-	fmt.Printf("Screen name = %s\n", os.Getenv("SCREEN_NAME"))
+	api := NewLiveTwitterAPI(server.ConsumerKey, server.ConsumerSecret,
+		server.AccessToken, server.AccessTokenSecret, server.ScreenName)
+	api.BaseURL = server.URL
+	api.Logger = DiscardLogger
+	api.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
 
-	config := oauth1.NewConfig(os.Getenv("CONSUMER_KEY"), os.Getenv("CONSUMER_SECRET"))
-	token := oauth1.NewToken(os.Getenv("ACCESS_TOKEN"), os.Getenv("ACCESS_TOKEN_SECRET"))
-	httpClient := config.Client(oauth1.NoContext, token)
-
-	return &LiveTwitterAPI{
-		HTTPClient: httpClient,
-		ScreenName: os.Getenv("SCREEN_NAME"),
-	}
+	return api, &sleeps
 }
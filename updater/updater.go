@@ -17,47 +17,372 @@ func FormatInterval(id int, message string) string {
 	return fmt.Sprintf(intervalFormat, id, message)
 }
 
+// ScanStopReason is the reason that Update stopped scanning backward through
+// an account's tweets looking for the last posted interval.
+type ScanStopReason string
+
+// The possible reasons for a scan to stop.
+const (
+	// ScanStopEndOfTimeline means that the API had no more tweets to return.
+	ScanStopEndOfTimeline ScanStopReason = "end_of_timeline"
+
+	// ScanStopFoundInterval means that the last posted interval was found.
+	ScanStopFoundInterval ScanStopReason = "found_interval"
+
+	// ScanStopMaxDepth means that UpdateOptions.MaxScanTweets were scanned
+	// without finding an interval.
+	ScanStopMaxDepth ScanStopReason = "max_depth"
+
+	// ScanStopPassedBaseTarget means that the scan reached a tweet older than
+	// the base interval's target. No interval can have been posted before
+	// then, so there's no point in going further.
+	ScanStopPassedBaseTarget ScanStopReason = "passed_base_target"
+)
+
+// UpdateOptions contains optional configuration for Update. A nil
+// *UpdateOptions is equivalent to one with all fields left at their zero
+// values.
+type UpdateOptions struct {
+	// CommitmentRoot is the root of a commitment over the schedule's future
+	// intervals (see CommitIntervals). If set, it's published along with the
+	// base interval.
+	CommitmentRoot string
+
+	// Discovery is how the last posted interval is found. Defaults to
+	// DiscoveryTimeline if empty.
+	Discovery DiscoveryStrategy
+
+	// LeaseTTL is how long the lease taken from Locker lasts if it's not
+	// released. Defaults to DefaultLeaseTTL if zero.
+	LeaseTTL time.Duration
+
+	// Locker is held while deciding whether to post and posting, so that
+	// overlapping invocations can't both post the same interval. If nil, no
+	// lock is taken. If another invocation holds it, Update returns its
+	// *LockHeldError as is.
+	Locker Locker
+
+	// Logger receives Update's logs. Defaults to a text logger on stdout if
+	// nil.
+	Logger Logger
+
+	// MaxScanTweets is the maximum number of tweets to scan looking for the
+	// last posted interval before giving up (the live API returns 200 per
+	// page). Zero means no limit beyond what the API will return.
+	MaxScanTweets int
+
+	// Metrics receives measurements of the run, like how long it took and
+	// how late an interval was posted. Defaults to DiscardMetrics if nil.
+	Metrics Metrics
+
+	// MessageKey opens intervals that were sealed. Only the interval being
+	// posted is ever opened. It's only required if the schedule contains
+	// sealed intervals.
+	MessageKey *MessageKey
+
+	// MissingPostPolicy is what to do about interval posts in the state
+	// ledger that have gone missing. Defaults to MissingPostHalt if empty.
+	MissingPostPolicy MissingPostPolicy
+
+	// Notifier is told when a run fails, refuses to post because the
+	// account's history is ambiguous, or posts an interval, and when the
+	// next interval is within ReminderLead of its target. If nil, nobody
+	// is notified.
+	Notifier Notifier
+
+	// ReminderLead is how long before the next interval's target that a
+	// reminder is sent to Notifier. Zero means no reminders.
+	ReminderLead time.Duration
+
+	// RunID identifies this invocation in logs (see LogKeyRunID). One is
+	// generated if empty.
+	RunID string
+
+	// Series is the name of the account being posted to, which is included
+	// in notifications.
+	Series string
+
+	// Signer signs posted intervals if set. If nil, intervals are posted
+	// unsigned.
+	Signer *Signer
+
+	// SkipPreflight skips the preflight check that's otherwise run on every
+	// invocation if the API implements PreflightChecker.
+	SkipPreflight bool
+
+	// StateStore keeps a ledger of posted intervals (see State). If set, it's
+	// the first place that the last posted interval is looked for, and posts
+	// in it are checked for on every run (see Reconcile).
+	StateStore StateStore
+
+	// UseMarker keeps a marker recording the last posted interval in the
+	// account itself (see Marker), and reads it before trying any other way
+	// of discovering the last posted interval.
+	UseMarker bool
+}
+
+// UpdateResult describes what happened during a call to Update.
+type UpdateResult struct {
+	// Discovery is the strategy that found the last posted interval, or
+	// DiscoveryTimeline if the timeline was scanned and none was found.
+	Discovery DiscoveryStrategy
+
+	// LastIntervalID is the ID of the last posted interval that was found, or
+	// -1 if none was.
+	LastIntervalID int
+
+	// LastIntervalTweetID is the tweet ID of the last posted interval, or zero
+	// if none was found or it's not known.
+	LastIntervalTweetID uint64
+
+	// NextIntervalID is the ID of the interval that's due to be posted next
+	// after this run, or -1 if there are none left.
+	NextIntervalID int
+
+	// NumTweetsScanned is the number of tweets that were scanned looking for
+	// the last posted interval.
+	NumTweetsScanned int
+
+	// PostedIntervalID is the ID of the interval that was posted, or -1 if
+	// none was.
+	PostedIntervalID int
+
+	// ScanStopReason is why scanning for the last posted interval stopped.
+	ScanStopReason ScanStopReason
+}
+
 // Update iterates through an account's tweets as far back as necessary to
 // discover the last posted interval, then decides whether or not to post a new
 // interval based off of the next interval's target time.
 //
 // now is injected as a parameter for better testability. It's safe to pass
-// this as time.Now in most cases.
+// this as time.Now in most cases. opts may be nil.
 //
-// Update returns an integer representing the ID of the interval that was posted if
-// one was posted, or -1 otherwise. An error is returned if there was a problem
-// communicating with Twitter's API.
-func Update(api TwitterAPI, intervals []*Interval, now time.Time) (int, error) {
-	var id int
+// Update returns a result describing what it found and which interval it
+// posted, if any. An error is returned if there was a problem communicating
+// with Twitter's API.
+func Update(api TwitterAPI, intervals []*Interval, now time.Time,
+	opts *UpdateOptions) (*UpdateResult, error) {
+
+	if opts == nil {
+		opts = &UpdateOptions{}
+	}
+
+	runID := opts.RunID
+	if runID == "" {
+		runID = NewRunID()
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = defaultLogger()
+	}
+	logger = WithLogAttrs(logger, LogKeyRunID, runID)
+
+	metrics := opts.Metrics
+	if metrics == nil {
+		metrics = DiscardMetrics
+	}
+
+	start := time.Now()
+	result, err := update(api, logger, intervals, now, opts)
+	metrics.Observe(MetricRunDuration, time.Since(start).Seconds())
+
+	switch {
+	case err != nil:
+		metrics.Count(MetricRuns, 1, "result", "error")
+
+	case result.PostedIntervalID != -1:
+		metrics.Count(MetricRuns, 1, "result", "posted")
+		metrics.Observe(MetricPostLateness,
+			now.Sub(intervals[result.PostedIntervalID].Target).Seconds())
+
+	default:
+		metrics.Count(MetricRuns, 1, "result", "idle")
+	}
+
+	if result != nil && result.Discovery == DiscoveryTimeline {
+		metrics.Observe(MetricTweetsScanned, float64(result.NumTweetsScanned))
+	}
+
+	// A failure to record the heartbeat doesn't fail the run, but it'll be
+	// noticed by the dead man's switch if it keeps happening
+	if err == nil && opts.StateStore != nil {
+		heartbeatErr := recordHeartbeat(opts.StateStore, runID, now)
+		if heartbeatErr != nil {
+			logger.Warn("Error recording heartbeat", "error", heartbeatErr)
+		}
+	}
+
+	if opts.Notifier != nil {
+		notifyRun(opts.Notifier, logger, intervals, now, result, err, opts)
+	}
+
+	return result, err
+}
+
+// AmbiguousHistoryError is returned by Update when it refuses to post because
+// it can't tell from the account's history whether the next interval was
+// already posted.
+type AmbiguousHistoryError struct {
+	msg string
+}
+
+func (e *AmbiguousHistoryError) Error() string {
+	return e.msg
+}
+
+// update is Update without its metrics and notifications.
+func update(api TwitterAPI, logger Logger, intervals []*Interval, now time.Time,
+	opts *UpdateOptions) (*UpdateResult, error) {
+
+	// Check that we'll be able to post before anything else, even though
+	// there may be nothing due, so that problems are noticed early.
+	if checker, isChecker := api.(PreflightChecker); isChecker && !opts.SkipPreflight {
+		preflight, err := checker.Preflight()
+		if err != nil {
+			return nil, fmt.Errorf("Preflight check failed: %v", err)
+		}
+
+		// A checker that wraps another API may have nothing to check
+		if preflight != nil {
+			logger.Info("Preflight check passed",
+				"screen_name", preflight.User.ScreenName,
+				"access_level", preflight.AccessLevel,
+				"timeline_requests_remaining", preflight.TimelineRequestsRemaining)
+
+			for _, warning := range preflight.Warnings {
+				logger.Warn("Preflight warning", "warning", warning)
+			}
+		}
+	}
+
+	// Hold a lease from before the last posted interval is found until after
+	// the next one is posted so that overlapping invocations can't both
+	// decide to post it.
+	var lease *Lease
+	if opts.Locker != nil {
+		ttl := opts.LeaseTTL
+		if ttl == 0 {
+			ttl = DefaultLeaseTTL
+		}
+
+		var err error
+		lease, err = opts.Locker.Acquire(newLockHolder(), ttl)
+		if err != nil {
+			// Returned as is so that callers can tell that another
+			// invocation is running, which is expected now and then
+			if _, ok := err.(*LockHeldError); ok {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Error acquiring lock: %v", err)
+		}
+		defer func() {
+			err := opts.Locker.Release(lease)
+			if err != nil {
+				logger.Warn("Error releasing lock; it'll expire on its own", "error", err)
+			}
+		}()
+
+		logger.Info("Acquired lock", "fencing_token", lease.Token)
+	}
+
+	result := &UpdateResult{LastIntervalID: -1, NextIntervalID: -1, PostedIntervalID: -1}
+
 	var lastTweet *Tweet
-	var ok bool
 
-	it := api.ListTweets()
+	var state *State
+	if opts.StateStore != nil {
+		var err error
+		state, err = opts.StateStore.LoadState()
+		if err != nil {
+			return nil, fmt.Errorf("Error loading state: %v", err)
+		}
 
-	fmt.Printf("Iterating backward through tweets\n")
+		// Everything saved from here on is fenced by our lease
+		if lease != nil {
+			if state.FencingToken > lease.Token {
+				return nil, ErrStaleFencingToken
+			}
+			state.FencingToken = lease.Token
+		}
 
-	// Keep in mind that we expect our API to return tweets in reverse order
-	// (i.e., newest first). Many assumptions are built into this code to take
-	// advantage of that.
-	for it.Next() {
-		lastTweet = it.Value()
+		changed, err := reconcileState(api, logger, intervals, state, opts)
+		if changed {
+			saveErr := opts.StateStore.SaveState(state)
+			if saveErr != nil {
+				return nil, fmt.Errorf("Error saving state: %v", saveErr)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
 
-		id, ok = extractIntervalID(lastTweet.Message)
-		if ok {
-			fmt.Printf("Found interval ID: %v\n", id)
-			break
+		readState(logger, state, result)
+	}
+
+	var marker *Marker
+	if opts.UseMarker {
+		var err error
+		marker, err = readMarker(api, logger, result)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	if it.Err() != nil {
-		return -1, it.Err()
+	switch opts.Discovery {
+	case "", DiscoveryTimeline:
+	case DiscoverySearch:
+		if result.LastIntervalID == -1 {
+			searchForInterval(api, logger, opts, result)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown discovery strategy: %q", opts.Discovery)
+	}
+
+	if result.LastIntervalID == -1 {
+		var err error
+		result.Discovery = DiscoveryTimeline
+		lastTweet, err = scanForInterval(api.ListTweets(), logger, intervals, opts, result)
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Info("Stopped scanning",
+			"num_tweets_scanned", result.NumTweetsScanned,
+			"reason", result.ScanStopReason)
+	}
+
+	if opts.UseMarker {
+		err := repairMarker(api, logger, marker, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if state != nil && repairState(logger, state, result) {
+		err := opts.StateStore.SaveState(state)
+		if err != nil {
+			return nil, fmt.Errorf("Error saving state: %v", err)
+		}
 	}
 
 	var nextIntervalID int
-	if ok {
+	switch {
+	case result.LastIntervalID != -1:
 		// Pick the next in the series
-		nextIntervalID = id + 1
-	} else {
+		nextIntervalID = result.LastIntervalID + 1
+
+	case result.ScanStopReason == ScanStopMaxDepth:
+		// We stopped before seeing either an interval or the beginning of the
+		// series, so we know nothing about whether we've posted.
+		return nil, &AmbiguousHistoryError{msg: fmt.Sprintf(
+			"Scanned the maximum of %v tweets without finding an interval; can't be "+
+				"sure if we've already posted or not so electing not to",
+			opts.MaxScanTweets,
+		)}
+
+	default:
 		// A special case: the Twitter API has a fundamental limitation in that
 		// it will not return every tweet. At some point when you go too far
 		// back, it gives up and gives you nothing more.
@@ -73,42 +398,165 @@ func Update(api TwitterAPI, intervals []*Interval, now time.Time) (int, error) {
 		// To avoid that failure case, we just error and do nothing. This does
 		// put us in a reasonably likely case of failing to post far future
 		// intervals because of this limitation, but there's little we can do
-		// to rectify that.
+		// to rectify that, short of importing the account's archive (see
+		// ReadArchive) so that older tweets can be scanned from a cache.
 		if lastTweet != nil && lastTweet.CreatedAt.After(intervals[0].Target) {
-			return -1, fmt.Errorf(
-				"Last available tweet is after beginning of intervals; can't be sure " +
-					"if we've already posted or not so electing not to",
-			)
+			return nil, &AmbiguousHistoryError{msg: "Last available tweet is after " +
+				"beginning of intervals; can't be sure if we've already posted or not " +
+				"so electing not to (seeding the tweet cache from the account's " +
+				"archive may help)"}
 		}
 
-		// If ok is false, we never extracted an interval ID, which means that this
-		// program has never posted before. Pick the first interval ID in the
-		// series.
+		// If we never extracted an interval ID, this program has never posted
+		// before. Pick the first interval ID in the series.
 		nextIntervalID = 0
 	}
 
-	fmt.Printf("Next interval ID: %v\n", nextIntervalID)
+	// Intervals can be skipped administratively (see SkipInterval)
+	for state != nil && state.Skipped(nextIntervalID) {
+		logger.Info("Interval was skipped", LogKeyIntervalID, nextIntervalID)
+		nextIntervalID++
+	}
+
+	logger.Info("Found next interval", LogKeyIntervalID, nextIntervalID)
 
 	if nextIntervalID >= len(intervals) {
-		fmt.Printf("There is no next interval; this program is done\n")
-		return -1, nil
+		logger.Info("There is no next interval; this program is done")
+		return result, nil
 	}
 
 	// Check if the Interval is ready to be posted
 	interval := intervals[nextIntervalID]
+	result.NextIntervalID = nextIntervalID
 
 	if interval.Target.After(now) {
-		fmt.Printf("Interval not ready, target: %v\n", interval.Target)
-		return -1, nil
+		logger.Info("Interval not ready",
+			LogKeyIntervalID, nextIntervalID, "target", interval.Target)
+		return result, nil
+	}
+
+	// Mark the interval as pending before posting it. If we're interrupted
+	// before the marker or state is committed, the next run knows not to
+	// trust it. State goes first because saving it fails if anyone else has
+	// modified it since we loaded it.
+	if state != nil {
+		err := saveRecord(opts.StateStore, state,
+			&PostRecord{IntervalID: nextIntervalID, Status: PostStatusPending})
+		if err != nil {
+			return nil, fmt.Errorf("Error saving pending state: %v", err)
+		}
+	}
+
+	if opts.UseMarker {
+		err := api.WriteMarker(&Marker{IntervalID: nextIntervalID, Pending: true})
+		if err != nil {
+			return nil, fmt.Errorf("Error writing pending marker: %v", err)
+		}
 	}
 
-	tweet, err := api.PostTweet(FormatInterval(nextIntervalID, interval.Message))
+	tweet, proof, err := postInterval(api, logger, intervals, nextIntervalID, opts)
 	if err != nil {
-		return -1, err
+		return nil, err
+	}
+
+	result.PostedIntervalID = nextIntervalID
+
+	result.NextIntervalID = nextIntervalID + 1
+	for state != nil && state.Skipped(result.NextIntervalID) {
+		result.NextIntervalID++
+	}
+	if result.NextIntervalID >= len(intervals) {
+		result.NextIntervalID = -1
+	}
+
+	if state != nil {
+		record := &PostRecord{
+			IntervalID: nextIntervalID,
+			PostedAt:   tweet.CreatedAt,
+			Status:     PostStatusPosted,
+			TweetID:    tweet.ID,
+		}
+		if proof != nil {
+			record.ProofTweetID = proof.ID
+		}
+
+		err = saveRecord(opts.StateStore, state, record)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Posted interval %v but failed to save it to state: %v",
+				nextIntervalID, err)
+		}
 	}
 
-	fmt.Printf("Posted tweet: %+v\n", tweet)
-	return nextIntervalID, nil
+	if opts.UseMarker {
+		err = api.WriteMarker(&Marker{IntervalID: nextIntervalID})
+		if err != nil {
+			return nil, fmt.Errorf(
+				"Posted interval %v but failed to commit its marker: %v",
+				nextIntervalID, err)
+		}
+	}
+
+	return result, nil
+}
+
+// FormatPost formats an interval's opened message exactly as it's posted:
+// with the commitment root appended if it's the base interval, and signed if
+// there's a signer.
+func FormatPost(id int, interval *Interval, message string, opts *UpdateOptions) string {
+	if id == 0 && opts.CommitmentRoot != "" {
+		message += rootSeparator + opts.CommitmentRoot
+	}
+
+	if opts.Signer != nil {
+		return opts.Signer.FormatInterval(id, interval.Target, message)
+	}
+	return FormatInterval(id, message)
+}
+
+// postInterval posts an interval, along with its commitment proof if it has
+// one. It returns the interval's post and the proof's reply, which is nil if
+// there's no proof.
+func postInterval(api TwitterAPI, logger Logger, intervals []*Interval, id int,
+	opts *UpdateOptions) (*Tweet, *Tweet, error) {
+
+	interval := intervals[id]
+
+	message, err := interval.Open(opts.MessageKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error opening interval %v: %v", id, err)
+	}
+
+	tweet, err := api.PostTweet(FormatPost(id, interval, message, opts))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger.Info("Posted interval", LogKeyIntervalID, id, LogKeyTweetID, tweet.ID)
+
+	salt, err := interval.OpenSalt(opts.MessageKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf(
+			"Posted interval %v but failed to open its commitment salt: %v", id, err)
+	}
+
+	// Thread the interval's commitment proof under it so that anyone can
+	// check it against the root published with the base interval.
+	if salt == "" {
+		return tweet, nil, nil
+	}
+
+	reply, err := api.PostReply(tweet.ID, FormatCommitmentProof(id, salt, interval.Proof))
+	if err != nil {
+		return nil, nil, fmt.Errorf(
+			"Posted interval %v but failed to post its commitment proof: %v",
+			id, err)
+	}
+
+	logger.Info("Posted commitment proof",
+		LogKeyIntervalID, id, LogKeyTweetID, reply.ID, "in_reply_to", tweet.ID)
+
+	return tweet, reply, nil
 }
 
 func extractIntervalID(content string) (int, bool) {
@@ -131,3 +579,51 @@ func extractIntervalID(content string) (int, bool) {
 
 	return id, true
 }
+
+// scanForInterval iterates backward through tweets looking for the last
+// posted interval, recording what it found and why it stopped in result. It
+// returns the last tweet that was scanned that wasn't an interval.
+func scanForInterval(it TweetIterator, logger Logger, intervals []*Interval,
+	opts *UpdateOptions, result *UpdateResult) (*Tweet, error) {
+
+	var lastTweet *Tweet
+
+	logger.Debug("Iterating backward through tweets")
+
+	// Keep in mind that we expect our API to return tweets in reverse order
+	// (i.e., newest first). Many assumptions are built into this code to take
+	// advantage of that.
+	for it.Next() {
+		tweet := it.Value()
+		result.NumTweetsScanned++
+
+		id, ok := extractIntervalID(tweet.Message)
+		if ok {
+			logger.Info("Found last interval in timeline",
+				LogKeyIntervalID, id, LogKeyTweetID, tweet.ID)
+			result.LastIntervalID = id
+			result.LastIntervalTweetID = tweet.ID
+			result.ScanStopReason = ScanStopFoundInterval
+			return lastTweet, nil
+		}
+
+		lastTweet = tweet
+
+		if len(intervals) > 0 && tweet.CreatedAt.Before(intervals[0].Target) {
+			result.ScanStopReason = ScanStopPassedBaseTarget
+			return lastTweet, nil
+		}
+
+		if opts.MaxScanTweets > 0 && result.NumTweetsScanned >= opts.MaxScanTweets {
+			result.ScanStopReason = ScanStopMaxDepth
+			return lastTweet, nil
+		}
+	}
+
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+
+	result.ScanStopReason = ScanStopEndOfTimeline
+	return lastTweet, nil
+}
@@ -51,12 +51,24 @@ func TestFormatInterval(t *testing.T) {
 	assert.Equal(t, "LHI999: goodbye", FormatInterval(999, "goodbye"))
 }
 
+func TestFormatPost(t *testing.T) {
+	interval := &Interval{Target: time.Now(), Message: "hello"}
+	opts := &UpdateOptions{CommitmentRoot: "abc"}
+
+	// Only the base interval carries the root
+	assert.Equal(t, "LHI000: hello\n\nroot:abc", FormatPost(0, interval, "hello", opts))
+	assert.Equal(t, "LHI001: hello", FormatPost(1, interval, "hello", opts))
+	assert.Equal(t, "LHI000: hello", FormatPost(0, interval, "hello", &UpdateOptions{}))
+}
+
 func TestUpdate(t *testing.T) {
 	now := time.Now()
 
 	// We have a check to make sure that intervals are after tweets that are
 	// listed from Twitter, so just make sure any of the messages we preload
-	// were posted in the past.
+	// were posted in the past. Scanning also stops at the first tweet from
+	// before the base interval's target, so tweets newer than a posted
+	// interval are posted at now instead.
 	past := now.Add(-1 * time.Second)
 
 	// A special error case: if there were no posted intervals and the last
@@ -73,6 +85,7 @@ func TestUpdate(t *testing.T) {
 				{Target: now, Message: "Interval 000"},
 			},
 			now,
+			&UpdateOptions{Logger: DiscardLogger},
 		)
 		assert.Error(t, fmt.Errorf(
 			"Last available tweet is after beginning of intervals; can't be sure "+
@@ -82,7 +95,7 @@ func TestUpdate(t *testing.T) {
 
 	// Posts a first interval given none existing
 	{
-		id, err := Update(
+		result, err := Update(
 			&mockTwitterAPI{tweets: []*Tweet{
 				{CreatedAt: past, Message: "this is a tweet"},
 				{CreatedAt: past, Message: "tweet"},
@@ -92,16 +105,17 @@ func TestUpdate(t *testing.T) {
 				{Target: now, Message: "Interval 000"},
 			},
 			now,
+			&UpdateOptions{Logger: DiscardLogger},
 		)
 		assert.NoError(t, err)
-		assert.Equal(t, 0, id)
+		assert.Equal(t, 0, result.PostedIntervalID)
 	}
 
 	// Posts nothing if the interval is already posted
 	{
-		id, err := Update(
+		result, err := Update(
 			&mockTwitterAPI{tweets: []*Tweet{
-				{CreatedAt: past, Message: "this is a tweet"},
+				{CreatedAt: now, Message: "this is a tweet"},
 				{CreatedAt: past, Message: "LHI000: Interval 000"},
 				{CreatedAt: past, Message: "tweet"},
 				{CreatedAt: past, Message: "first tweet"},
@@ -110,18 +124,19 @@ func TestUpdate(t *testing.T) {
 				{Target: now, Message: "Interval 000"},
 			},
 			now,
+			&UpdateOptions{Logger: DiscardLogger},
 		)
 		assert.NoError(t, err)
-		assert.Equal(t, -1, id)
+		assert.Equal(t, -1, result.PostedIntervalID)
 	}
 
 	// Posts nothing if the interval is already posted and future interval is not ready
 	{
 		assert.False(t, now.After(now.Add(2*time.Minute)))
 
-		id, err := Update(
+		result, err := Update(
 			&mockTwitterAPI{tweets: []*Tweet{
-				{CreatedAt: past, Message: "this is a tweet"},
+				{CreatedAt: now, Message: "this is a tweet"},
 				{CreatedAt: past, Message: "LHI000: Interval 000"},
 				{CreatedAt: past, Message: "tweet"},
 				{CreatedAt: past, Message: "first tweet"},
@@ -131,16 +146,17 @@ func TestUpdate(t *testing.T) {
 				{Target: now.Add(2 * time.Minute), Message: "Interval 001"},
 			},
 			now,
+			&UpdateOptions{Logger: DiscardLogger},
 		)
 		assert.NoError(t, err)
-		assert.Equal(t, -1, id)
+		assert.Equal(t, -1, result.PostedIntervalID)
 	}
 
 	// Posts a second interval given one existing
 	{
-		id, err := Update(
+		result, err := Update(
 			&mockTwitterAPI{tweets: []*Tweet{
-				{CreatedAt: past, Message: "this is a tweet"},
+				{CreatedAt: now, Message: "this is a tweet"},
 				{CreatedAt: past, Message: "LHI000: Interval 000"},
 				{CreatedAt: past, Message: "tweet"},
 				{CreatedAt: past, Message: "first tweet"},
@@ -150,17 +166,18 @@ func TestUpdate(t *testing.T) {
 				{Target: now, Message: "Interval 001"},
 			},
 			now,
+			&UpdateOptions{Logger: DiscardLogger},
 		)
 		assert.NoError(t, err)
-		assert.Equal(t, 1, id)
+		assert.Equal(t, 1, result.PostedIntervalID)
 	}
 
 	// Posts nothing if both intervals are already posted
 	{
-		id, err := Update(
+		result, err := Update(
 			&mockTwitterAPI{tweets: []*Tweet{
 				{CreatedAt: past, Message: "LHI001: Interval 001"},
-				{CreatedAt: past, Message: "this is a tweet"},
+				{CreatedAt: now, Message: "this is a tweet"},
 				{CreatedAt: past, Message: "LHI000: Interval 000"},
 				{CreatedAt: past, Message: "tweet"},
 				{CreatedAt: past, Message: "first tweet"},
@@ -170,9 +187,10 @@ func TestUpdate(t *testing.T) {
 				{Target: now, Message: "Interval 001"},
 			},
 			now,
+			&UpdateOptions{Logger: DiscardLogger},
 		)
 		assert.NoError(t, err)
-		assert.Equal(t, -1, id)
+		assert.Equal(t, -1, result.PostedIntervalID)
 	}
 
 	// Tests a full ladder of intervals. This one will probably be harder to debug,
@@ -201,24 +219,26 @@ func TestUpdate(t *testing.T) {
 
 			// At one second before target, make sure nothing gets posted
 			{
-				id, err := Update(
+				result, err := Update(
 					&mockTwitterAPI{tweets: tweets},
 					intervals,
 					targetNow.Add(-1*time.Second),
+					&UpdateOptions{Logger: DiscardLogger},
 				)
 				assert.NoError(t, err)
-				assert.Equal(t, -1, id)
+				assert.Equal(t, -1, result.PostedIntervalID)
 			}
 
 			// At one second after target, make sure we do post
 			{
-				id, err := Update(
+				result, err := Update(
 					&mockTwitterAPI{tweets: tweets},
 					intervals,
 					targetNow.Add(1*time.Second),
+					&UpdateOptions{Logger: DiscardLogger},
 				)
 				assert.NoError(t, err)
-				assert.Equal(t, i, id)
+				assert.Equal(t, i, result.PostedIntervalID)
 			}
 
 			// Add this interval to the mock API (note it gets *prepended* because
@@ -231,14 +251,92 @@ func TestUpdate(t *testing.T) {
 			// Test a duplicate operation: now that our message is in the list,
 			// nothing should get posted
 			{
-				id, err := Update(
+				result, err := Update(
 					&mockTwitterAPI{tweets: tweets},
 					intervals,
 					targetNow.Add(2*time.Second),
+					&UpdateOptions{Logger: DiscardLogger},
 				)
 				assert.NoError(t, err)
-				assert.Equal(t, -1, id)
+				assert.Equal(t, -1, result.PostedIntervalID)
 			}
 		}
 	}
 }
+
+func TestUpdate_ScanStop(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-1 * time.Second)
+	future := now.Add(1 * time.Second)
+
+	intervals := []*Interval{
+		{Target: now, Message: "Interval 000"},
+		{Target: now, Message: "Interval 001"},
+	}
+
+	// Finds an interval
+	{
+		result, err := Update(
+			&mockTwitterAPI{tweets: []*Tweet{
+				{CreatedAt: future, Message: "this is a tweet"},
+				{CreatedAt: future, Message: "LHI000: Interval 000"},
+				{CreatedAt: past, Message: "first tweet"},
+			}},
+			intervals,
+			now,
+			&UpdateOptions{Logger: DiscardLogger},
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, result.LastIntervalID)
+		assert.Equal(t, 2, result.NumTweetsScanned)
+		assert.Equal(t, 1, result.PostedIntervalID)
+		assert.Equal(t, ScanStopFoundInterval, result.ScanStopReason)
+	}
+
+	// Stops as soon as it passes the base target rather than paging through
+	// the rest of the account's history
+	{
+		result, err := Update(
+			&mockTwitterAPI{tweets: []*Tweet{
+				{CreatedAt: future, Message: "this is a tweet"},
+				{CreatedAt: past, Message: "tweet"},
+				{CreatedAt: past, Message: "LHI000: an old series"},
+				{CreatedAt: past, Message: "first tweet"},
+			}},
+			intervals,
+			now,
+			&UpdateOptions{Logger: DiscardLogger},
+		)
+		assert.NoError(t, err)
+		assert.Equal(t, -1, result.LastIntervalID)
+		assert.Equal(t, 2, result.NumTweetsScanned)
+		assert.Equal(t, 0, result.PostedIntervalID)
+		assert.Equal(t, ScanStopPassedBaseTarget, result.ScanStopReason)
+	}
+
+	// Runs out of tweets
+	{
+		result, err := Update(&mockTwitterAPI{}, intervals, now, &UpdateOptions{Logger: DiscardLogger})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, result.NumTweetsScanned)
+		assert.Equal(t, 0, result.PostedIntervalID)
+		assert.Equal(t, ScanStopEndOfTimeline, result.ScanStopReason)
+	}
+
+	// Hits the maximum depth, and because it can't be sure whether an
+	// interval was posted, posts nothing
+	{
+		_, err := Update(
+			&mockTwitterAPI{tweets: []*Tweet{
+				{CreatedAt: future, Message: "this is a tweet"},
+				{CreatedAt: future, Message: "tweet"},
+				{CreatedAt: future, Message: "LHI000: Interval 000"},
+			}},
+			intervals,
+			now,
+			&UpdateOptions{Logger: DiscardLogger, MaxScanTweets: 2},
+		)
+		assert.EqualError(t, err, "Scanned the maximum of 2 tweets without finding an "+
+			"interval; can't be sure if we've already posted or not so electing not to")
+	}
+}